@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// requireToken rejects requests without the token of TASMOGO_APITOKEN, if one is set. The token is
+// sent as "Authorization: Bearer <token>".
+func requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := viper.GetString("apitoken")
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "Missing or wrong API token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// findResult returns the result of the last scan for the device with the given IP
+func (d *daemon) findResult(ip string) (scanResult, bool) {
+	for _, result := range d.status().Devices {
+		if result.IP == ip {
+			return result, true
+		}
+	}
+	return scanResult{}, false
+}
+
+// deviceQuery selects devices of GET /api/devices. Missing selects the known devices the last scans
+// didn't find instead of the ones they found.
+type deviceQuery struct {
+	Filter   deviceFilter
+	Outdated *bool
+	Missing  bool
+	Offset   int
+	// Limit is the maximum number of devices returned, 0 returns all
+	Limit int
+}
+
+// queryList returns the values of a query parameter, which may be given several times or separated
+// by commas
+func queryList(values []string) []string {
+	list := make([]string, 0)
+	for _, value := range strings.Split(strings.Join(values, ","), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+// parseDeviceQuery reads the query parameters outdated, variant, tag, select, missing, offset and limit
+func parseDeviceQuery(values url.Values) (deviceQuery, error) {
+	q := deviceQuery{Filter: deviceFilter{Variants: queryList(values["variant"]), Tags: queryList(values["tag"])}}
+	selector, err := parseSelector(values.Get("select"))
+	if err != nil {
+		return q, err
+	}
+	q.Filter.Selector = selector
+	if value := values.Get("outdated"); value != "" {
+		outdated, err := strconv.ParseBool(value)
+		if err != nil {
+			return q, errors.New("Invalid value for outdated: " + value)
+		}
+		q.Outdated = &outdated
+	}
+	if value := values.Get("missing"); value != "" {
+		missing, err := strconv.ParseBool(value)
+		if err != nil {
+			return q, errors.New("Invalid value for missing: " + value)
+		}
+		q.Missing = missing
+	}
+	for name, target := range map[string]*int{"offset": &q.Offset, "limit": &q.Limit} {
+		if value := values.Get(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return q, errors.New("Invalid value for " + name + ": " + value)
+			}
+			*target = n
+		}
+	}
+	return q, nil
+}
+
+// missingDevices returns the devices of the inventory that the last scans didn't find. Archived devices
+// are only included with --include-archived.
+func missingDevices(inv *inventory) []tasmoDevice {
+	ips := make([]string, 0)
+	for ip, rec := range inv.Devices {
+		if rec.missing() && (!rec.Archived || viper.GetBool("includearchived")) {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Strings(ips)
+	devices := make([]tasmoDevice, 0, len(ips))
+	for _, ip := range ips {
+		devices = append(devices, deviceFromRecord(ip, inv.Devices[ip]))
+	}
+	return devices
+}
+
+// queryDevices returns the page of devices selected by the query and the number of all devices that
+// match it
+func (d *daemon) queryDevices(q deviceQuery) ([]scanResult, int, error) {
+	inv, err := loadInventory(viper.GetString("inventory"))
+	if err != nil {
+		return nil, 0, err
+	}
+	var devices []tasmoDevice
+	if q.Missing {
+		devices = missingDevices(inv)
+	} else {
+		d.mu.Lock()
+		devices = append([]tasmoDevice(nil), d.devices...)
+		d.mu.Unlock()
+	}
+	results := d.deviceResults(devices)
+	selected := make([]scanResult, 0, len(results))
+	for i, device := range devices {
+		if q.Outdated != nil && device.Outdated != *q.Outdated {
+			continue
+		}
+		if !q.Filter.matches(device, inv) {
+			continue
+		}
+		selected = append(selected, results[i])
+	}
+	total := len(selected)
+	if q.Offset > len(selected) {
+		q.Offset = len(selected)
+	}
+	selected = selected[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(selected) {
+		selected = selected[:q.Limit]
+	}
+	return selected, total, nil
+}
+
+// registerAPI adds the REST API for other automation to the mux:
+// GET /api/devices lists the devices of the last scan, filtered and paged by the query, GET /api/devices/{ip} returns a single one and
+// POST /api/devices/{ip}/update updates it. POST /api/scan?update=true updates all outdated devices.
+// GET /api/daemon returns the overview of the daemon, POST /api/pause and /api/resume pause and resume
+// the scheduled scans. With TASMOGO_TUNNEL the agents connect to /api/tunnel.
+func registerAPI(mux *http.ServeMux, d *daemon) {
+	if viper.GetBool("tunnel") {
+		mux.Handle("/api/tunnel", tunnelHandler(agentTunnel))
+	}
+	mux.HandleFunc("/api/daemon", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "Use GET")
+			return
+		}
+		writeJSON(w, http.StatusOK, d.summary())
+	})
+	for path, paused := range map[string]bool{"/api/pause": true, "/api/resume": false} {
+		paused := paused
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				writeError(w, http.StatusMethodNotAllowed, "Use POST")
+				return
+			}
+			d.setPaused(paused)
+			writeJSON(w, http.StatusOK, d.summary())
+		})
+	}
+	mux.HandleFunc("/api/devices", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "Use GET")
+			return
+		}
+		q, err := parseDeviceQuery(r.URL.Query())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		results, total, err := d.queryDevices(q)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Reading the inventory failed: "+err.Error())
+			return
+		}
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+		writeJSON(w, http.StatusOK, results)
+	})
+	mux.HandleFunc("/api/devices/", func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/api/devices/")
+		ip, action := path, ""
+		if i := strings.Index(path, "/"); i >= 0 {
+			ip, action = path[:i], path[i+1:]
+		}
+		result, ok := d.findResult(ip)
+		switch {
+		case action != "" && action != "update":
+			writeError(w, http.StatusNotFound, "Unknown action "+action)
+		case !ok:
+			writeError(w, http.StatusNotFound, "Unknown device "+ip)
+		case action == "" && r.Method != http.MethodGet:
+			writeError(w, http.StatusMethodNotAllowed, "Use GET")
+		case action == "":
+			writeJSON(w, http.StatusOK, result)
+		case r.Method != http.MethodPost:
+			writeError(w, http.StatusMethodNotAllowed, "Use POST")
+		default:
+			d.queueJob(w, scanOptions{Update: true, Only: []string{ip}})
+		}
+	})
+}
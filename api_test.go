@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_registerAPI(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	d := newDaemon(func(context.Context, scanOptions) []tasmoDevice { return nil })
+	d.devices = []tasmoDevice{{Name: "plug", IP: net.IPv4(10, 0, 0, 1), Outdated: true}, {Name: "lamp", IP: net.IPv4(10, 0, 0, 2)}}
+	handler := webUIHandler(d)
+	request := func(method string, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := request("GET", "/api/devices")
+	var results []scanResult
+	assert.Nil(json.Unmarshal(rec.Body.Bytes(), &results))
+	assert.Len(results, 2)
+
+	rec = request("GET", "/api/devices/10.0.0.2")
+	var result scanResult
+	assert.Nil(json.Unmarshal(rec.Body.Bytes(), &result))
+	assert.Equal("lamp", result.Name)
+	assert.Equal(http.StatusNotFound, request("GET", "/api/devices/10.0.0.3").Code)
+	assert.Equal(http.StatusNotFound, request("POST", "/api/devices/10.0.0.1/restart").Code)
+	assert.Equal(http.StatusMethodNotAllowed, request("GET", "/api/devices/10.0.0.1/update").Code)
+
+	assert.Equal(http.StatusAccepted, request("POST", "/api/devices/10.0.0.1/update").Code)
+	opts := <-d.jobs
+	assert.Equal(scanOptions{Update: true, Only: []string{"10.0.0.1"}}, opts)
+	assert.Equal(http.StatusAccepted, request("POST", "/api/scan?update=true").Code)
+	opts = <-d.jobs
+	assert.True(opts.Update)
+	assert.Empty(opts.Only)
+
+	assert.Equal(http.StatusOK, request("POST", "/api/pause").Code)
+	assert.True(d.isPaused())
+	rec = request("GET", "/api/daemon")
+	var summary daemonSummary
+	assert.Nil(json.Unmarshal(rec.Body.Bytes(), &summary))
+	assert.True(summary.Paused)
+	assert.Equal(2, summary.Devices)
+	assert.Equal(http.StatusOK, request("POST", "/api/resume").Code)
+	assert.False(d.isPaused())
+
+	// with a token set, requests without it are rejected
+	viper.Set("apitoken", "secret")
+	assert.Equal(http.StatusOK, request("GET", "/api/devices").Code)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/devices", nil))
+	assert.Equal(http.StatusUnauthorized, rec.Code)
+	// the page itself is served without a token, it sends the one from the address
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(http.StatusOK, rec.Code)
+}
+
+func Test_parseDeviceQuery(t *testing.T) {
+	assert := assert.New(t)
+	q, err := parseDeviceQuery(url.Values{"outdated": {"true"}, "variant": {"sensors,lite", "tasmota"}, "offset": {"10"}, "limit": {"5"}})
+	assert.Nil(err)
+	assert.True(*q.Outdated)
+	assert.Equal([]string{"sensors", "lite", "tasmota"}, q.Filter.Variants)
+	assert.Equal(10, q.Offset)
+	assert.Equal(5, q.Limit)
+	assert.False(q.Missing)
+
+	q, err = parseDeviceQuery(url.Values{})
+	assert.Nil(err)
+	assert.Nil(q.Outdated)
+	assert.True(q.Filter.empty())
+
+	_, err = parseDeviceQuery(url.Values{"missing": {"maybe"}})
+	assert.NotNil(err)
+	_, err = parseDeviceQuery(url.Values{"limit": {"-1"}})
+	assert.NotNil(err)
+	q, err = parseDeviceQuery(url.Values{"select": {"rssi<40"}})
+	assert.Nil(err)
+	assert.NotNil(q.Filter.Selector)
+	_, err = parseDeviceQuery(url.Values{"select": {"rssi<"}})
+	assert.NotNil(err)
+}
+
+func Test_queryDevices(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	path := filepath.Join(t.TempDir(), "inventory.json")
+	viper.Set("inventory", path)
+	inv := &inventory{Devices: map[string]*inventoryRecord{
+		"10.0.0.1": {Name: "plug", Tags: []string{"lights"}},
+		"10.0.0.9": {Name: "gone", Missed: 3},
+	}}
+	assert.Nil(inv.save(path))
+	d := newDaemon(func(context.Context, scanOptions) []tasmoDevice { return nil })
+	d.devices = []tasmoDevice{
+		{Name: "plug", IP: net.IPv4(10, 0, 0, 1), FirmwareType: "tasmota", Outdated: true},
+		{Name: "lamp", IP: net.IPv4(10, 0, 0, 2), FirmwareType: "sensors", Outdated: true},
+		{Name: "switch", IP: net.IPv4(10, 0, 0, 3), FirmwareType: "sensors"},
+	}
+	handler := webUIHandler(d)
+	request := func(path string) ([]scanResult, *httptest.ResponseRecorder) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		var results []scanResult
+		json.Unmarshal(rec.Body.Bytes(), &results)
+		return results, rec
+	}
+	names := func(results []scanResult) []string {
+		list := make([]string, 0, len(results))
+		for _, r := range results {
+			list = append(list, r.Name)
+		}
+		return list
+	}
+
+	results, rec := request("/api/devices?outdated=true")
+	assert.Equal([]string{"plug", "lamp"}, names(results))
+	assert.Equal("2", rec.Header().Get("X-Total-Count"))
+	results, _ = request("/api/devices?variant=sensors&outdated=false")
+	assert.Equal([]string{"switch"}, names(results))
+	results, _ = request("/api/devices?tag=lights")
+	assert.Equal([]string{"plug"}, names(results))
+	results, _ = request("/api/devices?missing=true")
+	assert.Equal([]string{"gone"}, names(results))
+
+	results, rec = request("/api/devices?offset=1&limit=1")
+	assert.Equal([]string{"lamp"}, names(results))
+	assert.Equal("3", rec.Header().Get("X-Total-Count"))
+	results, _ = request("/api/devices?offset=5")
+	assert.Empty(results)
+	_, rec = request("/api/devices?outdated=yes")
+	assert.Equal(http.StatusBadRequest, rec.Code)
+}
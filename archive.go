@@ -0,0 +1,45 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// archiveDevices archives the known devices that have been missing for TASMOGO_ARCHIVEAFTER. Archived
+// devices keep their record and history, but are left out of the results and the list of missing
+// devices and aren't asked between the sweeps of the networks. They return once a scan finds them.
+func archiveDevices(inv *inventory, now time.Time) {
+	after := viper.GetDuration("archiveafter")
+	if after <= 0 {
+		return
+	}
+	for ip, rec := range inv.Devices {
+		if rec.Archived || !rec.missing() || rec.LastSeen.IsZero() || now.Sub(rec.LastSeen) < after {
+			continue
+		}
+		rec.Archived = true
+		inv.addEvent(now, ip, rec.Name, "archived", "last seen "+formatSeen(rec.LastSeen))
+	}
+}
+
+// archivedDevices returns the archived devices of the inventory, restored from their records, for
+// --include-archived
+func archivedDevices(inv *inventory) []tasmoDevice {
+	ips := make([]string, 0)
+	for ip, rec := range inv.Devices {
+		if rec.Archived {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Strings(ips)
+	devices := make([]tasmoDevice, 0, len(ips))
+	for _, ip := range ips {
+		device := deviceFromRecord(ip, inv.Devices[ip])
+		device.Sources = []string{"archive"}
+		device.Archived = true
+		devices = append(devices, device)
+	}
+	return devices
+}
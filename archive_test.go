@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_archiveDevices(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	now := time.Date(2021, 3, 1, 3, 0, 0, 0, time.UTC)
+	inv, _ := loadInventory("")
+	inv.Devices["1.1.1.1"] = &inventoryRecord{Name: "plug", Missed: 5, LastSeen: now.AddDate(0, 0, -31)}
+	inv.Devices["1.1.1.2"] = &inventoryRecord{Name: "lamp", Missed: 5, LastSeen: now.AddDate(0, 0, -2)}
+	inv.Devices["1.1.1.3"] = &inventoryRecord{Name: "heater", LastSeen: now.AddDate(0, 0, -31)}
+
+	archiveDevices(inv, now)
+	assert.True(inv.Devices["1.1.1.1"].Archived)
+	assert.False(inv.Devices["1.1.1.2"].Archived)
+	assert.False(inv.Devices["1.1.1.3"].Archived)
+	assert.Len(inv.History, 1)
+	assert.Equal("archived", inv.History[0].Kind)
+	// archiving happens once
+	archiveDevices(inv, now)
+	assert.Len(inv.History, 1)
+
+	assert.NotContains(renderMissingDevices(inv), "plug")
+	assert.Contains(renderMissingDevices(inv), "lamp")
+	assert.Len(missingDevices(inv), 1)
+	assert.Len(knownTargets(inv), 2)
+	archived := archivedDevices(inv)
+	assert.Len(archived, 1)
+	assert.Equal("plug", archived[0].Name)
+	assert.Equal([]string{"archived", "cached"}, deviceStates(archived[0]))
+
+	viper.Set("includearchived", true)
+	assert.Len(missingDevices(inv), 2)
+
+	viper.Set("archiveafter", 0)
+	inv.Devices["1.1.1.2"].LastSeen = now.AddDate(-1, 0, 0)
+	archiveDevices(inv, now)
+	assert.False(inv.Devices["1.1.1.2"].Archived)
+}
+
+func Test_trackDevices_archived(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	inv, _ := loadInventory("")
+	inv.Devices["1.1.1.1"] = &inventoryRecord{Name: "plug", Missed: 5, Archived: true, FirstSeen: time.Now().AddDate(-1, 0, 0)}
+	trackDevices(inv, []tasmoDevice{{Name: "plug", IP: net.IPv4(1, 1, 1, 1), FirmwareVersion: "9.1.0", FirmwareType: "tasmota"}})
+	assert.False(inv.Devices["1.1.1.1"].Archived)
+	assert.Equal("returned", inv.History[0].Kind)
+}
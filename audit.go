@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// audit writes a message to the log and appends it to the audit log file if one is configured
+func audit(message string) {
+	logInfo(message)
+	path := viper.GetString("auditlog")
+	if path == "" {
+		return
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		logWarn("Writing the audit log failed: " + err.Error())
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, time.Now().Format(time.RFC3339)+" "+message)
+}
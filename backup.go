@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unsafeFileChars matches all characters that should not be part of a directory name
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// webRequest sends a request to the web UI of a device and fails unless it answers with status 200
+func webRequest(ctx context.Context, method string, url string, contentType string, body io.Reader) (*http.Response, error) {
+	return webRequestTimeout(ctx, 30*time.Second, method, url, contentType, body)
+}
+
+// webRequestTimeout sends a request like webRequest that may take longer, e.g. a firmware upload
+func webRequestTimeout(ctx context.Context, timeout time.Duration, method string, url string, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	setDeviceHeader(req)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	// the web UI uses basic authentication instead of the query parameters of the command API. A proxy
+	// in front of the device takes the basic authentication for itself.
+	if user, password, ok := deviceBasicAuth(req.URL.Host); ok {
+		req.SetBasicAuth(user, password)
+	} else if password := devicePassword(req.URL.Hostname()); password != "" {
+		req.SetBasicAuth("admin", password)
+	}
+	res, err := deviceHTTPClient(timeout).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, errors.New("Device answered with HTTP status " + strconv.Itoa(res.StatusCode))
+	}
+	return res, nil
+}
+
+// backupSuffix returns the end of the name of the backup directories of the device with the given IP
+func backupSuffix(ip string) string {
+	return unsafeFileChars.ReplaceAllString(ip, "_")
+}
+
+// backupDevice downloads the configuration dump of a device into a directory named after the device
+// and returns the path of the file. The dump is streamed to disk instead of being held in memory.
+func backupDevice(ctx context.Context, device tasmoDevice, dir string) (string, error) {
+	res, err := webRequest(ctx, "GET", deviceBaseURL(device.IP.String())+"/dl", "", nil)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	name := unsafeFileChars.ReplaceAllString(device.Name, "_")
+	deviceDir := filepath.Join(dir, name+"_"+backupSuffix(device.IP.String()))
+	if err := os.MkdirAll(deviceDir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(deviceDir, time.Now().Format("20060102-150405")+".dmp")
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, res.Body); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// backupDevices downloads the configuration of all given devices, several at the same time
+func backupDevices(ctx context.Context, devices []tasmoDevice, dir string) taskReport {
+	results := newEngine().run(ctx, devicePointers(devices), func(ctx context.Context, device *tasmoDevice) (string, error) {
+		path, err := backupDevice(ctx, *device, dir)
+		if err != nil {
+			deviceLogger(*device, "backup").warn("Backing up " + device.Name + " (" + device.IP.String() + ") failed: " + err.Error())
+			return "", err
+		}
+		deviceLogger(*device, "backup").info("Backed up " + device.Name + " (" + device.IP.String() + ") to " + path)
+		return path, nil
+	})
+	return newTaskReport("backup", results)
+}
+
+// latestBackup returns the newest backup of the device with the given IP in the backup directory
+func latestBackup(dir string, ip string) (string, error) {
+	dirs, err := filepath.Glob(filepath.Join(dir, "*_"+backupSuffix(ip)))
+	if err != nil {
+		return "", err
+	}
+	backups := make([]string, 0)
+	for _, d := range dirs {
+		files, _ := filepath.Glob(filepath.Join(d, "*.dmp"))
+		backups = append(backups, files...)
+	}
+	if len(backups) == 0 {
+		return "", errors.New("No backup of " + ip + " found in " + dir)
+	}
+	// the file names are timestamps, so they sort by age
+	sort.Slice(backups, func(i, j int) bool {
+		return filepath.Base(backups[i]) < filepath.Base(backups[j])
+	})
+	return backups[len(backups)-1], nil
+}
+
+// restoreDevice uploads a configuration dump to a device the way the "Restore Configuration" page of
+// the web UI does. The device restarts with the restored settings afterwards.
+func restoreDevice(host string, path string) error {
+	return uploadFile(context.Background(), host, "/rs", path, 30*time.Second, nil)
+}
+
+// progressReader reports how much of a file was read
+type progressReader struct {
+	r      io.Reader
+	sent   int64
+	total  int64
+	report func(sent int64, total int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.sent += int64(n)
+	p.report(p.sent, p.total)
+	return n, err
+}
+
+// uploadFile uploads a file to the upload endpoint of the web UI. The page of the web UI that offers
+// the upload has to be opened first, it tells the device what is uploaded: "/rs" for a configuration,
+// "/up" for a firmware. report is called with the number of bytes sent, unless it is nil.
+func uploadFile(ctx context.Context, host string, page string, path string, timeout time.Duration, report func(sent int64, total int64)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	var file io.Reader = f
+	if report != nil {
+		file = &progressReader{r: f, total: info.Size(), report: report}
+	}
+
+	res, err := webRequest(ctx, "GET", deviceBaseURL(host)+page, "", nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	// stream the file instead of loading it into memory
+	body, writer := io.Pipe()
+	// unblocks the writer if the request fails before the file was sent
+	defer body.Close()
+	form := multipart.NewWriter(writer)
+	go func() {
+		part, err := form.CreateFormFile("u2", filepath.Base(path))
+		if err == nil {
+			_, err = io.Copy(part, file)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+	res, err = webRequestTimeout(ctx, timeout, "POST", deviceBaseURL(host)+"/u2", form.FormDataContentType(), body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	answer, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(strings.ToLower(string(answer)), "failed") {
+		return errors.New("Device rejected the upload")
+	}
+	return nil
+}
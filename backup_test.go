@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_latestBackup(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	for _, file := range []string{"plug_10.0.0.1/20210101-120000.dmp", "plug_10.0.0.1/20210301-120000.dmp", "renamed_10.0.0.1/20210201-120000.dmp", "lamp_10.0.0.11/20210401-120000.dmp"} {
+		path := filepath.Join(dir, file)
+		assert.Nil(os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Nil(ioutil.WriteFile(path, []byte("dump"), 0644))
+	}
+	path, err := latestBackup(dir, "10.0.0.1")
+	assert.Nil(err)
+	assert.Equal(filepath.Join(dir, "plug_10.0.0.1/20210301-120000.dmp"), path)
+
+	_, err = latestBackup(dir, "10.0.0.2")
+	assert.NotNil(err)
+}
+
+func Test_restoreDevice(t *testing.T) {
+	assert := assert.New(t)
+	var opened bool
+	var uploaded string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rs":
+			opened = true
+		case "/u2":
+			f, _, err := r.FormFile("u2")
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			data, _ := ioutil.ReadAll(f)
+			uploaded = string(data)
+			w.Write([]byte("Upload Successful"))
+		}
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "backup.dmp")
+	assert.Nil(ioutil.WriteFile(path, []byte("dump"), 0644))
+	assert.Nil(restoreDevice(strings.TrimPrefix(srv.URL, "http://"), path))
+	assert.True(opened)
+	assert.Equal("dump", uploaded)
+
+	assert.NotNil(restoreDevice(strings.TrimPrefix(srv.URL, "http://"), filepath.Join(t.TempDir(), "missing.dmp")))
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/merlinschumacher/tasmogo/pkg/scanner"
+	"github.com/merlinschumacher/tasmogo/pkg/tasmota"
+	"github.com/spf13/viper"
+)
+
+// benchConcurrencies and benchTimeouts are the scan settings "tasmogo bench" tries by default
+var (
+	benchConcurrencies = []int{16, 64, 256}
+	benchTimeouts      = []time.Duration{2 * time.Second, 5 * time.Second, 10 * time.Second}
+)
+
+// benchResult is the outcome of a scan of the network with a single combination of settings
+type benchResult struct {
+	Concurrency int           `json:"concurrency"`
+	Timeout     time.Duration `json:"timeout"`
+	Devices     int           `json:"devices"`
+	Timeouts    int           `json:"timeouts"`
+	Duration    time.Duration `json:"duration"`
+}
+
+// benchReport holds the results of all combinations and the recommended one
+type benchReport struct {
+	Addresses   int           `json:"addresses"`
+	Results     []benchResult `json:"results"`
+	Recommended *benchResult  `json:"recommended,omitempty"`
+}
+
+// benchScan probes the addresses with the given concurrency and timeout and counts the devices found
+// and the addresses that timed out. The rate limit of the config applies, retries are left out so the
+// timeouts show.
+func benchScan(ctx context.Context, ips []net.IP, concurrency int, timeout time.Duration) benchResult {
+	result := benchResult{Concurrency: concurrency, Timeout: timeout}
+	var mu sync.Mutex
+	s := scanner.New(
+		scanner.WithClient(newDeviceClient()),
+		scanner.WithTimeout(timeout),
+		scanner.WithConcurrency(concurrency),
+		scanner.WithRateLimit(scanRate(), false),
+		scanner.WithLogger(debugLogger()),
+		scanner.WithFailures(func(ip net.IP, err error) {
+			if errors.Is(err, tasmota.ErrTimeout) {
+				mu.Lock()
+				result.Timeouts++
+				mu.Unlock()
+			}
+		}),
+	)
+	addresses := make(chan net.IP)
+	go func() {
+		defer close(addresses)
+		for _, ip := range ips {
+			select {
+			case addresses <- ip:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	started := time.Now()
+	result.Devices = len(s.Scan(ctx, addresses))
+	result.Duration = time.Since(started).Truncate(time.Millisecond)
+	return result
+}
+
+// runBench scans the addresses once with every combination of the concurrencies and timeouts and
+// recommends the fastest one that found as many devices as the best of them
+func runBench(ctx context.Context, ips []net.IP, concurrencies []int, timeouts []time.Duration) benchReport {
+	report := benchReport{Addresses: len(ips), Results: make([]benchResult, 0, len(concurrencies)*len(timeouts))}
+	for _, concurrency := range concurrencies {
+		for _, timeout := range timeouts {
+			if ctx.Err() != nil {
+				return report
+			}
+			logInfo("Scanning " + strconv.Itoa(len(ips)) + " addresses with a concurrency of " + strconv.Itoa(concurrency) + " and a timeout of " + timeout.String())
+			report.Results = append(report.Results, benchScan(ctx, ips, concurrency, timeout))
+		}
+	}
+	report.Recommended = recommendBench(report.Results)
+	return report
+}
+
+// recommendBench returns the fastest of the results that found the most devices. Of equally fast
+// ones, the lower concurrency is easier on the network.
+func recommendBench(results []benchResult) *benchResult {
+	var best *benchResult
+	for i := range results {
+		r := &results[i]
+		switch {
+		case best == nil, r.Devices > best.Devices:
+			best = r
+		case r.Devices < best.Devices:
+		case r.Duration < best.Duration, r.Duration == best.Duration && r.Concurrency < best.Concurrency:
+			best = r
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	recommended := *best
+	return &recommended
+}
+
+// renderBenchReport generates the report as JSON if TASMOGO_OUTPUT is "json", otherwise as a table of
+// the results with the recommended settings below
+func renderBenchReport(report benchReport) (string, error) {
+	if viper.GetString("output") == "json" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		return string(data), err
+	}
+	t := table.NewWriter()
+	t.AppendHeader(table.Row{"Concurrency", "Timeout", "Devices", "Timeouts", "Duration"})
+	for _, r := range report.Results {
+		t.AppendRow(table.Row{r.Concurrency, r.Timeout, r.Devices, r.Timeouts, r.Duration})
+	}
+	out := t.Render()
+	// the footer of a table is upper case, which would garble the settings
+	if r := report.Recommended; r != nil {
+		out += "\nRecommended: TASMOGO_CONCURRENCY=" + strconv.Itoa(r.Concurrency) + " TASMOGO_SCANTIMEOUT=" + r.Timeout.String()
+	}
+	return out, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_runBench(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	fakeDevices(t, map[string]map[string]string{
+		"10.0.0.1": {"Status 0": deviceData},
+		"10.0.0.2": {"Status 0": deviceData},
+	})
+	ips := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")}
+	report := runBench(context.Background(), ips, []int{1, 4}, []time.Duration{time.Second})
+	assert.Equal(3, report.Addresses)
+	assert.Len(report.Results, 2)
+	for _, r := range report.Results {
+		assert.Equal(2, r.Devices)
+	}
+	assert.NotNil(report.Recommended)
+
+	out, err := renderBenchReport(report)
+	assert.Nil(err)
+	assert.Contains(out, "TASMOGO_SCANTIMEOUT=1s")
+}
+
+func Test_recommendBench(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(recommendBench(nil))
+	results := []benchResult{
+		{Concurrency: 256, Timeout: 2 * time.Second, Devices: 10, Duration: 3 * time.Second},
+		{Concurrency: 16, Timeout: 2 * time.Second, Devices: 12, Duration: 9 * time.Second},
+		{Concurrency: 64, Timeout: 2 * time.Second, Devices: 12, Duration: 5 * time.Second},
+		{Concurrency: 32, Timeout: 5 * time.Second, Devices: 12, Duration: 5 * time.Second},
+	}
+	// the fastest scan missed devices, of the equally fast ones the lower concurrency wins
+	assert.Equal(results[3], *recommendBench(results))
+}
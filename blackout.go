@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// blackoutWindow is a time of the day in which tasmogo neither scans nor updates, given in minutes
+// after midnight. A window whose end is before its start lasts over midnight.
+type blackoutWindow struct {
+	from, to int
+}
+
+// parseClock converts a time of the day like "18:00" to minutes after midnight
+func parseClock(text string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(text))
+	if err != nil {
+		return 0, errors.New("invalid time " + text + ", expected a time like 18:00")
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parsePeriod reads a daily period like 18:00-23:00
+func parsePeriod(text string) (blackoutWindow, error) {
+	parts := strings.SplitN(text, "-", 2)
+	if len(parts) != 2 {
+		return blackoutWindow{}, errors.New("expected a period like 18:00-23:00")
+	}
+	from, err := parseClock(parts[0])
+	if err != nil {
+		return blackoutWindow{}, err
+	}
+	to, err := parseClock(parts[1])
+	if err != nil {
+		return blackoutWindow{}, err
+	}
+	if from == to {
+		return blackoutWindow{}, errors.New("it has no length")
+	}
+	return blackoutWindow{from: from, to: to}, nil
+}
+
+// blackoutWindows reads the blackout periods of TASMOGO_BLACKOUT, a list of times like 18:00-23:00
+func blackoutWindows() ([]blackoutWindow, error) {
+	windows := make([]blackoutWindow, 0)
+	for _, entry := range getList("blackout") {
+		w, err := parsePeriod(entry)
+		if err != nil {
+			return nil, errors.New("Invalid blackout period " + entry + ", " + err.Error())
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// updateWindow reads TASMOGO_ONLYUPDATEBETWEEN, the daily period in which devices may be updated. If it
+// isn't set, they may be updated anytime and ok is false.
+func updateWindow() (w blackoutWindow, ok bool, err error) {
+	text := strings.TrimSpace(viper.GetString("onlyupdatebetween"))
+	if text == "" {
+		return blackoutWindow{}, false, nil
+	}
+	w, err = parsePeriod(text)
+	if err != nil {
+		return blackoutWindow{}, false, errors.New("Invalid update window " + text + ", " + err.Error())
+	}
+	return w, true, nil
+}
+
+// end returns the end of the window if the time is inside of it. The time of the day is read on the
+// wall clock of the time's location.
+func (w blackoutWindow) end(t time.Time) (time.Time, bool) {
+	minute := t.Hour()*60 + t.Minute()
+	day := 0
+	switch {
+	case w.from < w.to && minute >= w.from && minute < w.to:
+	case w.from > w.to && minute >= w.from:
+		day = 1
+	case w.from > w.to && minute < w.to:
+	default:
+		return time.Time{}, false
+	}
+	return time.Date(t.Year(), t.Month(), t.Day()+day, w.to/60, w.to%60, 0, 0, t.Location()), true
+}
+
+// blackoutEnd reports if the time is inside a blackout period of TASMOGO_BLACKOUT and returns when the
+// period ends. Adjoining periods count as one. The periods are in the time zone of TASMOGO_TIMEZONE.
+func blackoutEnd(t time.Time) (time.Time, bool) {
+	windows, err := blackoutWindows()
+	if err != nil || len(windows) == 0 {
+		return time.Time{}, false
+	}
+	if loc, err := scheduleLocation(); err == nil {
+		t = t.In(loc)
+	}
+	end, in := t, false
+	// every window can extend the period only once
+	for range windows {
+		extended := false
+		for _, w := range windows {
+			if until, ok := w.end(end); ok {
+				end, in, extended = until, true, true
+			}
+		}
+		if !extended {
+			break
+		}
+	}
+	return end, in
+}
+
+// describeBlackout explains why a run doesn't happen now
+func describeBlackout(end time.Time) string {
+	return "the blackout period lasts until " + end.Format("2006-01-02 15:04 MST")
+}
+
+// updateWindowStart reports if the time is outside of the update window of TASMOGO_ONLYUPDATEBETWEEN
+// and returns when the window opens. The window is in the time zone of TASMOGO_TIMEZONE.
+func updateWindowStart(t time.Time) (time.Time, bool) {
+	w, ok, err := updateWindow()
+	if err != nil || !ok {
+		return time.Time{}, false
+	}
+	if loc, err := scheduleLocation(); err == nil {
+		t = t.In(loc)
+	}
+	// the time between the end of the window and its next start is a period of its own
+	return blackoutWindow{from: w.to, to: w.from}.end(t)
+}
+
+// describeUpdateWindow explains why no device is updated now
+func describeUpdateWindow(start time.Time) string {
+	return "updates are only allowed between " + strings.Replace(strings.TrimSpace(viper.GetString("onlyupdatebetween")), "-", " and ", 1) + ", the next window opens at " + start.Format("2006-01-02 15:04 MST")
+}
+
+// updatesHeld reports if no device may be told to update at the time, as it is in a blackout period or
+// outside of the update window, and explains why
+func updatesHeld(t time.Time) (string, bool) {
+	if end, in := blackoutEnd(t); in {
+		return describeBlackout(end), true
+	}
+	if start, outside := updateWindowStart(t); outside {
+		return describeUpdateWindow(start), true
+	}
+	return "", false
+}
+
+// blackoutSchedule moves the scans of a schedule that fall into a blackout period to its end
+type blackoutSchedule struct {
+	schedule
+}
+
+func (s blackoutSchedule) next(after time.Time) time.Time {
+	next := s.schedule.next(after)
+	if end, ok := blackoutEnd(next); ok {
+		return end.In(next.Location())
+	}
+	return next
+}
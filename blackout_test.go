@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_blackoutWindows(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	viper.Set("blackout", "18:00-23:00, 22:30-6:15")
+	windows, err := blackoutWindows()
+	assert.Nil(err)
+	assert.Equal([]blackoutWindow{{from: 18 * 60, to: 23 * 60}, {from: 22*60 + 30, to: 6*60 + 15}}, windows)
+
+	for _, invalid := range []string{"18:00", "18:00-25:00", "evening-23:00", "18:00-18:00"} {
+		viper.Set("blackout", invalid)
+		_, err = blackoutWindows()
+		assert.NotNil(err, invalid)
+	}
+}
+
+func Test_blackoutEnd(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	viper.Set("timezone", "Europe/Berlin")
+	loc, _ := time.LoadLocation("Europe/Berlin")
+	at := func(day, hour, minute int) time.Time { return time.Date(2021, 3, day, hour, minute, 0, 0, loc) }
+
+	_, ok := blackoutEnd(at(8, 19, 0))
+	assert.False(ok)
+
+	viper.Set("blackout", "18:00-23:00")
+	end, ok := blackoutEnd(at(8, 19, 0))
+	assert.True(ok)
+	assert.True(at(8, 23, 0).Equal(end))
+	_, ok = blackoutEnd(at(8, 23, 0))
+	assert.False(ok)
+	// the times are read in the time zone of the schedule
+	end, ok = blackoutEnd(at(8, 19, 0).UTC())
+	assert.True(ok)
+	assert.True(at(8, 23, 0).Equal(end))
+
+	// periods over midnight and adjoining periods
+	viper.Set("blackout", "18:00-23:00,22:30-06:00")
+	end, _ = blackoutEnd(at(8, 19, 0))
+	assert.True(at(9, 6, 0).Equal(end))
+	end, _ = blackoutEnd(at(9, 2, 0))
+	assert.True(at(9, 6, 0).Equal(end))
+}
+
+func Test_blackoutSchedule(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	viper.Set("timezone", "UTC")
+	viper.Set("blackout", "18:00-23:00")
+	s, _ := parseSchedule("0 * * * *")
+	s = blackoutSchedule{s}
+	assert.Equal(time.Date(2021, 3, 8, 17, 0, 0, 0, time.UTC), s.next(time.Date(2021, 3, 8, 16, 30, 0, 0, time.UTC)))
+	// the scan at 18:00 is moved to the end of the period
+	assert.Equal(time.Date(2021, 3, 8, 23, 0, 0, 0, time.UTC), s.next(time.Date(2021, 3, 8, 17, 30, 0, 0, time.UTC)))
+}
+
+func Test_updateWindowStart(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	viper.Set("timezone", "Europe/Berlin")
+	loc, _ := time.LoadLocation("Europe/Berlin")
+	at := func(day, hour, minute int) time.Time { return time.Date(2021, 3, day, hour, minute, 0, 0, loc) }
+
+	_, outside := updateWindowStart(at(8, 12, 0))
+	assert.False(outside)
+
+	viper.Set("onlyupdatebetween", "02:00-05:00")
+	_, outside = updateWindowStart(at(8, 3, 0))
+	assert.False(outside)
+	start, outside := updateWindowStart(at(8, 12, 0))
+	assert.True(outside)
+	assert.True(at(9, 2, 0).Equal(start))
+	start, outside = updateWindowStart(at(8, 1, 0))
+	assert.True(outside)
+	assert.True(at(8, 2, 0).Equal(start))
+	// the window is read in the time zone of the schedule
+	_, outside = updateWindowStart(at(8, 3, 0).UTC())
+	assert.False(outside)
+	assert.Contains(describeUpdateWindow(start), "between 02:00 and 05:00")
+
+	// a window over midnight
+	viper.Set("onlyupdatebetween", "23:00-01:00")
+	_, outside = updateWindowStart(at(8, 0, 30))
+	assert.False(outside)
+	start, _ = updateWindowStart(at(8, 12, 0))
+	assert.True(at(8, 23, 0).Equal(start))
+
+	// no device is told to update outside of the window
+	fake := fakeDevices(t, map[string]map[string]string{})
+	now := time.Now().In(loc)
+	viper.Set("onlyupdatebetween", now.Add(2*time.Hour).Format("15:04")+"-"+now.Add(3*time.Hour).Format("15:04"))
+	devices := []tasmoDevice{{Name: "plug", IP: net.ParseIP("10.0.0.1"), FirmwareType: "tasmota", Outdated: true}}
+	results := updateDevices(context.Background(), devices, &inventory{Devices: map[string]*inventoryRecord{}}, nil)
+	assert.Empty(fake.Commands)
+	// the device is skipped, not failed, so it stays pending
+	assert.True(results[0].Skipped)
+	assert.Empty(results[0].Error)
+	assert.Empty(devices[0].UpdateURL)
+	assert.Equal([]int{0}, pendingUpdates(devices))
+	// queued updates are left to the rollout, which waits for the window, too
+	inv := &inventory{Devices: map[string]*inventoryRecord{}}
+	inv.enqueue("10.0.0.1", "update", "", time.Time{})
+	processQueue(context.Background(), inv, devices)
+	assert.Len(inv.Queue, 1)
+	assert.Zero(inv.Queue[0].Attempts)
+	assert.Empty(fake.Commands)
+
+	// so do they in a blackout period
+	viper.Set("onlyupdatebetween", "")
+	_, held := updatesHeld(time.Now())
+	assert.False(held)
+	viper.Set("blackout", now.Add(-time.Hour).Format("15:04")+"-"+now.Add(time.Hour).Format("15:04"))
+	reason, held := updatesHeld(time.Now())
+	assert.True(held)
+	assert.Contains(reason, "blackout period")
+	processQueue(context.Background(), inv, devices)
+	assert.Zero(inv.Queue[0].Attempts)
+	assert.Empty(fake.Commands)
+	viper.Set("blackout", "")
+
+	viper.Set("onlyupdatebetween", "02:00")
+	_, _, err := updateWindow()
+	assert.NotNil(err)
+}
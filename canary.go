@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/spf13/viper"
+)
+
+// markCanaries marks the devices matching the selector of TASMOGO_CANARIES and remembers since when
+// every canary runs its current firmware. A crash starts the soak again. Devices that no longer match
+// are no canaries anymore.
+func markCanaries(devices []tasmoDevice, inv *inventory, now time.Time) {
+	selector, err := parseSelector(viper.GetString("canaries"))
+	if err != nil {
+		logWarn("Holding the updates of the fleet, the canary selector is invalid: " + err.Error())
+		return
+	}
+	for i, device := range devices {
+		if device.Cached {
+			continue
+		}
+		rec, known := inv.Devices[device.key()]
+		if selector == nil || !selector.match(device, inv) {
+			if known {
+				rec.CanaryVersion, rec.CanarySince = "", time.Time{}
+			}
+			continue
+		}
+		devices[i].Canary = true
+		rec = inv.record(device.key())
+		if rec.CanaryVersion != device.FirmwareVersion || device.Crashed {
+			rec.CanaryVersion, rec.CanarySince = device.FirmwareVersion, now
+		}
+	}
+}
+
+// canariesSoaked returns when all canaries of the inventory will have run the target version for
+// TASMOGO_CANARYSOAK and the canary that holds the fleet back the longest. ok is false while a canary
+// still runs an older version or if there is none. Canaries that may not be updated, e.g. as they are
+// quarantined or excluded, that never get the target version, e.g. as they are pinned, run a custom
+// build or aren't recognized, and the ones missing for TASMOGO_MISSEDSCANS don't hold the fleet back.
+func canariesSoaked(devices []tasmoDevice, inv *inventory, target *version.Version) (time.Time, string, bool) {
+	soak := viper.GetDuration("canarysoak")
+	found := make(map[string]tasmoDevice, len(devices))
+	for _, device := range devices {
+		found[device.key()] = device
+	}
+	ips := make([]string, 0, len(inv.Devices))
+	for ip := range inv.Devices {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	var due time.Time
+	last := ""
+	for _, ip := range ips {
+		rec := inv.Devices[ip]
+		if rec.CanaryVersion == "" || rec.missing() {
+			continue
+		}
+		name := rec.Name
+		if device, ok := found[ip]; ok {
+			if !mayAutomate(device) || device.Excluded || device.Unrecognized {
+				continue
+			}
+			if t := targetVersion(device, target); t == nil || !t.Equal(target) {
+				continue
+			}
+			name = device.Name
+		}
+		name = strings.TrimSpace(name + " (" + ip + ")")
+		current, err := version.NewVersion(rec.CanaryVersion)
+		if err != nil || current.LessThan(target) {
+			return time.Time{}, name + " still runs " + rec.CanaryVersion, false
+		}
+		if until := rec.CanarySince.Add(soak); last == "" || until.After(due) {
+			due, last = until, name
+		}
+	}
+	return due, last, last != ""
+}
+
+// canaryGate returns the pending updates allowed in this run. With TASMOGO_CANARIES set, only the
+// canaries are updated to a new release until all of them ran it for TASMOGO_CANARYSOAK, then the
+// rest of the fleet follows.
+func canaryGate(devices []tasmoDevice, pending []int, target *version.Version, inv *inventory, now time.Time) []int {
+	if viper.GetString("canaries") == "" || target == nil {
+		return pending
+	}
+	due, blocker, ok := canariesSoaked(devices, inv, target)
+	if ok && !now.Before(due) {
+		return pending
+	}
+	canaries := make([]int, 0, len(pending))
+	for _, i := range pending {
+		if devices[i].Canary {
+			canaries = append(canaries, i)
+		}
+	}
+	held := len(pending) - len(canaries)
+	switch {
+	case held == 0:
+	case ok:
+		logInfo("Holding the updates of " + strconv.Itoa(held) + " devices until the canaries ran " + target.String() + " for " + viper.GetDuration("canarysoak").String() + ", at " + due.Format("2006-01-02 15:04") + " for " + blocker)
+	case blocker != "":
+		logInfo("Holding the updates of " + strconv.Itoa(held) + " devices until all canaries run " + target.String() + ", " + blocker)
+	default:
+		logInfo("Holding the updates of " + strconv.Itoa(held) + " devices until a canary runs " + target.String() + ", none is known")
+	}
+	return canaries
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_markCanaries(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	viper.Set("canaries", `name == "plug"`)
+	now := time.Date(2021, 3, 8, 12, 0, 0, 0, time.UTC)
+	inv, _ := loadInventory("")
+	devices := []tasmoDevice{
+		{IP: net.ParseIP("10.0.0.1"), Name: "plug", FirmwareVersion: "9.1.0"},
+		{IP: net.ParseIP("10.0.0.2"), Name: "lamp", FirmwareVersion: "9.1.0"},
+	}
+	markCanaries(devices, inv, now)
+	assert.True(devices[0].Canary)
+	assert.False(devices[1].Canary)
+	assert.Contains(deviceStates(devices[0]), "canary")
+	assert.Equal("9.1.0", inv.Devices["10.0.0.1"].CanaryVersion)
+	assert.Equal(now, inv.Devices["10.0.0.1"].CanarySince)
+
+	// the soak goes on across scans and starts again with a new version or a crash
+	markCanaries(devices, inv, now.Add(time.Hour))
+	assert.Equal(now, inv.Devices["10.0.0.1"].CanarySince)
+	devices[0].FirmwareVersion = "9.2.0"
+	markCanaries(devices, inv, now.Add(2*time.Hour))
+	assert.Equal(now.Add(2*time.Hour), inv.Devices["10.0.0.1"].CanarySince)
+	devices[0].Crashed = true
+	markCanaries(devices, inv, now.Add(3*time.Hour))
+	assert.Equal(now.Add(3*time.Hour), inv.Devices["10.0.0.1"].CanarySince)
+
+	// a device that no longer matches is no canary anymore
+	viper.Set("canaries", `name == "lamp"`)
+	markCanaries(devices, inv, now)
+	assert.Empty(inv.Devices["10.0.0.1"].CanaryVersion)
+}
+
+func Test_canaryGate(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	now := time.Date(2021, 3, 8, 12, 0, 0, 0, time.UTC)
+	target := version.Must(version.NewVersion("9.2.0"))
+	inv, _ := loadInventory("")
+	devices := []tasmoDevice{
+		{IP: net.ParseIP("10.0.0.1"), Name: "plug", FirmwareVersion: "9.1.0", Outdated: true, Canary: true},
+		{IP: net.ParseIP("10.0.0.2"), Name: "lamp", FirmwareVersion: "9.1.0", Outdated: true},
+	}
+	pending := []int{0, 1}
+	// without canaries the whole fleet is updated
+	assert.Equal(pending, canaryGate(devices, pending, target, inv, now))
+
+	viper.Set("canaries", `name == "plug"`)
+	// without a known canary, the fleet waits
+	assert.Empty(canaryGate(devices[1:], []int{0}, target, inv, now))
+	rec := inv.record("10.0.0.1")
+	rec.CanaryVersion, rec.CanarySince = "9.1.0", now.Add(-72*time.Hour)
+	assert.Equal([]int{0}, canaryGate(devices, pending, target, inv, now))
+
+	// the canary runs the new release, but not long enough yet
+	rec.CanaryVersion, rec.CanarySince = "9.2.0", now.Add(-24*time.Hour)
+	devices[0].Outdated = false
+	assert.Empty(canaryGate(devices, []int{1}, target, inv, now))
+	due, last, ok := canariesSoaked(devices, inv, target)
+	assert.True(ok)
+	assert.Equal(now.Add(24*time.Hour), due)
+	assert.Equal("plug (10.0.0.1)", last)
+	assert.Equal([]int{1}, canaryGate(devices, []int{1}, target, inv, now.Add(24*time.Hour)))
+
+	// a canary on an older release holds the fleet back, unless it may not be updated or is gone
+	devices = append(devices, tasmoDevice{IP: net.ParseIP("10.0.0.3"), Name: "heater", FirmwareVersion: "9.1.0", Canary: true})
+	stuck := inv.record("10.0.0.3")
+	stuck.Name, stuck.CanaryVersion, stuck.CanarySince = "heater", "9.1.0", now.Add(-72*time.Hour)
+	_, blocker, ok := canariesSoaked(devices, inv, target)
+	assert.False(ok)
+	assert.Equal("heater (10.0.0.3) still runs 9.1.0", blocker)
+	devices[2].Quarantined = true
+	assert.Equal([]int{1}, canaryGate(devices, []int{1}, target, inv, now.Add(24*time.Hour)))
+	devices[2].Quarantined = false
+	// neither does one that never gets the release, as it is pinned, excluded or unrecognized
+	devices[2].PinnedVersion = "9.1.0"
+	assert.Equal([]int{1}, canaryGate(devices, []int{1}, target, inv, now.Add(24*time.Hour)))
+	devices[2].PinnedVersion = ""
+	devices[2].Excluded = true
+	assert.Equal([]int{1}, canaryGate(devices, []int{1}, target, inv, now.Add(24*time.Hour)))
+	devices[2].Excluded = false
+	devices[2].Unrecognized = true
+	assert.Equal([]int{1}, canaryGate(devices, []int{1}, target, inv, now.Add(24*time.Hour)))
+	devices[2].Unrecognized = false
+	stuck.Missed = 1
+	assert.Equal([]int{1}, canaryGate(devices, []int{1}, target, inv, now.Add(24*time.Hour)))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-version"
+	"github.com/merlinschumacher/tasmogo/pkg/tasmota"
+	"github.com/spf13/viper"
+	"github.com/tcnksm/go-latest"
+)
+
+// versionConstant matches the definition of the version in the source code of Tasmota, which encodes
+// major, minor, patch and build in one byte each, e.g. "const uint32_t VERSION = 0x09020003;"
+var versionConstant = regexp.MustCompile(`VERSION\s*=\s*0x([0-9A-Fa-f]{8})`)
+
+// parseVersionConstant converts the version defined in the source code of Tasmota to a version string.
+// The build number is only added for development builds.
+func parseVersionConstant(source string) (string, error) {
+	match := versionConstant.FindStringSubmatch(source)
+	if match == nil {
+		return "", errors.New("No version found")
+	}
+	n, err := strconv.ParseUint(match[1], 16, 32)
+	if err != nil {
+		return "", err
+	}
+	v := fmt.Sprintf("%d.%d.%d", n>>24, n>>16&0xff, n>>8&0xff)
+	if build := n & 0xff; build != 0 {
+		v += "." + strconv.FormatUint(build, 10)
+	}
+	return v, nil
+}
+
+// developmentVersion is a source for latest that reads the version of the development builds from the
+// source code of Tasmota
+type developmentVersion struct {
+	URL    string
+	getter func() *conditionalGetter
+}
+
+// Validate checks that the URL is set
+func (d *developmentVersion) Validate() error {
+	if d.URL == "" {
+		return errors.New("URL is required")
+	}
+	return nil
+}
+
+// Fetch downloads the version header and parses the version
+func (d *developmentVersion) Fetch() (*latest.FetchResponse, error) {
+	body, err := d.getter().get(context.Background(), d.URL)
+	if err != nil {
+		return nil, err
+	}
+	s, err := parseVersionConstant(string(body))
+	if err != nil {
+		return nil, err
+	}
+	v, err := version.NewVersion(s)
+	if err != nil {
+		return nil, err
+	}
+	return &latest.FetchResponse{Versions: []*version.Version{v}, Meta: &latest.Meta{}}, nil
+}
+
+// channelSource returns where the latest version of the release channel selected by TASMOGO_CHANNEL
+// is looked up: "stable" uses the release tags, "beta" also the pre-release tags and "development"
+// the version of the development branch.
+func channelSource() latest.Source {
+	switch channel := viper.GetString("channel"); channel {
+	case "stable":
+	case "beta":
+		return &githubTags{Owner: versionData.Owner, Repository: versionData.Repository, Prereleases: true, getter: sharedHTTPCache}
+	case "development":
+		return &developmentVersion{URL: viper.GetString("devversionurl"), getter: sharedHTTPCache}
+	default:
+		logWarn("Unknown release channel " + channel + ", using stable")
+	}
+	return versionData
+}
+
+// firmwareRelease returns the release a device is pulled from the archive of: the version it is pinned
+// to or TASMOGO_TARGETVERSION. An empty string means the newest release of the channel.
+func firmwareRelease(device tasmoDevice) string {
+	if device.PinnedVersion != "" {
+		return device.PinnedVersion
+	}
+	return viper.GetString("targetversion")
+}
+
+// channelOTAURL returns the folder from where the firmware of a device is pulled. It depends on the
+// release channel, a pinned or target version, which is pulled from the archive of its release, and the
+// chip family, as the ESP32 builds are published in folders of their own.
+func channelOTAURL(device tasmoDevice) string {
+	key := "otaurl"
+	release := firmwareRelease(device)
+	switch {
+	case release != "":
+		key = "otaversionurl"
+	case viper.GetString("channel") == "development":
+		key = "devotaurl"
+	}
+	if device.Chip == tasmota.ChipESP32 {
+		key += "32"
+	}
+	return strings.ReplaceAll(viper.GetString(key), "{version}", release)
+}
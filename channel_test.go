@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseVersionConstant(t *testing.T) {
+	assert := assert.New(t)
+	v, err := parseVersionConstant("const uint32_t VERSION = 0x09020003;  // 9.2.0.3")
+	assert.Nil(err)
+	assert.Equal("9.2.0.3", v)
+	v, err = parseVersionConstant("const uint32_t VERSION = 0x0C010100;")
+	assert.Nil(err)
+	assert.Equal("12.1.1", v)
+	_, err = parseVersionConstant("#define VERSION_MAJOR 9")
+	assert.NotNil(err)
+}
+
+func Test_developmentVersion(t *testing.T) {
+	assert := assert.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#ifndef _TASMOTA_VERSION_H_\nconst uint32_t VERSION = 0x09020003;\n#endif")
+	}))
+	defer srv.Close()
+	g := newConditionalGetter("")
+	source := &developmentVersion{URL: srv.URL, getter: func() *conditionalGetter { return g }}
+	assert.Equal("9.2.0.3", getCurrentTasmotaVersion(source).String())
+	assert.NotNil((&developmentVersion{}).Validate())
+}
+
+func Test_channelSource(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	assert.Equal(versionData, channelSource())
+	assert.Equal("http://ota.tasmota.com/tasmota/release/", channelOTAURL(tasmoDevice{}))
+	assert.Equal("http://ota.tasmota.com/tasmota32/release/", channelOTAURL(tasmoDevice{Chip: "esp32"}))
+	assert.Equal("http://ota.tasmota.com/tasmota32/release-9.1.0/", channelOTAURL(tasmoDevice{Chip: "esp32", PinnedVersion: "9.1.0"}))
+
+	viper.Set("channel", "beta")
+	assert.True(channelSource().(*githubTags).Prereleases)
+
+	viper.Set("channel", "development")
+	assert.IsType(&developmentVersion{}, channelSource())
+	assert.Equal("http://ota.tasmota.com/tasmota/", channelOTAURL(tasmoDevice{}))
+	assert.Equal("http://ota.tasmota.com/tasmota32/", channelOTAURL(tasmoDevice{Chip: "esp32"}))
+	assert.Equal("http://ota.tasmota.com/tasmota/tasmota-sensors.bin", otaURLForDevice(tasmoDevice{FirmwareType: "sensors"}))
+
+	viper.Set("channel", "nightly")
+	assert.Equal(versionData, channelSource())
+}
+
+func Test_firmwareRelease(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	assert.Equal("", firmwareRelease(tasmoDevice{}))
+	viper.Set("targetversion", "12.1.1")
+	assert.Equal("12.1.1", firmwareRelease(tasmoDevice{}))
+	assert.Equal("9.1.0", firmwareRelease(tasmoDevice{PinnedVersion: "9.1.0"}))
+	assert.Equal("http://ota.tasmota.com/tasmota/release-12.1.1/tasmota-sensors.bin", otaURLForDevice(tasmoDevice{FirmwareType: "sensors"}))
+	assert.Equal("12.1.1/tasmota-sensors.bin", firmwareFile(tasmoDevice{FirmwareType: "sensors"}))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// exitOutdated is the exit code of "tasmogo check" if more devices are outdated than allowed.
+// Errors exit with 1.
+const exitOutdated = 2
+
+// outdatedDevices lists the devices that are outdated. Devices excluded from the updates by the
+// policies or TASMOGO_GROUPS aren't expected to be current and don't count.
+func outdatedDevices(devices []tasmoDevice) []string {
+	outdated := make([]string, 0)
+	for _, device := range devices {
+		if device.Outdated && !device.Excluded {
+			outdated = append(outdated, strings.TrimSpace(device.Name+" ("+device.address()+")"))
+		}
+	}
+	return outdated
+}
+
+// checkFleet reports if no more than max devices are outdated and describes the result
+func checkFleet(devices []tasmoDevice, max int) (bool, string) {
+	outdated := outdatedDevices(devices)
+	text := strconv.Itoa(len(outdated)) + " of " + strconv.Itoa(len(devices)) + " devices are outdated, " + strconv.Itoa(max) + " are allowed"
+	if len(outdated) > 0 {
+		text += ": " + strings.Join(outdated, ", ")
+	}
+	return len(outdated) <= max, text
+}
+
+// runCheck scans without changing any device and exits with exitOutdated if more devices than
+// TASMOGO_CHECKMAXOUTDATED are outdated. Without a known latest release the devices running an
+// official build can't be checked, which is an error.
+func runCheck() {
+	viper.Set("doupdates", false)
+	// queued actions, rules and restarts are left for the next regular run
+	viper.Set("dryrun", true)
+	viper.Set("readonly", true)
+	ctx, stop := signalContext()
+	defer stop()
+	devices, latest := runScan(ctx, scanOptions{})
+	if ctx.Err() != nil {
+		logFatal("The check was interrupted")
+	}
+	if latest == nil {
+		logFatal("Check failed, the latest release is unknown")
+	}
+	ok, text := checkFleet(devices, viper.GetInt("checkmaxoutdated"))
+	if !ok {
+		logError("Check failed, " + text)
+		stop()
+		os.Exit(exitOutdated)
+	}
+	logInfo("Check passed, " + text)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_checkFleet(t *testing.T) {
+	assert := assert.New(t)
+	devices := []tasmoDevice{
+		{Name: "plug", IP: net.IPv4(10, 0, 0, 1), Outdated: true},
+		{Name: "lamp", IP: net.IPv4(10, 0, 0, 2)},
+		{Name: "door", IP: net.IPv4(10, 0, 0, 3), Outdated: true, Excluded: true},
+	}
+	assert.Equal([]string{"plug (10.0.0.1)"}, outdatedDevices(devices))
+	ok, text := checkFleet(devices, 0)
+	assert.False(ok)
+	assert.Equal("1 of 3 devices are outdated, 0 are allowed: plug (10.0.0.1)", text)
+	ok, _ = checkFleet(devices, 1)
+	assert.True(ok)
+	ok, text = checkFleet(devices[1:], 0)
+	assert.True(ok)
+	assert.Equal("0 of 2 devices are outdated, 0 are allowed", text)
+}
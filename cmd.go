@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// newRootCmd builds the command line interface of tasmogo. Without a subcommand tasmogo behaves as it
+// always did and scans, updates or runs as a daemon according to the configuration.
+func newRootCmd() *cobra.Command {
+	var configFile, profile string
+	root := &cobra.Command{
+		Use:           "tasmogo",
+		Short:         "A self contained auto-updater for Tasmota devices",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			setDefaults()
+			if err := loadConfig(configFile, profile); err != nil {
+				return errors.New("Reading the config file failed: " + err.Error())
+			}
+			if err := setupLogging(); err != nil {
+				return err
+			}
+			if _, err := blackoutWindows(); err != nil {
+				return err
+			}
+			if _, _, err := updateWindow(); err != nil {
+				return err
+			}
+			// a broken version pattern would show all devices of a fork as unrecognized
+			if _, err := firmwareParser(); err != nil {
+				return err
+			}
+			// a typo in a selector must not silently select nothing or everything
+			if _, err := parseSelector(viper.GetString("canaries")); err != nil {
+				return errors.New("Invalid canary selector: " + err.Error())
+			}
+			_, err := parseSelector(viper.GetString("select"))
+			return err
+		},
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			runRoot()
+		},
+	}
+	flags := root.PersistentFlags()
+	flags.StringVar(&configFile, "config", "", "path of the config file")
+	flags.StringVar(&profile, "profile", "", "name of the config file profile to use")
+	flags.String("cidr", "", "comma separated list of networks, ranges and IPs to scan for Tasmota devices")
+	flags.String("exclude", "", "comma separated list of addresses and networks that are never scanned")
+	flags.String("discovery", "", "how to find devices: comma separated list of cidr, hosts, mdns and mqtt")
+	flags.Int("concurrency", 0, "number of addresses probed at the same time")
+	flags.String("password", "", "password of the devices' web UI")
+	flags.String("otaurl", "", "URL from where the updates are pulled")
+	flags.String("target-version", "", "version to update the devices to instead of the latest release, without asking GitHub")
+	flags.String("inventory", "", "file in which tasmogo remembers the devices it has seen")
+	flags.Bool("include-archived", false, "also list the devices archived after they went missing")
+	flags.Bool("rescan-errors", false, "only probe the hosts that failed in the last run and keep the other results")
+	flags.Bool("slow-scan", false, "probe fewer addresses at once with longer timeouts and retries, for congested networks")
+	flags.Float64("requests-per-second", 0, "maximum number of requests per second during a scan, 0 for no limit")
+	flags.String("prescan", "", "comma separated list of icmp and neighbors, to only probe the hosts found alive")
+	flags.Bool("polite", false, "cap concurrency, rate and timeouts, for runs on networks shared with latency-sensitive traffic")
+	flags.String("filter-name", "", "comma separated list of name patterns like \"Steckdose*\", only matching devices are shown and updated")
+	flags.String("filter-variant", "", "comma separated list of firmware variants, only matching devices are shown and updated")
+	flags.String("filter-version", "", "version constraint like \"<9.0\", only matching devices are shown and updated")
+	flags.String("filter-tag", "", "comma separated list of tags and groups, only matching devices are shown and updated")
+	flags.String("select", "", "expression like 'name~\"bedroom\" && outdated', only matching devices are shown and updated")
+	flags.String("output", "", "format of the scan results: table, json, csv, yaml, knowndevices, influx or markdown")
+	flags.String("log-level", "", "least severe messages to log: debug, info, warn or error")
+	flags.String("log-format", "", "format of the log: text or json")
+	flags.String("output-file", "", "file to write the scan results to instead of stdout")
+	bindFlags(root, "prescan", "polite", "select", "cidr", "exclude", "discovery", "concurrency", "password", "otaurl", "inventory", "output")
+	if err := viper.BindPFlag("outputfile", flags.Lookup("output-file")); err != nil {
+		logFatal(err.Error())
+	}
+	if err := viper.BindPFlag("loglevel", flags.Lookup("log-level")); err != nil {
+		logFatal(err.Error())
+	}
+	if err := viper.BindPFlag("logformat", flags.Lookup("log-format")); err != nil {
+		logFatal(err.Error())
+	}
+	if err := viper.BindPFlag("targetversion", flags.Lookup("target-version")); err != nil {
+		logFatal(err.Error())
+	}
+	if err := viper.BindPFlag("includearchived", flags.Lookup("include-archived")); err != nil {
+		logFatal(err.Error())
+	}
+	if err := viper.BindPFlag("rescanerrors", flags.Lookup("rescan-errors")); err != nil {
+		logFatal(err.Error())
+	}
+	if err := viper.BindPFlag("slowscan", flags.Lookup("slow-scan")); err != nil {
+		logFatal(err.Error())
+	}
+	if err := viper.BindPFlag("requestspersecond", flags.Lookup("requests-per-second")); err != nil {
+		logFatal(err.Error())
+	}
+	for _, name := range []string{"name", "variant", "version", "tag"} {
+		if err := viper.BindPFlag("filter"+name, flags.Lookup("filter-"+name)); err != nil {
+			logFatal(err.Error())
+		}
+	}
+
+	root.AddCommand(newScanCmd(), newCheckCmd(), newStatusCmd(), newBackupCmd(), newReportCmd(), newPingCmd(), newHistoryCmd(), newVerifyCmd(), newWifiCmd(), newSpeedtestCmd(), newBenchCmd(), newSupportBundleCmd())
+	addModifyingCommands(root)
+	return root
+}
+
+// bindFlags makes the given flags of the command override the settings of the same name
+func bindFlags(cmd *cobra.Command, names ...string) {
+	for _, name := range names {
+		flag := cmd.Flags().Lookup(name)
+		if flag == nil {
+			flag = cmd.PersistentFlags().Lookup(name)
+		}
+		if err := viper.BindPFlag(name, flag); err != nil {
+			logFatal(err.Error())
+		}
+	}
+}
+
+// newScanCmd creates "tasmogo scan", which reports all devices without updating them
+func newScanCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "scan",
+		Short: "Scan the network and show all Tasmota devices",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			viper.Set("doupdates", false)
+			scanAndUpdate()
+		},
+	}
+}
+
+// newCheckCmd creates "tasmogo check", which scans the network and fails if too many devices are
+// outdated, e.g. as a compliance gate in CI
+func newCheckCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "check",
+		Short: "Scan the network without updating and exit with 2 if too many devices are outdated",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			runCheck()
+		},
+	}
+	cmd.Flags().Int("max-outdated", 0, "number of outdated devices that still pass the check")
+	if err := viper.BindPFlag("checkmaxoutdated", cmd.Flags().Lookup("max-outdated")); err != nil {
+		logFatal(err.Error())
+	}
+	return cmd
+}
+
+// newStatusCmd creates "tasmogo status [ip]", which shows the details of a single device or the
+// overview of a running daemon
+func newStatusCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "status [ip]",
+		Short: "Show the status of a single Tasmota device or, without an IP, of the running daemon",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				summary, err := fetchDaemonSummary()
+				if err != nil {
+					return err
+				}
+				fmt.Println(renderDaemonSummary(summary))
+				return nil
+			}
+			ip := net.ParseIP(args[0])
+			if ip == nil {
+				return errors.New("Invalid IP address " + args[0])
+			}
+			device, err := getDeviceData(context.Background(), ip)
+			if err != nil {
+				return err
+			}
+			if device, err = checkDeviceVersion(getCurrentTasmotaVersion(channelSource()), device); err != nil {
+				return err
+			}
+			fmt.Println(renderDeviceStatus(device))
+			return nil
+		},
+	}
+}
+
+// newBackupCmd creates "tasmogo backup", which downloads the configuration of all devices
+func newBackupCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "backup",
+		Short: "Scan the network and download the configuration of all Tasmota devices",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, stop := signalContext()
+			defer stop()
+			out, err := renderTaskReport(backupDevices(ctx, discoverDevices(), viper.GetString("backupdir")))
+			if err != nil {
+				return err
+			}
+			fmt.Println(out)
+			return nil
+		},
+	}
+	cmd.Flags().String("backupdir", "", "directory in which the backups are stored")
+	bindFlags(cmd, "backupdir")
+	return cmd
+}
+
+// newReportCmd creates "tasmogo report <file>", which writes a printable fleet report
+func newReportCmd() *cobra.Command {
+	var title string
+	cmd := &cobra.Command{
+		Use:   "report <file>",
+		Short: "Scan the network and write a printable HTML report of all devices",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			inv, err := loadInventory(viper.GetString("inventory"))
+			if err != nil {
+				return err
+			}
+			latest := getCurrentTasmotaVersion(channelSource())
+			devices := discoverDevices()
+			classifyDevices(devices, inv)
+			checkDevices(devices, latest)
+			notes := whatsNew(context.Background(), devices, latest)
+			f, err := os.Create(args[0])
+			if err != nil {
+				return err
+			}
+			if err := writeReport(f, title, devices, inv, latest.String(), notes); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+			logInfo("Report written to " + args[0])
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&title, "title", "Tasmota device report", "title of the report")
+	return cmd
+}
+
+// newPingCmd creates "tasmogo ping", which checks if the devices in the inventory are reachable
+func newPingCmd() *cobra.Command {
+	var timeout time.Duration
+	cmd := &cobra.Command{
+		Use:   "ping",
+		Short: "Check quickly which of the known devices are reachable",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			inv, err := loadInventory(viper.GetString("inventory"))
+			if err != nil {
+				return err
+			}
+			if len(inv.Devices) == 0 {
+				return errors.New("No known devices, run a scan first")
+			}
+			results := pingInventory(inv, timeout)
+			if path := viper.GetString("healthmetricsfile"); path != "" {
+				if err := replaceFile(path, []byte(renderHealthMetrics(results, time.Now()))); err != nil {
+					return err
+				}
+			}
+			out, err := renderPingResults(results)
+			if err != nil {
+				return err
+			}
+			fmt.Println(out)
+			return nil
+		},
+	}
+	cmd.Flags().DurationVar(&timeout, "timeout", pingTimeout, "how long to wait for each device")
+	return cmd
+}
+
+// newHistoryCmd creates "tasmogo history", which shows what changed between the scans
+func newHistoryCmd() *cobra.Command {
+	var since time.Duration
+	cmd := &cobra.Command{
+		Use:   "history [ip]",
+		Short: "Show the devices that appeared, disappeared or got a new firmware",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			inv, err := loadInventory(viper.GetString("inventory"))
+			if err != nil {
+				return err
+			}
+			ip := ""
+			if len(args) == 1 {
+				ip = args[0]
+			}
+			from := time.Time{}
+			if since > 0 {
+				from = time.Now().Add(-since)
+			}
+			events := filterHistory(inv.History, from, ip)
+			if len(events) == 0 {
+				fmt.Println("No changes recorded")
+				return nil
+			}
+			fmt.Println(renderHistory(events))
+			return nil
+		},
+	}
+	cmd.Flags().DurationVar(&since, "since", 0, "only show the changes of this period, e.g. 168h")
+	return cmd
+}
+
+// newVerifyCmd creates "tasmogo verify", which checks the signature of a run manifest
+func newVerifyCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "verify <manifest> <public key>",
+		Short: "Verify the signature of a run manifest",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := verifyManifest(args[0], args[1]); err != nil {
+				return errors.New("Verifying the manifest failed: " + err.Error())
+			}
+			logInfo("The signature of " + args[0] + " is valid.")
+			return nil
+		},
+	}
+}
+
+// newWifiCmd creates "tasmogo wifi", which shows how the devices are distributed across the access points
+// and channels
+func newWifiCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "wifi",
+		Short: "Show how the devices are distributed across access points and Wi-Fi channels",
+		Long: "Scan the network and group the devices by the access point and channel they are connected to, with their average signal quality. " +
+			"Access points with more devices than TASMOGO_WIFIMAXCLIENTS and channels shared by several access points are flagged as saturated.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			out, err := renderWifiAudit(auditWifi(discoverDevices()))
+			if err != nil {
+				return err
+			}
+			fmt.Println(out)
+			return nil
+		},
+	}
+}
+
+// newSpeedtestCmd creates "tasmogo speedtest", which downloads the firmware of the outdated devices and
+// estimates how long updating them takes
+func newSpeedtestCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "speedtest",
+		Short: "Measure the download of the firmware and estimate how long the rollout takes",
+		Long: "Scan the network, download the firmware every outdated device would be updated with once and estimate how long the rollout takes " +
+			"with the batches of TASMOGO_BATCHSIZE. The estimate is compared with TASMOGO_UPDATEWINDOW.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			inv, err := loadInventory(viper.GetString("inventory"))
+			if err != nil {
+				return err
+			}
+			devices := discoverDevices()
+			classifyDevices(devices, inv)
+			checkDevices(devices, releaseVersion())
+			pending := pendingUpdates(devices)
+			if len(pending) == 0 {
+				fmt.Println("No devices need an update")
+				return nil
+			}
+			ctx, stop := signalContext()
+			defer stop()
+			out, err := renderRolloutEstimate(estimateRollout(ctx, devices, pending))
+			if err != nil {
+				return err
+			}
+			fmt.Println(out)
+			return nil
+		},
+	}
+}
+
+// newBenchCmd creates "tasmogo bench", which scans the network with several settings and recommends the
+// fastest that finds all devices
+func newBenchCmd() *cobra.Command {
+	var concurrencies []int
+	var timeouts []time.Duration
+	cmd := &cobra.Command{
+		Use:   "bench",
+		Short: "Scan the network with several settings and recommend the concurrency and timeout",
+		Long: "Scan the networks of TASMOGO_CIDR and the hosts of TASMOGO_HOSTS once with every combination of the given concurrencies and timeouts. " +
+			"The fastest combination that finds as many devices as the best one is recommended for TASMOGO_CONCURRENCY and TASMOGO_SCANTIMEOUT.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ips := append(networkTargets(), resolveHosts(configuredHosts())...)
+			if len(ips) == 0 {
+				return errors.New("No addresses to scan, set TASMOGO_CIDR, TASMOGO_HOSTS or TASMOGO_HOSTSFILE")
+			}
+			ctx, stop := signalContext()
+			defer stop()
+			out, err := renderBenchReport(runBench(ctx, ips, concurrencies, timeouts))
+			if err != nil {
+				return err
+			}
+			fmt.Println(out)
+			return nil
+		},
+	}
+	cmd.Flags().IntSliceVar(&concurrencies, "concurrency-levels", benchConcurrencies, "comma separated list of the concurrencies to try")
+	cmd.Flags().DurationSliceVar(&timeouts, "timeouts", benchTimeouts, "comma separated list of the scan timeouts to try")
+	return cmd
+}
+
+// newSupportBundleCmd creates "tasmogo support-bundle", which collects what is needed to report a problem
+func newSupportBundleCmd() *cobra.Command {
+	var logPath string
+	cmd := &cobra.Command{
+		Use:   "support-bundle [file]",
+		Short: "Collect the config, logs and state of tasmogo into a tarball for a bug report",
+		Long: "Write the version of tasmogo, its settings with the passwords and tokens removed, the end of the audit log and of the log given with --log, " +
+			"the recent history, the newest run manifest and the state of the last run to a gzipped tarball.",
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			now := time.Now()
+			path := "tasmogo-support-" + now.Format("20060102-150405") + ".tar.gz"
+			if len(args) == 1 {
+				path = args[0]
+			}
+			files, err := supportFiles(logPath, now)
+			if err != nil {
+				return err
+			}
+			if err := writeSupportBundle(path, files, now); err != nil {
+				return err
+			}
+			logInfo("Support bundle written to " + path + ", check it for anything private before sharing it")
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&logPath, "log", "", "log file of tasmogo to include, e.g. the output of docker logs")
+	return cmd
+}
@@ -0,0 +1,526 @@
+//go:build !scanonly
+// +build !scanonly
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// scanOnly is set in the builds with the scanonly tag, which leave out the updater, the daemon and its
+// servers and every command that changes devices
+const scanOnly = false
+
+// addModifyingCommands adds the flags and subcommands that change devices or run the daemon
+func addModifyingCommands(root *cobra.Command) {
+	root.Flags().Bool("daemon", false, "scan for updates on the schedule")
+	root.Flags().String("schedule", "", "when the daemon scans: a duration like 24h or a cron expression like \"0 3 * * *\"")
+	root.Flags().Bool("doupdates", false, "update outdated devices")
+	root.Flags().String("webui", "", "address to serve the web UI on in daemon mode, e.g. :8080")
+	root.PersistentFlags().String("only-update-between", "", "daily period in which devices may be updated, e.g. 02:00-05:00")
+	root.PersistentFlags().Bool("dry-run", false, "show which devices would be updated without sending any commands")
+	root.PersistentFlags().Bool("interactive", false, "ask before updating each device")
+	root.PersistentFlags().Bool("resume", false, "continue the interrupted rollout instead of starting a new one")
+	root.PersistentFlags().Bool("force", false, "also modify protected devices")
+	root.PersistentFlags().String("groups", "", "comma separated list of groups, only the devices in them are updated")
+	bindFlags(root, "daemon", "schedule", "doupdates", "webui", "interactive", "resume", "force", "groups")
+	if err := viper.BindPFlag("dryrun", root.PersistentFlags().Lookup("dry-run")); err != nil {
+		logFatal(err.Error())
+	}
+	if err := viper.BindPFlag("onlyupdatebetween", root.PersistentFlags().Lookup("only-update-between")); err != nil {
+		logFatal(err.Error())
+	}
+	root.AddCommand(newUpdateCmd(), newPauseCmd(), newResumeCmd(), newRestoreCmd(), newQueueCmd(), newNormalizeCmd(), newTimersCmd(), newMacroCmd(), newCommandCmd(), newGoldenCmd(), newPatchCmd(), newUnquarantineCmd(), newAgentCmd(),
+		newRestartCmd(), newPowerCmd(), newWifiReconfigureCmd())
+}
+
+// runRoot runs tasmogo without a subcommand
+func runRoot() {
+	// tasmogo will run on the schedule of TASMOGO_SCHEDULE if TASMOGO_DAEMON is true
+	if viper.GetBool("daemon") {
+		runDaemon()
+		return
+	}
+	// tasmogo will run just once if TASMOGO_DAEMON is false, e.g. from cron, but not during a blackout
+	if end, ok := blackoutEnd(time.Now()); ok {
+		logInfo("Skipping the run, " + describeBlackout(end))
+		return
+	}
+	scanAndUpdate()
+}
+
+// newUpdateCmd creates "tasmogo update", which scans the network and updates all outdated devices
+func newUpdateCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "update",
+		Short: "Scan the network and update all outdated Tasmota devices",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			viper.Set("doupdates", true)
+			scanAndUpdate()
+		},
+	}
+}
+
+// newPauseCmd creates "tasmogo pause", which pauses the scheduled scans of the running daemon
+func newPauseCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "pause",
+		Short: "Pause the scheduled scans of the running daemon",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var summary daemonSummary
+			if err := daemonRequest("POST", "/api/pause", &summary); err != nil {
+				return err
+			}
+			fmt.Println(renderDaemonSummary(summary))
+			return nil
+		},
+	}
+}
+
+// newResumeCmd creates "tasmogo resume", which resumes the scheduled scans of the running daemon
+func newResumeCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "resume",
+		Short: "Resume the scheduled scans of the running daemon",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var summary daemonSummary
+			if err := daemonRequest("POST", "/api/resume", &summary); err != nil {
+				return err
+			}
+			fmt.Println(renderDaemonSummary(summary))
+			return nil
+		},
+	}
+}
+
+// newRestoreCmd creates "tasmogo restore <ip> [file]", which uploads a saved configuration dump to a
+// device. Without a file the newest backup of the device is used.
+func newRestoreCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "restore <ip> [file]",
+		Short: "Restore the configuration of a device from a backup",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ip := net.ParseIP(args[0])
+			if ip == nil {
+				return errors.New("Invalid IP address " + args[0])
+			}
+			inv, err := loadInventory(viper.GetString("inventory"))
+			if err != nil {
+				return err
+			}
+			device := tasmoDevice{IP: ip}
+			if rec, ok := inv.Devices[ip.String()]; ok {
+				device.Name = rec.Name
+			}
+			device.Protected = isProtected(device, inv)
+			if !mayModify(device) {
+				return errors.New(ip.String() + " is protected, use --force to restore it anyway")
+			}
+			var path string
+			if len(args) == 2 {
+				path = args[1]
+			} else if path, err = latestBackup(viper.GetString("backupdir"), ip.String()); err != nil {
+				return err
+			}
+			if err := restoreDevice(ip.String(), path); err != nil {
+				return errors.New("Restoring " + ip.String() + " failed: " + err.Error())
+			}
+			audit("Restored the configuration of " + ip.String() + " from " + path)
+			return nil
+		},
+	}
+}
+
+// newUnquarantineCmd creates "tasmogo unquarantine <ip|name>", which lets tasmogo update and restart a
+// quarantined device on its own again
+func newUnquarantineCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "unquarantine <ip|name>",
+		Short: "Lift the quarantine of a device that failed too many runs in a row",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path := viper.GetString("inventory")
+			inv, err := loadInventory(path)
+			if err != nil {
+				return err
+			}
+			if err := inv.liftQuarantine(args[0]); err != nil {
+				return err
+			}
+			if err := inv.save(path); err != nil {
+				return err
+			}
+			audit("Lifted the quarantine of " + args[0])
+			return nil
+		},
+	}
+}
+
+// newAgentCmd creates "tasmogo agent <controller URL>", which connects to a controller outside of this
+// network and relays its requests to the devices
+func newAgentCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "agent <controller URL>",
+		Short: "Let a tasmogo daemon outside of this network reach the devices through this host",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, stop := signalContext()
+			defer stop()
+			return runAgent(ctx, args[0])
+		},
+	}
+}
+
+// newQueueCmd creates "tasmogo queue", which manages the deferred actions
+func newQueueCmd() *cobra.Command {
+	queue := &cobra.Command{
+		Use:   "queue",
+		Short: "Manage the actions deferred to later runs",
+	}
+	// withInventory loads the inventory, runs fn and saves the inventory again
+	withInventory := func(fn func(inv *inventory) error) error {
+		path := viper.GetString("inventory")
+		inv, err := loadInventory(path)
+		if err != nil {
+			return err
+		}
+		if err := fn(inv); err != nil {
+			return err
+		}
+		return inv.save(path)
+	}
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "List all queued actions",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			inv, err := loadInventory(viper.GetString("inventory"))
+			if err != nil {
+				return err
+			}
+			fmt.Println(renderQueue(inv.Queue))
+			return nil
+		},
+	}
+	var after string
+	add := &cobra.Command{
+		Use:       "add <ip> update | add <ip> command <command>",
+		Short:     "Queue an update or a console command for a device",
+		Args:      cobra.MinimumNArgs(2),
+		ValidArgs: []string{"update", "command"},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var command string
+			switch {
+			case args[1] == "update" && len(args) == 2:
+			case args[1] == "command" && len(args) > 2:
+				command = strings.Join(args[2:], " ")
+			default:
+				return errors.New("Usage: tasmogo queue " + cmd.Use)
+			}
+			var notBefore time.Time
+			if after != "" {
+				var err error
+				if notBefore, err = parseNotBefore(after); err != nil {
+					return err
+				}
+			}
+			return withInventory(func(inv *inventory) error {
+				id := inv.enqueue(args[0], args[1], command, notBefore)
+				logInfo("Queued action " + strconv.Itoa(id))
+				return nil
+			})
+		},
+	}
+	add.Flags().StringVar(&after, "after", "", "run the action not before this duration (e.g. 2h) or RFC 3339 time")
+	cancel := &cobra.Command{
+		Use:   "cancel <id>",
+		Short: "Cancel a queued action",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id, err := strconv.Atoi(args[0])
+			if err != nil {
+				return errors.New("Invalid ID " + args[0])
+			}
+			return withInventory(func(inv *inventory) error {
+				if err := inv.cancel(id); err != nil {
+					return err
+				}
+				logInfo("Cancelled action " + args[0])
+				return nil
+			})
+		},
+	}
+	queue.AddCommand(list, add, cancel)
+	return queue
+}
+
+// newNormalizeCmd creates "tasmogo normalize", which reports and corrects devices whose settings
+// deviate from the ones defined in the config
+func newNormalizeCmd() *cobra.Command {
+	var apply bool
+	cmd := &cobra.Command{
+		Use:   "normalize",
+		Short: "Report devices whose settings (e.g. TelePeriod) deviate from the config",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(loadNormalization()) == 0 {
+				return errors.New("No settings defined in the normalize section of the config")
+			}
+			inv, err := loadInventory(viper.GetString("inventory"))
+			if err != nil {
+				return err
+			}
+			devices := discoverDevices()
+			protectDevices(devices, inv)
+			deviations := normalizeDevices(devices, apply)
+			fmt.Println(renderDeviations(deviations))
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&apply, "apply", false, "set the deviating settings to the configured values")
+	return cmd
+}
+
+// newTimersCmd creates "tasmogo timers", which exports the timers of all devices to a file and sets
+// them from the edited file
+func newTimersCmd() *cobra.Command {
+	timers := &cobra.Command{
+		Use:   "timers",
+		Short: "Export and bulk edit the timers of all devices",
+	}
+	export := &cobra.Command{
+		Use:   "export <file>",
+		Short: "Scan the network and write the timers of all devices to a YAML file",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return exportTimers(discoverDevices(), args[0])
+		},
+	}
+	var devices []string
+	push := &cobra.Command{
+		Use:   "import <file>",
+		Short: "Set the timers that were changed in the YAML file",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return importTimers(args[0], devices)
+		},
+	}
+	push.Flags().StringSliceVar(&devices, "device", nil, "only update the timers of these IPs")
+	timers.AddCommand(export, push)
+	return timers
+}
+
+// newMacroCmd creates "tasmogo macro <name> [key=value...]", which runs a command macro from the config
+func newMacroCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "macro <name> [key=value...]",
+		Short: "Send a parameterized command macro to all devices it applies to",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			m, err := loadMacro(args[0])
+			if err != nil {
+				return err
+			}
+			vars, err := parseVariables(args[1:])
+			if err != nil {
+				return err
+			}
+			inv, err := loadInventory(viper.GetString("inventory"))
+			if err != nil {
+				return err
+			}
+			ctx, stop := signalContext()
+			defer stop()
+			out, err := renderTaskReport(runMacro(ctx, m, vars, discoverDevices(), inv))
+			if err != nil {
+				return err
+			}
+			fmt.Println(out)
+			return nil
+		},
+	}
+}
+
+// newCommandCmd creates "tasmogo cmd <command>...", which sends console commands to all devices or the
+// selected ones and tabulates their answers
+func newCommandCmd() *cobra.Command {
+	var tag string
+	var names []string
+	cmd := &cobra.Command{
+		Use:   "cmd <command>...",
+		Short: "Send console commands to all devices, e.g. \"PowerOnState 3\"",
+		Long: "Send console commands to all devices, or the ones selected by --tag and --device, and show their answers. " +
+			"Several commands are sent as a single Backlog. Like the commands of macros, they can use {{.ip}} and {{.name}}.",
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			inv, err := loadInventory(viper.GetString("inventory"))
+			if err != nil {
+				return err
+			}
+			ctx, stop := signalContext()
+			defer stop()
+			out, err := renderTaskReport(runCommands(ctx, args, tag, names, discoverDevices(), inv))
+			if err != nil {
+				return err
+			}
+			fmt.Println(out)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&tag, "tag", "", "only send the commands to devices with this tag or in this group")
+	cmd.Flags().StringSliceVar(&names, "device", nil, "only send the commands to these IPs or names")
+	return cmd
+}
+
+// newFleetCmd creates a maintenance command that sends an operation to all devices, or the ones
+// selected by --tag and --device, after asking for confirmation
+func newFleetCmd(use string, short string, args cobra.PositionalArgs, operation func(args []string) (fleetOperation, error)) *cobra.Command {
+	var tag string
+	var names []string
+	var yes bool
+	cmd := &cobra.Command{
+		Use:   use,
+		Short: short,
+		Args:  args,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			op, err := operation(args)
+			if err != nil {
+				return err
+			}
+			inv, err := loadInventory(viper.GetString("inventory"))
+			if err != nil {
+				return err
+			}
+			devices := discoverDevices()
+			protectDevices(devices, inv)
+			devices = selectDevices(devices, inv, tag, names)
+			if len(devices) == 0 {
+				return errors.New("No devices selected")
+			}
+			if !yes && !confirmOperation(op, devices, os.Stdin, os.Stdout) {
+				return errors.New("Cancelled, no device was changed")
+			}
+			ctx, stop := signalContext()
+			defer stop()
+			out, err := renderTaskReport(runFleetOperation(ctx, op, devices))
+			if err != nil {
+				return err
+			}
+			fmt.Println(out)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&tag, "tag", "", "only change devices with this tag or in this group")
+	cmd.Flags().StringSliceVar(&names, "device", nil, "only change these IPs or names")
+	cmd.Flags().BoolVar(&yes, "yes", false, "don't ask for confirmation")
+	return cmd
+}
+
+// newRestartCmd creates "tasmogo restart", which restarts the devices
+func newRestartCmd() *cobra.Command {
+	return newFleetCmd("restart", "Restart all devices or the selected ones", cobra.NoArgs, func(args []string) (fleetOperation, error) {
+		return restartOperation(), nil
+	})
+}
+
+// newPowerCmd creates "tasmogo power <on|off|toggle>", which switches the relays of the devices
+func newPowerCmd() *cobra.Command {
+	return newFleetCmd("power <on|off|toggle>", "Switch the relays of all devices or the selected ones", cobra.ExactArgs(1), func(args []string) (fleetOperation, error) {
+		return powerOperation(args[0])
+	})
+}
+
+// newWifiReconfigureCmd creates "tasmogo wifi-reconfigure <ssid> <password>", which moves the devices to
+// another Wi-Fi network
+func newWifiReconfigureCmd() *cobra.Command {
+	var slot int
+	cmd := newFleetCmd("wifi-reconfigure <ssid>", "Set the Wi-Fi network of all devices or the selected ones", cobra.ExactArgs(1), func(args []string) (fleetOperation, error) {
+		password, err := wifiPassword(os.Stdin, os.Stderr)
+		if err != nil {
+			return fleetOperation{}, err
+		}
+		return wifiOperation(slot, args[0], password)
+	})
+	cmd.Long = "Set the SSID and password of a Wi-Fi slot of the devices. The password is taken from TASMOGO_WIFIPASSWORD or read from stdin. " +
+		"They restart and connect to the new network; with a mistake they fall back to the other slot or become unreachable, so try a single device with --device first."
+	cmd.Flags().IntVar(&slot, "slot", 1, "Wi-Fi slot to set, 1 or 2")
+	return cmd
+}
+
+// newGoldenCmd creates "tasmogo golden <ip|name>", which compares the settings of all devices with the
+// ones of a reference device
+func newGoldenCmd() *cobra.Command {
+	var details bool
+	cmd := &cobra.Command{
+		Use:   "golden <ip|name>",
+		Short: "Compare the settings of all devices with a golden reference device",
+		Long: "Compare the options, MQTT and network settings, the template and the rules of all devices with the ones of the given device. " +
+			"The devices that differ most are listed first.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			devices := discoverDevices()
+			golden, err := findDevice(devices, args[0])
+			if err != nil {
+				return err
+			}
+			ctx, stop := signalContext()
+			defer stop()
+			reports, err := compareFleet(ctx, golden, devices)
+			if err != nil {
+				return err
+			}
+			out, err := renderGoldenReport(golden, reports, details)
+			if err != nil {
+				return err
+			}
+			fmt.Println(out)
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&details, "details", false, "list every differing setting")
+	return cmd
+}
+
+// newPatchCmd creates "tasmogo patch <file>", which brings the settings of the devices to the state
+// described in a JSON file
+func newPatchCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "patch <file>",
+		Short: "Set the devices to the settings of a JSON file, sending only the ones that differ",
+		Long: "Set the devices to the settings of a JSON file like {\"*\": {\"TelePeriod\": 60}, \"plug\": {\"PowerOnState\": 3}}. " +
+			"The settings are keyed by IP or name, \"*\" applies to all devices. Only the settings that differ are sent, as a single Backlog, " +
+			"so applying the file again changes nothing. With --dry-run the Backlog is only shown.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			p, err := loadPatch(args[0])
+			if err != nil {
+				return err
+			}
+			inv, err := loadInventory(viper.GetString("inventory"))
+			if err != nil {
+				return err
+			}
+			ctx, stop := signalContext()
+			defer stop()
+			out, err := renderTaskReport(runPatch(ctx, p, discoverDevices(), inv, !viper.GetBool("dryrun")))
+			if err != nil {
+				return err
+			}
+			fmt.Println(out)
+			return nil
+		},
+	}
+}
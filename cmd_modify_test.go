@@ -0,0 +1,42 @@
+//go:build !scanonly
+// +build !scanonly
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newQueueCmd(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	path := filepath.Join(t.TempDir(), "inventory.json")
+	run := func(args ...string) error {
+		root := newRootCmd()
+		root.SetArgs(append([]string{"--inventory", path, "queue"}, args...))
+		return root.Execute()
+	}
+
+	assert.Nil(run("add", "1.1.1.1", "update", "--after", "2h"))
+	assert.Nil(run("add", "1.1.1.2", "command", "Restart", "1"))
+	assert.NotNil(run("add", "1.1.1.2", "reboot"))
+	assert.NotNil(run("add", "1.1.1.2", "update", "--after", "tomorrow"))
+	assert.Nil(run("list"))
+
+	inv, err := loadInventory(path)
+	assert.Nil(err)
+	assert.Len(inv.Queue, 2)
+	assert.True(inv.Queue[0].NotBefore.After(time.Now()))
+	assert.Equal("Restart 1", inv.Queue[1].Command)
+
+	assert.Nil(run("cancel", "1"))
+	assert.NotNil(run("cancel", "1"))
+	inv, _ = loadInventory(path)
+	assert.Len(inv.Queue, 1)
+	assert.Equal(2, inv.Queue[0].ID)
+}
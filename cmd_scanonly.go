@@ -0,0 +1,31 @@
+//go:build scanonly
+// +build scanonly
+
+package main
+
+import (
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// scanOnly is set in the builds with the scanonly tag, which leave out the updater, the daemon and its
+// servers and every command that changes devices
+const scanOnly = true
+
+// addModifyingCommands adds nothing, the scanonly builds can't change devices
+func addModifyingCommands(root *cobra.Command) {}
+
+// runRoot scans once. The settings that would update devices or start the daemon are refused instead
+// of silently ignored.
+func runRoot() {
+	if viper.GetBool("daemon") || viper.GetBool("doupdates") {
+		logFatal("This build of tasmogo only scans, it can't run as a daemon or update devices")
+	}
+	if end, ok := blackoutEnd(time.Now()); ok {
+		logInfo("Skipping the run, " + describeBlackout(end))
+		return
+	}
+	scanAndUpdate()
+}
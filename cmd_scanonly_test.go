@@ -0,0 +1,26 @@
+//go:build scanonly
+// +build scanonly
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_addModifyingCommands(t *testing.T) {
+	assert := assert.New(t)
+	root := newRootCmd()
+	for _, name := range []string{"update", "restore", "queue", "macro", "cmd", "patch"} {
+		cmd, _, err := root.Find([]string{name})
+		assert.True(err != nil || cmd == root, name)
+	}
+	assert.Nil(root.Flags().Lookup("daemon"))
+	for _, name := range []string{"dry-run", "interactive", "resume", "force", "groups"} {
+		assert.Nil(root.PersistentFlags().Lookup(name), name)
+	}
+	cmd, _, err := root.Find([]string{"check"})
+	assert.Nil(err)
+	assert.Equal("check", cmd.Name())
+}
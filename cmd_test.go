@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newRootCmd(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+
+	// flags override the settings
+	root := newRootCmd()
+	root.AddCommand(&cobra.Command{Use: "noop", Run: func(cmd *cobra.Command, args []string) {}})
+	root.SetArgs([]string{"noop", "--cidr", "10.0.0.0/24"})
+	assert.Nil(root.Execute())
+	assert.Equal("10.0.0.0/24", viper.GetString("cidr"))
+	assert.Equal("http://ota.tasmota.com/tasmota/release/", viper.GetString("otaurl"))
+
+	root = newRootCmd()
+	root.SetArgs([]string{"status", "no-ip"})
+	assert.NotNil(root.Execute())
+
+	root = newRootCmd()
+	root.SetArgs([]string{"--profile", "missing", "queue", "list"})
+	assert.NotNil(root.Execute())
+}
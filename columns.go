@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// detailColumns are the optional columns of the device table that TASMOGO_COLUMNS can add
+var detailColumns = map[string]func(tasmoDevice) string{
+	"mac": func(d tasmoDevice) string {
+		return d.MAC
+	},
+	"namesource": func(d tasmoDevice) string {
+		if d.NameSource == "" {
+			return "-"
+		}
+		return "name from " + d.NameSource
+	},
+	"hostname": func(d tasmoDevice) string {
+		return d.Hostname
+	},
+	"topic": func(d tasmoDevice) string {
+		return d.Topic
+	},
+	"module": func(d tasmoDevice) string {
+		if d.Cached {
+			return "-"
+		}
+		return "module " + strconv.Itoa(d.Module)
+	},
+	"uptime": func(d tasmoDevice) string {
+		if d.Cached || d.Uptime == 0 {
+			return "-"
+		}
+		return "up " + formatUptime(d.Uptime)
+	},
+	"rssi": func(d tasmoDevice) string {
+		if d.Cached {
+			return "-"
+		}
+		return strconv.Itoa(d.RSSI) + "%"
+	},
+}
+
+// formatUptime formats an uptime like Tasmota does, "3T04:05:06" becomes "3d 04:05"
+func formatUptime(uptime time.Duration) string {
+	minutes := int(uptime / time.Minute)
+	return strconv.Itoa(minutes/(24*60)) + "d " + twoDigits(minutes/60%24) + ":" + twoDigits(minutes%60)
+}
+
+// twoDigits pads a number with a leading zero
+func twoDigits(n int) string {
+	if n < 10 {
+		return "0" + strconv.Itoa(n)
+	}
+	return strconv.Itoa(n)
+}
+
+// deviceColumns returns the names of the optional columns of TASMOGO_COLUMNS. Unknown columns are
+// skipped with a warning.
+func deviceColumns() []string {
+	columns := make([]string, 0)
+	for _, column := range getList("columns") {
+		column = strings.ToLower(strings.TrimSpace(column))
+		if _, ok := detailColumns[column]; !ok {
+			logWarn("Unknown column " + column + ", expected mac, namesource, hostname, topic, module, uptime or rssi")
+			continue
+		}
+		columns = append(columns, column)
+	}
+	return columns
+}
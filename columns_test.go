@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_formatUptime(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("0d 00:03", formatUptime(3*time.Minute+30*time.Second))
+	assert.Equal("1d 02:03", formatUptime(26*time.Hour+3*time.Minute+4*time.Second))
+}
+
+func Test_deviceColumns(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	assert.Empty(deviceColumns())
+	viper.Set("columns", "MAC, uptime,serial")
+	assert.Equal([]string{"mac", "uptime"}, deviceColumns())
+
+	device := tasmoDevice{MAC: "DC:4F:22:00:12:34", Module: 18, Uptime: 26 * time.Hour, RSSI: 80}
+	assert.Equal("up 1d 02:00", detailColumns["uptime"](device))
+	assert.Equal("module 18", detailColumns["module"](device))
+	assert.Equal("80%", detailColumns["rssi"](device))
+	// devices restored from the last run weren't asked
+	device.Cached = true
+	assert.Equal("-", detailColumns["rssi"](device))
+}
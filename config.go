@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// setDefaults sets up the environment variables and the default value of every setting
+func setDefaults() {
+	viper.SetConfigName("tasmogo")
+	viper.AutomaticEnv()
+	viper.SetEnvPrefix("tasmogo")
+	viper.SetDefault("daemon", false)
+	viper.SetDefault("doupdates", false)
+	viper.SetDefault("otaurl", "http://ota.tasmota.com/tasmota/release/")
+	viper.SetDefault("otatemplate", "{{.Base}}{{.File}}")
+	viper.SetDefault("firmwaremanifest", "")
+	viper.SetDefault("channel", "stable")
+	viper.SetDefault("targetversion", "")
+	viper.SetDefault("versiontimeout", 20*time.Second)
+	viper.SetDefault("devotaurl", "http://ota.tasmota.com/tasmota/")
+	viper.SetDefault("otaurl32", "http://ota.tasmota.com/tasmota32/release/")
+	viper.SetDefault("devotaurl32", "http://ota.tasmota.com/tasmota32/")
+	viper.SetDefault("otaversionurl32", "http://ota.tasmota.com/tasmota32/release-{version}/")
+	viper.SetDefault("devversionurl", "https://raw.githubusercontent.com/arendst/Tasmota/development/tasmota/include/tasmota_version.h")
+	viper.SetDefault("password", "")
+	viper.SetDefault("wifipassword", "")
+	viper.SetDefault("scheme", "http")
+	viper.SetDefault("port", "")
+	viper.SetDefault("tlsinsecure", false)
+	viper.SetDefault("tlscafile", "")
+	viper.SetDefault("maxidleconns", 100)
+	viper.SetDefault("maxidleconnsperhost", 2)
+	viper.SetDefault("maxconnsperhost", 0)
+	viper.SetDefault("idleconntimeout", 30*time.Second)
+	viper.SetDefault("cidr", "192.168.0.0/24")
+	viper.SetDefault("discovery", "cidr")
+	viper.SetDefault("exclude", []string{})
+	viper.SetDefault("hosts", []string{})
+	viper.SetDefault("hostsfile", "")
+	viper.SetDefault("maxaddresses", 65536)
+	viper.SetDefault("concurrency", 256)
+	viper.SetDefault("scantimeout", 10*time.Second)
+	viper.SetDefault("scanretries", 0)
+	viper.SetDefault("scanbackoff", time.Second)
+	viper.SetDefault("slowscan", false)
+	viper.SetDefault("requestspersecond", 0)
+	viper.SetDefault("adaptivethrottle", false)
+	viper.SetDefault("polite", false)
+	viper.SetDefault("prescan", "")
+	viper.SetDefault("prescantimeout", 2*time.Second)
+	viper.SetDefault("progress", true)
+	viper.SetDefault("mdnstimeout", 5*time.Second)
+	viper.SetDefault("mqttbroker", "")
+	viper.SetDefault("mqttuser", "")
+	viper.SetDefault("mqttpassword", "")
+	viper.SetDefault("mqttcafile", "")
+	viper.SetDefault("mqttinsecure", false)
+	viper.SetDefault("mqtttimeout", 5*time.Second)
+	viper.SetDefault("hassdiscovery", false)
+	viper.SetDefault("hassprefix", "homeassistant")
+	viper.SetDefault("hasstopic", "tasmogo")
+	viper.SetDefault("profile", "")
+	viper.SetDefault("inventory", "tasmogo-inventory.json")
+	viper.SetDefault("rolloutfile", "tasmogo-rollout.json")
+	viper.SetDefault("resume", false)
+	viper.SetDefault("latencyfactor", 2.0)
+	viper.SetDefault("heapthreshold", 10)
+	viper.SetDefault("heapcycles", 3)
+	viper.SetDefault("restartlowheap", false)
+	viper.SetDefault("auditsample", 0)
+	viper.SetDefault("auditlog", "tasmogo-audit.log")
+	viper.SetDefault("twostepota", false)
+	viper.SetDefault("twostepflashsize", 1024)
+	viper.SetDefault("twostepretries", 2)
+	viper.SetDefault("updateretries", 1)
+	viper.SetDefault("dryrun", false)
+	viper.SetDefault("interactive", false)
+	viper.SetDefault("protected", []string{})
+	viper.SetDefault("protecttag", "protected")
+	viper.SetDefault("quarantineafter", 5)
+	viper.SetDefault("quarantinetag", "quarantined")
+	viper.SetDefault("provision", false)
+	viper.SetDefault("otalock", "lock")
+	viper.SetDefault("force", false)
+	viper.SetDefault("readonly", false)
+	viper.SetDefault("checkmaxoutdated", 0)
+	viper.SetDefault("output", "table")
+	viper.SetDefault("execconcurrency", 4)
+	viper.SetDefault("exectimeout", 30*time.Second)
+	viper.SetDefault("execretries", 0)
+	viper.SetDefault("execretrydelay", 2*time.Second)
+	viper.SetDefault("seencolumns", false)
+	viper.SetDefault("updatecolumn", false)
+	viper.SetDefault("columns", []string{})
+	viper.SetDefault("namefallback", []string{"devicename", "friendlyname", "hostname", "topic", "ip"})
+	viper.SetDefault("historysize", 1000)
+	viper.SetDefault("missedscans", 1)
+	viper.SetDefault("archiveafter", 30*24*time.Hour)
+	viper.SetDefault("includearchived", false)
+	viper.SetDefault("wifimaxclients", 20)
+	viper.SetDefault("useragent", "")
+	viper.SetDefault("webui", "")
+	viper.SetDefault("publicstatus", "")
+	viper.SetDefault("publicratelimit", 30)
+	viper.SetDefault("apitoken", "")
+	viper.SetDefault("daemonurl", "")
+	viper.SetDefault("socket", "")
+	viper.SetDefault("socketmode", "0600")
+	viper.SetDefault("notifyon", "always")
+	viper.SetDefault("notifywebhook", "")
+	viper.SetDefault("notifyntfy", "")
+	viper.SetDefault("notifygotify", "")
+	viper.SetDefault("notifygotifytoken", "")
+	viper.SetDefault("notifysmtp", "")
+	viper.SetDefault("notifysmtpuser", "")
+	viper.SetDefault("notifysmtppassword", "")
+	viper.SetDefault("notifyfrom", "tasmogo@localhost")
+	viper.SetDefault("notifyto", []string{})
+	viper.SetDefault("notifyavailability", false)
+	viper.SetDefault("lwt", false)
+	viper.SetDefault("lwttopic", "tele/+/LWT")
+	viper.SetDefault("rescanerrors", false)
+	viper.SetDefault("fullscaninterval", 0)
+	viper.SetDefault("tunnel", false)
+	viper.SetDefault("versionpatterns", []string{})
+	viper.SetDefault("canaries", "")
+	viper.SetDefault("canarysoak", 48*time.Hour)
+	viper.SetDefault("minrssi", 0)
+	viper.SetDefault("telemetry", false)
+	viper.SetDefault("releasenotes", false)
+	viper.SetDefault("variantaliases", []string{})
+	viper.SetDefault("schedule", "24h")
+	viper.SetDefault("timezone", "")
+	viper.SetDefault("blackout", []string{})
+	viper.SetDefault("onlyupdatebetween", "")
+	viper.SetDefault("scanonstart", true)
+	viper.SetDefault("headers", []string{})
+	viper.SetDefault("groupprefix", 24)
+	viper.SetDefault("groupprefix6", 64)
+	viper.SetDefault("groups", []string{})
+	viper.SetDefault("filtername", []string{})
+	viper.SetDefault("filtervariant", []string{})
+	viper.SetDefault("filterversion", "")
+	viper.SetDefault("filtertag", []string{})
+	viper.SetDefault("select", "")
+	viper.SetDefault("outputfile", "")
+	viper.SetDefault("loglevel", "info")
+	viper.SetDefault("logformat", "text")
+	viper.SetDefault("metricsfile", "")
+	viper.SetDefault("healthinterval", 0)
+	viper.SetDefault("healthmetricsfile", "")
+	viper.SetDefault("statefile", "")
+	viper.SetDefault("maxupdates", 0)
+	viper.SetDefault("httpcache", "")
+	viper.SetDefault("otaserver", "")
+	viper.SetDefault("otaserverurl", "")
+	viper.SetDefault("firmwaredir", "firmware")
+	viper.SetDefault("otadownload", true)
+	viper.SetDefault("pushupdate", false)
+	viper.SetDefault("otaversionurl", "http://ota.tasmota.com/tasmota/release-{version}/")
+	viper.SetDefault("batchsize", 0)
+	viper.SetDefault("updateconcurrency", 4)
+	viper.SetDefault("speedtest", false)
+	viper.SetDefault("updatewindow", 0)
+	viper.SetDefault("maxfailures", 0)
+	viper.SetDefault("verifytimeout", 10*time.Minute)
+	viper.SetDefault("verifydelay", 15*time.Second)
+	viper.SetDefault("verifymaxdelay", 2*time.Minute)
+	viper.SetDefault("manifestdir", "")
+	viper.SetDefault("signingkey", "")
+	viper.SetDefault("backupdir", "backups")
+	viper.SetDefault("backupbeforeupdate", false)
+	viper.SetDefault("backupfilesystem", false)
+}
+
+// loadConfig reads the config file and applies the settings of the selected profile on top of it.
+// Without an explicit path tasmogo.yaml/.toml/.json is searched in the working directory,
+// ~/.config/tasmogo and /etc/tasmogo. Environment variables still take precedence over both.
+func loadConfig(path string, profile string) error {
+	if path != "" {
+		viper.SetConfigFile(path)
+	} else {
+		viper.AddConfigPath(".")
+		viper.AddConfigPath("$HOME/.config/tasmogo")
+		viper.AddConfigPath("/etc/tasmogo")
+	}
+	if err := viper.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+			return err
+		}
+	}
+
+	if profile == "" {
+		profile = viper.GetString("profile")
+	}
+	if profile == "" {
+		return nil
+	}
+	settings := viper.GetStringMap("profiles." + profile)
+	if len(settings) == 0 {
+		return errors.New("Unknown profile " + profile)
+	}
+	return viper.MergeConfigMap(settings)
+}
+
+// getList reads a setting that is either a list or a comma separated string, as environment variables are
+func getList(key string) []string {
+	values := make([]string, 0)
+	for _, value := range strings.Split(strings.Join(viper.GetStringSlice(key), ","), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
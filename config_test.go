@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+const testConfig = `
+cidr: 192.168.0.0/24
+password: secret
+profiles:
+  office:
+    cidr: 10.0.0.0/24
+    doupdates: true
+`
+
+func Test_loadConfig(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	path := filepath.Join(t.TempDir(), "tasmogo.yaml")
+	assert.Nil(ioutil.WriteFile(path, []byte(testConfig), 0644))
+
+	setDefaults()
+	assert.Nil(loadConfig(path, "office"))
+	assert.Equal("10.0.0.0/24", viper.GetString("cidr"))
+	assert.Equal("secret", viper.GetString("password"))
+	assert.True(viper.GetBool("doupdates"))
+	assert.Equal("tasmogo-inventory.json", viper.GetString("inventory"))
+
+	assert.NotNil(loadConfig(path, "home"))
+	assert.NotNil(loadConfig(filepath.Join(t.TempDir(), "missing.yaml"), ""))
+}
+
+func Test_getList(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("cidr", "10.0.0.0/24, 10.0.1.0/24,")
+	assert.Equal(t, []string{"10.0.0.0/24", "10.0.1.0/24"}, getList("cidr"))
+	viper.Set("cidr", []string{"10.0.0.0/24", "10.0.1.0/24"})
+	assert.Equal(t, []string{"10.0.0.0/24", "10.0.1.0/24"}, getList("cidr"))
+	viper.Set("cidr", "")
+	assert.Empty(t, getList("cidr"))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// identities maps the IP of every device tasmogo has seen to its hostname and MAC address, so the
+// credentials of a device can be given by any of them
+var identities = struct {
+	sync.Mutex
+	names map[string][]string
+}{names: make(map[string][]string)}
+
+// credentialKey normalizes an IP, hostname or MAC address for the lookup of credentials. MAC addresses
+// can be written with colons or dashes.
+func credentialKey(name string) string {
+	if mac, err := net.ParseMAC(name); err == nil {
+		return mac.String()
+	}
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// rememberDevice notes the hostname and MAC address of a device for the lookup of its credentials
+func rememberDevice(ip string, hostname string, mac string) {
+	names := make([]string, 0, 2)
+	for _, name := range []string{hostname, mac} {
+		if name != "" {
+			names = append(names, credentialKey(name))
+		}
+	}
+	if ip == "" || len(names) == 0 {
+		return
+	}
+	identities.Lock()
+	identities.names[ip] = names
+	identities.Unlock()
+}
+
+// rememberInventory notes the hostnames and MAC addresses the inventory knows, so devices that can't be
+// reached without their password can still be found by them
+func rememberInventory(inv *inventory) {
+	for ip, rec := range inv.Devices {
+		identities.Lock()
+		_, known := identities.names[ip]
+		identities.Unlock()
+		if !known {
+			rememberDevice(ip, rec.Hostname, rec.MAC)
+		}
+	}
+}
+
+// lookupDevice returns the value for a device from a setting that maps IPs, hostnames and MAC addresses
+// to values. The host may contain a port.
+func lookupDevice(setting string, host string) (string, bool) {
+	values := make(map[string]string)
+	for key, value := range viper.GetStringMapString(setting) {
+		values[credentialKey(key)] = value
+	}
+	if len(values) == 0 {
+		return "", false
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	names := []string{credentialKey(host)}
+	identities.Lock()
+	names = append(names, identities.names[host]...)
+	identities.Unlock()
+	for _, name := range names {
+		if value, ok := values[name]; ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// devicePassword returns the web password of a device from TASMOGO_CREDENTIALS, which maps IPs,
+// hostnames and MAC addresses to passwords, or TASMOGO_PASSWORD if the device isn't listed
+func devicePassword(host string) string {
+	if password, ok := lookupDevice("credentials", host); ok {
+		return password
+	}
+	return viper.GetString("password")
+}
+
+// deviceBasicAuth returns the basic authentication of a device from TASMOGO_PROXYAUTH, which maps IPs,
+// hostnames and MAC addresses to "user:password", for devices behind an authenticating proxy
+func deviceBasicAuth(host string) (string, string, bool) {
+	auth, ok := lookupDevice("proxyauth", host)
+	if !ok {
+		return "", "", false
+	}
+	user, password := auth, ""
+	if i := strings.Index(auth, ":"); i >= 0 {
+		user, password = auth[:i], auth[i+1:]
+	}
+	return user, password, true
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+const credentialsConfig = `
+password: fallback
+credentials:
+  192.168.0.10: by-ip
+  Plug-Garage: by-hostname
+  AA-BB-CC-DD-EE-01: by-mac
+`
+
+func Test_devicePassword(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	path := filepath.Join(t.TempDir(), "tasmogo.yaml")
+	assert.Nil(ioutil.WriteFile(path, []byte(credentialsConfig), 0644))
+	setDefaults()
+	assert.Nil(loadConfig(path, ""))
+
+	rememberDevice("192.168.0.11", "plug-garage", "")
+	rememberInventory(&inventory{Devices: map[string]*inventoryRecord{
+		"192.168.0.12": {MAC: "aa:bb:cc:dd:ee:01"},
+		"192.168.0.14": {Hostname: "Plug-Garage"},
+	}})
+	assert.Equal("by-ip", devicePassword("192.168.0.10"))
+	assert.Equal("by-hostname", devicePassword("192.168.0.11"))
+	assert.Equal("by-hostname", devicePassword("plug-garage"))
+	assert.Equal("by-mac", devicePassword("192.168.0.12"))
+	assert.Equal("by-hostname", devicePassword("192.168.0.14"))
+	assert.Equal("fallback", devicePassword("192.168.0.13"))
+
+	// the credentials can be given as JSON in the environment
+	viper.Reset()
+	setDefaults()
+	os.Setenv("TASMOGO_CREDENTIALS", `{"192.168.0.13": "from-env"}`)
+	defer os.Unsetenv("TASMOGO_CREDENTIALS")
+	assert.Equal("from-env", devicePassword("192.168.0.13"))
+}
+
+func Test_newDeviceClient_credentials(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	viper.Set("credentials", map[string]string{"127.0.0.1": "secret"})
+	var password string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		password = r.URL.Query().Get("password")
+		w.Write([]byte(`{"POWER":"ON"}`))
+	}))
+	defer srv.Close()
+	_, err := newDeviceClient().Command(context.Background(), strings.TrimPrefix(srv.URL, "http://"), "Power")
+	assert.Nil(err)
+	assert.Equal("secret", password)
+}
+
+func Test_deviceBasicAuth(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	viper.Set("proxyauth", map[string]string{"192.168.0.20": "nginx:secret:with:colons", "192.168.0.21": "nginx"})
+	user, password, ok := deviceBasicAuth("192.168.0.20:8080")
+	assert.True(ok)
+	assert.Equal("nginx", user)
+	assert.Equal("secret:with:colons", password)
+	user, password, ok = deviceBasicAuth("192.168.0.21")
+	assert.True(ok)
+	assert.Equal("nginx", user)
+	assert.Equal("", password)
+	_, _, ok = deviceBasicAuth("192.168.0.22")
+	assert.False(ok)
+}
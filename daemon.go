@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/spf13/viper"
+)
+
+// daemon runs the scheduled scans and the ones requested via the web UI one after another and keeps
+// the results of the last one
+type daemon struct {
+	mu           sync.Mutex
+	devices      []tasmoDevice
+	started      time.Time
+	lastScan     time.Time
+	lastDuration time.Duration
+	nextScan     time.Time
+	schedule     string
+	location     *time.Location
+	paused       bool
+	job          string
+	jobs         chan scanOptions
+	log          *logTail
+	availability *availabilityTracker
+	scan         func(context.Context, scanOptions) []tasmoDevice
+}
+
+// daemonStatus is the state of the daemon as reported to the web UI
+type daemonStatus struct {
+	Job      string       `json:"job"`
+	LastScan time.Time    `json:"lastScan"`
+	NextScan time.Time    `json:"nextScan"`
+	Schedule string       `json:"schedule"`
+	TimeZone string       `json:"timeZone"`
+	Devices  []scanResult `json:"devices"`
+	Log      []string     `json:"log"`
+}
+
+// daemonSummary is the overview of the daemon shown by "tasmogo status"
+type daemonSummary struct {
+	Started      time.Time     `json:"started"`
+	Uptime       time.Duration `json:"uptime"`
+	Job          string        `json:"job"`
+	Paused       bool          `json:"paused"`
+	LastScan     time.Time     `json:"lastScan"`
+	LastDuration time.Duration `json:"lastDuration"`
+	NextScan     time.Time     `json:"nextScan"`
+	Schedule     string        `json:"schedule"`
+	TimeZone     string        `json:"timeZone"`
+	Devices      int           `json:"devices"`
+	Outdated     int           `json:"outdated"`
+	Updated      int           `json:"updated"`
+	Failed       int           `json:"failed"`
+	Pending      int           `json:"pending"`
+	Online       int           `json:"online"`
+	Offline      int           `json:"offline"`
+	// Agent tells if an agent is connected to the tunnel, it is only set with TASMOGO_TUNNEL
+	Agent *bool `json:"agent,omitempty"`
+}
+
+// newDaemon creates a daemon that runs the given scan function
+func newDaemon(scan func(context.Context, scanOptions) []tasmoDevice) *daemon {
+	return &daemon{jobs: make(chan scanOptions, 1), log: &logTail{}, availability: newAvailabilityTracker(), scan: scan, started: time.Now(), location: time.Local}
+}
+
+// request queues a run and reports if it was accepted. Only one run can wait while another is running.
+func (d *daemon) request(opts scanOptions) bool {
+	select {
+	case d.jobs <- opts:
+		return true
+	default:
+		return false
+	}
+}
+
+// execute runs a scan and keeps its results
+func (d *daemon) execute(ctx context.Context, opts scanOptions) {
+	job := "scan"
+	if opts.Update {
+		job = "update"
+	}
+	d.mu.Lock()
+	d.job = job
+	d.mu.Unlock()
+	started := time.Now()
+	devices := d.scan(ctx, opts)
+	d.mu.Lock()
+	d.devices, d.lastScan, d.lastDuration, d.job = devices, time.Now(), time.Since(started), ""
+	d.mu.Unlock()
+	// the scan wrote the state file without the availability of the devices
+	if viper.GetBool("lwt") {
+		d.saveState()
+	}
+}
+
+// setPaused pauses or resumes the scheduled scans. Requested scans are run while the daemon is paused.
+func (d *daemon) setPaused(paused bool) {
+	d.mu.Lock()
+	d.paused = paused
+	d.mu.Unlock()
+	if paused {
+		logInfo("Paused the scheduled scans")
+	} else {
+		logInfo("Resumed the scheduled scans")
+	}
+}
+
+// isPaused reports if the scheduled scans are paused
+func (d *daemon) isPaused() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.paused
+}
+
+// run scans at the times of the schedule, the first time right away if immediate is set, and runs the
+// requested scans in between until ctx is cancelled
+func (d *daemon) run(ctx context.Context, s schedule, immediate bool, defaults scanOptions) {
+	if end, ok := blackoutEnd(time.Now()); immediate && ok {
+		logInfo("Not scanning on start, " + describeBlackout(end))
+	} else if immediate {
+		d.execute(ctx, defaults)
+	}
+	for ctx.Err() == nil {
+		next := s.next(time.Now().In(d.location))
+		d.mu.Lock()
+		d.nextScan = next
+		d.mu.Unlock()
+		logInfo("Next scan at: " + next.Format("2006-01-02 15:04:05 MST") + " (in " + time.Until(next).Truncate(time.Second).String() + ")")
+		timer := time.NewTimer(time.Until(next))
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+				if d.isPaused() {
+					logInfo("Skipping the scheduled scan, the daemon is paused")
+				} else {
+					d.execute(ctx, defaults)
+				}
+				break wait
+			case opts := <-d.jobs:
+				if end, ok := blackoutEnd(time.Now()); ok {
+					logInfo("Postponing the requested run, " + describeBlackout(end))
+					go d.postpone(ctx, opts, end)
+					continue
+				}
+				d.execute(ctx, opts)
+			}
+		}
+	}
+}
+
+// postpone requests a run once the given time has come, unless tasmogo was stopped in the meantime
+func (d *daemon) postpone(ctx context.Context, opts scanOptions, until time.Time) {
+	if pause(ctx, time.Until(until)) && !d.request(opts) {
+		logWarn("Dropping the postponed run, another run is already waiting")
+	}
+}
+
+// deviceResults converts the devices to their machine-readable state. The devices are marked online or
+// offline if their last will was seen.
+func (d *daemon) deviceResults(devices []tasmoDevice) []scanResult {
+	results := scanResults(devices)
+	for i, device := range devices {
+		if state, ok := d.availability.get(device.Topic); ok && device.Topic != "" {
+			online := state.Online
+			results[i].Online = &online
+		}
+	}
+	return results
+}
+
+// status returns the current state of the daemon
+func (d *daemon) status() daemonStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return daemonStatus{Job: d.job, LastScan: d.lastScan, NextScan: d.nextScan, Schedule: d.schedule, TimeZone: d.location.String(), Devices: d.deviceResults(d.devices), Log: d.log.snapshot()}
+}
+
+// summary returns the overview of the daemon and its last scan
+func (d *daemon) summary() daemonSummary {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	run := summarizeRun(d.devices)
+	online, offline := d.availability.count()
+	var agent *bool
+	if viper.GetBool("tunnel") {
+		connected := agentTunnel.connected()
+		agent = &connected
+	}
+	return daemonSummary{
+		Started:      d.started,
+		Uptime:       time.Since(d.started).Truncate(time.Second),
+		Job:          d.job,
+		Paused:       d.paused,
+		LastScan:     d.lastScan,
+		LastDuration: d.lastDuration.Truncate(time.Second),
+		NextScan:     d.nextScan,
+		Schedule:     d.schedule,
+		TimeZone:     d.location.String(),
+		Devices:      run.Devices,
+		Outdated:     run.Outdated,
+		Updated:      run.Updated,
+		Failed:       run.Failed,
+		Pending:      len(pendingUpdates(d.devices)),
+		Online:       online,
+		Offline:      offline,
+		Agent:        agent,
+	}
+}
+
+// daemonURL returns the address of the API of a running daemon, TASMOGO_DAEMONURL or the address of
+// TASMOGO_WEBUI on this host
+func daemonURL() (string, error) {
+	if url := viper.GetString("daemonurl"); url != "" {
+		return strings.TrimRight(url, "/"), nil
+	}
+	addr := viper.GetString("webui")
+	switch {
+	case addr == "":
+		return "", errors.New("Set TASMOGO_DAEMONURL or TASMOGO_WEBUI to reach the daemon")
+	case strings.HasPrefix(addr, ":"):
+		return "http://localhost" + addr, nil
+	}
+	return "http://" + addr, nil
+}
+
+// daemonRequest sends a request to the API of a running daemon and decodes the answer into v. The
+// daemon is reached via TASMOGO_SOCKET, if it is set and TASMOGO_DAEMONURL is not.
+func daemonRequest(method string, path string, v interface{}) error {
+	base, client, err := daemonClient()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, base+path, nil)
+	if err != nil {
+		return err
+	}
+	setDeviceHeader(req)
+	if token := viper.GetString("apitoken"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return errors.New("The daemon is not reachable: " + err.Error())
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.New("The daemon answered with HTTP status " + strconv.Itoa(res.StatusCode))
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// fetchDaemonSummary asks a running daemon for its overview
+func fetchDaemonSummary() (daemonSummary, error) {
+	var s daemonSummary
+	err := daemonRequest("GET", "/api/daemon", &s)
+	return s, err
+}
+
+// formatZoned formats a time in the named time zone of the daemon, so the scans are shown as the
+// daemon sees them, and in the local one if the zone is unknown
+func formatZoned(t time.Time, zone string) string {
+	if t.IsZero() {
+		return "never"
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil || zone == "" {
+		loc = time.Local
+	}
+	return t.In(loc).Format("2006-01-02 15:04:05 MST")
+}
+
+// renderDaemonSummary generates a table with the overview of the daemon
+func renderDaemonSummary(s daemonSummary) string {
+	state := "idle"
+	switch {
+	case s.Job != "":
+		state = "running " + s.Job
+	case s.Paused:
+		state = "paused"
+	}
+	t := table.NewWriter()
+	t.AppendRows([]table.Row{
+		{"State", state},
+		{"Uptime", s.Uptime.String()},
+		{"Last scan", formatZoned(s.LastScan, s.TimeZone) + " (took " + s.LastDuration.String() + ")"},
+		{"Devices", strconv.Itoa(s.Devices) + ", " + strconv.Itoa(s.Outdated) + " outdated"},
+		{"Updates", strconv.Itoa(s.Updated) + " verified, " + strconv.Itoa(s.Failed) + " failed"},
+		{"Pending updates", s.Pending},
+		{"Next scan", formatZoned(s.NextScan, s.TimeZone)},
+	})
+	if s.Online+s.Offline > 0 {
+		t.AppendRow(table.Row{"Availability", strconv.Itoa(s.Online) + " online, " + strconv.Itoa(s.Offline) + " offline"})
+	}
+	if s.Agent != nil {
+		agent := "disconnected"
+		if *s.Agent {
+			agent = "connected"
+		}
+		t.AppendRow(table.Row{"Agent", agent})
+	}
+	return t.Render()
+}
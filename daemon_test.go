@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_daemon_execute(t *testing.T) {
+	assert := assert.New(t)
+	var got scanOptions
+	d := newDaemon(func(ctx context.Context, opts scanOptions) []tasmoDevice {
+		got = opts
+		return []tasmoDevice{{Name: "plug", IP: net.IPv4(10, 0, 0, 1), Outdated: true}}
+	})
+	d.execute(context.Background(), scanOptions{Update: true, Only: []string{"10.0.0.1"}})
+	assert.Equal([]string{"10.0.0.1"}, got.Only)
+	status := d.status()
+	assert.Equal("", status.Job)
+	assert.False(status.LastScan.IsZero())
+	assert.Equal("plug", status.Devices[0].Name)
+}
+
+func Test_daemon_run(t *testing.T) {
+	assert := assert.New(t)
+	scans := 0
+	d := newDaemon(func(ctx context.Context, opts scanOptions) []tasmoDevice {
+		scans++
+		return nil
+	})
+	// a stopped daemon finishes the current scan and returns
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.run(ctx, intervalSchedule{every: time.Hour}, true, scanOptions{})
+	assert.Equal(1, scans)
+}
+
+func Test_daemon_summary(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	d := newDaemon(nil)
+	d.devices = []tasmoDevice{
+		{Name: "plug", IP: net.IPv4(10, 0, 0, 1), Outdated: true},
+		{Name: "lamp", IP: net.IPv4(10, 0, 0, 2), Outdated: true, UpdateURL: "http://ota/tasmota.bin", Verified: true},
+		{Name: "heater", IP: net.IPv4(10, 0, 0, 3), Outdated: true, UpdateURL: "http://ota/tasmota.bin"},
+		{Name: "fan", IP: net.IPv4(10, 0, 0, 4)},
+	}
+	s := d.summary()
+	assert.Equal(4, s.Devices)
+	assert.Equal(3, s.Outdated)
+	assert.Equal(1, s.Updated)
+	assert.Equal(1, s.Failed)
+	assert.Equal(1, s.Pending)
+	assert.False(s.Paused)
+	d.setPaused(true)
+	assert.True(d.summary().Paused)
+}
+
+func Test_daemonURL(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	_, err := daemonURL()
+	assert.NotNil(err)
+	viper.Set("webui", ":8080")
+	url, _ := daemonURL()
+	assert.Equal("http://localhost:8080", url)
+	viper.Set("webui", "10.0.0.5:8080")
+	url, _ = daemonURL()
+	assert.Equal("http://10.0.0.5:8080", url)
+	viper.Set("daemonurl", "https://tasmogo.example.com/")
+	url, _ = daemonURL()
+	assert.Equal("https://tasmogo.example.com", url)
+}
+
+func Test_fetchDaemonSummary(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	d := newDaemon(nil)
+	d.devices = []tasmoDevice{{Name: "plug", IP: net.IPv4(10, 0, 0, 1), Outdated: true}}
+	srv := httptest.NewServer(webUIHandler(d))
+	defer srv.Close()
+	viper.Set("daemonurl", srv.URL)
+	viper.Set("apitoken", "secret")
+
+	s, err := fetchDaemonSummary()
+	assert.Nil(err)
+	assert.Equal(1, s.Outdated)
+
+	res, err := srv.Client().Post(srv.URL+"/api/pause", "application/json", nil)
+	assert.Nil(err)
+	res.Body.Close()
+	// without the token the daemon refuses to pause
+	assert.False(d.isPaused())
+
+	refused := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer refused.Close()
+	viper.Set("daemonurl", refused.URL)
+	_, err = fetchDaemonSummary()
+	assert.NotNil(err)
+}
+
+func Test_renderDaemonSummary(t *testing.T) {
+	assert := assert.New(t)
+	table := renderDaemonSummary(daemonSummary{Paused: true, Uptime: 90 * time.Minute, Devices: 3, Outdated: 1, Pending: 1})
+	assert.Contains(table, "paused")
+	assert.Contains(table, "1h30m0s")
+	assert.Contains(table, "3, 1 outdated")
+	assert.Contains(table, "never")
+	assert.Contains(renderDaemonSummary(daemonSummary{Job: "update", Paused: true}), "running update")
+	// the next scan is shown in the time zone of the daemon
+	next := time.Date(2021, 11, 7, 6, 30, 0, 0, time.UTC)
+	assert.Contains(renderDaemonSummary(daemonSummary{NextScan: next, TimeZone: "America/New_York"}), "2021-11-07 01:30:00 EST")
+}
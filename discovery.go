@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/mdns"
+	"github.com/spf13/viper"
+)
+
+// target is an address to probe and the discovery methods that found it
+type target struct {
+	IP      net.IP
+	Sources []string
+}
+
+// targetList collects the addresses found by the discovery methods. An address found by several
+// methods is only listed once, so it is only probed once.
+type targetList struct {
+	targets []target
+	index   map[string]int
+	// failed are the addresses whose errors are worth another try
+	failed []net.IP
+}
+
+// add appends the addresses found by a discovery method to the list
+func (l *targetList) add(source string, ips []net.IP) {
+	if l.index == nil {
+		l.index = make(map[string]int)
+	}
+	for _, ip := range ips {
+		key := ip.String()
+		if i, ok := l.index[key]; ok {
+			l.targets[i].Sources = appendSource(l.targets[i].Sources, source)
+			continue
+		}
+		l.index[key] = len(l.targets)
+		l.targets = append(l.targets, target{IP: ip, Sources: []string{source}})
+	}
+}
+
+// probe requests the data of all addresses in the list and returns the Tasmota devices among them
+func (l *targetList) probe(ctx context.Context) []tasmoDevice {
+	if len(l.targets) == 0 {
+		return []tasmoDevice{}
+	}
+	logInfo("Starting scan of " + strconv.Itoa(len(l.targets)) + " ip addresses")
+	devices, failed := probeAddresses(ctx, int64(len(l.targets)), func(addresses chan<- net.IP) {
+		for _, t := range l.targets {
+			addresses <- t.IP
+		}
+	})
+	l.failed = failed
+	for i := range devices {
+		if j, ok := l.index[devices[i].IP.String()]; ok {
+			devices[i].Sources = append([]string(nil), l.targets[j].Sources...)
+		}
+	}
+	return devices
+}
+
+// appendSource adds a discovery method to a list of methods, unless it is already part of it
+func appendSource(sources []string, source string) []string {
+	for _, s := range sources {
+		if s == source {
+			return sources
+		}
+	}
+	return append(sources, source)
+}
+
+// discoverDevices finds all Tasmota devices with the discovery methods selected in the config, given
+// as a comma separated list: "cidr" sweeps the configured network, "mdns" listens for mDNS
+// announcements, "hosts" asks every host of a fixed list and "mqtt" reads the discovery messages from the MQTT broker. "both" is short for "cidr,mdns".
+// The methods run at the same time. Addresses found by several methods are probed only once, devices
+// found by several methods are merged by their IP and MAC address and remember the methods that found
+// them. Only the devices passing the filters are returned.
+func discoverDevices() []tasmoDevice {
+	devices, _ := discover(context.Background(), nil)
+	return filterDiscovered(devices)
+}
+
+// discoveryMethods returns the discovery methods of the config in their order, with "both" expanded
+// and every method only once
+func discoveryMethods() []string {
+	methods := make([]string, 0)
+	for _, method := range strings.Split(viper.GetString("discovery"), ",") {
+		switch method = strings.TrimSpace(method); method {
+		case "cidr", "hosts", "mdns", "mqtt":
+			methods = appendSource(methods, method)
+		case "both":
+			methods = appendSource(appendSource(methods, "cidr"), "mdns")
+		default:
+			logWarn("Unknown discovery method " + method)
+		}
+	}
+	return methods
+}
+
+// discover finds all Tasmota devices like discoverDevices and also returns the addresses whose errors
+// are worth another try. The methods run at the same time: the addresses of all methods but MQTT are
+// collected and then probed, while MQTT listens for the discovery messages. If known is not nil, these
+// addresses are probed instead of sweeping the networks and listed as found by "known".
+func discover(ctx context.Context, known []net.IP) ([]tasmoDevice, []net.IP) {
+	methods := discoveryMethods()
+	sources := append([]string{}, methods...)
+	found := make([][]net.IP, len(methods))
+	var mqttDevices []tasmoDevice
+	var addressing, listening sync.WaitGroup
+	// devices found by the method listed first are preferred, e.g. to update them via MQTT
+	mqttFirst := len(methods) > 0 && methods[0] == "mqtt"
+	for i, method := range methods {
+		if method == "mqtt" {
+			listening.Add(1)
+			go func() {
+				defer listening.Done()
+				mqttDevices = scanMQTT()
+			}()
+			continue
+		}
+		if method == "cidr" && known != nil {
+			sources[i], found[i] = "known", known
+			continue
+		}
+		addressing.Add(1)
+		go func(i int, method string) {
+			defer addressing.Done()
+			found[i] = discoveryTargets(ctx, method)
+		}(i, method)
+	}
+	addressing.Wait()
+	var targets targetList
+	for i, source := range sources {
+		targets.add(source, found[i])
+	}
+	devices := targets.probe(ctx)
+	listening.Wait()
+	for i := range mqttDevices {
+		mqttDevices[i].Sources = []string{"mqtt"}
+	}
+	if mqttFirst {
+		devices = mergeDevices(mqttDevices, devices)
+	} else {
+		devices = mergeDevices(devices, mqttDevices)
+	}
+	sortDevices(devices)
+	if len(sources) > 1 {
+		logInfo(describeSources(sources, devices))
+	}
+	return devices, targets.failed
+}
+
+// discoveryTargets returns the addresses found by a discovery method other than MQTT. The sweep of the
+// networks is narrowed down by the pre-scan.
+func discoveryTargets(ctx context.Context, method string) []net.IP {
+	switch method {
+	case "cidr":
+		return prescanTargets(ctx, networkTargets())
+	case "hosts":
+		return resolveHosts(configuredHosts())
+	case "mdns":
+		return mdnsTargets()
+	}
+	return nil
+}
+
+// describeSources counts the devices every discovery method found, e.g. to see which method misses
+// a device
+func describeSources(methods []string, devices []tasmoDevice) string {
+	counts := make(map[string]int)
+	for _, device := range devices {
+		for _, source := range device.Sources {
+			counts[source]++
+		}
+	}
+	parts := make([]string, 0, len(methods))
+	for _, method := range methods {
+		parts = append(parts, method+": "+strconv.Itoa(counts[method]))
+	}
+	return "Found " + strconv.Itoa(len(devices)) + " devices (" + strings.Join(parts, ", ") + ")"
+}
+
+// sortDevices orders the devices by their IP address, as the parallelized scans find them in a random
+// order. Devices without a known IP come last, ordered by their MQTT topic.
+func sortDevices(devices []tasmoDevice) {
+	sort.SliceStable(devices, func(i, j int) bool {
+		a, b := devices[i], devices[j]
+		if a.IP == nil || b.IP == nil {
+			if a.IP == nil && b.IP == nil {
+				return a.Topic < b.Topic
+			}
+			return b.IP == nil
+		}
+		return bytes.Compare(a.IP.To16(), b.IP.To16()) < 0
+	})
+}
+
+// moreResponsive reports if device a is the better address of a device found twice: one that answered
+// in this scan beats one taken over from the last run or that rejected the password, then the one seen
+// last and at last the one answering faster, e.g. over Ethernet rather than Wi-Fi.
+func moreResponsive(a, b tasmoDevice) bool {
+	liveA, liveB := !a.Cached && !a.AuthFailed, !b.Cached && !b.AuthFailed
+	switch {
+	case liveA != liveB:
+		return liveA
+	case !a.LastSeen.Equal(b.LastSeen):
+		return a.LastSeen.After(b.LastSeen)
+	}
+	return a.Latency < b.Latency
+}
+
+// mergeDevices combines two lists of devices and drops the duplicates, but keeps the discovery methods
+// that found them. Devices are the same if they have the same IP or MAC address; devices without a
+// known IP are told apart by their MQTT topic. A device answering at several IPs with the same MAC
+// address, e.g. over Ethernet and Wi-Fi or at a new address after the DHCP lease changed, is kept at
+// its most responsive address and the others are recorded as its duplicates, so it is listed and
+// updated only once.
+func mergeDevices(a []tasmoDevice, b []tasmoDevice) []tasmoDevice {
+	seen := make(map[string]int)
+	merged := make([]tasmoDevice, 0, len(a)+len(b))
+	for _, devices := range [][]tasmoDevice{a, b} {
+		for _, device := range devices {
+			key := device.key()
+			mac := normalizeMAC(device.MAC)
+			i, ok := seen[key]
+			sameIP := ok
+			if !ok && mac != "" {
+				i, ok = seen["mac:"+mac]
+			}
+			if !ok {
+				seen[key] = len(merged)
+				if mac != "" {
+					seen["mac:"+mac] = len(merged)
+				}
+				merged = append(merged, device)
+				continue
+			}
+			kept, other := merged[i], device
+			switch {
+			case !sameIP && kept.IP != nil && device.IP != nil:
+				if moreResponsive(device, kept) {
+					kept, other = device, merged[i]
+				}
+				kept.Duplicates = append(append(kept.Duplicates, other.IP.String()), other.Duplicates...)
+				seen[key] = i
+			case kept.AuthFailed && !device.AuthFailed:
+				// a device that answered elsewhere, e.g. via MQTT, is better than one that rejected the
+				// password, but the methods that found it first stay in front
+				kept = device
+				kept.Sources, kept.Duplicates = merged[i].Sources, merged[i].Duplicates
+			}
+			for _, source := range other.Sources {
+				kept.Sources = appendSource(kept.Sources, source)
+			}
+			merged[i] = kept
+		}
+	}
+	return merged
+}
+
+// warnDuplicates logs the devices that answer at several addresses
+func warnDuplicates(devices []tasmoDevice) {
+	for _, device := range devices {
+		if len(device.Duplicates) > 0 {
+			deviceLogger(device, "scan").warn(device.Name + " (" + device.IP.String() + ") also answers at " + strings.Join(device.Duplicates, ", ") + ", it is only updated at " + device.IP.String())
+		}
+	}
+}
+
+// lookupMDNS collects the IPv4 addresses of all hosts announcing a web server via mDNS
+func lookupMDNS() ([]net.IP, error) {
+	entries := make(chan *mdns.ServiceEntry, 64)
+	var ips []net.IP
+	done := make(chan struct{})
+	go func() {
+		seen := make(map[string]bool)
+		for entry := range entries {
+			if entry.AddrV4 == nil || seen[entry.AddrV4.String()] {
+				continue
+			}
+			seen[entry.AddrV4.String()] = true
+			ips = append(ips, entry.AddrV4)
+		}
+		close(done)
+	}()
+
+	// Tasmota announces its web server as _http._tcp
+	params := mdns.DefaultParams("_http._tcp")
+	params.Entries = entries
+	params.Timeout = viper.GetDuration("mdnstimeout")
+	params.DisableIPv6 = true
+	err := mdns.Query(params)
+	close(entries)
+	<-done
+	if err != nil {
+		return nil, errors.New("mDNS query failed: " + err.Error())
+	}
+	return ips, nil
+}
+
+// mdnsTargets returns the addresses of all hosts announcing a web server via mDNS
+func mdnsTargets() []net.IP {
+	ips, err := lookupMDNS()
+	if err != nil {
+		logWarn(err.Error())
+		return []net.IP{}
+	}
+	logInfo("Found " + strconv.Itoa(len(ips)) + " hosts via mDNS")
+	return ips
+}
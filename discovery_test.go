@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_mergeDevices(t *testing.T) {
+	a := []tasmoDevice{{Name: "a", IP: net.IPv4(1, 1, 1, 1)}, {Name: "b", IP: net.IPv4(1, 1, 1, 2)}}
+	b := []tasmoDevice{{Name: "b2", IP: net.IPv4(1, 1, 1, 2)}, {Name: "c", IP: net.IPv4(1, 1, 1, 3)}}
+	merged := mergeDevices(a, b)
+	assert.Len(t, merged, 3)
+	assert.Equal(t, "b", merged[1].Name)
+	assert.Equal(t, "c", merged[2].Name)
+
+	// the discovery methods of duplicates are kept
+	a = []tasmoDevice{{Name: "a", IP: net.IPv4(1, 1, 1, 1), Sources: []string{"cidr"}}}
+	b = []tasmoDevice{{Name: "a", IP: net.IPv4(1, 1, 1, 1), Sources: []string{"mqtt"}}}
+	merged = mergeDevices(a, b)
+	assert.Equal(t, []string{"cidr", "mqtt"}, merged[0].Sources)
+
+	// a device that rejected the password is replaced by the one found via MQTT
+	a = []tasmoDevice{{IP: net.IPv4(1, 1, 1, 1), Sources: []string{"cidr"}, AuthFailed: true}}
+	merged = mergeDevices(a, b)
+	assert.Equal(t, "a", merged[0].Name)
+	assert.False(t, merged[0].AuthFailed)
+	assert.Equal(t, []string{"cidr", "mqtt"}, merged[0].Sources)
+
+	// a device found at another address is recognized by its MAC
+	a = []tasmoDevice{{Name: "a", IP: net.IPv4(1, 1, 1, 1), MAC: "DC:4F:22:00:12:34", Sources: []string{"cidr"}}}
+	b = []tasmoDevice{{Name: "a", IP: net.IPv4(1, 1, 1, 9), MAC: "DC4F22001234", Sources: []string{"mqtt"}}}
+	merged = mergeDevices(a, b)
+	assert.Len(t, merged, 1)
+	assert.Equal(t, []string{"cidr", "mqtt"}, merged[0].Sources)
+	assert.Equal(t, []string{"1.1.1.9"}, merged[0].Duplicates)
+}
+
+func Test_moreResponsive(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+	live := tasmoDevice{Latency: 80 * time.Millisecond}
+	assert.True(moreResponsive(live, tasmoDevice{Cached: true, LastSeen: now}))
+	assert.True(moreResponsive(live, tasmoDevice{AuthFailed: true}))
+	assert.True(moreResponsive(tasmoDevice{Cached: true, LastSeen: now}, tasmoDevice{Cached: true, LastSeen: now.Add(-time.Hour)}))
+	assert.True(moreResponsive(tasmoDevice{Latency: 5 * time.Millisecond}, live))
+	assert.False(moreResponsive(live, live))
+}
+
+func Test_mergeDevices_duplicates(t *testing.T) {
+	assert := assert.New(t)
+	devices := []tasmoDevice{
+		{Name: "plug", IP: net.IPv4(10, 0, 0, 2), MAC: "DC:4F:22:00:12:34", Latency: 80 * time.Millisecond, Sources: []string{"cidr"}},
+		{Name: "lamp", IP: net.IPv4(10, 0, 0, 3), MAC: "DC:4F:22:00:56:78"},
+		{Name: "plug", IP: net.IPv4(10, 0, 0, 7), MAC: "dc4f22001234", Latency: 5 * time.Millisecond, Sources: []string{"mdns"}},
+		{Name: "plug", IP: net.IPv4(10, 0, 0, 9), MAC: "DC:4F:22:00:12:34", Cached: true, Sources: []string{"cache"}},
+		{Name: "bulb", IP: net.IPv4(10, 0, 0, 4)},
+		{Name: "bulb", IP: net.IPv4(10, 0, 0, 5)},
+	}
+	// the slower address answers again via MQTT
+	mqtt := []tasmoDevice{{Name: "plug", IP: net.IPv4(10, 0, 0, 2), MAC: "DC:4F:22:00:12:34", Sources: []string{"mqtt"}}}
+	merged := mergeDevices(devices, mqtt)
+	if assert.Len(merged, 4) {
+		// the faster address is kept
+		assert.Equal("10.0.0.7", merged[0].IP.String())
+		assert.Equal([]string{"10.0.0.2", "10.0.0.9"}, merged[0].Duplicates)
+		assert.Equal([]string{"mdns", "cidr", "cache", "mqtt"}, merged[0].Sources)
+		assert.Contains(deviceStates(merged[0]), "also at 10.0.0.2, 10.0.0.9")
+		assert.Equal("lamp", merged[1].Name)
+		assert.Empty(merged[1].Duplicates)
+		// devices without a MAC can't be told apart
+		assert.Equal("10.0.0.5", merged[3].IP.String())
+	}
+	// merging again changes nothing
+	assert.Equal(merged, mergeDevices(merged, nil))
+
+	// the duplicates aren't missing and select the device
+	inv := &inventory{Devices: map[string]*inventoryRecord{"10.0.0.2": {Name: "plug"}}}
+	trackDevices(inv, merged)
+	assert.Zero(inv.Devices["10.0.0.2"].Missed)
+	excludeOthers(merged, []string{"10.0.0.2"})
+	assert.False(merged[0].Excluded)
+	assert.True(merged[1].Excluded)
+}
+
+func Test_discoveryMethods(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	viper.Set("discovery", "mqtt, both,cidr,carrier-pigeon")
+	assert.Equal([]string{"mqtt", "cidr", "mdns"}, discoveryMethods())
+}
+
+func Test_describeSources(t *testing.T) {
+	devices := []tasmoDevice{{Sources: []string{"cidr", "mqtt"}}, {Sources: []string{"mqtt"}}}
+	assert.Equal(t, "Found 2 devices (cidr: 1, mdns: 0, mqtt: 2)", describeSources([]string{"cidr", "mdns", "mqtt"}, devices))
+}
+
+func Test_targetList(t *testing.T) {
+	assert := assert.New(t)
+	var targets targetList
+	targets.add("cidr", []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")})
+	targets.add("mdns", []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")})
+	targets.add("hosts", []net.IP{net.ParseIP("10.0.0.2")})
+	assert.Len(targets.targets, 3)
+	assert.Equal([]string{"cidr", "mdns", "hosts"}, targets.targets[1].Sources)
+	assert.Equal([]string{"mdns"}, targets.targets[2].Sources)
+
+	defer viper.Reset()
+	setDefaults()
+	viper.Set("progress", false)
+	fake := fakeDevices(t, map[string]map[string]string{
+		"10.0.0.2": {"Status 0": `{"StatusFWR": {"Version": "9.1.0(tasmota)"}}`},
+	})
+	fake.Unauthorized = map[string]bool{"10.0.0.3": true}
+	devices := targets.probe(context.Background())
+	assert.Len(devices, 2)
+	assert.Equal([]string{"cidr", "mdns", "hosts"}, devices[0].Sources)
+	// the device that rejected the password is listed, but also probed again by --rescan-errors
+	assert.True(devices[1].AuthFailed)
+	assert.Equal([]string{"mdns"}, devices[1].Sources)
+	assert.Equal([]net.IP{net.ParseIP("10.0.0.3")}, targets.failed)
+}
+
+func Test_sortDevices(t *testing.T) {
+	devices := []tasmoDevice{
+		{Name: "mqtt-b", Topic: "b"},
+		{Name: "c", IP: net.IPv4(10, 0, 0, 12)},
+		{Name: "mqtt-a", Topic: "a"},
+		{Name: "a", IP: net.IPv4(10, 0, 0, 2)},
+		{Name: "b", IP: net.IPv4(10, 0, 0, 10)},
+	}
+	sortDevices(devices)
+	names := make([]string, 0, len(devices))
+	for _, device := range devices {
+		names = append(names, device.Name)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "mqtt-a", "mqtt-b"}, names)
+}
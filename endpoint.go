@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/merlinschumacher/tasmogo/pkg/tasmota"
+	"github.com/spf13/viper"
+)
+
+// deviceEndpoint returns the scheme and port of the web server of a device from TASMOGO_ENDPOINTS,
+// which maps IPs, hostnames and MAC addresses to "scheme" or "scheme:port", or from TASMOGO_SCHEME
+// and TASMOGO_PORT if the device isn't listed
+func deviceEndpoint(host string) (string, string) {
+	scheme, port := viper.GetString("scheme"), viper.GetString("port")
+	if endpoint, ok := lookupDevice("endpoints", host); ok {
+		scheme, port = endpoint, ""
+		if i := strings.Index(endpoint, ":"); i >= 0 {
+			scheme, port = endpoint[:i], endpoint[i+1:]
+		}
+	}
+	return strings.ToLower(scheme), port
+}
+
+// deviceBaseURL returns the URL of the web server of a device
+func deviceBaseURL(host string) string {
+	scheme, port := deviceEndpoint(host)
+	return tasmota.DeviceURL(scheme, host, port)
+}
+
+// deviceTLSConfig returns the TLS settings for devices with the TLS web server. The certificates of
+// TASMOGO_TLSCAFILE are trusted in addition to the ones of the system, TASMOGO_TLSINSECURE skips
+// the verification, e.g. for the self-signed certificates the devices create.
+func deviceTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: viper.GetBool("tlsinsecure")}
+	caFile := viper.GetString("tlscafile")
+	if caFile == "" {
+		return config, nil
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("No certificates found in " + caFile)
+	}
+	config.RootCAs = pool
+	return config, nil
+}
+
+var (
+	deviceTransportsMu sync.Mutex
+	deviceTransports   = make(map[string]*http.Transport)
+)
+
+// deviceTransport returns the transport shared by all clients for the devices, so the connections are
+// reused across the requests and closed once they were idle for TASMOGO_IDLECONNTIMEOUT instead of
+// piling up during big scans. TASMOGO_MAXIDLECONNS and TASMOGO_MAXIDLECONNSPERHOST limit the idle
+// connections, TASMOGO_MAXCONNSPERHOST the connections to a single device. A transport is kept for
+// each combination of the settings, as they may change while the daemon runs. Without customTLS, the
+// TLS settings of the system are used.
+func deviceTransport(customTLS bool) (*http.Transport, error) {
+	customTLS = customTLS && (viper.GetBool("tlsinsecure") || viper.GetString("tlscafile") != "")
+	key := fmt.Sprint(customTLS, viper.GetBool("tlsinsecure"), viper.GetString("tlscafile"), viper.GetInt("maxidleconns"),
+		viper.GetInt("maxidleconnsperhost"), viper.GetInt("maxconnsperhost"), viper.GetDuration("idleconntimeout"))
+	deviceTransportsMu.Lock()
+	defer deviceTransportsMu.Unlock()
+	if transport, ok := deviceTransports[key]; ok {
+		return transport, nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = viper.GetInt("maxidleconns")
+	transport.MaxIdleConnsPerHost = viper.GetInt("maxidleconnsperhost")
+	transport.MaxConnsPerHost = viper.GetInt("maxconnsperhost")
+	transport.IdleConnTimeout = viper.GetDuration("idleconntimeout")
+	if customTLS {
+		config, err := deviceTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = config
+	}
+	deviceTransports[key] = transport
+	return transport, nil
+}
+
+// deviceHTTPClient returns a client for the web servers of the devices with the given timeout. If
+// the TLS settings can't be loaded, the devices are reached with the default settings.
+func deviceHTTPClient(timeout time.Duration) *http.Client {
+	client := &http.Client{Timeout: timeout}
+	// a controller in the cloud reaches the devices through the agent on their network
+	if viper.GetBool("tunnel") {
+		client.Transport = agentTunnel
+		return client
+	}
+	transport, err := deviceTransport(true)
+	if err != nil {
+		logWarn("Loading the TLS settings for the devices failed: " + err.Error())
+		transport, _ = deviceTransport(false)
+	}
+	client.Transport = transport
+	return client
+}
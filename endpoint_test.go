@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_deviceEndpoint(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	scheme, port := deviceEndpoint("10.0.0.1")
+	assert.Equal("http", scheme)
+	assert.Equal("", port)
+	viper.Set("endpoints", map[string]string{"10.0.0.2": "https", "plug-office": "HTTPS:8443"})
+	rememberDevice("10.0.0.3", "plug-office", "")
+	scheme, port = deviceEndpoint("10.0.0.2")
+	assert.Equal("https", scheme)
+	assert.Equal("", port)
+	scheme, port = deviceEndpoint("10.0.0.3")
+	assert.Equal("https", scheme)
+	assert.Equal("8443", port)
+	assert.Equal("https://10.0.0.3:8443", deviceBaseURL("10.0.0.3"))
+	viper.Set("scheme", "https")
+	viper.Set("port", 4443)
+	assert.Equal("https://10.0.0.1:4443", deviceBaseURL("10.0.0.1"))
+}
+
+func Test_deviceHTTPClient(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"POWER":"ON"}`)
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "https://")
+	viper.Set("scheme", "https")
+	// the self-signed certificate is refused unless the verification is skipped
+	_, err := sendCommand(host, "Power")
+	assert.NotNil(err)
+	viper.Set("tlsinsecure", true)
+	body, err := sendCommand(host, "Power")
+	assert.Nil(err)
+	assert.Equal(`{"POWER":"ON"}`, body)
+	res, err := webRequest(context.Background(), "GET", deviceBaseURL(host)+"/dl", "", nil)
+	if assert.Nil(err) {
+		res.Body.Close()
+	}
+
+	viper.Set("tlsinsecure", false)
+	viper.Set("tlscafile", filepath.Join(t.TempDir(), "missing.pem"))
+	_, err = deviceTLSConfig()
+	assert.NotNil(err)
+	file := filepath.Join(t.TempDir(), "empty.pem")
+	ioutil.WriteFile(file, []byte("no certificate"), 0644)
+	viper.Set("tlscafile", file)
+	_, err = deviceTLSConfig()
+	assert.NotNil(err)
+}
+
+func Test_deviceTransport(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	viper.Set("maxconnsperhost", 1)
+	// the clients share the connections of one transport
+	a, b := deviceHTTPClient(time.Second), deviceHTTPClient(time.Minute)
+	assert.Same(a.Transport, b.Transport)
+	transport := a.Transport.(*http.Transport)
+	assert.Equal(1, transport.MaxConnsPerHost)
+	assert.Equal(2, transport.MaxIdleConnsPerHost)
+	assert.Equal(30*time.Second, transport.IdleConnTimeout)
+
+	viper.Set("tlsinsecure", true)
+	insecure := deviceHTTPClient(0).Transport.(*http.Transport)
+	assert.NotSame(transport, insecure)
+	assert.True(insecure.TLSClientConfig.InsecureSkipVerify)
+
+	// invalid TLS settings fall back to the ones of the system
+	viper.Set("tlscafile", filepath.Join(t.TempDir(), "missing.pem"))
+	fallback := deviceHTTPClient(0).Transport.(*http.Transport)
+	assert.False(fallback.TLSClientConfig != nil && fallback.TLSClientConfig.InsecureSkipVerify)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/spf13/viper"
+)
+
+// task is a piece of work on a single device, e.g. an update, a backup or a command. It returns a
+// short description of its outcome.
+type task func(ctx context.Context, device *tasmoDevice) (string, error)
+
+// errSkipped is returned by a task that leaves the device alone for now, e.g. outside of the update
+// window. The device is reported as skipped instead of failed and the task isn't retried.
+var errSkipped = errors.New("skipped")
+
+// taskResult is the outcome of a task on a single device
+type taskResult struct {
+	IP       string        `json:"ip"`
+	Name     string        `json:"name"`
+	Command  string        `json:"command,omitempty"`
+	Output   string        `json:"output,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Attempts int           `json:"attempts"`
+	Duration time.Duration `json:"duration"`
+	// Skipped is set if the task was never started because tasmogo was stopped or if it left the
+	// device alone
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+// taskReport is the aggregated outcome of a task on all devices
+type taskReport struct {
+	Task      string       `json:"task"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+	Skipped   int          `json:"skipped"`
+	Results   []taskResult `json:"results"`
+}
+
+// engine runs a task on many devices at the same time. Every attempt on a device is limited to Timeout,
+// if it is set, and failed attempts are repeated up to Retries times after RetryDelay. Delay spaces out
+// the start of the devices.
+type engine struct {
+	Concurrency int
+	Timeout     time.Duration
+	Retries     int
+	RetryDelay  time.Duration
+	Delay       time.Duration
+}
+
+// newEngine creates an engine with the settings of TASMOGO_EXECCONCURRENCY, TASMOGO_EXECTIMEOUT,
+// TASMOGO_EXECRETRIES and TASMOGO_EXECRETRYDELAY, within the limits of TASMOGO_POLITE
+func newEngine() engine {
+	e := engine{
+		Concurrency: politeInt(viper.GetInt("execconcurrency"), politeExecConcurrency),
+		Timeout:     politeDuration(viper.GetDuration("exectimeout"), politeExecTimeout),
+		Retries:     viper.GetInt("execretries"),
+		RetryDelay:  viper.GetDuration("execretrydelay"),
+	}
+	if polite() {
+		e.Delay = politeDelay
+	}
+	return e
+}
+
+// devicePointers returns pointers to all devices, so tasks can change them
+func devicePointers(devices []tasmoDevice) []*tasmoDevice {
+	pointers := make([]*tasmoDevice, 0, len(devices))
+	for i := range devices {
+		pointers = append(pointers, &devices[i])
+	}
+	return pointers
+}
+
+// run executes the task on all devices and returns the results in the order of the devices. Once ctx
+// is cancelled, no further devices are started, but the running tasks are finished.
+func (e engine) run(ctx context.Context, devices []*tasmoDevice, t task) []taskResult {
+	results := make([]taskResult, len(devices))
+	concurrency := e.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				results[i] = e.runDevice(ctx, devices[i], t)
+			}
+		}()
+	}
+	for i := range devices {
+		// a stopped run still hands out the remaining devices, so they are reported as skipped
+		if i > 0 && e.Delay > 0 {
+			pause(ctx, e.Delay)
+		}
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+	return results
+}
+
+// runDevice executes the task on a single device and retries it as configured
+func (e engine) runDevice(ctx context.Context, device *tasmoDevice, t task) taskResult {
+	result := taskResult{IP: device.address(), Name: device.Name}
+	if ctx.Err() != nil {
+		result.Skipped = true
+		return result
+	}
+	started := time.Now()
+	for {
+		result.Attempts++
+		attemptCtx, cancel := e.attemptContext(ctx)
+		output, err := t(attemptCtx, device)
+		cancel()
+		result.Output, result.Error = output, ""
+		if err == nil {
+			break
+		}
+		if errors.Is(err, errSkipped) {
+			result.Skipped = true
+			break
+		}
+		result.Error = err.Error()
+		if result.Attempts > e.Retries || !e.wait(ctx) {
+			break
+		}
+	}
+	result.Duration = time.Since(started).Truncate(time.Millisecond)
+	return result
+}
+
+// attemptContext returns the context of a single attempt, limited to the timeout
+func (e engine) attemptContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if e.Timeout > 0 {
+		return context.WithTimeout(ctx, e.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// wait pauses before a retry and reports if the retry should happen
+func (e engine) wait(ctx context.Context) bool {
+	return pause(ctx, e.RetryDelay)
+}
+
+// newTaskReport aggregates the results of a task
+func newTaskReport(name string, results []taskResult) taskReport {
+	report := taskReport{Task: name, Results: results}
+	for _, result := range results {
+		switch {
+		case result.Skipped:
+			report.Skipped++
+		case result.Error != "":
+			report.Failed++
+		default:
+			report.Succeeded++
+		}
+	}
+	return report
+}
+
+// renderTaskReport generates the report as JSON if TASMOGO_OUTPUT is "json", otherwise as a table
+func renderTaskReport(report taskReport) (string, error) {
+	if viper.GetString("output") == "json" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		return string(data), err
+	}
+	t := table.NewWriter()
+	t.AppendHeader(table.Row{"IP", "Name", "Command", "Attempts", "Result"})
+	for _, result := range report.Results {
+		outcome := result.Output
+		switch {
+		case result.Skipped:
+			outcome = "skipped"
+		case result.Error != "":
+			outcome = "failed: " + result.Error
+		}
+		t.AppendRow(table.Row{result.IP, result.Name, result.Command, result.Attempts, outcome})
+	}
+	t.AppendFooter(table.Row{"", "", "", "", strconv.Itoa(report.Succeeded) + " succeeded, " + strconv.Itoa(report.Failed) + " failed, " + strconv.Itoa(report.Skipped) + " skipped"})
+	// the command column is only shown for command batches and patches
+	t.SetColumnConfigs([]table.ColumnConfig{{Number: 3, Hidden: report.Task != "macro" && report.Task != "patch"}})
+	return t.Render(), nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_engine_run(t *testing.T) {
+	assert := assert.New(t)
+	devices := []tasmoDevice{
+		{Name: "lamp", IP: net.IPv4(1, 1, 1, 1)},
+		{Name: "plug", IP: net.IPv4(1, 1, 1, 2)},
+		{Name: "heater", IP: net.IPv4(1, 1, 1, 3)},
+	}
+	// the plug fails once, the heater never answers in time
+	var running, maxRunning int32
+	plugAttempts := 0
+	e := engine{Concurrency: 2, Timeout: 20 * time.Millisecond, Retries: 1, RetryDelay: time.Millisecond}
+	results := e.run(context.Background(), devicePointers(devices), func(ctx context.Context, device *tasmoDevice) (string, error) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		switch device.Name {
+		case "plug":
+			plugAttempts++
+			if plugAttempts == 1 {
+				return "", errors.New("offline")
+			}
+		case "heater":
+			<-ctx.Done()
+			return "", ctx.Err()
+		}
+		device.Name += " (done)"
+		return "ok", nil
+	})
+	assert.Equal(taskResult{IP: "1.1.1.1", Name: "lamp", Output: "ok", Attempts: 1, Duration: results[0].Duration}, results[0])
+	assert.Equal(2, results[1].Attempts)
+	assert.Equal("", results[1].Error)
+	assert.Equal(2, results[2].Attempts)
+	assert.Equal(context.DeadlineExceeded.Error(), results[2].Error)
+	assert.True(maxRunning <= 2)
+	// the tasks can change the devices
+	assert.Equal("lamp (done)", devices[0].Name)
+
+	report := newTaskReport("test", results)
+	assert.Equal(2, report.Succeeded)
+	assert.Equal(1, report.Failed)
+
+	// once stopped, no device is started
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results = e.run(ctx, devicePointers(devices), func(ctx context.Context, device *tasmoDevice) (string, error) {
+		t.Error("the task must not run")
+		return "", nil
+	})
+	assert.True(results[0].Skipped)
+	assert.Equal(3, newTaskReport("test", results).Skipped)
+
+	// a task that leaves a device alone skips it and isn't retried
+	results = e.run(context.Background(), devicePointers(devices[:1]), func(ctx context.Context, device *tasmoDevice) (string, error) {
+		return "", errSkipped
+	})
+	assert.True(results[0].Skipped)
+	assert.Equal(1, results[0].Attempts)
+	assert.Empty(results[0].Error)
+}
+
+func Test_renderTaskReport(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	report := newTaskReport("backup", []taskResult{
+		{IP: "1.1.1.1", Name: "lamp", Output: "backups/lamp.dmp", Attempts: 1},
+		{IP: "1.1.1.2", Name: "plug", Error: "timeout", Attempts: 3},
+		{IP: "1.1.1.3", Name: "heater", Skipped: true},
+	})
+	out, err := renderTaskReport(report)
+	assert.Nil(err)
+	assert.Contains(out, "backups/lamp.dmp")
+	assert.Contains(out, "failed: timeout")
+	assert.Contains(out, "skipped")
+	assert.Contains(out, "1 SUCCEEDED, 1 FAILED, 1 SKIPPED")
+	assert.NotContains(out, "COMMAND")
+
+	viper.Set("output", "json")
+	out, err = renderTaskReport(report)
+	assert.Nil(err)
+	assert.Contains(out, `"task": "backup"`)
+	assert.Contains(out, `"failed": 1`)
+	assert.Contains(out, `"error": "timeout"`)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// yamlDevice is a device in the YAML output, for pasting into YAML-configured systems
+type yamlDevice struct {
+	Name     string `yaml:"name"`
+	IP       string `yaml:"ip,omitempty"`
+	MAC      string `yaml:"mac,omitempty"`
+	Hostname string `yaml:"hostname,omitempty"`
+	DNSName  string `yaml:"dnsname,omitempty"`
+	Topic    string `yaml:"topic,omitempty"`
+}
+
+// knownDevice is a device in the format of the known_devices.yaml of Home Assistant, which doesn't
+// allow any other keys
+type knownDevice struct {
+	Name  string `yaml:"name"`
+	MAC   string `yaml:"mac"`
+	Track bool   `yaml:"track"`
+}
+
+// nonSlug matches the characters that aren't allowed in the keys of the YAML output
+var nonSlug = regexp.MustCompile(`[^a-z0-9]+`)
+
+// deviceSlugs returns a unique key for every device, its name in lowercase with underscores like Home
+// Assistant uses for its entity IDs. Devices without a name are keyed by their ID.
+func deviceSlugs(devices []tasmoDevice) []string {
+	slugs := make([]string, 0, len(devices))
+	used := make(map[string]bool)
+	for _, device := range devices {
+		slug := strings.Trim(nonSlug.ReplaceAllString(strings.ToLower(device.Name), "_"), "_")
+		if slug == "" {
+			slug = "tasmota_" + hassID(device)
+		}
+		unique := slug
+		for i := 2; used[unique]; i++ {
+			unique = slug + "_" + strconv.Itoa(i)
+		}
+		used[unique] = true
+		slugs = append(slugs, unique)
+	}
+	return slugs
+}
+
+// writeYAML writes the devices as a YAML map keyed by their slugs. With knownDevices set, it uses the
+// format of the known_devices.yaml of Home Assistant, which identifies the devices by their MAC
+// address, so the devices without one are left out. Tracking is off, tasmogo doesn't know which
+// devices should be tracked.
+func writeYAML(w io.Writer, devices []tasmoDevice, knownDevices bool) error {
+	entries := make(map[string]interface{})
+	for i, slug := range deviceSlugs(devices) {
+		device := devices[i]
+		if !knownDevices {
+			entries[slug] = yamlDevice{Name: device.Name, IP: device.address(), MAC: device.MAC, Hostname: device.Hostname, DNSName: device.DNSName, Topic: device.Topic}
+			continue
+		}
+		if device.MAC == "" {
+			continue
+		}
+		entries[slug] = knownDevice{Name: device.Name, MAC: strings.ToUpper(device.MAC)}
+	}
+	if len(entries) == 0 {
+		_, err := io.WriteString(w, "{}\n")
+		return err
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(entries); err != nil {
+		return err
+	}
+	return enc.Close()
+}
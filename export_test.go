@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_deviceSlugs(t *testing.T) {
+	assert := assert.New(t)
+	devices := []tasmoDevice{
+		{Name: "Living Room Lamp"},
+		{Name: "living-room lamp!"},
+		{IP: net.ParseIP("10.0.0.3")},
+	}
+	assert.Equal([]string{"living_room_lamp", "living_room_lamp_2", "tasmota_10_0_0_3"}, deviceSlugs(devices))
+}
+
+func Test_writeYAML(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	assert.Nil(writeScanResults(&buf, "yaml", outputDevices))
+	assert.Equal(`lamp_hallway:
+  name: lamp, hallway
+  ip: 10.0.0.2
+plug:
+  name: plug
+  ip: 10.0.0.1
+  mac: DC:4F:22:00:12:34
+  hostname: plug-1234
+  dnsname: plug-kitchen.lan
+  topic: plug
+`, buf.String())
+
+	// Home Assistant tracks the devices by their MAC address
+	buf.Reset()
+	assert.Nil(writeScanResults(&buf, "knowndevices", outputDevices))
+	assert.Equal(`plug:
+  name: plug
+  mac: DC:4F:22:00:12:34
+  track: false
+`, buf.String())
+
+	buf.Reset()
+	assert.Nil(writeYAML(&buf, nil, true))
+	assert.Equal("{}\n", buf.String())
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/merlinschumacher/tasmogo/pkg/tasmota"
+	"github.com/tidwall/gjson"
+)
+
+// safebootVariant is the variant reported by the safeboot image of the ESP32, which only flashes the
+// application image and is never the firmware a device should end up with
+const safebootVariant = "safeboot"
+
+// maxFilesystemDepth limits how deep the folders of a filesystem are listed
+const maxFilesystemDepth = 4
+
+// The links of the file manager of the web UI to the files and folders of the filesystem
+var (
+	ufsFileLink   = regexp.MustCompile(`ufsd\?download=([^'"&>\s]+)`)
+	ufsFolderLink = regexp.MustCompile(`ufsd\?dir=([^'"&>\s]+)`)
+)
+
+// otaSafeURL replaces the ".factory.bin" image of an ESP32, which also contains the partition table and
+// would wipe the filesystem, by the OTA image next to it, e.g. if a firmware manifest or
+// TASMOGO_OTATEMPLATE points to the wrong file
+func otaSafeURL(device tasmoDevice, otaURL string) string {
+	if device.Chip != tasmota.ChipESP32 || !strings.HasSuffix(otaURL, ".factory.bin") {
+		return otaURL
+	}
+	safe := strings.TrimSuffix(otaURL, ".factory.bin") + ".bin"
+	deviceLogger(device, "update").warn("Using " + safe + " for " + device.Name + " (" + device.address() + "), the factory image would erase its filesystem")
+	return safe
+}
+
+// safebootTarget picks the variant of an ESP32 running the safeboot image, e.g. after an interrupted
+// update: the one it ran before according to the inventory. Flashing the safeboot image again would
+// leave it there.
+func safebootTarget(device *tasmoDevice, inv *inventory) error {
+	if device.FirmwareType != safebootVariant || device.TargetType != "" {
+		return nil
+	}
+	if device.IP != nil {
+		if rec, ok := inv.lookup(device.key()); ok && rec.FullVariant != "" && rec.FullVariant != safebootVariant {
+			device.TargetType = rec.FullVariant
+			return nil
+		}
+	}
+	return errors.New("Device runs the safeboot image and its variant is unknown, pin it in the devices section of the config")
+}
+
+// filesystemFiles lists the files on the filesystem of an ESP32, e.g. the autoexec.be of Berry. Devices
+// without a filesystem have none.
+func filesystemFiles(ctx context.Context, device tasmoDevice) ([]string, error) {
+	response, err := newDeviceClient().Command(ctx, device.IP.String(), "UfsType")
+	if err != nil {
+		return nil, err
+	}
+	if gjson.Get(response, "UfsType").Int() == 0 {
+		return []string{}, nil
+	}
+	files := make([]string, 0)
+	visited := make(map[string]bool)
+	var list func(dir string, depth int) error
+	list = func(dir string, depth int) error {
+		visited[dir] = true
+		res, err := webRequest(ctx, "GET", deviceBaseURL(device.IP.String())+"/ufsd?"+url.Values{"dir": {dir}}.Encode(), "", nil)
+		if err != nil {
+			return err
+		}
+		page, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, match := range ufsFileLink.FindAllStringSubmatch(string(page), -1) {
+			if file, err := url.QueryUnescape(match[1]); err == nil && !visited[file] {
+				visited[file] = true
+				files = append(files, file)
+			}
+		}
+		for _, match := range ufsFolderLink.FindAllStringSubmatch(string(page), -1) {
+			folder, err := url.QueryUnescape(match[1])
+			// the link to the parent folder leads back up
+			if err != nil || visited[folder] || strings.Contains(folder, "..") || !strings.HasPrefix(folder, strings.TrimSuffix(dir, "/")+"/") || depth >= maxFilesystemDepth {
+				continue
+			}
+			if err := list(folder, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := list("/", 0); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// backupFilesystem downloads the files of a device's filesystem into a folder next to its configuration
+// backups and returns its path
+func backupFilesystem(ctx context.Context, device tasmoDevice, dir string, files []string) (string, error) {
+	name := unsafeFileChars.ReplaceAllString(device.Name, "_")
+	target := filepath.Join(dir, name+"_"+backupSuffix(device.IP.String()), time.Now().Format("20060102-150405")+"-ufs")
+	for _, file := range files {
+		path := filepath.Join(target, filepath.FromSlash(strings.TrimPrefix(file, "/")))
+		// the names come from the device, they must not point outside the backup
+		if !strings.HasPrefix(path, target+string(filepath.Separator)) {
+			return "", errors.New("Invalid file name " + file)
+		}
+		if err := downloadDeviceFile(ctx, device, file, path); err != nil {
+			return "", errors.New("Downloading " + file + " failed: " + err.Error())
+		}
+	}
+	return target, nil
+}
+
+// downloadDeviceFile downloads a file of the filesystem of a device to path
+func downloadDeviceFile(ctx context.Context, device tasmoDevice, file string, path string) error {
+	res, err := webRequest(ctx, "GET", deviceBaseURL(device.IP.String())+"/ufsd?"+url.Values{"download": {file}}.Encode(), "", nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, res.Body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// checkFilesystem lists the files on the filesystem of an ESP32 before it is updated and, with backup,
+// backs them up into dir. Then a device whose filesystem can't be listed or backed up isn't updated,
+// otherwise the files are only logged.
+func checkFilesystem(ctx context.Context, device tasmoDevice, dir string, backup bool) error {
+	if device.Chip != tasmota.ChipESP32 || device.IP == nil || device.ViaMQTT {
+		return nil
+	}
+	files, err := filesystemFiles(ctx, device)
+	if err != nil && !backup {
+		deviceLogger(device, "backup").warn("Listing the files on the filesystem of " + device.Name + " (" + device.IP.String() + ") failed: " + err.Error())
+		return nil
+	}
+	if err != nil {
+		return errors.New("Listing the files on the filesystem failed: " + err.Error())
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	berry := ""
+	for _, file := range files {
+		if strings.HasSuffix(file, ".be") {
+			berry = ", including Berry scripts"
+			break
+		}
+	}
+	if !backup {
+		deviceLogger(device, "backup").warn(device.Name + " (" + device.IP.String() + ") has " + strconv.Itoa(len(files)) + " files on its filesystem" + berry + ", set TASMOGO_BACKUPFILESYSTEM to back them up before updates")
+		return nil
+	}
+	deviceLogger(device, "backup").info(device.Name + " (" + device.IP.String() + ") has " + strconv.Itoa(len(files)) + " files on its filesystem" + berry)
+	path, err := backupFilesystem(ctx, device, dir, files)
+	if err != nil {
+		return errors.New("Backing up the filesystem failed: " + err.Error())
+	}
+	deviceLogger(device, "backup").info("Backed up the filesystem of " + device.Name + " (" + device.IP.String() + ") to " + path)
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/merlinschumacher/tasmogo/pkg/tasmota"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_otaSafeURL(t *testing.T) {
+	assert := assert.New(t)
+	esp32 := tasmoDevice{Name: "plug", Chip: tasmota.ChipESP32}
+	assert.Equal("http://ota/tasmota32.bin", otaSafeURL(esp32, "http://ota/tasmota32.factory.bin"))
+	assert.Equal("http://ota/tasmota32.bin", otaSafeURL(esp32, "http://ota/tasmota32.bin"))
+	assert.Equal("http://ota/tasmota.factory.bin", otaSafeURL(tasmoDevice{Chip: tasmota.ChipESP8266}, "http://ota/tasmota.factory.bin"))
+}
+
+func Test_safebootTarget(t *testing.T) {
+	assert := assert.New(t)
+	inv := &inventory{Devices: map[string]*inventoryRecord{"10.0.0.1": {FullVariant: "tasmota32-bluetooth"}}}
+	device := tasmoDevice{IP: net.ParseIP("10.0.0.1"), FirmwareType: safebootVariant}
+	assert.Nil(safebootTarget(&device, inv))
+	assert.Equal("tasmota32-bluetooth", device.TargetType)
+
+	// a pinned variant is kept
+	device = tasmoDevice{IP: net.ParseIP("10.0.0.1"), FirmwareType: safebootVariant, TargetType: "tasmota32"}
+	assert.Nil(safebootTarget(&device, inv))
+	assert.Equal("tasmota32", device.TargetType)
+
+	device = tasmoDevice{IP: net.ParseIP("10.0.0.2"), FirmwareType: safebootVariant}
+	assert.NotNil(safebootTarget(&device, inv))
+
+	device = tasmoDevice{IP: net.ParseIP("10.0.0.2"), FirmwareType: "tasmota32"}
+	assert.Nil(safebootTarget(&device, inv))
+	assert.Empty(device.TargetType)
+}
+
+func Test_checkFilesystem(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	pages := map[string]string{
+		"/":    `<a href='ufsd?dir=/..'>..</a><a href='ufsd?download=/autoexec.be'>autoexec.be</a><a href='ufsd?dir=/www'>www</a>`,
+		"/www": `<a href='ufsd?dir=/'>..</a><a href='ufsd?download=/www/index%20page.html'>index page.html</a>`,
+	}
+	files := map[string]string{"/autoexec.be": "load('lights.be')", "/www/index page.html": "<html>"}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if dir := r.URL.Query().Get("dir"); dir != "" {
+			w.Write([]byte(pages[dir]))
+			return
+		}
+		w.Write([]byte(files[r.URL.Query().Get("download")]))
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	viper.Set("port", u.Port())
+	fakeDevices(t, map[string]map[string]string{
+		"127.0.0.1": {"UfsType": `{"UfsType":2}`},
+		"127.0.0.2": {"UfsType": `{"UfsType":0}`},
+	})
+	device := tasmoDevice{Name: "plug", IP: net.ParseIP("127.0.0.1"), Chip: tasmota.ChipESP32}
+
+	found, err := filesystemFiles(context.Background(), device)
+	assert.Nil(err)
+	assert.Equal([]string{"/autoexec.be", "/www/index page.html"}, found)
+
+	// without the setting the files are only logged
+	dir := t.TempDir()
+	assert.Nil(checkFilesystem(context.Background(), device, dir, false))
+	backups, _ := filepath.Glob(filepath.Join(dir, "plug_127.0.0.1", "*-ufs"))
+	assert.Empty(backups)
+
+	assert.Nil(checkFilesystem(context.Background(), device, dir, true))
+	backups, _ = filepath.Glob(filepath.Join(dir, "plug_127.0.0.1", "*-ufs"))
+	if assert.Len(backups, 1) {
+		data, _ := ioutil.ReadFile(filepath.Join(backups[0], "www", "index page.html"))
+		assert.Equal("<html>", string(data))
+		data, _ = ioutil.ReadFile(filepath.Join(backups[0], "autoexec.be"))
+		assert.Equal("load('lights.be')", string(data))
+	}
+
+	// names leading outside the backup are refused
+	_, err = backupFilesystem(context.Background(), device, dir, []string{"/../escape"})
+	assert.NotNil(err)
+
+	// devices without a filesystem and ESP8266 devices have nothing to back up
+	found, err = filesystemFiles(context.Background(), tasmoDevice{IP: net.ParseIP("127.0.0.2")})
+	assert.Nil(err)
+	assert.Empty(found)
+	assert.Nil(checkFilesystem(context.Background(), tasmoDevice{IP: net.ParseIP("127.0.0.3"), Chip: tasmota.ChipESP8266}, dir, true))
+	// an unlisted filesystem only stops the update if it should be backed up
+	assert.NotNil(checkFilesystem(context.Background(), tasmoDevice{IP: net.ParseIP("127.0.0.3"), Chip: tasmota.ChipESP32}, dir, true))
+	assert.Nil(checkFilesystem(context.Background(), tasmoDevice{IP: net.ParseIP("127.0.0.3"), Chip: tasmota.ChipESP32}, dir, false))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/go-version"
+	"github.com/spf13/viper"
+)
+
+// deviceFilter restricts the devices tasmogo shows and updates. A device has to match every criterion
+// that is set, and one of the values of each.
+type deviceFilter struct {
+	// Names are patterns like "Steckdose*" matched against the name of the device
+	Names    []string
+	Variants []string
+	// Version is a constraint like "< 9.0" or ">= 9.1, < 10" for the firmware of the device
+	Version version.Constraints
+	// Tags are tags of the inventory or groups derived from the network
+	Tags []string
+	// Selector is an expression like `name~"bedroom" && outdated`
+	Selector *deviceSelector
+}
+
+// loadFilter reads the filter from TASMOGO_FILTERNAME, TASMOGO_FILTERVARIANT, TASMOGO_FILTERVERSION,
+// TASMOGO_FILTERTAG and TASMOGO_SELECT
+func loadFilter() (deviceFilter, error) {
+	f := deviceFilter{
+		Names:    getList("filtername"),
+		Variants: getList("filtervariant"),
+		Tags:     getList("filtertag"),
+	}
+	for _, pattern := range f.Names {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return f, errors.New("Invalid name pattern " + pattern)
+		}
+	}
+	if constraint := viper.GetString("filterversion"); constraint != "" {
+		c, err := version.NewConstraint(constraint)
+		if err != nil {
+			return f, errors.New("Invalid version constraint " + constraint)
+		}
+		f.Version = c
+	}
+	s, err := parseSelector(viper.GetString("select"))
+	if err != nil {
+		return f, err
+	}
+	f.Selector = s
+	return f, nil
+}
+
+// empty reports if the filter lets all devices pass
+func (f deviceFilter) empty() bool {
+	return len(f.Names) == 0 && len(f.Variants) == 0 && f.Version == nil && len(f.Tags) == 0 && f.Selector == nil
+}
+
+// matches reports if the device passes the filter. Names and variants are compared without regard to
+// case, devices with an unknown firmware version never match a version constraint.
+func (f deviceFilter) matches(device tasmoDevice, inv *inventory) bool {
+	if len(f.Names) > 0 && !matchesAny(f.Names, func(pattern string) bool {
+		ok, _ := filepath.Match(strings.ToLower(pattern), strings.ToLower(device.Name))
+		return ok
+	}) {
+		return false
+	}
+	if len(f.Variants) > 0 && !matchesAny(f.Variants, func(variant string) bool {
+		return strings.EqualFold(variant, device.FirmwareType)
+	}) {
+		return false
+	}
+	if f.Version != nil {
+		v, err := version.NewVersion(device.FirmwareVersion)
+		if err != nil || !f.Version.Check(v) {
+			return false
+		}
+	}
+	if len(f.Tags) > 0 && !matchesAny(f.Tags, func(tag string) bool {
+		return inGroup(device, inv, tag)
+	}) {
+		return false
+	}
+	if f.Selector != nil && !f.Selector.match(device, inv) {
+		return false
+	}
+	return true
+}
+
+// matchesAny reports if the check succeeds for one of the values
+func matchesAny(values []string, check func(string) bool) bool {
+	for _, value := range values {
+		if check(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterDevices returns the devices that pass the filter
+func filterDevices(devices []tasmoDevice, inv *inventory, f deviceFilter) []tasmoDevice {
+	if f.empty() {
+		return devices
+	}
+	filtered := make([]tasmoDevice, 0, len(devices))
+	for _, device := range devices {
+		if f.matches(device, inv) {
+			filtered = append(filtered, device)
+		}
+	}
+	return filtered
+}
+
+// filterDiscovered applies the filters to the devices found by a command. The devices are classified
+// first, so selectors can ask for protected or excluded devices. Only selectors that ask for outdated
+// devices need the latest release, so it is only looked up for them.
+func filterDiscovered(devices []tasmoDevice) []tasmoDevice {
+	f, err := loadFilter()
+	if err != nil {
+		logWarn("Ignoring all devices, the device filter is invalid: " + err.Error())
+		return make([]tasmoDevice, 0)
+	}
+	if f.empty() {
+		return devices
+	}
+	inv, err := loadInventory(viper.GetString("inventory"))
+	if err != nil {
+		logWarn("Loading the inventory failed: " + err.Error())
+	}
+	classifyDevices(devices, inv)
+	if f.Selector.uses("outdated") {
+		checkDevices(devices, releaseVersion())
+	}
+	return filterDevices(devices, inv, f)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_loadFilter(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	f, err := loadFilter()
+	assert.Nil(err)
+	assert.True(f.empty())
+	viper.Set("filtername", "Steckdose*,lamp")
+	viper.Set("filterversion", ">= 9.1, < 10")
+	f, err = loadFilter()
+	assert.Nil(err)
+	assert.Equal([]string{"Steckdose*", "lamp"}, f.Names)
+	assert.NotNil(f.Version)
+	viper.Set("filterversion", "newest")
+	_, err = loadFilter()
+	assert.NotNil(err)
+	viper.Set("filterversion", "")
+	viper.Set("filtername", "[")
+	_, err = loadFilter()
+	assert.NotNil(err)
+	viper.Set("filtername", "")
+	viper.Set("select", "outdated && name~lamp")
+	f, err = loadFilter()
+	assert.Nil(err)
+	assert.False(f.empty())
+	assert.True(f.Selector.uses("outdated"))
+	viper.Set("select", "outdated &&")
+	_, err = loadFilter()
+	assert.NotNil(err)
+}
+
+func Test_filterDevices(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	inv := &inventory{Devices: map[string]*inventoryRecord{"10.0.0.3": {Tags: []string{"garage"}}}}
+	devices := []tasmoDevice{
+		{Name: "Steckdose Küche", IP: net.IPv4(10, 0, 0, 1), FirmwareVersion: "8.5.1", FirmwareType: "tasmota"},
+		{Name: "steckdose Bad", IP: net.IPv4(10, 0, 0, 2), FirmwareVersion: "9.2.0", FirmwareType: "sensors"},
+		{Name: "Tor", IP: net.IPv4(10, 0, 0, 3), FirmwareVersion: "8.5.1", FirmwareType: "sensors"},
+		{Name: "Steckdose Flur", IP: net.IPv4(10, 0, 0, 4), FirmwareVersion: "unknown", FirmwareType: "tasmota"},
+	}
+	names := func(devices []tasmoDevice) []string {
+		result := make([]string, 0)
+		for _, device := range devices {
+			result = append(result, device.Name)
+		}
+		return result
+	}
+	assert.Len(filterDevices(devices, inv, deviceFilter{}), 4)
+	assert.Equal([]string{"Steckdose Küche", "steckdose Bad", "Steckdose Flur"}, names(filterDevices(devices, inv, deviceFilter{Names: []string{"Steckdose*"}})))
+	assert.Equal([]string{"steckdose Bad", "Tor"}, names(filterDevices(devices, inv, deviceFilter{Variants: []string{"Sensors"}})))
+	assert.Equal([]string{"Tor"}, names(filterDevices(devices, inv, deviceFilter{Tags: []string{"garage"}})))
+
+	viper.Set("filterversion", "<9.0")
+	f, _ := loadFilter()
+	// devices with an unknown version never match
+	assert.Equal([]string{"Steckdose Küche", "Tor"}, names(filterDevices(devices, inv, f)))
+	f.Variants = []string{"sensors"}
+	assert.Equal([]string{"Tor"}, names(filterDevices(devices, inv, f)))
+	f.Selector, _ = parseSelector(`name!="Tor"`)
+	assert.Empty(filterDevices(devices, inv, f))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-version"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// firmwareBuild is a self-compiled firmware of the manifest: where it is downloaded from and the version
+// it reports once it is flashed
+type firmwareBuild struct {
+	URL     string `yaml:"url"`
+	Version string `yaml:"version"`
+}
+
+// loadFirmwareManifest reads the firmware manifest, a YAML or JSON file that maps variant names to
+// builds, e.g. {"mybuild": {"url": "http://nas/mybuild.bin", "version": "12.1.1"}}
+func loadFirmwareManifest(path string) (map[string]firmwareBuild, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var builds map[string]firmwareBuild
+	if err := yaml.Unmarshal(data, &builds); err != nil {
+		return nil, errors.New("Invalid firmware manifest " + path + ": " + err.Error())
+	}
+	manifest := make(map[string]firmwareBuild, len(builds))
+	for variant, build := range builds {
+		if build.URL == "" {
+			return nil, errors.New("Firmware " + variant + " of the manifest has no URL")
+		}
+		if _, err := version.NewVersion(build.Version); err != nil {
+			return nil, errors.New("Firmware " + variant + " of the manifest has the invalid version " + build.Version)
+		}
+		manifest[strings.ToLower(variant)] = build
+	}
+	return manifest, nil
+}
+
+// manifestCache keeps the manifest of TASMOGO_FIRMWAREMANIFEST, so it is read and a broken one is
+// reported only once
+var manifestCache struct {
+	mu       sync.Mutex
+	path     string
+	manifest map[string]firmwareBuild
+}
+
+// firmwareManifest returns the manifest of TASMOGO_FIRMWAREMANIFEST. Without a manifest or if it can't
+// be read, no variant is custom.
+func firmwareManifest() map[string]firmwareBuild {
+	path := viper.GetString("firmwaremanifest")
+	if path == "" {
+		return nil
+	}
+	manifestCache.mu.Lock()
+	defer manifestCache.mu.Unlock()
+	if manifestCache.path != path {
+		manifest, err := loadFirmwareManifest(path)
+		if err != nil {
+			logWarn("Ignoring the firmware manifest: " + err.Error())
+		}
+		manifestCache.path, manifestCache.manifest = path, manifest
+	}
+	return manifestCache.manifest
+}
+
+// customBuild returns the build of the manifest for the variant a device has or is supposed to get
+func customBuild(device tasmoDevice) (firmwareBuild, bool) {
+	variant := device.FirmwareType
+	if device.TargetType != "" {
+		variant = device.TargetType
+	}
+	build, ok := firmwareManifest()[strings.ToLower(variant)]
+	return build, ok
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/go-version"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeFirmwareManifest writes a firmware manifest to a temporary file and returns its path
+func writeFirmwareManifest(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "firmware.yaml")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func Test_loadFirmwareManifest(t *testing.T) {
+	assert := assert.New(t)
+	manifest, err := loadFirmwareManifest(writeFirmwareManifest(t, "MyBuild:\n  url: http://nas/mybuild.bin\n  version: 12.1.1\n"))
+	assert.Nil(err)
+	assert.Equal(map[string]firmwareBuild{"mybuild": {URL: "http://nas/mybuild.bin", Version: "12.1.1"}}, manifest)
+
+	// JSON is read as well
+	manifest, err = loadFirmwareManifest(writeFirmwareManifest(t, `{"mybuild32": {"url": "http://nas/mybuild32.bin", "version": "12.1.1"}}`))
+	assert.Nil(err)
+	assert.Equal("http://nas/mybuild32.bin", manifest["mybuild32"].URL)
+
+	_, err = loadFirmwareManifest(writeFirmwareManifest(t, "mybuild:\n  version: 12.1.1\n"))
+	assert.NotNil(err)
+	_, err = loadFirmwareManifest(writeFirmwareManifest(t, "mybuild:\n  url: http://nas/mybuild.bin\n  version: latest\n"))
+	assert.NotNil(err)
+	_, err = loadFirmwareManifest(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.NotNil(err)
+}
+
+func Test_customBuild(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	device := tasmoDevice{Name: "plug", IP: net.IPv4(10, 0, 0, 1), FirmwareVersion: "12.0.2", FirmwareType: "mybuild"}
+	_, ok := customBuild(device)
+	assert.False(ok)
+
+	viper.Set("firmwaremanifest", writeFirmwareManifest(t, "mybuild:\n  url: http://nas/builds/mybuild.bin\n  version: 12.1.1\n"))
+	build, ok := customBuild(device)
+	assert.True(ok)
+	assert.Equal("12.1.1", build.Version)
+
+	// custom builds replace the release check and the usual file names
+	latest, _ := version.NewVersion("13.0.0")
+	assert.Equal("12.1.1", targetVersion(device, latest).String())
+	devices := []tasmoDevice{device, {Name: "lamp", FirmwareVersion: "12.1.1", FirmwareType: "mybuild"}, {Name: "official", FirmwareVersion: "12.0.0", FirmwareType: "tasmota"}}
+	checkDevices(devices, nil)
+	assert.True(devices[0].Outdated)
+	assert.False(devices[1].Outdated)
+	// without a release version only the custom builds are checked
+	assert.False(devices[2].Outdated)
+	assert.Equal("http://nas/builds/mybuild.bin", otaURLForDevice(device))
+	assert.Equal("mybuild.bin", firmwareName(device))
+	assert.Equal("http://ota.tasmota.com/tasmota/release/tasmota.bin", otaURLForDevice(devices[2]))
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/merlinschumacher/tasmogo/pkg/tasmota"
+	"github.com/spf13/viper"
+	"golang.org/x/term"
+)
+
+// fleetOperation is a maintenance command sent to a set of devices, like a restart. Shown is what the
+// report and the audit log show instead of the command, e.g. to keep a Wi-Fi password out of them.
+type fleetOperation struct {
+	Task    string
+	Command string
+	Shown   string
+}
+
+// fleetError is the error of a device with the command replaced by what is shown of it
+type fleetError struct {
+	err error
+	msg string
+}
+
+func (e *fleetError) Error() string {
+	return e.msg
+}
+
+func (e *fleetError) Unwrap() error {
+	return e.err
+}
+
+// showError replaces the command of the operation in an error by what is shown of it, as errors of
+// devices include the command and its URL
+func showError(op fleetOperation, err error) error {
+	msg := strings.Replace(err.Error(), op.Command, op.Shown, -1)
+	return &fleetError{err: err, msg: tasmota.MaskPasswords(msg)}
+}
+
+// restartOperation restarts the devices
+func restartOperation() fleetOperation {
+	return fleetOperation{Task: "restart", Command: "Restart 1", Shown: "Restart 1"}
+}
+
+// powerOperation switches the relays of the devices on, off or toggles them
+func powerOperation(state string) (fleetOperation, error) {
+	state = strings.ToLower(state)
+	switch state {
+	case "on", "off", "toggle":
+		return fleetOperation{Task: "power", Command: "Power " + state, Shown: "Power " + state}, nil
+	}
+	return fleetOperation{}, errors.New("Invalid power state " + state + ", expected on, off or toggle")
+}
+
+// wifiOperation sets the SSID and password of one of the two Wi-Fi slots of the devices. The devices
+// restart and connect to the new network, so a mistake makes them unreachable.
+func wifiOperation(slot int, ssid string, password string) (fleetOperation, error) {
+	if slot != 1 && slot != 2 {
+		return fleetOperation{}, errors.New("Invalid Wi-Fi slot " + strconv.Itoa(slot) + ", expected 1 or 2")
+	}
+	// a semicolon would split the Backlog
+	if ssid == "" || strings.Contains(ssid, ";") || strings.Contains(password, ";") {
+		return fleetOperation{}, errors.New("The SSID must not be empty and neither it nor the password may contain a semicolon")
+	}
+	n := strconv.Itoa(slot)
+	return fleetOperation{
+		Task:    "wifi",
+		Command: "Backlog SSId" + n + " " + ssid + "; Password" + n + " " + password,
+		Shown:   "SSId" + n + " " + ssid,
+	}, nil
+}
+
+// wifiPassword returns the Wi-Fi password of TASMOGO_WIFIPASSWORD or reads it from the first line of in,
+// so it doesn't show up in the process list or the shell history. A password typed on a terminal isn't
+// echoed either.
+func wifiPassword(in io.Reader, out io.Writer) (string, error) {
+	if password := viper.GetString("wifipassword"); password != "" {
+		return password, nil
+	}
+	fmt.Fprint(out, "Wi-Fi password: ")
+	if f, ok := in.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		line, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(out)
+		if err != nil {
+			return "", errors.New("Reading the Wi-Fi password failed: " + err.Error())
+		}
+		return checkWifiPassword(string(line))
+	}
+	// read piped input byte by byte, the confirmation reads the next line
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := in.Read(b)
+		if n == 1 && b[0] != '\n' {
+			line = append(line, b[0])
+			continue
+		}
+		if n == 1 || err != nil {
+			break
+		}
+	}
+	return checkWifiPassword(string(line))
+}
+
+// checkWifiPassword strips the line ending of an entered password and refuses an empty one
+func checkWifiPassword(line string) (string, error) {
+	password := strings.TrimRight(line, "\r")
+	if password == "" {
+		return "", errors.New("No Wi-Fi password given, set TASMOGO_WIFIPASSWORD or enter it")
+	}
+	return password, nil
+}
+
+// confirmOperation lists the devices and asks if the operation should go ahead. Anything but "y"
+// declines it.
+func confirmOperation(op fleetOperation, devices []tasmoDevice, in io.Reader, out io.Writer) bool {
+	names := make([]string, 0, len(devices))
+	for _, device := range devices {
+		names = append(names, device.Name+" ("+device.address()+")")
+	}
+	fmt.Fprintf(out, "Send \"%s\" to %d devices: %s? [y/N] ", op.Shown, len(devices), strings.Join(names, ", "))
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
+// runFleetOperation sends the operation to the devices, several at the same time, and returns the result
+// of each device. Protected devices are only changed if forced.
+func runFleetOperation(ctx context.Context, op fleetOperation, devices []tasmoDevice) taskReport {
+	results := make([]taskResult, len(devices))
+	targets := make([]*tasmoDevice, 0, len(devices))
+	sent := make([]int, 0, len(devices))
+	for i := range devices {
+		results[i] = taskResult{IP: devices[i].address(), Name: devices[i].Name, Command: op.Shown}
+		if !mayModify(devices[i]) {
+			results[i].Error = "device may not be modified"
+			continue
+		}
+		targets = append(targets, &devices[i])
+		sent = append(sent, i)
+	}
+	client := newDeviceClient()
+	outcomes := newEngine().run(ctx, targets, func(ctx context.Context, device *tasmoDevice) (string, error) {
+		response, err := client.Command(ctx, device.IP.String(), op.Command)
+		if err != nil {
+			return response, showError(op, err)
+		}
+		audit("Sent \"" + op.Shown + "\" to " + device.Name + " (" + device.IP.String() + ")")
+		return response, nil
+	})
+	for k, i := range sent {
+		outcomes[k].Command = op.Shown
+		results[i] = outcomes[k]
+	}
+	return newTaskReport(op.Task, results)
+}
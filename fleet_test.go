@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_powerOperation(t *testing.T) {
+	assert := assert.New(t)
+	op, err := powerOperation("OFF")
+	assert.Nil(err)
+	assert.Equal("Power off", op.Command)
+	_, err = powerOperation("blink")
+	assert.NotNil(err)
+}
+
+func Test_wifiOperation(t *testing.T) {
+	assert := assert.New(t)
+	op, err := wifiOperation(2, "iot", "secret")
+	assert.Nil(err)
+	assert.Equal("Backlog SSId2 iot; Password2 secret", op.Command)
+	assert.NotContains(op.Shown, "secret")
+	_, err = wifiOperation(3, "iot", "secret")
+	assert.NotNil(err)
+	_, err = wifiOperation(1, "iot", "se;cret")
+	assert.NotNil(err)
+	_, err = wifiOperation(1, "", "secret")
+	assert.NotNil(err)
+}
+
+func Test_wifiPassword(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	var out bytes.Buffer
+	in := strings.NewReader("secret\r\ny\n")
+	password, err := wifiPassword(in, &out)
+	assert.Nil(err)
+	assert.Equal("secret", password)
+	// the confirmation gets the next line
+	assert.True(confirmOperation(restartOperation(), nil, in, &out))
+	_, err = wifiPassword(strings.NewReader("\n"), &out)
+	assert.NotNil(err)
+	viper.Set("wifipassword", "other")
+	password, _ = wifiPassword(strings.NewReader(""), &out)
+	assert.Equal("other", password)
+}
+
+func Test_confirmOperation(t *testing.T) {
+	assert := assert.New(t)
+	devices := []tasmoDevice{{Name: "plug", IP: net.ParseIP("10.0.0.1")}}
+	var out bytes.Buffer
+	assert.True(confirmOperation(restartOperation(), devices, strings.NewReader("y\n"), &out))
+	assert.Contains(out.String(), "plug (10.0.0.1)")
+	assert.False(confirmOperation(restartOperation(), devices, strings.NewReader("\n"), &out))
+	assert.False(confirmOperation(restartOperation(), devices, strings.NewReader(""), &out))
+}
+
+func Test_runFleetOperation(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	viper.Set("auditlog", "")
+	fake := fakeDevices(t, map[string]map[string]string{
+		"10.0.0.1": {"Restart 1": `{"Restart": "Restarting"}`},
+		"10.0.0.2": {"Restart 1": `{"Restart": "Restarting"}`},
+	})
+	devices := []tasmoDevice{
+		{Name: "plug", IP: net.ParseIP("10.0.0.1")},
+		{Name: "fridge", IP: net.ParseIP("10.0.0.2"), Protected: true},
+	}
+	report := runFleetOperation(context.Background(), restartOperation(), devices)
+	assert.Equal("restart", report.Task)
+	assert.Equal(1, report.Succeeded)
+	assert.Equal(1, report.Failed)
+	assert.Equal([]string{"10.0.0.1: Restart 1"}, fake.Commands)
+
+	// the password doesn't show up in the errors
+	op, _ := wifiOperation(1, "iot", "secret")
+	report = runFleetOperation(context.Background(), op, []tasmoDevice{{Name: "lamp", IP: net.ParseIP("10.0.0.3")}})
+	if assert.Len(report.Results, 1) {
+		assert.NotEmpty(report.Results[0].Error)
+		assert.NotContains(report.Results[0].Error, "secret")
+	}
+}
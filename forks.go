@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/merlinschumacher/tasmogo/pkg/tasmota"
+	"github.com/spf13/viper"
+)
+
+// versionPatterns returns the patterns of TASMOGO_VERSIONPATTERNS. They are not split at commas like
+// other lists, as regular expressions contain them, so the environment variable holds a single pattern.
+func versionPatterns() []string {
+	var patterns []string
+	if value, ok := viper.Get("versionpatterns").(string); ok {
+		patterns = []string{value}
+	} else {
+		patterns = viper.GetStringSlice("versionpatterns")
+	}
+	nonEmpty := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		if strings.TrimSpace(pattern) != "" {
+			nonEmpty = append(nonEmpty, pattern)
+		}
+	}
+	return nonEmpty
+}
+
+// firmwareParser creates the parser of the version strings with the patterns of the forks from
+// TASMOGO_VERSIONPATTERNS and the variant aliases from TASMOGO_VARIANTALIASES
+func firmwareParser() (*tasmota.FirmwareParser, error) {
+	aliases := make(map[string]string)
+	for _, entry := range getList("variantaliases") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, errors.New("Invalid variant alias " + entry + ", expected fork-variant=variant")
+		}
+		aliases[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return tasmota.NewFirmwareParser(versionPatterns(), aliases)
+}
+
+// firmwareParsers keeps the parser of the current settings, so the patterns are compiled once per run
+// and not for every device. It is rebuilt when the daemon reloads other patterns or aliases.
+var firmwareParsers = struct {
+	sync.Mutex
+	settings string
+	parser   *tasmota.FirmwareParser
+}{}
+
+// currentFirmwareParser returns the parser of the current settings
+func currentFirmwareParser() *tasmota.FirmwareParser {
+	settings := strings.Join(versionPatterns(), "\n") + "\n\n" + strings.Join(getList("variantaliases"), ",")
+	firmwareParsers.Lock()
+	defer firmwareParsers.Unlock()
+	if firmwareParsers.parser != nil && firmwareParsers.settings == settings {
+		return firmwareParsers.parser
+	}
+	parser, err := firmwareParser()
+	if err != nil {
+		// the settings were checked at the start, so this only keeps tasmogo going
+		parser, _ = tasmota.NewFirmwareParser(nil, nil)
+	}
+	firmwareParsers.settings, firmwareParsers.parser = settings, parser
+	return parser
+}
+
+// recognizeFirmware splits the version string reported by a device into the version and the variant.
+// ok is false for version strings neither Tasmota nor the configured forks use, then the string is
+// returned as the version and the device is shown as unrecognized.
+func recognizeFirmware(raw string) (string, string, bool) {
+	version, variant, err := currentFirmwareParser().Parse(raw)
+	if err != nil {
+		return strings.TrimSpace(raw), "", false
+	}
+	return version, variant, true
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/hashicorp/go-version"
+	"github.com/merlinschumacher/tasmogo/pkg/scanner"
+	"github.com/merlinschumacher/tasmogo/pkg/tasmota"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_recognizeFirmware(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	version, variant, ok := recognizeFirmware("9.1.0(sensors)")
+	assert.True(ok)
+	assert.Equal("9.1.0", version)
+	assert.Equal("sensors", variant)
+	version, variant, ok = recognizeFirmware("Fork-12.1.1-sensors")
+	assert.False(ok)
+	assert.Equal("Fork-12.1.1-sensors", version)
+	assert.Empty(variant)
+
+	// a single pattern from the environment keeps its commas
+	viper.Set("versionpatterns", `^Fork-(?P<version>\d+(\.\d+){0,3})-(?P<variant>\w+)$`)
+	viper.Set("variantaliases", "sonoff-sensors=sensors,basic=tasmota")
+	version, variant, ok = recognizeFirmware("Fork-12.1.1-basic")
+	assert.True(ok)
+	assert.Equal("12.1.1", version)
+	assert.Equal("tasmota", variant)
+	_, variant, _ = recognizeFirmware("8.1.0(sonoff-sensors)")
+	assert.Equal("sensors", variant)
+
+	viper.Set("versionpatterns", []string{`^(?P<version>\d+)$`, `^Fork (?P<version>[\d.]+)$`})
+	_, _, ok = recognizeFirmware("Fork 3.2")
+	assert.True(ok)
+
+	// the parser is only built again when the settings change
+	parser := currentFirmwareParser()
+	assert.Same(parser, currentFirmwareParser())
+	viper.Set("variantaliases", "basic=tasmota")
+	assert.NotSame(parser, currentFirmwareParser())
+
+	viper.Set("variantaliases", "sensors")
+	_, err := firmwareParser()
+	assert.NotNil(err)
+	viper.Set("variantaliases", "")
+	viper.Set("versionpatterns", `^(\d+)$`)
+	_, err = firmwareParser()
+	assert.NotNil(err)
+}
+
+func Test_deviceFromScan_unrecognized(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	device := deviceFromScan(scanner.Device{IP: net.ParseIP("10.0.0.1"), Status: tasmota.Status{Name: "plug", Version: "Fork-12.1.1-lite"}})
+	assert.True(device.Unrecognized)
+	assert.Equal("Fork-12.1.1-lite", device.FirmwareVersion)
+	assert.Contains(deviceStates(device), "unrecognized")
+
+	viper.Set("versionpatterns", `^Fork-(?P<version>[\d.]+)-(?P<variant>tasmota32\w*)$`)
+	device = deviceFromScan(scanner.Device{IP: net.ParseIP("10.0.0.1"), Status: tasmota.Status{Name: "plug", Version: "Fork-12.1.1-tasmota32"}})
+	assert.False(device.Unrecognized)
+	assert.Equal("tasmota32", device.FirmwareType)
+	assert.Equal(tasmota.ChipESP32, device.Chip)
+
+	device = deviceFromScan(scanner.Device{IP: net.ParseIP("10.0.0.1"), Status: tasmota.Status{Version: "9.1.0", Variant: "sensors"}})
+	assert.False(device.Unrecognized)
+	assert.Equal("sensors", device.FirmwareType)
+
+	// an unrecognized version string that still parses as a version isn't compared or updated
+	target, _ := version.NewVersion("9.2.0")
+	devices := []tasmoDevice{{Name: "plug", IP: net.ParseIP("10.0.0.1"), FirmwareVersion: "9.1.0-custom", Unrecognized: true}}
+	checkDevices(devices, target)
+	assert.False(devices[0].Outdated)
+	devices[0].Outdated = true
+	assert.Empty(pendingUpdates(devices))
+}
@@ -3,12 +3,19 @@ module github.com/merlinschumacher/tasmogo
 go 1.15
 
 require (
+	github.com/eclipse/paho.mqtt.golang v1.4.3
 	github.com/google/go-github v17.0.0+incompatible // indirect
 	github.com/google/go-querystring v1.0.0 // indirect
 	github.com/hashicorp/go-version v1.7.0
+	github.com/hashicorp/mdns v1.0.5
 	github.com/jedib0t/go-pretty/v6 v6.5.9
+	github.com/miekg/dns v1.1.58 // indirect
+	github.com/spf13/cobra v1.8.1
 	github.com/spf13/viper v1.19.0
 	github.com/stretchr/testify v1.9.0
 	github.com/tcnksm/go-latest v0.0.0-20170313132115-e3007ae9052e
 	github.com/tidwall/gjson v1.17.1
+	golang.org/x/net v0.23.0
+	golang.org/x/term v0.18.0
+	gopkg.in/yaml.v3 v3.0.1
 )
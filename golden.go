@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/merlinschumacher/tasmogo/pkg/tasmota"
+	"github.com/spf13/viper"
+)
+
+// goldenCommands are asked in addition to "Status 0", so the template and the rules are compared as well
+var goldenCommands = []string{"Template", "Rule1", "Rule2", "Rule3"}
+
+// identitySettings tell the devices apart and differ on every device, so they are not compared
+var identitySettings = map[string]bool{
+	"Status.DeviceName":    true,
+	"Status.FriendlyName":  true,
+	"Status.Topic":         true,
+	"StatusNET.Hostname":   true,
+	"StatusNET.IPAddress":  true,
+	"StatusNET.Mac":        true,
+	"StatusNET.IP6Global":  true,
+	"StatusNET.IP6Local":   true,
+	"StatusMQT.MqttClient": true,
+}
+
+// driftReport is the comparison of a device with the golden device
+type driftReport struct {
+	Device     tasmoDevice
+	Deviations []deviation
+	Error      string
+}
+
+// comparableSettings reads the settings of a device that are compared with the golden device: the
+// options, network and MQTT settings of "Status 0", the template and the rules
+func comparableSettings(ctx context.Context, client tasmota.DeviceClient, host string) (map[string]string, error) {
+	status, err := client.Status(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	settings := flattenSettings(status.Response)
+	for name := range settings {
+		if identitySettings[name] {
+			delete(settings, name)
+		}
+	}
+	for _, command := range goldenCommands {
+		response, err := client.Command(ctx, host, command)
+		if err != nil {
+			return nil, err
+		}
+		settings[command] = strings.TrimSpace(response)
+	}
+	return settings, nil
+}
+
+// findDevice returns the device with the given IP or name
+func findDevice(devices []tasmoDevice, name string) (tasmoDevice, error) {
+	for _, device := range devices {
+		if device.IP.String() == name || device.Name == name {
+			return device, nil
+		}
+	}
+	return tasmoDevice{}, errors.New("Device " + name + " was not found")
+}
+
+// compareFleet compares the settings of all devices with the ones of the golden device and returns the
+// reports ranked by the number of differences, the device that deviates most first
+func compareFleet(ctx context.Context, golden tasmoDevice, devices []tasmoDevice) ([]driftReport, error) {
+	client := newDeviceClient()
+	reference, err := comparableSettings(ctx, client, golden.IP.String())
+	if err != nil {
+		return nil, errors.New("Reading the settings of the golden device failed: " + err.Error())
+	}
+	others := make([]tasmoDevice, 0, len(devices))
+	for _, device := range devices {
+		if device.IP != nil && !device.IP.Equal(golden.IP) {
+			others = append(others, device)
+		}
+	}
+	var mu sync.Mutex
+	deviations := make(map[string][]deviation)
+	results := newEngine().run(ctx, devicePointers(others), func(ctx context.Context, device *tasmoDevice) (string, error) {
+		settings, err := comparableSettings(ctx, client, device.IP.String())
+		if err != nil {
+			return "", err
+		}
+		d := diffSettings(*device, reference, settings)
+		mu.Lock()
+		deviations[device.IP.String()] = d
+		mu.Unlock()
+		return strconv.Itoa(len(d)) + " differences", nil
+	})
+	reports := make([]driftReport, 0, len(others))
+	for i, device := range others {
+		report := driftReport{Device: device, Deviations: deviations[device.IP.String()], Error: results[i].Error}
+		if results[i].Skipped {
+			report.Error = "skipped"
+		}
+		reports = append(reports, report)
+	}
+	sort.SliceStable(reports, func(i, j int) bool {
+		return len(reports[i].Deviations) > len(reports[j].Deviations)
+	})
+	return reports, nil
+}
+
+// renderGoldenReport generates the ranked drift report as JSON if TASMOGO_OUTPUT is "json", otherwise as
+// a table. With details every differing setting is listed.
+func renderGoldenReport(golden tasmoDevice, reports []driftReport, details bool) (string, error) {
+	if viper.GetString("output") == "json" {
+		type settingDiff struct {
+			Setting string `json:"setting"`
+			Golden  string `json:"golden"`
+			Device  string `json:"device"`
+		}
+		type deviceDrift struct {
+			IP          string        `json:"ip"`
+			Name        string        `json:"name"`
+			Differences int           `json:"differences"`
+			Settings    []settingDiff `json:"settings"`
+			Error       string        `json:"error,omitempty"`
+		}
+		out := struct {
+			Golden  string        `json:"golden"`
+			Devices []deviceDrift `json:"devices"`
+		}{Golden: golden.IP.String(), Devices: make([]deviceDrift, 0, len(reports))}
+		for _, r := range reports {
+			drift := deviceDrift{IP: r.Device.IP.String(), Name: r.Device.Name, Differences: len(r.Deviations), Settings: make([]settingDiff, 0), Error: r.Error}
+			for _, d := range r.Deviations {
+				drift.Settings = append(drift.Settings, settingDiff{Setting: d.Setting, Golden: d.Desired, Device: d.Current})
+			}
+			out.Devices = append(out.Devices, drift)
+		}
+		data, err := json.MarshalIndent(out, "", "  ")
+		return string(data), err
+	}
+	t := table.NewWriter()
+	t.SetTitle("Compared with " + golden.Name + " (" + golden.IP.String() + ")")
+	if details {
+		t.AppendHeader(table.Row{"IP", "Name", "Setting", "Golden", "Device"})
+	} else {
+		t.AppendHeader(table.Row{"IP", "Name", "Differences", "Settings"})
+	}
+	for _, r := range reports {
+		ip := r.Device.IP.String()
+		switch {
+		case r.Error != "" && details:
+			t.AppendRow(table.Row{ip, r.Device.Name, "", "failed: " + r.Error, ""})
+		case r.Error != "":
+			t.AppendRow(table.Row{ip, r.Device.Name, "-", "failed: " + r.Error})
+		case details:
+			for _, d := range r.Deviations {
+				t.AppendRow(table.Row{ip, r.Device.Name, d.Setting, d.Desired, d.Current})
+			}
+		default:
+			names := make([]string, 0, len(r.Deviations))
+			for _, d := range r.Deviations {
+				names = append(names, d.Setting)
+			}
+			t.AppendRow(table.Row{ip, r.Device.Name, len(r.Deviations), strings.Join(names, ", ")})
+		}
+	}
+	return t.Render(), nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// goldenStatus builds the answer to "Status 0" of a device with the given name and settings
+func goldenStatus(name string, telePeriod string, mqttHost string) string {
+	return `{"Status":{"DeviceName":"` + name + `","Topic":"` + name + `","PowerOnState":3},` +
+		`"StatusFWR":{"Version":"9.1.0(tasmota)"},` +
+		`"StatusLOG":{"TelePeriod":` + telePeriod + `},` +
+		`"StatusMQT":{"MqttHost":"` + mqttHost + `","MqttClient":"DVES_` + name + `"},` +
+		`"StatusNET":{"Hostname":"` + name + `","IPAddress":"10.0.0.1"}}`
+}
+
+func Test_compareFleet(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	device := func(status string, template string, rule string) map[string]string {
+		return map[string]string{"Status 0": status, "Template": template, "Rule1": rule, "Rule2": `{}`, "Rule3": `{}`}
+	}
+	fakeDevices(t, map[string]map[string]string{
+		"10.0.0.1": device(goldenStatus("golden", "300", "broker"), `{"NAME":"Plug"}`, `{"Rule1":"ON"}`),
+		"10.0.0.2": device(goldenStatus("same", "300", "broker"), `{"NAME":"Plug"}`, `{"Rule1":"ON"}`),
+		"10.0.0.3": device(goldenStatus("drifted", "60", "other"), `{"NAME":"Custom"}`, `{"Rule1":"ON"}`),
+	})
+	devices := []tasmoDevice{
+		{Name: "golden", IP: net.IPv4(10, 0, 0, 1)},
+		{Name: "same", IP: net.IPv4(10, 0, 0, 2)},
+		{Name: "drifted", IP: net.IPv4(10, 0, 0, 3)},
+		{Name: "gone", IP: net.IPv4(10, 0, 0, 4)},
+	}
+	golden, err := findDevice(devices, "golden")
+	assert.Nil(err)
+	_, err = findDevice(devices, "missing")
+	assert.NotNil(err)
+
+	reports, err := compareFleet(context.Background(), golden, devices)
+	assert.Nil(err)
+	assert.Len(reports, 3)
+	// the device that differs most comes first, the names and addresses are never compared
+	assert.Equal("drifted", reports[0].Device.Name)
+	settings := make([]string, 0)
+	for _, d := range reports[0].Deviations {
+		settings = append(settings, d.Setting)
+	}
+	assert.Equal([]string{"StatusLOG.TelePeriod", "StatusMQT.MqttHost", "Template"}, settings)
+	assert.Equal("300", reports[0].Deviations[0].Desired)
+	assert.Equal("60", reports[0].Deviations[0].Current)
+	assert.Empty(reports[1].Deviations)
+	assert.NotEmpty(reports[2].Error)
+
+	table, err := renderGoldenReport(golden, reports, false)
+	assert.Nil(err)
+	assert.Contains(table, "StatusLOG.TelePeriod, StatusMQT.MqttHost, Template")
+	table, _ = renderGoldenReport(golden, reports, true)
+	assert.Contains(table, `{"NAME":"Custom"}`)
+	viper.Set("output", "json")
+	out, _ := renderGoldenReport(golden, reports, false)
+	assert.Contains(out, `"differences": 3`)
+
+	_, err = compareFleet(context.Background(), tasmoDevice{Name: "gone", IP: net.IPv4(10, 0, 0, 4)}, devices)
+	assert.NotNil(err)
+}
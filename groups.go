@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/spf13/viper"
+)
+
+// deviceGroups returns the groups a device belongs to by its network: "subnet:" followed by the network
+// of its IP, sized by TASMOGO_GROUPPREFIX, and "ssid:" followed by the Wi-Fi it is connected to
+func deviceGroups(device tasmoDevice) []string {
+	groups := make([]string, 0, 2)
+	if device.IP != nil {
+		bits, prefix := 128, viper.GetInt("groupprefix6")
+		if ip4 := device.IP.To4(); ip4 != nil {
+			bits, prefix = 32, viper.GetInt("groupprefix")
+		}
+		if prefix > 0 && prefix <= bits {
+			mask := net.CIDRMask(prefix, bits)
+			groups = append(groups, "subnet:"+device.IP.Mask(mask).String()+"/"+strconv.Itoa(prefix))
+		}
+	}
+	if device.SSID != "" {
+		groups = append(groups, "ssid:"+device.SSID)
+	}
+	return groups
+}
+
+// inGroup reports if the device is part of the given group. Besides the groups derived from the
+// network, the tags of the device in the inventory count as groups.
+func inGroup(device tasmoDevice, inv *inventory, group string) bool {
+	for _, g := range deviceGroups(device) {
+		if g == group {
+			return true
+		}
+	}
+	if inv == nil {
+		return false
+	}
+	if rec, ok := inv.Devices[device.key()]; ok {
+		for _, t := range rec.Tags {
+			if t == group {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_deviceGroups(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	assert.Equal([]string{"subnet:10.0.3.0/24", "ssid:garage"}, deviceGroups(tasmoDevice{IP: net.IPv4(10, 0, 3, 17), SSID: "garage"}))
+	assert.Equal([]string{"subnet:fd00::/64"}, deviceGroups(tasmoDevice{IP: net.ParseIP("fd00::17")}))
+	assert.Equal([]string{"ssid:garage"}, deviceGroups(tasmoDevice{SSID: "garage"}))
+	viper.Set("groupprefix", 16)
+	assert.Equal([]string{"subnet:10.0.0.0/16"}, deviceGroups(tasmoDevice{IP: net.IPv4(10, 0, 3, 17)}))
+	viper.Set("groupprefix", 0)
+	assert.Empty(deviceGroups(tasmoDevice{IP: net.IPv4(10, 0, 3, 17)}))
+}
+
+func Test_inGroup(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	inv, _ := loadInventory("")
+	inv.record("10.0.3.17").addTag("lights")
+	device := tasmoDevice{IP: net.IPv4(10, 0, 3, 17), SSID: "garage"}
+	assert.True(inGroup(device, inv, "ssid:garage"))
+	assert.True(inGroup(device, inv, "subnet:10.0.3.0/24"))
+	assert.True(inGroup(device, inv, "lights"))
+	assert.False(inGroup(device, nil, "lights"))
+	assert.False(inGroup(device, inv, "ssid:house"))
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/hashicorp/go-version"
+	"github.com/spf13/viper"
+)
+
+// hassMessage is a retained MQTT message for Home Assistant
+type hassMessage struct {
+	Topic   string
+	Payload []byte
+}
+
+// hassState is the state of a device that the entities of Home Assistant read
+type hassState struct {
+	Online           bool   `json:"online"`
+	Outdated         bool   `json:"outdated"`
+	InstalledVersion string `json:"installed_version"`
+	LatestVersion    string `json:"latest_version"`
+	Variant          string `json:"variant"`
+}
+
+// hassDevice links the entities of a device to the device Home Assistant knows from Tasmota
+type hassDevice struct {
+	Identifiers []string   `json:"identifiers"`
+	Connections [][]string `json:"connections,omitempty"`
+	Name        string     `json:"name"`
+}
+
+// hassID returns the ID of a device in the topics and entities, its MAC address if it is known,
+// otherwise its IP address or MQTT topic
+func hassID(device tasmoDevice) string {
+	id := device.MAC
+	switch {
+	case id != "":
+		id = strings.ReplaceAll(id, ":", "")
+	case device.IP != nil:
+		id = device.IP.String()
+	default:
+		id = device.Topic
+	}
+	return strings.ToLower(strings.NewReplacer(".", "_", ":", "_", "/", "_").Replace(id))
+}
+
+// hassDeviceMessages returns the discovery configs of the "update available" and the connectivity
+// entity of a device and its current state
+func hassDeviceMessages(device tasmoDevice, state hassState) []hassMessage {
+	id := hassID(device)
+	prefix := strings.TrimRight(viper.GetString("hassprefix"), "/")
+	stateTopic := strings.TrimRight(viper.GetString("hasstopic"), "/") + "/" + id + "/state"
+	info := hassDevice{Identifiers: []string{"tasmogo_" + id}, Name: device.Name}
+	if device.MAC != "" {
+		info.Connections = [][]string{{"mac", strings.ToLower(device.MAC)}}
+	}
+	configs := []struct {
+		topic  string
+		config map[string]interface{}
+	}{
+		{prefix + "/update/tasmogo_" + id + "/config", map[string]interface{}{
+			"name":           "Firmware",
+			"unique_id":      "tasmogo_" + id + "_firmware",
+			"state_topic":    stateTopic,
+			"value_template": "{{ {'installed_version': value_json.installed_version, 'latest_version': value_json.latest_version} | to_json }}",
+			"title":          "Tasmota",
+			"device":         info,
+		}},
+		{prefix + "/binary_sensor/tasmogo_" + id + "/config", map[string]interface{}{
+			"name":           "Online",
+			"unique_id":      "tasmogo_" + id + "_online",
+			"state_topic":    stateTopic,
+			"value_template": "{{ 'ON' if value_json.online else 'OFF' }}",
+			"device_class":   "connectivity",
+			"device":         info,
+		}},
+	}
+	messages := make([]hassMessage, 0, len(configs)+1)
+	for _, c := range configs {
+		payload, _ := json.Marshal(c.config)
+		messages = append(messages, hassMessage{Topic: c.topic, Payload: payload})
+	}
+	payload, _ := json.Marshal(state)
+	return append(messages, hassMessage{Topic: stateTopic, Payload: payload})
+}
+
+// hassStateOf returns the state of a device found by the scan. A device updated in this run reports the
+// version it was updated to.
+func hassStateOf(device tasmoDevice, latest *version.Version, online bool) hassState {
+	state := hassState{Online: online, Outdated: device.Outdated, InstalledVersion: device.FirmwareVersion, LatestVersion: device.FirmwareVersion, Variant: device.FirmwareType}
+	// only devices with a known target version are outdated or updated
+	switch {
+	case updateResult(device) == "verified":
+		target := targetVersion(device, latest).String()
+		state.Outdated, state.InstalledVersion, state.LatestVersion = false, target, target
+	case device.Outdated:
+		state.LatestVersion = targetVersion(device, latest).String()
+	}
+	return state
+}
+
+// hassMessages returns the messages for all devices found by the scan and the known devices that are
+// missing, which are reported as offline. Archived devices are no longer reported.
+func hassMessages(devices []tasmoDevice, inv *inventory, latest *version.Version) []hassMessage {
+	messages := make([]hassMessage, 0)
+	found := make(map[string]bool)
+	for _, device := range devices {
+		// devices restored from the last run keep the state published then
+		if device.FirmwareVersion == "" || device.Cached {
+			continue
+		}
+		found[device.IP.String()] = true
+		messages = append(messages, hassDeviceMessages(device, hassStateOf(device, latest, true))...)
+	}
+	missing := make([]tasmoDevice, 0)
+	for ip, rec := range inv.Devices {
+		if rec.missing() && !rec.Archived && rec.Version != "" && !found[ip] {
+			missing = append(missing, deviceFromRecord(ip, rec))
+		}
+	}
+	sortDevices(missing)
+	checkDevices(missing, latest)
+	for _, device := range missing {
+		messages = append(messages, hassDeviceMessages(device, hassStateOf(device, latest, false))...)
+	}
+	return messages
+}
+
+// publishHass publishes the state of the devices to the MQTT broker with the discovery messages of Home
+// Assistant, so every device gets an entity that tells if an update is available
+func publishHass(devices []tasmoDevice, inv *inventory, latest *version.Version) {
+	client, err := newMQTTClient()
+	if err != nil {
+		logWarn("Publishing to Home Assistant failed: " + err.Error())
+		return
+	}
+	defer client.Disconnect(250)
+	for _, msg := range hassMessages(devices, inv, latest) {
+		if err := waitForToken(client.Publish(msg.Topic, 1, true, msg.Payload)); err != nil {
+			logWarn("Publishing " + msg.Topic + " failed: " + err.Error())
+			return
+		}
+	}
+}
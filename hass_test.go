@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/hashicorp/go-version"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_hassID(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("aabbccddeeff", hassID(tasmoDevice{MAC: "AA:BB:CC:DD:EE:FF", IP: net.IPv4(10, 0, 0, 1)}))
+	assert.Equal("10_0_0_1", hassID(tasmoDevice{IP: net.IPv4(10, 0, 0, 1)}))
+	assert.Equal("plug", hassID(tasmoDevice{Topic: "Plug"}))
+}
+
+func Test_hassMessages(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	latest, _ := version.NewVersion("9.2.0")
+	devices := []tasmoDevice{
+		{Name: "plug", IP: net.IPv4(10, 0, 0, 1), MAC: "AA:BB:CC:DD:EE:01", FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true},
+		{Name: "lamp", IP: net.IPv4(10, 0, 0, 2), FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true, UpdateURL: "http://ota/tasmota.bin", Verified: true},
+		{Name: "cached", IP: net.IPv4(10, 0, 0, 4), FirmwareVersion: "9.1.0", Cached: true},
+	}
+	inv := &inventory{Devices: map[string]*inventoryRecord{
+		"10.0.0.3": {Name: "heater", Missed: 2, Version: "9.1.0", Variant: "lite"},
+		"10.0.0.4": {Name: "cached", Version: "9.1.0"},
+	}}
+	messages := hassMessages(devices, inv, latest)
+	assert.Len(messages, 9)
+
+	assert.Equal("homeassistant/update/tasmogo_aabbccddee01/config", messages[0].Topic)
+	var config map[string]interface{}
+	assert.Nil(json.Unmarshal(messages[0].Payload, &config))
+	assert.Equal("tasmogo/aabbccddee01/state", config["state_topic"])
+	assert.Equal("tasmogo_aabbccddee01_firmware", config["unique_id"])
+	assert.Equal([]interface{}{[]interface{}{"mac", "aa:bb:cc:dd:ee:01"}}, config["device"].(map[string]interface{})["connections"])
+	assert.Equal("homeassistant/binary_sensor/tasmogo_aabbccddee01/config", messages[1].Topic)
+
+	states := make(map[string]hassState)
+	for _, msg := range messages {
+		var state hassState
+		if json.Unmarshal(msg.Payload, &state) == nil && state.InstalledVersion != "" {
+			states[msg.Topic] = state
+		}
+	}
+	assert.Equal(hassState{Online: true, Outdated: true, InstalledVersion: "9.1.0", LatestVersion: "9.2.0", Variant: "tasmota"}, states["tasmogo/aabbccddee01/state"])
+	// the updated device reports its new version
+	assert.Equal(hassState{Online: true, InstalledVersion: "9.2.0", LatestVersion: "9.2.0", Variant: "tasmota"}, states["tasmogo/10_0_0_2/state"])
+	// the missing device is offline
+	assert.Equal(hassState{Outdated: true, InstalledVersion: "9.1.0", LatestVersion: "9.2.0", Variant: "lite"}, states["tasmogo/10_0_0_3/state"])
+	assert.NotContains(states, "tasmogo/10_0_0_4/state")
+}
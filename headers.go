@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// appVersion is the version of tasmogo, set when building a release with
+// -ldflags "-X main.appVersion=1.0.0"
+var appVersion = "dev"
+
+// userAgent returns the User-Agent sent with every request, TASMOGO_USERAGENT or tasmogo/<version>
+func userAgent() string {
+	if ua := viper.GetString("useragent"); ua != "" {
+		return ua
+	}
+	return "tasmogo/" + appVersion
+}
+
+// deviceHeader returns the header fields sent with every request to the devices and the daemon: the
+// User-Agent and the extra headers of TASMOGO_HEADERS, given as "Name: value", e.g. for an
+// authenticating proxy in front of them
+func deviceHeader() http.Header {
+	header := make(http.Header)
+	header.Set("User-Agent", userAgent())
+	for _, entry := range getList("headers") {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			logWarn("Ignoring invalid header " + entry + ", expected \"Name: value\"")
+			continue
+		}
+		header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return header
+}
+
+// setDeviceHeader adds the header fields of deviceHeader to a request to a device or the daemon
+func setDeviceHeader(req *http.Request) {
+	for key, values := range deviceHeader() {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+}
+
+// setRequestHeader sets the User-Agent of a request to an external host, like GitHub or a notification
+// service. The extra headers are meant for the devices and must not leak to them.
+func setRequestHeader(req *http.Request) {
+	req.Header.Set("User-Agent", userAgent())
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_userAgent(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	assert.Equal("tasmogo/"+appVersion, userAgent())
+	viper.Set("useragent", "fleet-updater")
+	assert.Equal("fleet-updater", userAgent())
+}
+
+func Test_deviceHeader(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	viper.Set("headers", []string{"X-Proxy-Token: secret", "invalid", "X-Site: garage"})
+	header := deviceHeader()
+	assert.Equal("tasmogo/"+appVersion, header.Get("User-Agent"))
+	assert.Equal("secret", header.Get("X-Proxy-Token"))
+	assert.Equal("garage", header.Get("X-Site"))
+	assert.Len(header, 3)
+
+	req, _ := http.NewRequest("GET", "http://10.0.0.1/", nil)
+	setDeviceHeader(req)
+	assert.Equal("secret", req.Header.Get("X-Proxy-Token"))
+
+	// external hosts only get the User-Agent
+	req, _ = http.NewRequest("GET", "https://api.github.com/", nil)
+	setRequestHeader(req)
+	assert.Empty(req.Header.Get("X-Proxy-Token"))
+	assert.Equal("tasmogo/"+appVersion, req.Header.Get("User-Agent"))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/spf13/viper"
+)
+
+// historyEvent is a change of the fleet noticed during a scan: a new device, a device that disappeared
+// or came back, a changed firmware or an update by tasmogo
+type historyEvent struct {
+	Time   time.Time `json:"time"`
+	IP     string    `json:"ip"`
+	Name   string    `json:"name"`
+	Kind   string    `json:"kind"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// addEvent appends an event to the history of the inventory and drops the oldest events beyond
+// TASMOGO_HISTORYSIZE
+func (inv *inventory) addEvent(t time.Time, ip string, name string, kind string, detail string) {
+	inv.History = append(inv.History, historyEvent{Time: t, IP: ip, Name: name, Kind: kind, Detail: detail})
+	if max := viper.GetInt("historysize"); max > 0 && len(inv.History) > max {
+		inv.History = inv.History[len(inv.History)-max:]
+	}
+}
+
+// firmwareChange describes how the firmware of a device changed: "upgraded", "downgraded" or
+// "changed" if only the variant differs or the versions can't be compared
+func firmwareChange(from string, to string) string {
+	a, errA := version.NewVersion(from)
+	b, errB := version.NewVersion(to)
+	switch {
+	case errA != nil || errB != nil:
+		return "changed"
+	case b.GreaterThan(a):
+		return "upgraded"
+	case b.LessThan(a):
+		return "downgraded"
+	}
+	return "changed"
+}
+
+// recordChanges compares a device found in a scan with what the inventory remembers about it and adds
+// the differences to the history. It has to be called before the record is updated with the device.
+func recordChanges(inv *inventory, rec *inventoryRecord, device tasmoDevice, now time.Time) {
+	ip := device.key()
+	switch {
+	case rec.FirstSeen.IsZero():
+		inv.addEvent(now, ip, device.Name, "new", device.FirmwareVersion+" ("+device.FirmwareType+")")
+		return
+	case rec.missing():
+		inv.addEvent(now, ip, device.Name, "returned", "after "+formatSeen(rec.LastSeen))
+	}
+	if rec.Version != "" && (rec.Version != device.FirmwareVersion || rec.Variant != device.FirmwareType) {
+		inv.addEvent(now, ip, device.Name, firmwareChange(rec.Version, device.FirmwareVersion),
+			rec.Version+" ("+rec.Variant+") -> "+device.FirmwareVersion+" ("+device.FirmwareType+")")
+	}
+}
+
+// updateHistory returns when tasmogo last updated the device with the given IP and how many of its
+// updates failed since then
+func (inv *inventory) updateHistory(ip string) (time.Time, int) {
+	var last time.Time
+	if rec, ok := inv.Devices[ip]; ok {
+		last = rec.LastUpdate
+	}
+	failed := 0
+	for _, event := range inv.History {
+		if event.IP != ip {
+			continue
+		}
+		switch {
+		case event.Kind == "updated" && !event.Time.Before(last):
+			last, failed = event.Time, 0
+		case event.Kind == "update failed" && event.Time.After(last):
+			failed++
+		}
+	}
+	return last, failed
+}
+
+// formatLastUpdate describes when tasmogo last updated a device and how often it failed since
+func formatLastUpdate(device tasmoDevice) string {
+	text := "never updated"
+	if !device.LastUpdate.IsZero() {
+		text = "updated " + formatSeen(device.LastUpdate)
+	}
+	if device.FailedUpdates > 0 {
+		text += ", " + strconv.Itoa(device.FailedUpdates) + " failed attempts"
+	}
+	return text
+}
+
+// filterHistory returns the events since the given time, of the given device if ip is not empty
+func filterHistory(events []historyEvent, since time.Time, ip string) []historyEvent {
+	filtered := make([]historyEvent, 0)
+	for _, event := range events {
+		if event.Time.Before(since) || (ip != "" && event.IP != ip) {
+			continue
+		}
+		filtered = append(filtered, event)
+	}
+	return filtered
+}
+
+// renderHistory generates a table of the events, ordered by time and IP
+func renderHistory(events []historyEvent) string {
+	sorted := append([]historyEvent(nil), events...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if !sorted[i].Time.Equal(sorted[j].Time) {
+			return sorted[i].Time.Before(sorted[j].Time)
+		}
+		return bytes.Compare(net.ParseIP(sorted[i].IP), net.ParseIP(sorted[j].IP)) < 0
+	})
+	t := table.NewWriter()
+	t.AppendHeader(table.Row{"Time", "IP", "Name", "Change", "Details"})
+	for _, event := range sorted {
+		t.AppendRow(table.Row{event.Time.Format("2006-01-02 15:04"), event.IP, event.Name, event.Kind, event.Detail})
+	}
+	return t.Render()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_addEvent(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	viper.Set("historysize", 2)
+	inv, _ := loadInventory("")
+	for _, kind := range []string{"new", "upgraded", "disappeared"} {
+		inv.addEvent(time.Now(), "1.1.1.1", "plug", kind, "")
+	}
+	assert.Len(inv.History, 2)
+	assert.Equal("upgraded", inv.History[0].Kind)
+}
+
+func Test_firmwareChange(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("upgraded", firmwareChange("9.1.0", "9.2.0"))
+	assert.Equal("downgraded", firmwareChange("9.2.0", "9.1.0"))
+	assert.Equal("changed", firmwareChange("9.2.0", "9.2.0"))
+	assert.Equal("changed", firmwareChange("9.2.0", "weird"))
+}
+
+func Test_trackDevices_history(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	inv, _ := loadInventory("")
+	plug := tasmoDevice{Name: "plug", IP: net.IPv4(1, 1, 1, 1), FirmwareVersion: "9.1.0", FirmwareType: "tasmota"}
+	lamp := tasmoDevice{Name: "lamp", IP: net.IPv4(1, 1, 1, 2), FirmwareVersion: "9.1.0", FirmwareType: "tasmota"}
+	trackDevices(inv, []tasmoDevice{plug, lamp})
+	assert.Len(inv.History, 2)
+	assert.Equal("new", inv.History[0].Kind)
+
+	// the lamp is gone, the plug got a new firmware
+	plug.FirmwareVersion = "9.2.0"
+	trackDevices(inv, []tasmoDevice{plug})
+	events := filterHistory(inv.History, time.Time{}, "1.1.1.1")
+	assert.Len(events, 2)
+	assert.Equal("upgraded", events[1].Kind)
+	assert.Equal("9.1.0 (tasmota) -> 9.2.0 (tasmota)", events[1].Detail)
+	assert.Equal("disappeared", inv.History[3].Kind)
+	assert.Equal("9.2.0", inv.Devices["1.1.1.1"].Version)
+
+	// nothing changed, but the lamp is back
+	trackDevices(inv, []tasmoDevice{plug, lamp})
+	assert.Len(inv.History, 5)
+	assert.Equal("returned", inv.History[4].Kind)
+	assert.Equal("1.1.1.2", inv.History[4].IP)
+}
+
+func Test_trackDevices_missedScans(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	viper.Set("missedscans", 2)
+	inv, _ := loadInventory("")
+	plug := tasmoDevice{Name: "plug", IP: net.IPv4(1, 1, 1, 1), FirmwareVersion: "9.1.0", FirmwareType: "tasmota"}
+	trackDevices(inv, []tasmoDevice{plug})
+
+	// a single missed scan is a hiccup
+	trackDevices(inv, []tasmoDevice{})
+	assert.Len(inv.History, 1)
+	assert.False(inv.Devices["1.1.1.1"].missing())
+	assert.Equal("", renderMissingDevices(inv))
+	trackDevices(inv, []tasmoDevice{plug})
+	assert.Len(inv.History, 1)
+
+	trackDevices(inv, []tasmoDevice{})
+	trackDevices(inv, []tasmoDevice{})
+	trackDevices(inv, []tasmoDevice{})
+	assert.Len(inv.History, 2)
+	assert.Equal("disappeared", inv.History[1].Kind)
+	assert.True(inv.Devices["1.1.1.1"].missing())
+	assert.Contains(renderMissingDevices(inv), "plug")
+	trackDevices(inv, []tasmoDevice{plug})
+	assert.Equal("returned", inv.History[2].Kind)
+}
+
+func Test_updateHistory(t *testing.T) {
+	assert := assert.New(t)
+	day := time.Date(2021, 3, 1, 3, 0, 0, 0, time.UTC)
+	inv := &inventory{
+		Devices: map[string]*inventoryRecord{"1.1.1.1": {LastUpdate: day}},
+		History: []historyEvent{
+			{Time: day, IP: "1.1.1.1", Kind: "updated"},
+			{Time: day.AddDate(0, 0, 1), IP: "1.1.1.1", Kind: "update failed"},
+			{Time: day.AddDate(0, 0, 2), IP: "1.1.1.1", Kind: "update failed"},
+			{Time: day.AddDate(0, 0, 1), IP: "1.1.1.2", Kind: "update failed"},
+		},
+	}
+	last, failed := inv.updateHistory("1.1.1.1")
+	assert.Equal(day, last)
+	assert.Equal(2, failed)
+	last, failed = inv.updateHistory("1.1.1.2")
+	assert.True(last.IsZero())
+	assert.Equal(1, failed)
+
+	assert.Equal("updated 2021-03-01 03:00, 2 failed attempts", formatLastUpdate(tasmoDevice{LastUpdate: day, FailedUpdates: 2}))
+	assert.Equal("never updated", formatLastUpdate(tasmoDevice{}))
+}
+
+func Test_filterHistory(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+	events := []historyEvent{
+		{Time: now.Add(-48 * time.Hour), IP: "1.1.1.1", Kind: "new"},
+		{Time: now, IP: "1.1.1.1", Kind: "upgraded"},
+		{Time: now, IP: "1.1.1.2", Kind: "new"},
+	}
+	assert.Len(filterHistory(events, time.Time{}, ""), 3)
+	assert.Len(filterHistory(events, now.Add(-time.Hour), ""), 2)
+	assert.Len(filterHistory(events, time.Time{}, "1.1.1.1"), 2)
+}
+
+func Test_renderHistory(t *testing.T) {
+	assert := assert.New(t)
+	at := time.Date(2021, 3, 8, 12, 0, 0, 0, time.UTC)
+	history := renderHistory([]historyEvent{
+		{Time: at, IP: "1.1.1.10", Name: "lamp", Kind: "disappeared"},
+		{Time: at, IP: "1.1.1.9", Name: "plug", Kind: "upgraded", Detail: "9.1.0 (tasmota) -> 9.2.0 (tasmota)"},
+	})
+	assert.Contains(history, "2021-03-08 12:00")
+	assert.Less(strings.Index(history, "plug"), strings.Index(history, "lamp"))
+}
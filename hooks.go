@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// updateHook defines console commands, local scripts and webhooks that run before and after a device is
+// updated and when its update failed. Device matches either the IP or the name of a device, an empty
+// one every device.
+type updateHook struct {
+	Device         string   `mapstructure:"device"`
+	Before         []string `mapstructure:"before"`
+	After          []string `mapstructure:"after"`
+	BeforeScript   string   `mapstructure:"beforescript"`
+	AfterScript    string   `mapstructure:"afterscript"`
+	FailureScript  string   `mapstructure:"failurescript"`
+	BeforeWebhook  string   `mapstructure:"beforewebhook"`
+	AfterWebhook   string   `mapstructure:"afterwebhook"`
+	FailureWebhook string   `mapstructure:"failurewebhook"`
+}
+
+// hookPayload is the JSON posted to the webhooks of the hooks
+type hookPayload struct {
+	Stage   string    `json:"stage"`
+	Time    time.Time `json:"time"`
+	IP      string    `json:"ip"`
+	Name    string    `json:"name"`
+	MAC     string    `json:"mac"`
+	Version string    `json:"version"`
+	Variant string    `json:"variant"`
+	OtaURL  string    `json:"otaUrl,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// loadHooks reads the update hooks from the configuration
+func loadHooks() ([]updateHook, error) {
+	var hooks []updateHook
+	err := viper.UnmarshalKey("hooks", &hooks)
+	return hooks, err
+}
+
+// matches reports if the hook applies to the given device
+func (h updateHook) matches(device tasmoDevice) bool {
+	return h.Device == "" || h.Device == device.IP.String() || h.Device == device.Name
+}
+
+// stage returns the console commands, the script and the webhook of the given stage
+func (h updateHook) stage(stage string) ([]string, string, string) {
+	switch stage {
+	case "after":
+		return h.After, h.AfterScript, h.AfterWebhook
+	case "failure":
+		// a device whose update failed might not take any commands
+		return nil, h.FailureScript, h.FailureWebhook
+	}
+	return h.Before, h.BeforeScript, h.BeforeWebhook
+}
+
+// runScript executes a local shell script and passes the device data, the stage and the reason of a
+// failure as environment variables
+func runScript(script string, device tasmoDevice, stage string, reason string) error {
+	cmd := exec.Command("sh", "-c", script)
+	cmd.Env = append(os.Environ(),
+		"TASMOGO_HOOK_STAGE="+stage,
+		"TASMOGO_DEVICE_IP="+device.IP.String(),
+		"TASMOGO_DEVICE_NAME="+device.Name,
+		"TASMOGO_DEVICE_MAC="+device.MAC,
+		"TASMOGO_DEVICE_VERSION="+device.FirmwareVersion,
+		"TASMOGO_DEVICE_VARIANT="+device.FirmwareType,
+		"TASMOGO_UPDATE_ERROR="+reason,
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// callWebhook posts the device data, the stage and the reason of a failure to the URL
+func callWebhook(url string, device tasmoDevice, stage string, reason string) error {
+	data, err := json.Marshal(hookPayload{
+		Stage:   stage,
+		Time:    time.Now(),
+		IP:      device.IP.String(),
+		Name:    device.Name,
+		MAC:     device.MAC,
+		Version: device.FirmwareVersion,
+		Variant: device.FirmwareType,
+		OtaURL:  device.UpdateURL,
+		Error:   reason,
+	})
+	if err != nil {
+		return err
+	}
+	return postNotification(url, "application/json", data, nil)
+}
+
+// runHooks executes all hooks of the given stage ("before" or "after") that match the device.
+// Console commands are sent first, then the script runs and the webhook is called. The first failure
+// aborts the hook.
+func runHooks(device tasmoDevice, stage string) error {
+	return runStage(device, stage, "")
+}
+
+// runFailureHooks executes the failure scripts and webhooks of the hooks matching a device whose update
+// failed for the given reason. Their own failures are only logged.
+func runFailureHooks(device tasmoDevice, reason string) {
+	if err := runStage(device, "failure", reason); err != nil {
+		deviceLogger(device, "hooks").warn("Running the hooks after the failed update of " + device.Name + " (" + device.address() + ") failed: " + err.Error())
+	}
+}
+
+// runAfterHooks executes the hooks after the update of a device. They also run if the update failed, as
+// the hooks before it may have disabled an automation. Their failures are only logged.
+func runAfterHooks(device tasmoDevice) {
+	if err := runHooks(device, "after"); err != nil {
+		deviceLogger(device, "hooks").warn("Running the hooks after updating " + device.Name + " (" + device.address() + ") failed: " + err.Error())
+	}
+}
+
+// runStage executes the hooks of a stage that match the device
+func runStage(device tasmoDevice, stage string, reason string) error {
+	hooks, err := loadHooks()
+	if err != nil {
+		return err
+	}
+	description := stage + " the update"
+	if stage == "failure" {
+		description = "after the failed update"
+	}
+	for _, h := range hooks {
+		if !h.matches(device) {
+			continue
+		}
+		commands, script, webhook := h.stage(stage)
+		for _, command := range commands {
+			if _, err := sendCommand(device.IP.String(), command); err != nil {
+				return errors.New("Sending \"" + command + "\" failed: " + err.Error())
+			}
+			audit("Hook sent \"" + command + "\" to " + device.Name + " (" + device.address() + ") " + description)
+		}
+		if script != "" {
+			if err := runScript(script, device, stage, reason); err != nil {
+				return errors.New("Script \"" + script + "\" failed: " + err.Error())
+			}
+			audit("Hook ran \"" + script + "\" for " + device.Name + " (" + device.address() + ") " + description)
+		}
+		if webhook != "" {
+			// webhooks often carry a token in the URL
+			shown := urlCredentials.ReplaceAllString(webhook, "://"+redacted+"@")
+			if err := callWebhook(webhook, device, stage, reason); err != nil {
+				return errors.New("Webhook " + shown + " failed: " + err.Error())
+			}
+			audit("Hook called " + shown + " for " + device.Name + " (" + device.address() + ") " + description)
+		}
+	}
+	return nil
+}
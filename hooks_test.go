@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_updateHookMatches(t *testing.T) {
+	device := tasmoDevice{Name: "Aquarium", IP: net.IPv4(1, 1, 1, 1)}
+	assert.True(t, updateHook{Device: "Aquarium"}.matches(device))
+	assert.True(t, updateHook{Device: "1.1.1.1"}.matches(device))
+	assert.False(t, updateHook{Device: "1.1.1.2"}.matches(device))
+	assert.True(t, updateHook{}.matches(device))
+}
+
+func Test_runHooks(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("auditlog", "")
+	out := filepath.Join(t.TempDir(), "out")
+	viper.Set("hooks", []map[string]interface{}{
+		{"device": "Aquarium", "afterscript": "echo $TASMOGO_DEVICE_NAME $TASMOGO_DEVICE_IP > " + out},
+		{"device": "Heater", "beforescript": "exit 1"},
+	})
+	defer viper.Set("hooks", nil)
+
+	assert.Nil(runHooks(tasmoDevice{Name: "Aquarium", IP: net.IPv4(1, 1, 1, 1)}, "before"))
+	assert.Nil(runHooks(tasmoDevice{Name: "Aquarium", IP: net.IPv4(1, 1, 1, 1)}, "after"))
+	data, err := ioutil.ReadFile(out)
+	assert.Nil(err)
+	assert.Equal("Aquarium 1.1.1.1\n", string(data))
+
+	assert.NotNil(runHooks(tasmoDevice{Name: "Heater", IP: net.IPv4(1, 1, 1, 2)}, "before"))
+}
+
+func Test_runFailureHooks(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	viper.Set("auditlog", "")
+	var payload hookPayload
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("application/json", r.Header.Get("Content-Type"))
+		payload = hookPayload{}
+		assert.Nil(json.NewDecoder(r.Body).Decode(&payload))
+	}))
+	defer srv.Close()
+	out := filepath.Join(t.TempDir(), "out")
+	viper.Set("hooks", []map[string]interface{}{
+		{"failurescript": "echo $TASMOGO_HOOK_STAGE $TASMOGO_DEVICE_MAC $TASMOGO_UPDATE_ERROR > " + out, "failurewebhook": srv.URL},
+		{"device": "Heater", "before": []string{"Rule1 0"}},
+	})
+	fake := fakeDevices(t, map[string]map[string]string{})
+
+	device := tasmoDevice{Name: "Aquarium", IP: net.IPv4(1, 1, 1, 1), MAC: "AA:BB", FirmwareVersion: "9.1.0"}
+	runFailureHooks(device, "timeout")
+	data, err := ioutil.ReadFile(out)
+	assert.Nil(err)
+	assert.Equal("failure AA:BB timeout\n", string(data))
+	assert.Equal("failure", payload.Stage)
+	assert.Equal("1.1.1.1", payload.IP)
+	assert.Equal("9.1.0", payload.Version)
+	assert.Equal("timeout", payload.Error)
+
+	// failure hooks send no commands
+	runFailureHooks(tasmoDevice{Name: "Heater", IP: net.IPv4(1, 1, 1, 2)}, "timeout")
+	assert.Empty(fake.Commands)
+
+	// the webhook of a stage is called after its script
+	viper.Set("hooks", []map[string]interface{}{{"device": "Heater", "beforewebhook": srv.URL}})
+	assert.Nil(runHooks(tasmoDevice{Name: "Heater", IP: net.IPv4(1, 1, 1, 2)}, "before"))
+	assert.Equal("before", payload.Stage)
+	assert.Empty(payload.Error)
+	srv.Close()
+	assert.NotNil(runHooks(tasmoDevice{Name: "Heater", IP: net.IPv4(1, 1, 1, 2)}, "before"))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+var (
+	hostNamesMu sync.Mutex
+	// hostNames are the names the addresses of the hosts discovery were resolved from
+	hostNames = make(map[string]string)
+)
+
+// rememberHostName keeps the name an address was resolved from, so it can be shown next to the IP
+func rememberHostName(ip net.IP, name string) {
+	hostNamesMu.Lock()
+	defer hostNamesMu.Unlock()
+	hostNames[ip.String()] = name
+}
+
+// hostName returns the name of TASMOGO_HOSTS or TASMOGO_HOSTSFILE an address was resolved from
+func hostName(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	hostNamesMu.Lock()
+	defer hostNamesMu.Unlock()
+	return hostNames[ip.String()]
+}
+
+// configuredHosts returns the hosts of TASMOGO_HOSTS followed by the ones of TASMOGO_HOSTSFILE. If the
+// file can't be read, only the former are returned.
+func configuredHosts() []string {
+	hosts := getList("hosts")
+	path := viper.GetString("hostsfile")
+	if path == "" {
+		return hosts
+	}
+	fromFile, names, err := readHostsFile(path)
+	if err != nil {
+		logWarn("Reading the hosts file failed: " + err.Error())
+		return hosts
+	}
+	for ip, name := range names {
+		rememberHostName(net.ParseIP(ip), name)
+	}
+	return append(hosts, fromFile...)
+}
+
+// readHostsFile reads a list of hosts, one per line, with "#" starting a comment. Lines in the format of
+// /etc/hosts, an address followed by its names, are taken as the address and returned with their first
+// name, so they aren't resolved again. Loopback addresses like the localhost line of /etc/hosts are
+// skipped.
+func readHostsFile(path string) ([]string, map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	hosts := make([]string, 0)
+	names := make(map[string]string)
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		line := lines.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip != nil && ip.IsLoopback() {
+			continue
+		}
+		hosts = append(hosts, fields[0])
+		if ip != nil && len(fields) > 1 {
+			names[ip.String()] = fields[1]
+		}
+	}
+	return hosts, names, lines.Err()
+}
+
+// addressLabel returns the IP of a device followed by the name it was resolved from, if any
+func (d tasmoDevice) addressLabel() string {
+	if d.DNSName == "" {
+		return d.address()
+	}
+	return d.address() + " (" + d.DNSName + ")"
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_readHostsFile(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "hosts")
+	ioutil.WriteFile(path, []byte("# devices\n127.0.0.1 localhost\n::1 localhost ip6-localhost\n10.0.0.5 plug-kitchen.lan plug-kitchen\nbulb-office.lan # the desk lamp\n\n10.0.0.6\n"), 0644)
+	hosts, names, err := readHostsFile(path)
+	assert.Nil(err)
+	assert.Equal([]string{"10.0.0.5", "bulb-office.lan", "10.0.0.6"}, hosts)
+	assert.Equal(map[string]string{"10.0.0.5": "plug-kitchen.lan"}, names)
+
+	_, _, err = readHostsFile(filepath.Join(t.TempDir(), "missing"))
+	assert.NotNil(err)
+}
+
+func Test_configuredHosts(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	path := filepath.Join(t.TempDir(), "hosts")
+	ioutil.WriteFile(path, []byte("10.0.0.7 heater.lan\n"), 0644)
+	viper.Set("hosts", []string{"10.0.0.8"})
+	viper.Set("hostsfile", path)
+	assert.Equal([]string{"10.0.0.8", "10.0.0.7"}, configuredHosts())
+	assert.Equal("heater.lan", hostName(net.ParseIP("10.0.0.7")))
+	assert.Equal("", hostName(net.ParseIP("10.0.0.8")))
+	assert.Equal("", hostName(nil))
+
+	// an unreadable file leaves the list of TASMOGO_HOSTS
+	viper.Set("hostsfile", filepath.Join(t.TempDir(), "missing"))
+	assert.Equal([]string{"10.0.0.8"}, configuredHosts())
+}
+
+func Test_addressLabel(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("10.0.0.5 (plug-kitchen.lan)", tasmoDevice{IP: net.ParseIP("10.0.0.5"), DNSName: "plug-kitchen.lan"}.addressLabel())
+	assert.Equal("10.0.0.5", tasmoDevice{IP: net.ParseIP("10.0.0.5")}.addressLabel())
+	assert.Equal("-", tasmoDevice{}.addressLabel())
+}
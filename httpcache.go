@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/spf13/viper"
+	"github.com/tcnksm/go-latest"
+)
+
+// cachedResponse is the last answer of a server to a GET request, kept to make the next request for
+// the same URL conditional
+type cachedResponse struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	Body         []byte `json:"body"`
+}
+
+// conditionalGetter fetches URLs with If-None-Match and If-Modified-Since, so data that didn't change
+// since the last request is taken from the cache instead of being downloaded again. If a path is set,
+// the cache is kept in that file across runs.
+type conditionalGetter struct {
+	client *http.Client
+	path   string
+	mu     sync.Mutex
+	cache  map[string]*cachedResponse
+}
+
+// newConditionalGetter creates a getter whose cache is stored in the given file, if it isn't empty
+func newConditionalGetter(path string) *conditionalGetter {
+	g := &conditionalGetter{
+		client: &http.Client{Timeout: 30 * time.Second},
+		path:   path,
+		cache:  make(map[string]*cachedResponse),
+	}
+	if path == "" {
+		return g
+	}
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &g.cache)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		logWarn("Reading the HTTP cache failed: " + err.Error())
+	}
+	return g
+}
+
+// get returns the body of the given URL. It is only downloaded if the server reports a change since
+// the cached copy was fetched.
+func (g *conditionalGetter) get(ctx context.Context, url string) ([]byte, error) {
+	g.mu.Lock()
+	cached := g.cache[url]
+	g.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	setRequestHeader(req)
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	res, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusNotModified && cached != nil:
+		return cached.Body, nil
+	case res.StatusCode != http.StatusOK:
+		return nil, errors.New("HTTP status " + res.Status)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	etag, lastModified := res.Header.Get("ETag"), res.Header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		// without validators the response can't be requested conditionally
+		return body, nil
+	}
+	g.mu.Lock()
+	g.cache[url] = &cachedResponse{ETag: etag, LastModified: lastModified, Body: body}
+	g.mu.Unlock()
+	if err := g.save(); err != nil {
+		logWarn("Writing the HTTP cache failed: " + err.Error())
+	}
+	return body, nil
+}
+
+// save writes the cache to its file
+func (g *conditionalGetter) save() error {
+	if g.path == "" {
+		return nil
+	}
+	g.mu.Lock()
+	data, err := json.Marshal(g.cache)
+	g.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(g.path, data, 0600)
+}
+
+var (
+	httpCache     *conditionalGetter
+	httpCacheOnce sync.Once
+)
+
+// sharedHTTPCache returns the getter used for all requests to GitHub and the OTA server. It is created
+// on first use, so the daemon keeps its cache in memory between the cycles.
+func sharedHTTPCache() *conditionalGetter {
+	httpCacheOnce.Do(func() {
+		httpCache = newConditionalGetter(viper.GetString("httpcache"))
+	})
+	return httpCache
+}
+
+// githubTags is a source for latest that lists the tags of a GitHub repository with conditional
+// requests. GitHub doesn't count answers with "304 Not Modified" against the rate limit. Pre-release
+// tags like "v9.3.0-rc1" are ignored unless Prereleases is set.
+type githubTags struct {
+	Owner       string
+	Repository  string
+	Prereleases bool
+	// URL is the base URL of the API, it defaults to https://api.github.com
+	URL    string
+	getter func() *conditionalGetter
+}
+
+// Validate checks that the repository is set
+func (g *githubTags) Validate() error {
+	if g.Owner == "" || g.Repository == "" {
+		return errors.New("Owner and Repository are required")
+	}
+	return nil
+}
+
+// Fetch lists the tags of the repository and parses them as versions
+func (g *githubTags) Fetch() (*latest.FetchResponse, error) {
+	base := g.URL
+	if base == "" {
+		base = "https://api.github.com"
+	}
+	body, err := g.getter().get(context.Background(), strings.TrimSuffix(base, "/")+"/repos/"+g.Owner+"/"+g.Repository+"/tags")
+	if err != nil {
+		return nil, err
+	}
+	var tags []struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(body, &tags); err != nil {
+		return nil, err
+	}
+	fr := &latest.FetchResponse{Meta: &latest.Meta{}}
+	for _, tag := range tags {
+		name := strings.TrimPrefix(tag.Name, "v")
+		v, err := version.NewVersion(name)
+		if err != nil {
+			fr.Malformeds = append(fr.Malformeds, name)
+			continue
+		}
+		if v.Prerelease() != "" && !g.Prereleases {
+			continue
+		}
+		fr.Versions = append(fr.Versions, v)
+	}
+	return fr, nil
+}
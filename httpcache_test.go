@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// conditionalServer answers with the given body and "304 Not Modified" if the client knows its ETag.
+// It counts the full downloads.
+func conditionalServer(body string, downloads *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		*downloads++
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, body)
+	}))
+}
+
+func Test_conditionalGetter(t *testing.T) {
+	assert := assert.New(t)
+	downloads := 0
+	srv := conditionalServer("data", &downloads)
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "cache.json")
+	g := newConditionalGetter(path)
+	for i := 0; i < 2; i++ {
+		body, err := g.get(context.Background(), srv.URL)
+		assert.Nil(err)
+		assert.Equal("data", string(body))
+	}
+	assert.Equal(1, downloads)
+
+	// the cache survives a restart
+	body, err := newConditionalGetter(path).get(context.Background(), srv.URL)
+	assert.Nil(err)
+	assert.Equal("data", string(body))
+	assert.Equal(1, downloads)
+}
+
+func Test_githubTags(t *testing.T) {
+	assert := assert.New(t)
+	downloads := 0
+	srv := conditionalServer(`[{"name": "v9.3.0-rc1"}, {"name": "v9.2.0"}, {"name": "v9.1.0"}, {"name": "nightly"}]`, &downloads)
+	defer srv.Close()
+
+	g := newConditionalGetter("")
+	source := &githubTags{Owner: "arendst", Repository: "tasmota", URL: srv.URL, getter: func() *conditionalGetter { return g }}
+	assert.Nil(source.Validate())
+	fr, err := source.Fetch()
+	assert.Nil(err)
+	assert.Len(fr.Versions, 2)
+	assert.Equal([]string{"nightly"}, fr.Malformeds)
+	assert.Equal("9.2.0", getCurrentTasmotaVersion(source).String())
+	assert.Equal(1, downloads)
+
+	// pre-releases are only considered if requested
+	source.Prereleases = true
+	assert.Equal("9.3.0-rc1", getCurrentTasmotaVersion(source).String())
+
+	assert.NotNil((&githubTags{Owner: "arendst"}).Validate())
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// knownTargets returns the addresses of the devices of the inventory that aren't archived and the ones
+// that failed in the last run
+func knownTargets(inv *inventory) []net.IP {
+	keys := append([]string{}, inv.Errors...)
+	for ip, rec := range inv.Devices {
+		if !rec.Archived {
+			keys = append(keys, ip)
+		}
+	}
+	sort.Strings(keys)
+	ips := make([]net.IP, 0, len(keys))
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if ip := net.ParseIP(key); ip != nil && !seen[key] {
+			seen[key] = true
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// incrementalTargets returns the known addresses that are probed instead of sweeping the networks, or
+// nil if the sweep is due. The networks are swept every TASMOGO_FULLSCANINTERVAL, the runs in between
+// only ask the devices of the inventory again. New devices are found by the next sweep or the other
+// discovery methods.
+func incrementalTargets(inv *inventory, now time.Time) []net.IP {
+	interval := viper.GetDuration("fullscaninterval")
+	if interval <= 0 || inv.LastSweep.IsZero() || now.Sub(inv.LastSweep) >= interval {
+		return nil
+	}
+	known := knownTargets(inv)
+	if len(known) == 0 {
+		return nil
+	}
+	logInfo("Asking the " + strconv.Itoa(len(known)) + " known addresses, the next sweep of the networks is due at " + inScheduleZone(inv.LastSweep.Add(interval)).Format("2006-01-02 15:04 MST"))
+	return known
+}
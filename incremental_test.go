@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_knownTargets(t *testing.T) {
+	assert := assert.New(t)
+	inv, _ := loadInventory("")
+	inv.Errors = []string{"10.0.0.9", "10.0.0.1"}
+	inv.record("10.0.0.1")
+	inv.record("10.0.0.5").Missed = 3
+	inv.record("plug")
+	assert.Equal([]string{"10.0.0.1", "10.0.0.5", "10.0.0.9"}, ipStrings(knownTargets(inv)))
+}
+
+func Test_incrementalTargets(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	now := time.Date(2021, 3, 8, 12, 0, 0, 0, time.UTC)
+	inv, _ := loadInventory("")
+	inv.record("10.0.0.1")
+	inv.LastSweep = now.Add(-time.Hour)
+	// without an interval every run sweeps the networks
+	assert.Nil(incrementalTargets(inv, now))
+
+	viper.Set("fullscaninterval", "24h")
+	assert.Equal([]string{"10.0.0.1"}, ipStrings(incrementalTargets(inv, now)))
+	inv.LastSweep = now.Add(-25 * time.Hour)
+	assert.Nil(incrementalTargets(inv, now))
+	// the first run sweeps them as well
+	inv.LastSweep = time.Time{}
+	assert.Nil(incrementalTargets(inv, now))
+}
+
+func Test_discover_known(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	viper.Set("progress", false)
+	viper.Set("discovery", "cidr")
+	viper.Set("cidr", "10.0.1.0/24")
+	inv, _ := loadInventory("")
+	inv.record("10.0.0.1")
+	fake := fakeDevices(t, map[string]map[string]string{
+		"10.0.0.1": {"Status 0": `{"Status": {"DeviceName": "plug"}, "StatusFWR": {"Version": "9.2.0(tasmota)"}}`},
+	})
+	devices, failed := discover(context.Background(), knownTargets(inv))
+	assert.Empty(failed)
+	// the network isn't swept
+	assert.Equal([]string{"10.0.0.1: Status 0"}, fake.Commands)
+	assert.Len(devices, 1)
+	assert.Equal([]string{"known"}, devices[0].Sources)
+}
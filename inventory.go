@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/spf13/viper"
+)
+
+// maxSamples is the number of measurements kept per device to evaluate trends
+const maxSamples = 20
+
+// inventoryRecord holds everything tasmogo remembers about a single device between scans
+type inventoryRecord struct {
+	Name      string          `json:"name"`
+	Latencies []time.Duration `json:"latencies"`
+	Heaps     []int           `json:"heaps"`
+	Signal    int             `json:"signal"`
+	Missed    int             `json:"missed"`
+	Tags      []string        `json:"tags"`
+	// OTAVariant is the variant a device gets after the minimal firmware of a two-step update
+	OTAVariant  string `json:"otaVariant,omitempty"`
+	OTAAttempts int    `json:"otaAttempts,omitempty"`
+	// FullVariant is the last variant the device ran other than the minimal firmware or the safeboot
+	// image, the one it gets back if it is stuck on either
+	FullVariant string `json:"fullVariant,omitempty"`
+	// Archived devices have been missing for TASMOGO_ARCHIVEAFTER
+	Archived bool `json:"archived,omitempty"`
+	// Failures is the number of runs in a row in which the device failed to answer or to update
+	Failures int `json:"failures,omitempty"`
+	// CanaryVersion is the firmware a canary runs since CanarySince without a crash
+	CanaryVersion string    `json:"canaryVersion,omitempty"`
+	CanarySince   time.Time `json:"canarySince"`
+	// Baseline holds the settings of the last deep inspection of the device
+	Baseline map[string]string `json:"baseline,omitempty"`
+	// LastUpdate is the time of the last verified update of the device
+	LastUpdate time.Time `json:"lastUpdate"`
+	// FirstSeen and LastSeen are the times the device was found first and last
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	// MAC, Hostname, Version and Variant are the hardware address, the hostname and the firmware of the
+	// device at the last scan
+	MAC      string `json:"mac,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	Version  string `json:"version,omitempty"`
+	Variant  string `json:"variant,omitempty"`
+	// BootCount and RestartReason tell if and why the device restarted since the last scan
+	BootCount     int    `json:"bootCount,omitempty"`
+	RestartReason string `json:"restartReason,omitempty"`
+}
+
+// inventory is the persistent store of all devices tasmogo has seen, keyed by their IP address, and
+// of the actions deferred to later runs
+type inventory struct {
+	// mu guards the devices while the updates run in parallel
+	mu      sync.Mutex
+	Devices map[string]*inventoryRecord `json:"devices"`
+	Queue   []queuedAction              `json:"queue"`
+	NextID  int                         `json:"nextID"`
+	History []historyEvent              `json:"history,omitempty"`
+	// Errors are the addresses that failed in the last run with an error worth another try
+	Errors []string `json:"errors,omitempty"`
+	// Release is the latest release found by the last successful lookup at ReleaseChecked, used when
+	// GitHub can't be reached
+	Release        string    `json:"release,omitempty"`
+	ReleaseChecked time.Time `json:"releaseChecked"`
+	// LastSweep is when the networks were swept the last time, see TASMOGO_FULLSCANINTERVAL
+	LastSweep time.Time `json:"lastSweep"`
+}
+
+// loadInventory reads the inventory from the given file. A missing file results in an empty inventory.
+func loadInventory(path string) (*inventory, error) {
+	inv := &inventory{Devices: make(map[string]*inventoryRecord)}
+	if path == "" {
+		return inv, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return inv, nil
+	}
+	if err != nil {
+		return inv, err
+	}
+	err = json.Unmarshal(data, inv)
+	if inv.Devices == nil {
+		inv.Devices = make(map[string]*inventoryRecord)
+	}
+	return inv, err
+}
+
+// save writes the inventory to the given file. An empty path disables persistence.
+func (inv *inventory) save(path string) error {
+	if path == "" {
+		return nil
+	}
+	inv.mu.Lock()
+	data, err := json.MarshalIndent(inv, "", "  ")
+	inv.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// the health checks of the daemon read the inventory while a scan may be saving it
+	return replaceFile(path, data)
+}
+
+// key returns the key of the device in the inventory, its history and the queue: its IP, or its MQTT
+// topic if it was found over MQTT without one
+func (d tasmoDevice) key() string {
+	if d.IP == nil && d.Topic != "" {
+		return "topic:" + d.Topic
+	}
+	return d.IP.String()
+}
+
+// record returns the inventory record for the given key and creates it if necessary
+func (inv *inventory) record(key string) *inventoryRecord {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	rec, ok := inv.Devices[key]
+	if !ok {
+		rec = &inventoryRecord{}
+		inv.Devices[key] = rec
+	}
+	return rec
+}
+
+// lookup returns the inventory record for the given key, if there is one
+func (inv *inventory) lookup(key string) (*inventoryRecord, bool) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	rec, ok := inv.Devices[key]
+	return rec, ok
+}
+
+// addLatency appends a latency measurement and drops the oldest ones if there are too many
+func (rec *inventoryRecord) addLatency(d time.Duration) {
+	rec.Latencies = append(rec.Latencies, d)
+	if len(rec.Latencies) > maxSamples {
+		rec.Latencies = rec.Latencies[len(rec.Latencies)-maxSamples:]
+	}
+}
+
+// latencyDegraded reports if the average of the last three measurements exceeds the average of the
+// older ones by the given factor. At least six measurements are needed to make a decision.
+func (rec *inventoryRecord) latencyDegraded(factor float64) bool {
+	n := len(rec.Latencies)
+	if n < 6 {
+		return false
+	}
+	baseline := averageDuration(rec.Latencies[:n-3])
+	recent := averageDuration(rec.Latencies[n-3:])
+	return float64(recent) > float64(baseline)*factor
+}
+
+// averageDuration calculates the mean of the given durations
+func averageDuration(durations []time.Duration) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for _, d := range durations {
+		sum += d
+	}
+	return sum / time.Duration(len(durations))
+}
+
+// addHeap appends a free heap measurement in kB and drops the oldest ones if there are too many
+func (rec *inventoryRecord) addHeap(heap int) {
+	rec.Heaps = append(rec.Heaps, heap)
+	if len(rec.Heaps) > maxSamples {
+		rec.Heaps = rec.Heaps[len(rec.Heaps)-maxSamples:]
+	}
+}
+
+// heapDropping reports if the free heap is below the given threshold or if its trend will reach the
+// threshold within the given number of scan cycles. At least four measurements are needed for a trend.
+func (rec *inventoryRecord) heapDropping(threshold int, cycles int) bool {
+	n := len(rec.Heaps)
+	if n == 0 {
+		return false
+	}
+	last := rec.Heaps[n-1]
+	if last <= threshold {
+		return true
+	}
+	if n < 4 {
+		return false
+	}
+	// fit a line through the measurements with the least squares method
+	var sumX, sumY, sumXY, sumXX float64
+	for i, heap := range rec.Heaps {
+		x, y := float64(i), float64(heap)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	slope := (float64(n)*sumXY - sumX*sumY) / (float64(n)*sumXX - sumX*sumX)
+	if slope >= 0 {
+		return false
+	}
+	return float64(last-threshold)/-slope <= float64(cycles)
+}
+
+// isCrash reports if a restart reason is a crash, i.e. an exception, a watchdog reset or a brownout,
+// as opposed to a power cycle or a restart by software
+func isCrash(reason string) bool {
+	reason = strings.ToLower(reason)
+	for _, crash := range []string{"exception", "watchdog", "watch dog", "wdt", "panic", "brownout"} {
+		if strings.Contains(reason, crash) {
+			return true
+		}
+	}
+	return false
+}
+
+// restartedByCrash reports if the device restarted since the last scan and the restart was a crash.
+// Devices that don't report their boot count are never considered crashed.
+func (rec *inventoryRecord) restartedByCrash(device tasmoDevice) bool {
+	return rec.BootCount > 0 && device.BootCount > 0 && device.BootCount != rec.BootCount && isCrash(device.RestartReason)
+}
+
+// missing reports if the device was missed in enough consecutive scans, TASMOGO_MISSEDSCANS, to be
+// considered gone. A single scan missing a device is often just a hiccup of the Wi-Fi.
+func (rec *inventoryRecord) missing() bool {
+	return rec.Missed >= missedScans()
+}
+
+// missedScans returns TASMOGO_MISSEDSCANS, at least one scan
+func missedScans() int {
+	if n := viper.GetInt("missedscans"); n > 1 {
+		return n
+	}
+	return 1
+}
+
+// addTag adds a tag to the record and reports if it wasn't there before
+func (rec *inventoryRecord) addTag(tag string) bool {
+	for _, t := range rec.Tags {
+		if t == tag {
+			return false
+		}
+	}
+	rec.Tags = append(rec.Tags, tag)
+	return true
+}
+
+// trackDevices stores the health data, firmware and the time they were seen of the given devices in
+// the inventory and flags the devices whose latency or free heap got notably worse or that crashed since
+// the last scan. Known devices that weren't found get their missed scans counted and are archived once
+// they were missing for long. New, returned, disappeared, archived, reflashed and crashed devices are
+// added to the history.
+func trackDevices(inv *inventory, devices []tasmoDevice) {
+	now := time.Now()
+	seen := make(map[string]bool)
+	for i, device := range devices {
+		seen[device.key()] = true
+		// the other addresses of a device found twice aren't missing
+		for _, ip := range device.Duplicates {
+			seen[ip] = true
+		}
+		devices[i].LastUpdate, devices[i].FailedUpdates = inv.updateHistory(device.key())
+		// devices taken over from the last run weren't asked for any new data, the ones that rejected the
+		// password only get their name from the last time they answered
+		if device.Cached {
+			continue
+		}
+		if device.AuthFailed {
+			if rec, ok := inv.Devices[device.key()]; ok {
+				devices[i].Name, devices[i].MAC = rec.Name, rec.MAC
+				devices[i].FirstSeen, devices[i].LastSeen = rec.FirstSeen, rec.LastSeen
+			}
+			continue
+		}
+		rec := inv.record(device.key())
+		recordChanges(inv, rec, device, now)
+		devices[i].Crashed = rec.restartedByCrash(device)
+		if devices[i].Crashed {
+			deviceLogger(device, "scan").warn(device.Name + " (" + device.address() + ") crashed: " + device.RestartReason)
+			inv.addEvent(now, device.key(), device.Name, "crashed", device.RestartReason)
+		}
+		if device.BootCount > 0 {
+			rec.BootCount, rec.RestartReason = device.BootCount, device.RestartReason
+		}
+		rec.Name = device.Name
+		rec.MAC, rec.Version, rec.Variant = device.MAC, device.FirmwareVersion, device.FirmwareType
+		if device.Hostname != "" {
+			rec.Hostname = device.Hostname
+		}
+		if device.FirmwareType != "" && device.FirmwareType != minimalVariant && device.FirmwareType != safebootVariant {
+			rec.FullVariant = device.FirmwareType
+		}
+		rec.Missed = 0
+		rec.Archived = false
+		rec.LastSeen = now
+		if rec.FirstSeen.IsZero() {
+			rec.FirstSeen = now
+		}
+		devices[i].FirstSeen, devices[i].LastSeen = rec.FirstSeen, rec.LastSeen
+		rec.Signal = device.Signal
+		rec.addLatency(device.Latency)
+		devices[i].LatencyDegraded = rec.latencyDegraded(viper.GetFloat64("latencyfactor"))
+		if devices[i].LatencyDegraded {
+			deviceLogger(device, "scan").warn(device.Name + " (" + device.address() + ") responds slower than it used to")
+		}
+		// devices that don't report their heap are not tracked
+		if device.Heap == 0 {
+			continue
+		}
+		rec.addHeap(device.Heap)
+		devices[i].HeapDropping = rec.heapDropping(viper.GetInt("heapthreshold"), viper.GetInt("heapcycles"))
+		if devices[i].HeapDropping {
+			deviceLogger(device, "scan").warn(device.Name + " (" + device.address() + ") is running out of memory")
+		}
+	}
+	for ip, rec := range inv.Devices {
+		if !seen[ip] {
+			rec.Missed++
+			// the device is reported once when it is considered missing
+			if rec.Missed == missedScans() {
+				inv.addEvent(now, ip, rec.Name, "disappeared", "last seen "+formatSeen(rec.LastSeen))
+			}
+		}
+	}
+	archiveDevices(inv, now)
+}
+
+// formatSeen formats the time a device was seen for the tables
+func formatSeen(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format("2006-01-02 15:04")
+}
+
+// renderMissingDevices generates a table of the known devices that are missing, the ones that
+// disappeared first at the top. Archived devices are left out.
+func renderMissingDevices(inv *inventory) string {
+	ips := make([]string, 0)
+	for ip, rec := range inv.Devices {
+		if rec.missing() && !rec.Archived {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return ""
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		return inv.Devices[ips[i]].LastSeen.Before(inv.Devices[ips[j]].LastSeen)
+	})
+	t := table.NewWriter()
+	t.AppendHeader(table.Row{"IP", "Name", "First seen", "Last seen", "Missed scans"})
+	for _, ip := range ips {
+		rec := inv.Devices[ip]
+		t.AppendRow(table.Row{ip, rec.Name, formatSeen(rec.FirstSeen), formatSeen(rec.LastSeen), rec.Missed})
+	}
+	return t.Render()
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_loadInventory(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "inventory.json")
+	inv, err := loadInventory(path)
+	assert.Nil(err)
+	assert.Empty(inv.Devices)
+
+	rec := inv.record("1.1.1.1")
+	rec.Name = "testdev"
+	rec.addLatency(10 * time.Millisecond)
+	assert.Nil(inv.save(path))
+
+	inv, err = loadInventory(path)
+	assert.Nil(err)
+	assert.Equal("testdev", inv.Devices["1.1.1.1"].Name)
+	assert.Equal([]time.Duration{10 * time.Millisecond}, inv.Devices["1.1.1.1"].Latencies)
+}
+
+func Test_addLatency(t *testing.T) {
+	var rec inventoryRecord
+	for i := 0; i < maxSamples+5; i++ {
+		rec.addLatency(time.Duration(i))
+	}
+	assert.Len(t, rec.Latencies, maxSamples)
+	assert.Equal(t, time.Duration(5), rec.Latencies[0])
+}
+
+func Test_latencyDegraded(t *testing.T) {
+	assert := assert.New(t)
+	var rec inventoryRecord
+	for i := 0; i < 5; i++ {
+		rec.addLatency(10 * time.Millisecond)
+	}
+	assert.False(rec.latencyDegraded(2))
+	rec.addLatency(10 * time.Millisecond)
+	assert.False(rec.latencyDegraded(2))
+	for i := 0; i < 3; i++ {
+		rec.addLatency(50 * time.Millisecond)
+	}
+	assert.True(rec.latencyDegraded(2))
+}
+
+func Test_heapDropping(t *testing.T) {
+	assert := assert.New(t)
+	var rec inventoryRecord
+	assert.False(rec.heapDropping(10, 3))
+	rec.addHeap(25)
+	rec.addHeap(24)
+	assert.False(rec.heapDropping(10, 3))
+	rec.addHeap(25)
+	rec.addHeap(25)
+	assert.False(rec.heapDropping(10, 3))
+	rec.addHeap(20)
+	rec.addHeap(15)
+	assert.True(rec.heapDropping(10, 3))
+	rec.addHeap(9)
+	assert.True(rec.heapDropping(10, 0))
+}
+
+func Test_trackDevices(t *testing.T) {
+	assert := assert.New(t)
+	inv, _ := loadInventory("")
+	inv.record("1.1.1.2").Missed = 2
+	devices := []tasmoDevice{{Name: "testdev", IP: net.IPv4(1, 1, 1, 1), Hostname: "testdev-1234", Heap: 25, Signal: -70}}
+	trackDevices(inv, devices)
+	assert.Equal(0, inv.Devices["1.1.1.1"].Missed)
+	assert.Equal("testdev-1234", inv.Devices["1.1.1.1"].Hostname)
+	assert.Equal(-70, inv.Devices["1.1.1.1"].Signal)
+	assert.Equal([]int{25}, inv.Devices["1.1.1.1"].Heaps)
+	assert.Equal(3, inv.Devices["1.1.1.2"].Missed)
+	assert.False(inv.Devices["1.1.1.1"].FirstSeen.IsZero())
+	assert.Equal(inv.Devices["1.1.1.1"].LastSeen, devices[0].LastSeen)
+
+	// the first sighting is kept, the last one moves on
+	firstSeen := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	inv.Devices["1.1.1.1"].FirstSeen = firstSeen
+	trackDevices(inv, devices)
+	assert.Equal(firstSeen, devices[0].FirstSeen)
+	assert.True(devices[0].LastSeen.After(firstSeen))
+
+	// a device that rejected the password keeps its last known state in the inventory
+	lastSeen := inv.Devices["1.1.1.1"].LastSeen
+	rejected := []tasmoDevice{{IP: net.IPv4(1, 1, 1, 1), AuthFailed: true}}
+	trackDevices(inv, rejected)
+	assert.Equal("testdev", rejected[0].Name)
+	assert.Equal(lastSeen, inv.Devices["1.1.1.1"].LastSeen)
+	assert.Equal(0, inv.Devices["1.1.1.1"].Missed)
+}
+
+func Test_trackDevices_withoutIP(t *testing.T) {
+	assert := assert.New(t)
+	inv, _ := loadInventory("")
+	// devices found over MQTT without an IP are told apart by their topic
+	devices := []tasmoDevice{{Name: "plug", Topic: "plug"}, {Name: "lamp", Topic: "lamp"}, {Name: "heater", IP: net.IPv4(1, 1, 1, 1)}}
+	trackDevices(inv, devices)
+	assert.Len(inv.Devices, 3)
+	assert.Equal("plug", inv.Devices["topic:plug"].Name)
+	assert.Equal("lamp", inv.Devices["topic:lamp"].Name)
+	assert.Equal("1.1.1.1", devices[2].key())
+}
+
+func Test_isCrash(t *testing.T) {
+	assert := assert.New(t)
+	for _, reason := range []string{"Exception", "Hardware Watchdog", "Software Watchdog", "Task watchdog", "Brownout", "Panic exception"} {
+		assert.True(isCrash(reason), reason)
+	}
+	for _, reason := range []string{"Power On", "Software/System restart", "Deep-Sleep Wake", "External System", ""} {
+		assert.False(isCrash(reason), reason)
+	}
+}
+
+func Test_trackDevices_crash(t *testing.T) {
+	assert := assert.New(t)
+	inv, _ := loadInventory("")
+	devices := []tasmoDevice{{Name: "plug", IP: net.IPv4(1, 1, 1, 1), BootCount: 10, RestartReason: "Exception"}}
+	// the reason of a restart before the first scan is no news
+	trackDevices(inv, devices)
+	assert.False(devices[0].Crashed)
+	// the device didn't restart since the last scan
+	trackDevices(inv, devices)
+	assert.False(devices[0].Crashed)
+	devices[0].BootCount = 11
+	trackDevices(inv, devices)
+	assert.True(devices[0].Crashed)
+	assert.Equal("crashed", inv.History[len(inv.History)-1].Kind)
+	assert.Equal(11, inv.Devices["1.1.1.1"].BootCount)
+	devices[0].BootCount, devices[0].RestartReason = 12, "Software/System restart"
+	trackDevices(inv, devices)
+	assert.False(devices[0].Crashed)
+}
+
+func Test_renderMissingDevices(t *testing.T) {
+	assert := assert.New(t)
+	inv, _ := loadInventory("")
+	assert.Equal("", renderMissingDevices(inv))
+	inv.record("1.1.1.1").LastSeen = time.Date(2021, 3, 8, 12, 0, 0, 0, time.UTC)
+	rec := inv.record("1.1.1.2")
+	rec.Name, rec.Missed, rec.LastSeen = "gone", 5, time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	table := renderMissingDevices(inv)
+	assert.Contains(table, "gone")
+	assert.Contains(table, "2021-03-01 12:00")
+	assert.NotContains(table, "1.1.1.1")
+}
+
+func Test_record_concurrent(t *testing.T) {
+	assert := assert.New(t)
+	inv := &inventory{Devices: map[string]*inventoryRecord{}}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
+			inv.record(ip).FullVariant = "tasmota32"
+			inv.lookup("10.0.0.1")
+		}("10.0.0." + strconv.Itoa(i))
+	}
+	wg.Wait()
+	assert.Len(inv.Devices, 10)
+	_, ok := inv.lookup("10.0.0.9")
+	assert.True(ok)
+}
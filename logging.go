@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// logLevel is the severity of a log message
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// levelNames are the names of the levels in the config and the JSON logs
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// levelPrefixes start the messages of the levels in the text logs
+var levelPrefixes = []string{"DEBUG: ", "", "WARNING: ", "ERROR: "}
+
+// logSettings are TASMOGO_LOGLEVEL and TASMOGO_LOGFORMAT. Until the config is read, everything but
+// debug messages is logged as text.
+var logSettings = struct {
+	mu    sync.RWMutex
+	level logLevel
+	json  bool
+}{level: levelInfo}
+
+// parseLogLevel returns the level with the given name
+func parseLogLevel(name string) (logLevel, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return logLevel(i), nil
+		}
+	}
+	if strings.EqualFold(name, "warning") {
+		return levelWarn, nil
+	}
+	return levelInfo, errors.New("Unknown log level " + name + ", expected debug, info, warn or error")
+}
+
+// setupLogging applies TASMOGO_LOGLEVEL and TASMOGO_LOGFORMAT
+func setupLogging() error {
+	level, err := parseLogLevel(viper.GetString("loglevel"))
+	if err != nil {
+		return err
+	}
+	format := strings.ToLower(viper.GetString("logformat"))
+	if format != "text" && format != "json" {
+		return errors.New("Unknown log format " + format + ", expected text or json")
+	}
+	logSettings.mu.Lock()
+	defer logSettings.mu.Unlock()
+	logSettings.level, logSettings.json = level, format == "json"
+	return nil
+}
+
+// logEnabled reports if messages of the level are logged
+func logEnabled(level logLevel) bool {
+	logSettings.mu.RLock()
+	defer logSettings.mu.RUnlock()
+	return level >= logSettings.level
+}
+
+// logField is a key and value added to the JSON logs
+type logField struct {
+	key   string
+	value interface{}
+}
+
+// logger writes messages with fields, e.g. the device and the action it is about. The fields are only
+// part of the JSON logs, the text logs show just the message.
+type logger struct {
+	fields []logField
+}
+
+// with returns a logger that adds another field
+func (l logger) with(key string, value interface{}) logger {
+	fields := make([]logField, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+	return logger{fields: append(fields, logField{key, value})}
+}
+
+// deviceLogger returns a logger for the messages about an action on a device
+func deviceLogger(device tasmoDevice, action string) logger {
+	l := logger{}.with("ip", device.address()).with("name", device.Name)
+	if action != "" {
+		l = l.with("action", action)
+	}
+	return l
+}
+
+// log writes the message if its level is enabled
+func (l logger) log(level logLevel, message string) {
+	if !logEnabled(level) {
+		return
+	}
+	logSettings.mu.RLock()
+	asJSON := logSettings.json
+	logSettings.mu.RUnlock()
+	if !asJSON {
+		log.Println(levelPrefixes[level] + message)
+		return
+	}
+	entry := map[string]interface{}{"time": time.Now().Format(time.RFC3339), "level": levelNames[level], "msg": message}
+	for _, field := range l.fields {
+		entry[field.key] = field.value
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Println(levelPrefixes[level] + message)
+		return
+	}
+	// the JSON lines go to the same output as the standard logger, e.g. the log of the web UI
+	log.Writer().Write(append(data, '\n'))
+}
+
+func (l logger) debug(message string) { l.log(levelDebug, message) }
+func (l logger) info(message string)  { l.log(levelInfo, message) }
+func (l logger) warn(message string)  { l.log(levelWarn, message) }
+func (l logger) error(message string) { l.log(levelError, message) }
+
+// logDebug logs a message that helps to find out what went wrong, e.g. the requests sent to the devices
+func logDebug(message string) { logger{}.debug(message) }
+
+// logInfo logs the progress of a run
+func logInfo(message string) { logger{}.info(message) }
+
+// logWarn logs a problem tasmogo works around
+func logWarn(message string) { logger{}.warn(message) }
+
+// logError logs a failure
+func logError(message string) { logger{}.error(message) }
+
+// logFatal logs a failure tasmogo can't go on after and exits
+func logFatal(message string) {
+	logger{}.error(message)
+	os.Exit(1)
+}
+
+// debugWriter logs every line written to it as a debug message
+type debugWriter struct{}
+
+func (debugWriter) Write(p []byte) (int, error) {
+	for _, line := range bytes.Split(bytes.TrimRight(p, "\n"), []byte("\n")) {
+		logDebug(string(line))
+	}
+	return len(p), nil
+}
+
+// debugLogger returns a standard logger for the packages that writes debug messages, or discards
+// everything if they aren't logged
+func debugLogger() *log.Logger {
+	if !logEnabled(levelDebug) {
+		return log.New(ioutil.Discard, "", 0)
+	}
+	return log.New(debugWriter{}, "", 0)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// captureLog collects the log output and restores the default logging when the test ends
+func captureLog(t *testing.T) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		logSettings.level, logSettings.json = levelInfo, false
+		viper.Reset()
+	})
+	return buf
+}
+
+func Test_parseLogLevel(t *testing.T) {
+	assert := assert.New(t)
+	level, err := parseLogLevel("DEBUG")
+	assert.Nil(err)
+	assert.Equal(levelDebug, level)
+	level, err = parseLogLevel("warning")
+	assert.Nil(err)
+	assert.Equal(levelWarn, level)
+	_, err = parseLogLevel("verbose")
+	assert.NotNil(err)
+}
+
+func Test_setupLogging(t *testing.T) {
+	assert := assert.New(t)
+	buf := captureLog(t)
+	setDefaults()
+	viper.Set("logformat", "xml")
+	assert.NotNil(setupLogging())
+	viper.Set("logformat", "text")
+	viper.Set("loglevel", "warn")
+	assert.Nil(setupLogging())
+	logInfo("scanning")
+	logWarn("slow device")
+	assert.NotContains(buf.String(), "scanning")
+	assert.Contains(buf.String(), "WARNING: slow device")
+}
+
+func Test_logger_json(t *testing.T) {
+	assert := assert.New(t)
+	buf := captureLog(t)
+	setDefaults()
+	viper.Set("logformat", "json")
+	assert.Nil(setupLogging())
+	deviceLogger(tasmoDevice{Name: "plug", IP: net.IPv4(10, 0, 0, 1)}, "update").error("Updating plug failed")
+	var entry map[string]interface{}
+	assert.Nil(json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal("error", entry["level"])
+	assert.Equal("Updating plug failed", entry["msg"])
+	assert.Equal("10.0.0.1", entry["ip"])
+	assert.Equal("plug", entry["name"])
+	assert.Equal("update", entry["action"])
+	assert.NotEmpty(entry["time"])
+}
+
+func Test_debugLogger(t *testing.T) {
+	assert := assert.New(t)
+	buf := captureLog(t)
+	setDefaults()
+	assert.Nil(setupLogging())
+	debugLogger().Println("Sending \"Status 0\" to 10.0.0.1")
+	assert.Empty(buf.String())
+
+	viper.Set("loglevel", "debug")
+	assert.Nil(setupLogging())
+	debugLogger().Println("Sending \"Status 0\" to 10.0.0.1")
+	assert.Contains(buf.String(), "DEBUG: Sending \"Status 0\" to 10.0.0.1")
+}
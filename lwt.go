@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/spf13/viper"
+)
+
+// availability is the state of a device as reported by its MQTT last will
+type availability struct {
+	Online bool      `json:"online"`
+	Since  time.Time `json:"since"`
+}
+
+// availabilityTracker keeps the last reported state of every device by its MQTT topic
+type availabilityTracker struct {
+	mu     sync.Mutex
+	states map[string]availability
+}
+
+// newAvailabilityTracker creates an empty tracker
+func newAvailabilityTracker() *availabilityTracker {
+	return &availabilityTracker{states: make(map[string]availability)}
+}
+
+// update records the LWT message of a device and reports if its state changed. The first message of a
+// device, usually the retained one, is no change. Payloads other than "Online" and "Offline" are ignored.
+func (a *availabilityTracker) update(topic string, payload string, now time.Time) (availability, bool) {
+	var online bool
+	switch strings.TrimSpace(payload) {
+	case "Online":
+		online = true
+	case "Offline":
+		online = false
+	default:
+		return availability{}, false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	last, known := a.states[topic]
+	if known && last.Online == online {
+		return last, false
+	}
+	state := availability{Online: online, Since: now}
+	a.states[topic] = state
+	return state, known
+}
+
+// get returns the state of the device with the given topic
+func (a *availabilityTracker) get(topic string) (availability, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	state, ok := a.states[topic]
+	return state, ok
+}
+
+// count returns the number of online and offline devices
+func (a *availabilityTracker) count() (int, int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	online, offline := 0, 0
+	for _, state := range a.states {
+		if state.Online {
+			online++
+		} else {
+			offline++
+		}
+	}
+	return online, offline
+}
+
+// lwtDeviceTopic returns the topic of the device an LWT message was sent by. It is the part of the
+// topic at the position of the "+" in the subscribed pattern.
+func lwtDeviceTopic(pattern string, topic string) (string, bool) {
+	patternParts := strings.Split(pattern, "/")
+	topicParts := strings.Split(topic, "/")
+	if len(patternParts) != len(topicParts) {
+		return "", false
+	}
+	device := ""
+	for i, part := range patternParts {
+		switch part {
+		case "+":
+			device = topicParts[i]
+		case topicParts[i]:
+		default:
+			return "", false
+		}
+	}
+	return device, device != ""
+}
+
+// handleLWT updates the availability of a device and reports the change
+func (d *daemon) handleLWT(topic string, payload string, now time.Time) {
+	state, changed := d.availability.update(topic, payload, now)
+	if !changed {
+		return
+	}
+	name := topic
+	d.mu.Lock()
+	for _, device := range d.devices {
+		if device.Topic == topic {
+			name = device.Name + " (" + device.address() + ")"
+			break
+		}
+	}
+	d.mu.Unlock()
+	event := "went offline"
+	if state.Online {
+		event = "came online"
+	}
+	logInfo(name + " " + event)
+	d.saveState()
+	if viper.GetBool("notifyavailability") {
+		sendNotification(notification{
+			Title:   "tasmogo: " + name + " " + event,
+			Message: name + " " + event + " at " + now.Local().Format("2006-01-02 15:04:05"),
+			Urgent:  !state.Online,
+			Fields:  map[string]interface{}{"topic": topic, "online": state.Online, "since": state.Since},
+		})
+	}
+}
+
+// watchAvailability subscribes to the LWT topics of TASMOGO_LWTTOPIC and keeps the availability of the
+// devices up to date between the scans until ctx is cancelled
+func watchAvailability(ctx context.Context, d *daemon) {
+	pattern := viper.GetString("lwttopic")
+	subscribe := func(c mqtt.Client) {
+		err := waitForToken(c.Subscribe(pattern, 1, func(c mqtt.Client, msg mqtt.Message) {
+			if topic, ok := lwtDeviceTopic(pattern, msg.Topic()); ok {
+				d.handleLWT(topic, string(msg.Payload()), time.Now())
+			}
+		}))
+		if err != nil {
+			logWarn("Subscribing to " + pattern + " failed: " + err.Error())
+		}
+	}
+	client, err := newMQTTClient(func(opts *mqtt.ClientOptions) {
+		// the scans connect on their own, so the monitor needs a client ID of its own
+		opts.SetClientID("tasmogo-lwt-" + strconv.Itoa(os.Getpid()))
+		// subscribe again after the connection to the broker was lost
+		opts.SetOnConnectHandler(func(c mqtt.Client) {
+			go subscribe(c)
+		})
+	})
+	if err != nil {
+		logWarn("Monitoring the availability failed: " + err.Error())
+		return
+	}
+	defer client.Disconnect(250)
+	logInfo("Monitoring the availability of the devices via " + pattern)
+	<-ctx.Done()
+}
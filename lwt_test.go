@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_availabilityTracker_update(t *testing.T) {
+	assert := assert.New(t)
+	a := newAvailabilityTracker()
+	now := time.Now()
+	// the retained message is no change
+	state, changed := a.update("plug", "Online", now)
+	assert.False(changed)
+	assert.True(state.Online)
+	_, changed = a.update("plug", "Online", now.Add(time.Minute))
+	assert.False(changed)
+	state, changed = a.update("plug", "Offline", now.Add(2*time.Minute))
+	assert.True(changed)
+	assert.False(state.Online)
+	assert.Equal(now.Add(2*time.Minute), state.Since)
+	_, changed = a.update("plug", "garbage", now)
+	assert.False(changed)
+	online, offline := a.count()
+	assert.Equal(0, online)
+	assert.Equal(1, offline)
+}
+
+func Test_lwtDeviceTopic(t *testing.T) {
+	assert := assert.New(t)
+	topic, ok := lwtDeviceTopic("tele/+/LWT", "tele/plug/LWT")
+	assert.True(ok)
+	assert.Equal("plug", topic)
+	topic, ok = lwtDeviceTopic("home/+/tele/LWT", "home/lamp/tele/LWT")
+	assert.True(ok)
+	assert.Equal("lamp", topic)
+	_, ok = lwtDeviceTopic("tele/+/LWT", "tele/plug/STATE")
+	assert.False(ok)
+	_, ok = lwtDeviceTopic("tele/+/LWT", "tele/a/b/LWT")
+	assert.False(ok)
+}
+
+func Test_daemon_handleLWT(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	d := newDaemon(nil)
+	d.devices = []tasmoDevice{{Name: "plug", IP: net.IPv4(10, 0, 0, 1), Topic: "plug"}, {Name: "lamp", IP: net.IPv4(10, 0, 0, 2), Topic: "lamp"}}
+	d.handleLWT("plug", "Online", time.Now())
+	d.handleLWT("plug", "Offline", time.Now())
+	status := d.status()
+	if assert.NotNil(status.Devices[0].Online) {
+		assert.False(*status.Devices[0].Online)
+	}
+	assert.Nil(status.Devices[1].Online)
+	s := d.summary()
+	assert.Equal(1, s.Offline)
+	assert.Contains(renderDaemonSummary(s), "0 online, 1 offline")
+}
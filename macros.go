@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/viper"
+)
+
+// macro is a list of console commands that is sent to a set of devices. The commands are Go templates
+// that can use variables given on invocation, e.g. "Dimmer {{.level}}".
+type macro struct {
+	Tag      string   `mapstructure:"tag"`
+	Devices  []string `mapstructure:"devices"`
+	Commands []string `mapstructure:"commands"`
+}
+
+// loadMacro reads the macro with the given name from the config
+func loadMacro(name string) (macro, error) {
+	var m macro
+	if !viper.IsSet("macros." + name) {
+		return m, errors.New("Unknown macro " + name)
+	}
+	err := viper.UnmarshalKey("macros."+name, &m)
+	if err == nil && len(m.Commands) == 0 {
+		err = errors.New("Macro " + name + " has no commands")
+	}
+	return m, err
+}
+
+// parseVariables converts arguments of the form key=value to a map
+func parseVariables(args []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("Invalid variable " + arg + ", expected key=value")
+		}
+		vars[parts[0]] = parts[1]
+	}
+	return vars, nil
+}
+
+// renderBacklog fills in the variables of the macro's commands for a device and joins them into a
+// single Backlog command. Besides the given variables, the templates can use .ip and .name.
+func (m macro) renderBacklog(device tasmoDevice, vars map[string]string) (string, error) {
+	data := map[string]string{"ip": device.IP.String(), "name": device.Name}
+	for key, value := range vars {
+		data[key] = value
+	}
+	commands := make([]string, 0, len(m.Commands))
+	for _, command := range m.Commands {
+		tmpl, err := template.New("command").Option("missingkey=error").Parse(command)
+		if err != nil {
+			return "", err
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return "", err
+		}
+		commands = append(commands, buf.String())
+	}
+	if len(commands) == 1 {
+		return commands[0], nil
+	}
+	return "Backlog " + strings.Join(commands, "; "), nil
+}
+
+// selectDevices returns the devices matching one of the given IPs or names, or carrying the given tag
+// in the inventory or being part of the given network group. Without any criteria all devices are
+// returned.
+func selectDevices(devices []tasmoDevice, inv *inventory, tag string, names []string) []tasmoDevice {
+	if tag == "" && len(names) == 0 {
+		return devices
+	}
+	selected := make([]tasmoDevice, 0)
+	for _, device := range devices {
+		match := false
+		for _, name := range names {
+			if name == device.IP.String() || name == device.Name {
+				match = true
+			}
+		}
+		if tag != "" && inGroup(device, inv, tag) {
+			match = true
+		}
+		if match {
+			selected = append(selected, device)
+		}
+	}
+	return selected
+}
+
+// runMacro sends the macro to all devices it applies to, several at the same time, and returns the
+// result of each device
+func runMacro(ctx context.Context, m macro, vars map[string]string, devices []tasmoDevice, inv *inventory) taskReport {
+	protectDevices(devices, inv)
+	selected := selectDevices(devices, inv, m.Tag, m.Devices)
+	results := make([]taskResult, len(selected))
+	// the commands are rendered up front, devices without a valid command are never contacted
+	backlogs := make(map[*tasmoDevice]string)
+	targets := make([]*tasmoDevice, 0, len(selected))
+	sent := make([]int, 0, len(selected))
+	for i := range selected {
+		device := &selected[i]
+		backlog, err := m.renderBacklog(*device, vars)
+		if err == nil && !mayModify(*device) {
+			err = errors.New("device may not be modified")
+		}
+		results[i] = taskResult{IP: device.address(), Name: device.Name, Command: backlog}
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		backlogs[device] = backlog
+		targets = append(targets, device)
+		sent = append(sent, i)
+	}
+	client := newDeviceClient()
+	outcomes := newEngine().run(ctx, targets, func(ctx context.Context, device *tasmoDevice) (string, error) {
+		response, err := client.Command(ctx, device.IP.String(), backlogs[device])
+		if err == nil {
+			audit("Sent \"" + backlogs[device] + "\" to " + device.Name + " (" + device.IP.String() + ")")
+		}
+		return response, err
+	})
+	for k, i := range sent {
+		outcomes[k].Command = results[i].Command
+		results[i] = outcomes[k]
+	}
+	return newTaskReport("macro", results)
+}
+
+// runCommands sends the given console commands to the devices with the tag or the given IPs or names,
+// or to all devices without either, like an ad hoc macro
+func runCommands(ctx context.Context, commands []string, tag string, names []string, devices []tasmoDevice, inv *inventory) taskReport {
+	report := runMacro(ctx, macro{Tag: tag, Devices: names, Commands: commands}, nil, devices, inv)
+	report.Task = "command"
+	return report
+}
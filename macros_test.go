@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_loadMacro(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("macros", map[string]interface{}{
+		"evening": map[string]interface{}{"tag": "lights", "commands": []string{"Dimmer {{.level}}"}},
+		"empty":   map[string]interface{}{"tag": "lights"},
+	})
+	defer viper.Set("macros", nil)
+	m, err := loadMacro("evening")
+	assert.Nil(err)
+	assert.Equal("lights", m.Tag)
+	_, err = loadMacro("empty")
+	assert.NotNil(err)
+	_, err = loadMacro("morning")
+	assert.NotNil(err)
+}
+
+func Test_parseVariables(t *testing.T) {
+	vars, err := parseVariables([]string{"level=30", "scene=a=b"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"level": "30", "scene": "a=b"}, vars)
+	_, err = parseVariables([]string{"level"})
+	assert.NotNil(t, err)
+}
+
+func Test_renderBacklog(t *testing.T) {
+	assert := assert.New(t)
+	device := tasmoDevice{Name: "lamp", IP: net.IPv4(1, 1, 1, 1)}
+	m := macro{Commands: []string{"Dimmer {{.level}}", "WebLog {{.name}}"}}
+	backlog, err := m.renderBacklog(device, map[string]string{"level": "30"})
+	assert.Nil(err)
+	assert.Equal("Backlog Dimmer 30; WebLog lamp", backlog)
+
+	m = macro{Commands: []string{"Dimmer {{.level}}"}}
+	backlog, err = m.renderBacklog(device, map[string]string{"level": "30"})
+	assert.Nil(err)
+	assert.Equal("Dimmer 30", backlog)
+	_, err = m.renderBacklog(device, nil)
+	assert.NotNil(err)
+}
+
+func Test_selectDevices(t *testing.T) {
+	assert := assert.New(t)
+	devices := []tasmoDevice{
+		{Name: "lamp", IP: net.IPv4(1, 1, 1, 1)},
+		{Name: "plug", IP: net.IPv4(1, 1, 1, 2)},
+		{Name: "heater", IP: net.IPv4(1, 1, 1, 3)},
+	}
+	inv, _ := loadInventory("")
+	inv.record("1.1.1.1").addTag("lights")
+	assert.Len(selectDevices(devices, inv, "", nil), 3)
+	selected := selectDevices(devices, inv, "lights", []string{"heater"})
+	assert.Len(selected, 2)
+	assert.Equal("lamp", selected[0].Name)
+	assert.Equal("heater", selected[1].Name)
+	devices[2].SSID = "garage"
+	selected = selectDevices(devices, inv, "ssid:garage", nil)
+	assert.Len(selected, 1)
+	assert.Equal("heater", selected[0].Name)
+}
+
+func Test_runMacro(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	viper.Set("auditlog", "")
+	viper.Set("protected", "heater")
+	fake := fakeDevices(t, map[string]map[string]string{
+		"1.1.1.1": {"Dimmer 30": `{"Dimmer":30}`},
+		"1.1.1.3": {},
+	})
+	devices := []tasmoDevice{
+		{Name: "lamp", IP: net.IPv4(1, 1, 1, 1)},
+		{Name: "plug", IP: net.IPv4(1, 1, 1, 2)},
+		{Name: "heater", IP: net.IPv4(1, 1, 1, 3)},
+	}
+	inv := &inventory{Devices: map[string]*inventoryRecord{}}
+	m := macro{Devices: []string{"lamp", "plug", "heater"}, Commands: []string{"Dimmer {{.level}}"}}
+	report := runMacro(context.Background(), m, map[string]string{"level": "30"}, devices, inv)
+	assert.Equal("macro", report.Task)
+	assert.Equal(1, report.Succeeded)
+	assert.Equal(2, report.Failed)
+	assert.Equal(taskResult{IP: "1.1.1.1", Name: "lamp", Command: "Dimmer 30", Output: `{"Dimmer":30}`, Attempts: 1, Duration: report.Results[0].Duration}, report.Results[0])
+	assert.NotEmpty(report.Results[1].Error)
+	// the protected device is never contacted
+	assert.Equal("device may not be modified", report.Results[2].Error)
+	assert.Equal(0, report.Results[2].Attempts)
+	assert.NotContains(fake.Commands, "1.1.1.3: Dimmer 30")
+}
+
+func Test_runCommands(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	viper.Set("auditlog", "")
+	fake := fakeDevices(t, map[string]map[string]string{
+		"1.1.1.1": {"PowerOnState 3": `{"PowerOnState":3}`},
+		"1.1.1.2": {"PowerOnState 3": `{"PowerOnState":3}`, "Backlog FriendlyName1 plug; TelePeriod 60": `{"FriendlyName1":"plug"}`},
+	})
+	devices := []tasmoDevice{{Name: "lamp", IP: net.IPv4(1, 1, 1, 1)}, {Name: "plug", IP: net.IPv4(1, 1, 1, 2)}}
+	inv := &inventory{Devices: map[string]*inventoryRecord{}}
+	report := runCommands(context.Background(), []string{"PowerOnState 3"}, "", nil, devices, inv)
+	assert.Equal("command", report.Task)
+	assert.Equal(2, len(report.Results))
+	assert.Equal(`{"PowerOnState":3}`, report.Results[0].Output)
+	assert.Equal(2, report.Succeeded)
+
+	// several commands are sent as one backlog to the selected devices only
+	report = runCommands(context.Background(), []string{"FriendlyName1 {{.name}}", "TelePeriod 60"}, "", []string{"plug"}, devices, inv)
+	assert.Equal(1, report.Succeeded)
+	assert.Equal(1, len(report.Results))
+	assert.Contains(fake.Commands, "1.1.1.2: Backlog FriendlyName1 plug; TelePeriod 60")
+}
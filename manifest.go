@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runManifest documents the outcome of a single tasmogo run
+type runManifest struct {
+	Started        time.Time        `json:"started"`
+	Finished       time.Time        `json:"finished"`
+	CurrentVersion string           `json:"currentVersion"`
+	Devices        []manifestDevice `json:"devices"`
+}
+
+// manifestDevice is the state of a single device as recorded in the run manifest
+type manifestDevice struct {
+	IP              string `json:"ip"`
+	Name            string `json:"name"`
+	FirmwareVersion string `json:"firmwareVersion"`
+	FirmwareType    string `json:"firmwareType"`
+	Outdated        bool   `json:"outdated"`
+	UpdateURL       string `json:"updateURL,omitempty"`
+	Verified        bool   `json:"verified"`
+}
+
+// newRunManifest creates a manifest from the devices found and updated in a run
+func newRunManifest(started time.Time, currentVersion string, devices []tasmoDevice) runManifest {
+	manifest := runManifest{
+		Started:        started.UTC(),
+		Finished:       time.Now().UTC(),
+		CurrentVersion: currentVersion,
+		Devices:        make([]manifestDevice, 0, len(devices)),
+	}
+	for _, device := range devices {
+		manifest.Devices = append(manifest.Devices, manifestDevice{
+			IP:              device.IP.String(),
+			Name:            device.Name,
+			FirmwareVersion: device.FirmwareVersion,
+			FirmwareType:    device.FirmwareType,
+			Outdated:        device.Outdated,
+			UpdateURL:       device.UpdateURL,
+			Verified:        device.Verified,
+		})
+	}
+	return manifest
+}
+
+// writeManifest stores the manifest in the given directory and returns the path of the file. If a
+// signing key is given, an Ed25519 signature is stored next to it with the suffix ".sig".
+func writeManifest(manifest runManifest, dir string, keyPath string) (string, error) {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "tasmogo-"+manifest.Started.Format("20060102T150405Z")+".json")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return "", err
+	}
+	if keyPath == "" {
+		return path, nil
+	}
+	key, err := loadPrivateKey(keyPath)
+	if err != nil {
+		return path, err
+	}
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))
+	return path, ioutil.WriteFile(path+".sig", []byte(signature+"\n"), 0644)
+}
+
+// verifyManifest checks the signature stored next to the given manifest with the public key
+func verifyManifest(path string, keyPath string) error {
+	key, err := loadPublicKey(keyPath)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	encoded, err := ioutil.ReadFile(path + ".sig")
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return errors.New("Signature is not valid base64")
+	}
+	if !ed25519.Verify(key, data, signature) {
+		return errors.New("Signature does not match the manifest")
+	}
+	return nil
+}
+
+// loadPrivateKey reads a PEM encoded PKCS #8 Ed25519 private key, as created by
+// "openssl genpkey -algorithm ed25519"
+func loadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("Private key is not an Ed25519 key")
+	}
+	return edKey, nil
+}
+
+// loadPublicKey reads a PEM encoded PKIX Ed25519 public key, as created by "openssl pkey -pubout"
+func loadPublicKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("Public key is not an Ed25519 key")
+	}
+	return edKey, nil
+}
+
+// readPEM reads the first PEM block from a file
+func readPEM(path string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("No PEM data found in " + path)
+	}
+	return block, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestKeys creates an Ed25519 key pair in PEM format and returns the paths of both files
+func writeTestKeys(t *testing.T, dir string) (string, string) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	assert.Nil(t, err)
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	assert.Nil(t, err)
+	privatePath := filepath.Join(dir, "key.pem")
+	publicPath := filepath.Join(dir, "key.pub")
+	assert.Nil(t, ioutil.WriteFile(privatePath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0600))
+	assert.Nil(t, ioutil.WriteFile(publicPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0644))
+	return privatePath, publicPath
+}
+
+func Test_newRunManifest(t *testing.T) {
+	devices := []tasmoDevice{{Name: "testdev", IP: net.IPv4(1, 1, 1, 1), FirmwareVersion: "9.1.0", Outdated: true, UpdateURL: "http://ota/tasmota.bin"}}
+	manifest := newRunManifest(time.Now(), "9.2.0", devices)
+	assert.Equal(t, "9.2.0", manifest.CurrentVersion)
+	assert.Equal(t, "1.1.1.1", manifest.Devices[0].IP)
+	assert.Equal(t, "http://ota/tasmota.bin", manifest.Devices[0].UpdateURL)
+}
+
+func Test_verifyManifest(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	privatePath, publicPath := writeTestKeys(t, dir)
+
+	manifest := newRunManifest(time.Now(), "9.2.0", nil)
+	path, err := writeManifest(manifest, dir, privatePath)
+	assert.Nil(err)
+	assert.Nil(verifyManifest(path, publicPath))
+
+	// tampering with the manifest must break the signature
+	data, _ := ioutil.ReadFile(path)
+	assert.Nil(ioutil.WriteFile(path, append(data, ' '), 0644))
+	assert.NotNil(verifyManifest(path, publicPath))
+
+	// the private key is no valid public key
+	assert.NotNil(verifyManifest(path, privatePath))
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metricsWriter builds metrics in the OpenMetrics text format. All metrics are gauges, which the
+// textfile collector of node_exporter reads as well.
+type metricsWriter struct {
+	buf bytes.Buffer
+}
+
+// family starts a metric with its description
+func (m *metricsWriter) family(name string, help string) {
+	m.buf.WriteString("# HELP " + name + " " + help + "\n")
+	m.buf.WriteString("# TYPE " + name + " gauge\n")
+}
+
+// sample adds a value of the current metric. The labels are given as pairs of name and value.
+func (m *metricsWriter) sample(name string, value float64, labels ...string) {
+	m.buf.WriteString(name)
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, labels[i]+"=\""+escapeLabel(labels[i+1])+"\"")
+		}
+		m.buf.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	m.buf.WriteString(" " + strconv.FormatFloat(value, 'f', -1, 64) + "\n")
+}
+
+// escapeLabel escapes backslashes, quotes and line breaks in a label value
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// boolValue converts a flag to a metric value
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// renderMetrics generates the metrics of a run: the totals of the run and the state of every device.
+// Devices restored from the last run only report their firmware, as their health wasn't measured.
+func renderMetrics(devices []tasmoDevice, now time.Time) string {
+	var m metricsWriter
+	s := summarizeRun(devices)
+	totals := []struct {
+		name  string
+		help  string
+		value float64
+	}{
+		{"tasmogo_last_run_timestamp_seconds", "Time of the last run of tasmogo.", float64(now.Unix())},
+		{"tasmogo_devices", "Number of devices found by the last run.", float64(s.Devices)},
+		{"tasmogo_devices_outdated", "Number of devices with an outdated firmware.", float64(s.Outdated)},
+		{"tasmogo_updates_verified", "Number of updates verified in the last run.", float64(s.Updated)},
+		{"tasmogo_updates_failed", "Number of updates that failed in the last run.", float64(s.Failed)},
+		{"tasmogo_devices_crashed", "Number of devices that crashed since the previous run.", float64(len(s.Crashes))},
+	}
+	for _, total := range totals {
+		m.family(total.name, total.help)
+		m.sample(total.name, total.value)
+	}
+
+	m.family("tasmogo_device_info", "Firmware of a device.")
+	for _, device := range devices {
+		m.sample("tasmogo_device_info", 1, "ip", device.address(), "name", device.Name, "mac", device.MAC, "version", device.FirmwareVersion, "variant", device.FirmwareType)
+	}
+	perDevice := []struct {
+		name   string
+		help   string
+		cached bool
+		value  func(tasmoDevice) (float64, bool)
+	}{
+		{"tasmogo_device_outdated", "Whether the firmware of a device is outdated.", true, func(d tasmoDevice) (float64, bool) {
+			return boolValue(d.Outdated), true
+		}},
+		{"tasmogo_device_last_seen_timestamp_seconds", "Time a device was last found.", true, func(d tasmoDevice) (float64, bool) {
+			return float64(d.LastSeen.Unix()), !d.LastSeen.IsZero()
+		}},
+		{"tasmogo_device_latency_seconds", "Time a device took to answer the scan.", false, func(d tasmoDevice) (float64, bool) {
+			return d.Latency.Seconds(), d.Latency > 0
+		}},
+		{"tasmogo_device_heap_bytes", "Free heap of a device.", false, func(d tasmoDevice) (float64, bool) {
+			return float64(d.Heap * 1024), d.Heap > 0
+		}},
+		{"tasmogo_device_wifi_signal_dbm", "Wi-Fi signal strength of a device.", false, func(d tasmoDevice) (float64, bool) {
+			return float64(d.Signal), d.Signal != 0
+		}},
+		{"tasmogo_device_boot_count", "Number of times a device has started.", false, func(d tasmoDevice) (float64, bool) {
+			return float64(d.BootCount), d.BootCount > 0
+		}},
+		{"tasmogo_device_crashed", "Whether a device crashed since the previous run.", false, func(d tasmoDevice) (float64, bool) {
+			return boolValue(d.Crashed), true
+		}},
+	}
+	for _, metric := range perDevice {
+		m.family(metric.name, metric.help)
+		for _, device := range devices {
+			if device.Cached && !metric.cached {
+				continue
+			}
+			if value, ok := metric.value(device); ok {
+				m.sample(metric.name, value, "ip", device.address(), "name", device.Name)
+			}
+		}
+	}
+	m.family("tasmogo_device_sensor", "Reading of a sensor of a device, with TASMOGO_TELEMETRY.")
+	for _, device := range devices {
+		for _, sensor := range sensorNames(device.Sensors) {
+			for _, reading := range sortedKeys(device.Sensors[sensor]) {
+				m.sample("tasmogo_device_sensor", device.Sensors[sensor][reading], "ip", device.address(), "name", device.Name, "sensor", sensor, "reading", reading)
+			}
+		}
+	}
+	m.buf.WriteString("# EOF\n")
+	return m.buf.String()
+}
+
+// writeMetrics writes the metrics of a run to the file of TASMOGO_METRICSFILE. The file is replaced
+// at once, so the textfile collector never reads a partial file.
+func writeMetrics(path string, devices []tasmoDevice, now time.Time) error {
+	return replaceFile(path, []byte(renderMetrics(devices, now)))
+}
+
+// renderHealthMetrics generates the metrics of a health check: whether every device answered and how
+// long it took, and the uptime, Wi-Fi quality and free heap of the devices that accepted the password
+func renderHealthMetrics(results []pingResult, now time.Time) string {
+	var m metricsWriter
+	m.family("tasmogo_health_check_timestamp_seconds", "Time of the last health check.")
+	m.sample("tasmogo_health_check_timestamp_seconds", float64(now.Unix()))
+	perDevice := []struct {
+		name  string
+		help  string
+		value func(pingResult) (float64, bool)
+	}{
+		{"tasmogo_health_up", "Whether a device answered the health check.", func(r pingResult) (float64, bool) {
+			return boolValue(r.Up), true
+		}},
+		{"tasmogo_health_latency_seconds", "Time a device took to answer the health check.", func(r pingResult) (float64, bool) {
+			return r.Latency.Seconds(), r.Up
+		}},
+		{"tasmogo_health_uptime_seconds", "Time since a device restarted.", func(r pingResult) (float64, bool) {
+			return r.Uptime.Seconds(), r.State == "up"
+		}},
+		{"tasmogo_health_wifi_rssi_percent", "Wi-Fi quality of a device.", func(r pingResult) (float64, bool) {
+			return float64(r.RSSI), r.State == "up"
+		}},
+		{"tasmogo_health_heap_bytes", "Free heap of a device.", func(r pingResult) (float64, bool) {
+			return float64(r.Heap * 1024), r.State == "up"
+		}},
+	}
+	for _, metric := range perDevice {
+		m.family(metric.name, metric.help)
+		for _, result := range results {
+			if value, ok := metric.value(result); ok {
+				m.sample(metric.name, value, "ip", result.IP, "name", result.Name)
+			}
+		}
+	}
+	m.buf.WriteString("# EOF\n")
+	return m.buf.String()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_escapeLabel(t *testing.T) {
+	assert.Equal(t, `a \"plug\" \\ \n`, escapeLabel("a \"plug\" \\ \n"))
+}
+
+func Test_renderMetrics(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Unix(1600000000, 0)
+	devices := []tasmoDevice{
+		{Name: "plug", IP: net.IPv4(10, 0, 0, 1), MAC: "DC:4F:22:00:12:34", FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true, Latency: 250 * time.Millisecond, Heap: 25, Signal: -60, LastSeen: now},
+		{Name: "lamp", IP: net.IPv4(10, 0, 0, 2), FirmwareVersion: "9.2.0", FirmwareType: "tasmota", Heap: 20, Cached: true},
+	}
+	metrics := renderMetrics(devices, now)
+	assert.Contains(metrics, "# TYPE tasmogo_devices gauge\ntasmogo_devices 2\n")
+	assert.Contains(metrics, "tasmogo_last_run_timestamp_seconds 1600000000\n")
+	assert.Contains(metrics, "tasmogo_devices_outdated 1\n")
+	assert.Contains(metrics, `tasmogo_device_info{ip="10.0.0.1",name="plug",mac="DC:4F:22:00:12:34",version="9.1.0",variant="tasmota"} 1`)
+	assert.Contains(metrics, `tasmogo_device_latency_seconds{ip="10.0.0.1",name="plug"} 0.25`)
+	assert.Contains(metrics, `tasmogo_device_heap_bytes{ip="10.0.0.1",name="plug"} 25600`)
+	assert.Contains(metrics, `tasmogo_device_wifi_signal_dbm{ip="10.0.0.1",name="plug"} -60`)
+	assert.Contains(metrics, `tasmogo_device_outdated{ip="10.0.0.2",name="lamp"} 0`)
+	// the health of cached devices wasn't measured
+	assert.NotContains(metrics, `tasmogo_device_heap_bytes{ip="10.0.0.2"`)
+	assert.Contains(metrics, "\n# EOF\n")
+}
+
+func Test_writeMetrics(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tasmogo.prom")
+	assert.Nil(writeMetrics(path, []tasmoDevice{{Name: "plug", IP: net.IPv4(10, 0, 0, 1)}}, time.Now()))
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+	assert.Contains(string(data), "tasmogo_devices 1")
+	// no temporary files are left behind
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(files, 1)
+	assert.NotNil(writeMetrics(filepath.Join(dir, "missing", "tasmogo.prom"), nil, time.Now()))
+}
+
+func Test_renderHealthMetrics(t *testing.T) {
+	assert := assert.New(t)
+	results := []pingResult{
+		{IP: "10.0.0.1", Name: "plug", Up: true, State: "up", Latency: 50 * time.Millisecond, Uptime: time.Hour, RSSI: 80, Heap: 25},
+		{IP: "10.0.0.2", Name: "locked", Up: true, State: "auth failed", Latency: 20 * time.Millisecond},
+		{IP: "10.0.0.3", Name: "gone", State: "unreachable"},
+	}
+	metrics := renderHealthMetrics(results, time.Unix(1600000000, 0))
+	assert.Contains(metrics, "tasmogo_health_check_timestamp_seconds 1600000000\n")
+	assert.Contains(metrics, `tasmogo_health_up{ip="10.0.0.3",name="gone"} 0`)
+	assert.Contains(metrics, `tasmogo_health_latency_seconds{ip="10.0.0.2",name="locked"} 0.02`)
+	assert.NotContains(metrics, `tasmogo_health_latency_seconds{ip="10.0.0.3"`)
+	assert.Contains(metrics, `tasmogo_health_uptime_seconds{ip="10.0.0.1",name="plug"} 3600`)
+	assert.NotContains(metrics, `tasmogo_health_heap_bytes{ip="10.0.0.2"`)
+	assert.Contains(metrics, `tasmogo_health_heap_bytes{ip="10.0.0.1",name="plug"} 25600`)
+}
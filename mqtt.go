@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/merlinschumacher/tasmogo/pkg/tasmota"
+	"github.com/spf13/viper"
+	"github.com/tidwall/gjson"
+)
+
+// mqttTimeout limits how long tasmogo waits for the broker to acknowledge a request
+const mqttTimeout = 10 * time.Second
+
+// discoveryMessage is the part of the retained message Tasmota publishes to tasmota/discovery/<MAC>/config
+type discoveryMessage struct {
+	IP   string `json:"ip"`
+	Name string `json:"dn"`
+	// FriendlyNames are the names of the relays, the first one is the friendly name of the device
+	FriendlyNames []string `json:"fn"`
+	Topic         string   `json:"t"`
+	FullTopic     string   `json:"ft"`
+	Hostname      string   `json:"hn"`
+	MAC           string   `json:"mac"`
+}
+
+// mqttConnections counts the connections to the broker. The broker drops a connection when another
+// one uses its client ID, so every connection gets its own.
+var mqttConnections uint64
+
+// mqttClientID returns a client ID that no other connection of this or another tasmogo uses
+func mqttClientID() string {
+	return "tasmogo-" + strconv.Itoa(os.Getpid()) + "-" + strconv.FormatUint(atomic.AddUint64(&mqttConnections, 1), 10)
+}
+
+// newMQTTClient connects to the broker defined in the config. The options can be adjusted before the
+// client connects.
+func newMQTTClient(configure ...func(*mqtt.ClientOptions)) (mqtt.Client, error) {
+	broker := viper.GetString("mqttbroker")
+	if broker == "" {
+		return nil, errors.New("No MQTT broker configured")
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(mqttClientID()).
+		SetUsername(viper.GetString("mqttuser")).
+		SetPassword(viper.GetString("mqttpassword"))
+
+	// brokers with TLS are addressed as ssl://, tls:// or mqtts://
+	caFile := viper.GetString("mqttcafile")
+	if caFile != "" || viper.GetBool("mqttinsecure") {
+		tlsConfig := &tls.Config{InsecureSkipVerify: viper.GetBool("mqttinsecure")}
+		if caFile != "" {
+			pem, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, errors.New("No certificates found in " + caFile)
+			}
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	for _, c := range configure {
+		c(opts)
+	}
+
+	client := mqtt.NewClient(opts)
+	if err := waitForToken(client.Connect()); err != nil {
+		return nil, errors.New("Connecting to the MQTT broker failed: " + err.Error())
+	}
+	return client, nil
+}
+
+// waitForToken waits for an MQTT operation to finish and returns its error
+func waitForToken(token mqtt.Token) error {
+	if !token.WaitTimeout(mqttTimeout) {
+		return errors.New("Timeout")
+	}
+	return token.Error()
+}
+
+// deviceTopic builds the topic of a device for the given prefix (cmnd, stat or tele) and command
+func deviceTopic(device tasmoDevice, prefix string, command string) string {
+	fullTopic := device.FullTopic
+	if fullTopic == "" {
+		fullTopic = "%prefix%/%topic%/"
+	}
+	topic := strings.ReplaceAll(fullTopic, "%prefix%", prefix)
+	topic = strings.ReplaceAll(topic, "%topic%", device.Topic)
+	if !strings.HasSuffix(topic, "/") {
+		topic += "/"
+	}
+	return topic + command
+}
+
+// parseDiscoveryMessage converts a Tasmota discovery message to a device. The message contains no
+// firmware variant, so the version has to be requested separately.
+func parseDiscoveryMessage(payload []byte) (tasmoDevice, error) {
+	var msg discoveryMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return tasmoDevice{}, err
+	}
+	if msg.Topic == "" {
+		return tasmoDevice{}, errors.New("Discovery message without topic")
+	}
+	device := tasmoDevice{
+		DeviceName: msg.Name,
+		IP:         net.ParseIP(msg.IP),
+		Topic:      msg.Topic,
+		FullTopic:  msg.FullTopic,
+		Hostname:   msg.Hostname,
+		MAC:        msg.MAC,
+		ViaMQTT:    true,
+	}
+	if len(msg.FriendlyNames) > 0 {
+		device.FriendlyName = msg.FriendlyNames[0]
+	}
+	return nameDevice(device), nil
+}
+
+// scanMQTT collects the retained discovery messages of all devices on the broker and asks each of them
+// for its firmware version
+func scanMQTT() []tasmoDevice {
+	// the handler of the discovery messages subscribes and publishes itself, which would block the
+	// delivery of the messages in order
+	client, err := newMQTTClient(func(opts *mqtt.ClientOptions) { opts.SetOrderMatters(false) })
+	if err != nil {
+		logWarn(err.Error())
+		return []tasmoDevice{}
+	}
+	defer client.Disconnect(250)
+
+	var mu sync.Mutex
+	devices := make(map[string]tasmoDevice)
+	versions := make(map[string]string)
+	hardware := make(map[string]string)
+	err = waitForToken(client.Subscribe("tasmota/discovery/+/config", 0, func(c mqtt.Client, msg mqtt.Message) {
+		device, err := parseDiscoveryMessage(msg.Payload())
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		devices[device.Topic] = device
+		mu.Unlock()
+		// the answer arrives at the full topic of the device, which may differ from the default one. The
+		// broker handles the subscription before the request.
+		c.Subscribe(deviceTopic(device, "stat", "STATUS2"), 0, func(c mqtt.Client, msg mqtt.Message) {
+			mu.Lock()
+			versions[device.Topic] = gjson.GetBytes(msg.Payload(), "StatusFWR.Version").String()
+			hardware[device.Topic] = gjson.GetBytes(msg.Payload(), "StatusFWR.Hardware").String()
+			mu.Unlock()
+		})
+		c.Publish(deviceTopic(device, "cmnd", "STATUS"), 0, false, "2")
+	}))
+	if err != nil {
+		logWarn("Subscribing to the discovery topics failed: " + err.Error())
+		return []tasmoDevice{}
+	}
+	time.Sleep(viper.GetDuration("mqtttimeout"))
+
+	mu.Lock()
+	defer mu.Unlock()
+	foundDevices := make([]tasmoDevice, 0, len(devices))
+	for topic, device := range devices {
+		if versions[topic] == "" {
+			deviceLogger(device, "discover").warn(device.Name + " (" + topic + ") did not report its firmware version via MQTT")
+			continue
+		}
+		// unknown version formats are shown as they are
+		version, variant, ok := recognizeFirmware(versions[topic])
+		device.FirmwareVersion = version
+		device.FirmwareType = variant
+		device.Unrecognized = !ok
+		device.Chip = tasmota.ChipFamily(hardware[topic], variant)
+		if device.IP != nil {
+			rememberDevice(device.IP.String(), device.Hostname, device.MAC)
+		}
+		foundDevices = append(foundDevices, device)
+	}
+	logInfo("Found " + strconv.Itoa(len(foundDevices)) + " devices via MQTT")
+	return foundDevices
+}
+
+// getDeviceDataMQTT requests the firmware version of a device via MQTT
+func getDeviceDataMQTT(device tasmoDevice) (tasmoDevice, error) {
+	client, err := newMQTTClient()
+	if err != nil {
+		return device, err
+	}
+	defer client.Disconnect(250)
+
+	response := make(chan string, 1)
+	err = waitForToken(client.Subscribe(deviceTopic(device, "stat", "STATUS2"), 0, func(c mqtt.Client, msg mqtt.Message) {
+		select {
+		case response <- gjson.GetBytes(msg.Payload(), "StatusFWR.Version").String():
+		default:
+		}
+	}))
+	if err != nil {
+		return device, err
+	}
+	if err := waitForToken(client.Publish(deviceTopic(device, "cmnd", "STATUS"), 0, false, "2")); err != nil {
+		return device, err
+	}
+	select {
+	case fw := <-response:
+		if fw == "" {
+			return device, errors.New("Device did not report its firmware version via MQTT")
+		}
+		version, variant, ok := recognizeFirmware(fw)
+		device.FirmwareVersion = version
+		device.FirmwareType = variant
+		device.Unrecognized = !ok
+		return device, nil
+	case <-time.After(mqttTimeout):
+		return device, errors.New("Device did not answer via MQTT")
+	}
+}
+
+// sendMQTTCommand publishes a console command to the command topic of a device
+func sendMQTTCommand(device tasmoDevice, command string, payload string) error {
+	client, err := newMQTTClient()
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(250)
+	return waitForToken(client.Publish(deviceTopic(device, "cmnd", command), 0, false, payload))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseDiscoveryMessage(t *testing.T) {
+	assert := assert.New(t)
+	device, err := parseDiscoveryMessage([]byte(`{"ip":"192.168.0.23","dn":"Steckdose","hn":"tasmota-ABCDEF-1234","mac":"A4CF12ABCDEF","sw":"9.1.0","t":"tasmota_ABCDEF","ft":"%prefix%/%topic%/","tp":["cmnd","stat","tele"]}`))
+	assert.Nil(err)
+	assert.Equal("Steckdose", device.Name)
+	assert.Equal(net.ParseIP("192.168.0.23"), device.IP)
+	assert.Equal("tasmota_ABCDEF", device.Topic)
+	assert.True(device.ViaMQTT)
+
+	defer viper.Reset()
+	viper.Set("namefallback", "devicename,friendlyname")
+	device, err = parseDiscoveryMessage([]byte(`{"ip":"192.168.0.23","dn":"Tasmota","fn":["Lamp",null],"t":"tasmota_ABCDEF"}`))
+	assert.Nil(err)
+	assert.Equal("Lamp", device.Name)
+	assert.Equal("friendlyname", device.NameSource)
+
+	_, err = parseDiscoveryMessage([]byte(`{"ip":"192.168.0.23"}`))
+	assert.NotNil(err)
+	_, err = parseDiscoveryMessage([]byte(`offline`))
+	assert.NotNil(err)
+}
+
+func Test_deviceTopic(t *testing.T) {
+	assert := assert.New(t)
+	device := tasmoDevice{Topic: "plug"}
+	assert.Equal("cmnd/plug/Upgrade", deviceTopic(device, "cmnd", "Upgrade"))
+	device.FullTopic = "home/%topic%/%prefix%"
+	assert.Equal("home/plug/stat/STATUS2", deviceTopic(device, "stat", "STATUS2"))
+}
+
+func Test_mqttClientID(t *testing.T) {
+	assert := assert.New(t)
+	first := mqttClientID()
+	assert.True(strings.HasPrefix(first, "tasmogo-"))
+	assert.NotEqual(first, mqttClientID())
+	assert.LessOrEqual(len(first), 23)
+}
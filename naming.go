@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+)
+
+// defaultDeviceName is the device and friendly name of a freshly flashed Tasmota, which tells the
+// devices apart as little as no name at all
+const defaultDeviceName = "Tasmota"
+
+// nameSources are the places a device can take its displayed name from, for TASMOGO_NAMEFALLBACK
+var nameSources = map[string]func(tasmoDevice) string{
+	"devicename":   func(d tasmoDevice) string { return d.DeviceName },
+	"friendlyname": func(d tasmoDevice) string { return d.FriendlyName },
+	"hostname":     func(d tasmoDevice) string { return d.Hostname },
+	"topic":        func(d tasmoDevice) string { return d.Topic },
+	"ip": func(d tasmoDevice) string {
+		if d.IP == nil {
+			return ""
+		}
+		return d.IP.String()
+	},
+}
+
+// nameDevice sets the name of a device to the first of the sources of TASMOGO_NAMEFALLBACK that holds
+// something other than Tasmota's default name and remembers which source that was. Without any, the
+// device keeps its device name.
+func nameDevice(device tasmoDevice) tasmoDevice {
+	device.Name, device.NameSource = device.DeviceName, "devicename"
+	for _, source := range getList("namefallback") {
+		source = strings.ToLower(strings.TrimSpace(source))
+		name, ok := nameSources[source]
+		if !ok {
+			logWarn("Unknown name source " + source + ", expected devicename, friendlyname, hostname, topic or ip")
+			continue
+		}
+		if value := strings.TrimSpace(name(device)); value != "" && !strings.EqualFold(value, defaultDeviceName) {
+			device.Name, device.NameSource = value, source
+			return device
+		}
+	}
+	return device
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_nameDevice(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	device := tasmoDevice{DeviceName: "Tasmota", FriendlyName: "Tasmota", Hostname: "tasmota-ABCDEF-1234", Topic: "tasmota_ABCDEF", IP: net.ParseIP("10.0.0.1")}
+	named := nameDevice(device)
+	assert.Equal("tasmota-ABCDEF-1234", named.Name)
+	assert.Equal("hostname", named.NameSource)
+
+	device.FriendlyName = "Kitchen"
+	named = nameDevice(device)
+	assert.Equal("Kitchen", named.Name)
+	assert.Equal("friendlyname", named.NameSource)
+
+	device.DeviceName = "Kitchen plug"
+	assert.Equal("Kitchen plug", nameDevice(device).Name)
+
+	viper.Set("namefallback", "topic,ip")
+	assert.Equal("tasmota_ABCDEF", nameDevice(device).Name)
+	device.Topic = ""
+	named = nameDevice(device)
+	assert.Equal("10.0.0.1", named.Name)
+	assert.Equal("ip", named.NameSource)
+
+	// without a usable source the device name is kept
+	viper.Set("namefallback", "unknown")
+	named = nameDevice(tasmoDevice{DeviceName: "Tasmota"})
+	assert.Equal("Tasmota", named.Name)
+	assert.Equal("devicename", named.NameSource)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/spf13/viper"
+	"github.com/tidwall/gjson"
+)
+
+// deviation is a setting of a device that differs from the value defined in the config
+type deviation struct {
+	Device    tasmoDevice
+	Setting   string
+	Current   string
+	Desired   string
+	Corrected bool
+}
+
+// loadNormalization reads the settings that should be identical on all devices, e.g. TelePeriod
+func loadNormalization() map[string]string {
+	return viper.GetStringMapString("normalize")
+}
+
+// extractValue returns the value of the given key of a command response. Tasmota answers commands
+// with their name as key, but the case may differ from the one used in the config.
+func extractValue(response string, key string) (string, bool) {
+	var value string
+	found := false
+	gjson.Parse(response).ForEach(func(k, v gjson.Result) bool {
+		if strings.EqualFold(k.String(), key) {
+			value = v.String()
+			found = true
+			return false
+		}
+		return true
+	})
+	return value, found
+}
+
+// sameValue compares two setting values, treating the switch states ON/OFF like 1/0
+func sameValue(a string, b string) bool {
+	normalize := func(s string) string {
+		s = strings.ToUpper(strings.TrimSpace(s))
+		switch s {
+		case "ON":
+			return "1"
+		case "OFF":
+			return "0"
+		}
+		return s
+	}
+	return normalize(a) == normalize(b)
+}
+
+// normalizeDevice compares the settings of a device with the desired ones and sets the deviating
+// ones if apply is true
+func normalizeDevice(device tasmoDevice, settings map[string]string, apply bool) ([]deviation, error) {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	deviations := make([]deviation, 0)
+	for _, name := range names {
+		// sending a command without a value returns the current value
+		response, err := sendCommand(device.IP.String(), name)
+		if err != nil {
+			return deviations, err
+		}
+		current, ok := extractValue(response, name)
+		if !ok {
+			return deviations, errors.New("Device does not know the setting " + name)
+		}
+		if sameValue(current, settings[name]) {
+			continue
+		}
+		d := deviation{Device: device, Setting: name, Current: current, Desired: settings[name]}
+		if apply && mayModify(device) {
+			if _, err := sendCommand(device.IP.String(), name+" "+settings[name]); err != nil {
+				return append(deviations, d), err
+			}
+			d.Corrected = true
+			audit("Set " + name + " of " + device.Name + " (" + device.IP.String() + ") from " + current + " to " + settings[name])
+		}
+		deviations = append(deviations, d)
+	}
+	return deviations, nil
+}
+
+// normalizeDevices checks all devices against the settings in the config and returns all deviations
+func normalizeDevices(devices []tasmoDevice, apply bool) []deviation {
+	settings := loadNormalization()
+	deviations := make([]deviation, 0)
+	for _, device := range devices {
+		d, err := normalizeDevice(device, settings, apply)
+		if err != nil {
+			deviceLogger(device, "normalize").warn("Checking the settings of " + device.Name + " (" + device.IP.String() + ") failed: " + err.Error())
+		}
+		deviations = append(deviations, d...)
+	}
+	return deviations
+}
+
+// renderDeviations generates a table of all devices whose settings deviate from the config
+func renderDeviations(deviations []deviation) string {
+	t := table.NewWriter()
+	t.AppendHeader(table.Row{"IP", "Name", "Setting", "Current", "Desired", ""})
+	for _, d := range deviations {
+		status := "deviates"
+		if d.Corrected {
+			status = "corrected"
+		}
+		t.AppendRow(table.Row{d.Device.IP.String(), d.Device.Name, d.Setting, d.Current, d.Desired, status})
+	}
+	return t.Render()
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_extractValue(t *testing.T) {
+	assert := assert.New(t)
+	value, ok := extractValue(`{"TelePeriod":300}`, "teleperiod")
+	assert.True(ok)
+	assert.Equal("300", value)
+	value, ok = extractValue(`{"SetOption8":"OFF"}`, "SetOption8")
+	assert.True(ok)
+	assert.Equal("OFF", value)
+	_, ok = extractValue(`{"Command":"Unknown"}`, "TempRes")
+	assert.False(ok)
+}
+
+func Test_sameValue(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(sameValue("ON", "1"))
+	assert.True(sameValue("off", "0"))
+	assert.True(sameValue("300", " 300"))
+	assert.False(sameValue("300", "60"))
+}
+
+func Test_renderDeviations(t *testing.T) {
+	deviations := []deviation{
+		{Device: tasmoDevice{Name: "testdev", IP: net.IPv4(1, 1, 1, 1)}, Setting: "teleperiod", Current: "300", Desired: "60", Corrected: true},
+	}
+	assert.Contains(t, renderDeviations(deviations), "| 1.1.1.1 | testdev | teleperiod | 300     | 60      | corrected |")
+}
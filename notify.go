@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// runSummary is the outcome of a run that is sent to the notification targets
+type runSummary struct {
+	Devices  int      `json:"devices"`
+	Outdated int      `json:"outdated"`
+	Updated  int      `json:"updated"`
+	Failed   int      `json:"failed"`
+	Failures []string `json:"failures"`
+	// Crashes are the devices that crashed since the last scan
+	Crashes []string `json:"crashes"`
+	// WhatsNew are the release notes between the firmware of the outdated devices and their target
+	WhatsNew []upgradeNotes `json:"whatsNew,omitempty"`
+}
+
+// summarizeRun counts the devices found, the outdated ones and the outcome of the updates
+func summarizeRun(devices []tasmoDevice) runSummary {
+	s := runSummary{Devices: len(devices), Failures: make([]string, 0), Crashes: make([]string, 0)}
+	for _, device := range devices {
+		if device.Outdated {
+			s.Outdated++
+		}
+		if device.Crashed {
+			s.Crashes = append(s.Crashes, device.Name+" ("+device.address()+"): "+device.RestartReason)
+		}
+		switch updateResult(device) {
+		case "verified":
+			s.Updated++
+		case "failed":
+			s.Failed++
+			s.Failures = append(s.Failures, device.Name+" ("+device.address()+")")
+		}
+	}
+	return s
+}
+
+// title returns the subject of the notification
+func (s runSummary) title() string {
+	switch {
+	case s.Failed > 0:
+		return "tasmogo: " + strconv.Itoa(s.Failed) + " of " + strconv.Itoa(s.Updated+s.Failed) + " updates failed"
+	case len(s.Crashes) > 0:
+		return "tasmogo: " + strconv.Itoa(len(s.Crashes)) + " devices crashed"
+	}
+	return "tasmogo: scan finished"
+}
+
+// message returns the text of the notification
+func (s runSummary) message() string {
+	msg := strconv.Itoa(s.Devices) + " devices found, " + strconv.Itoa(s.Outdated) + " outdated, " +
+		strconv.Itoa(s.Updated) + " updated, " + strconv.Itoa(s.Failed) + " failed"
+	if len(s.Failures) > 0 {
+		msg += "\nFailed: " + strings.Join(s.Failures, ", ")
+	}
+	if len(s.Crashes) > 0 {
+		msg += "\nCrashed: " + strings.Join(s.Crashes, ", ")
+	}
+	if len(s.WhatsNew) > 0 {
+		msg += "\nWhat's new:\n" + renderWhatsNew(s.WhatsNew)
+	}
+	return msg
+}
+
+// shouldNotify reports if a run is worth a notification according to TASMOGO_NOTIFYON: "always",
+// "updates" if a device was updated or failed, or "failures" if an update failed. Crashed devices are
+// always worth a notification.
+func shouldNotify(s runSummary) bool {
+	switch viper.GetString("notifyon") {
+	case "updates":
+		return s.Updated > 0 || s.Failed > 0 || len(s.Crashes) > 0
+	case "failures":
+		return s.Failed > 0 || len(s.Crashes) > 0
+	}
+	return true
+}
+
+// notification is a message for the notification targets. Fields are added to the JSON of the
+// webhook, urgent notifications get a higher priority.
+type notification struct {
+	Title   string
+	Message string
+	Urgent  bool
+	Fields  interface{}
+}
+
+// notify sends the summary of a run to all configured notification targets
+func notify(s runSummary) {
+	if !shouldNotify(s) {
+		return
+	}
+	sendNotification(notification{Title: s.title(), Message: s.message(), Urgent: s.Failed > 0 || len(s.Crashes) > 0, Fields: s})
+}
+
+// sendNotification sends a notification to all configured notification targets
+func sendNotification(n notification) {
+	targets := []struct {
+		name    string
+		enabled bool
+		send    func(notification) error
+	}{
+		{"webhook", viper.GetString("notifywebhook") != "", sendWebhook},
+		{"ntfy", viper.GetString("notifyntfy") != "", sendNtfy},
+		{"Gotify", viper.GetString("notifygotify") != "", sendGotify},
+		{"email", viper.GetString("notifysmtp") != "", sendMail},
+	}
+	for _, target := range targets {
+		if !target.enabled {
+			continue
+		}
+		if err := target.send(n); err != nil {
+			logWarn("Sending the " + target.name + " notification failed: " + err.Error())
+		}
+	}
+}
+
+// postNotification sends a notification to a web service
+func postNotification(url string, contentType string, body []byte, header http.Header) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	setRequestHeader(req)
+	req.Header.Set("Content-Type", contentType)
+	for key, values := range header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	client := http.Client{
+		Timeout: 10 * time.Second,
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.New("HTTP status " + strconv.Itoa(res.StatusCode))
+	}
+	return nil
+}
+
+// sendWebhook posts the notification as JSON to TASMOGO_NOTIFYWEBHOOK, the title and message along
+// with its fields
+func sendWebhook(n notification) error {
+	body := make(map[string]interface{})
+	if n.Fields != nil {
+		data, err := json.Marshal(n.Fields)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &body); err != nil {
+			return err
+		}
+	}
+	body["title"], body["message"] = n.Title, n.Message
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return postNotification(viper.GetString("notifywebhook"), "application/json", data, nil)
+}
+
+// sendNtfy publishes the notification to the ntfy topic of TASMOGO_NOTIFYNTFY
+func sendNtfy(n notification) error {
+	header := make(http.Header)
+	header.Set("Title", n.Title)
+	if n.Urgent {
+		header.Set("Priority", "high")
+	}
+	return postNotification(viper.GetString("notifyntfy"), "text/plain", []byte(n.Message), header)
+}
+
+// sendGotify sends the notification to the Gotify server of TASMOGO_NOTIFYGOTIFY
+func sendGotify(n notification) error {
+	priority := 5
+	if n.Urgent {
+		priority = 8
+	}
+	body, err := json.Marshal(map[string]interface{}{"title": n.Title, "message": n.Message, "priority": priority})
+	if err != nil {
+		return err
+	}
+	header := make(http.Header)
+	header.Set("X-Gotify-Key", viper.GetString("notifygotifytoken"))
+	return postNotification(strings.TrimRight(viper.GetString("notifygotify"), "/")+"/message", "application/json", body, header)
+}
+
+// mailMessage builds the email with the notification
+func mailMessage(from string, to []string, n notification, now time.Time) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("From: " + from + "\r\n")
+	buf.WriteString("To: " + strings.Join(to, ", ") + "\r\n")
+	buf.WriteString("Subject: " + n.Title + "\r\n")
+	buf.WriteString("Date: " + now.Format(time.RFC1123Z) + "\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	buf.WriteString(strings.ReplaceAll(n.Message, "\n", "\r\n") + "\r\n")
+	return buf.Bytes()
+}
+
+// sendMail mails the notification via the SMTP server of TASMOGO_NOTIFYSMTP to TASMOGO_NOTIFYTO
+func sendMail(n notification) error {
+	addr := viper.GetString("notifysmtp")
+	to := getList("notifyto")
+	if len(to) == 0 {
+		return errors.New("Set TASMOGO_NOTIFYTO to the recipients")
+	}
+	from := viper.GetString("notifyfrom")
+	var auth smtp.Auth
+	if user := viper.GetString("notifysmtpuser"); user != "" {
+		host := addr
+		if i := strings.LastIndex(addr, ":"); i >= 0 {
+			host = addr[:i]
+		}
+		auth = smtp.PlainAuth("", user, viper.GetString("notifysmtppassword"), host)
+	}
+	return smtp.SendMail(addr, auth, from, to, mailMessage(from, to, n, time.Now()))
+}
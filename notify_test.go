@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_summarizeRun(t *testing.T) {
+	assert := assert.New(t)
+	s := summarizeRun([]tasmoDevice{
+		{Name: "plug", IP: net.IPv4(10, 0, 0, 1), Outdated: true},
+		{Name: "lamp", IP: net.IPv4(10, 0, 0, 2), Outdated: true, UpdateURL: "http://ota/tasmota.bin", Verified: true},
+		{Name: "heater", IP: net.IPv4(10, 0, 0, 3), Outdated: true, UpdateURL: "http://ota/tasmota.bin"},
+		{Name: "fan", IP: net.IPv4(10, 0, 0, 4)},
+	})
+	assert.Equal(runSummary{Devices: 4, Outdated: 3, Updated: 1, Failed: 1, Failures: []string{"heater (10.0.0.3)"}, Crashes: []string{}}, s)
+	assert.Equal("tasmogo: 1 of 2 updates failed", s.title())
+	assert.Equal("4 devices found, 3 outdated, 1 updated, 1 failed\nFailed: heater (10.0.0.3)", s.message())
+	assert.Equal("tasmogo: scan finished", runSummary{}.title())
+
+	s = summarizeRun([]tasmoDevice{{Name: "plug", IP: net.IPv4(10, 0, 0, 1), Crashed: true, RestartReason: "Exception"}})
+	assert.Equal("tasmogo: 1 devices crashed", s.title())
+	assert.Equal("1 devices found, 0 outdated, 0 updated, 0 failed\nCrashed: plug (10.0.0.1): Exception", s.message())
+}
+
+func Test_shouldNotify(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	assert.True(shouldNotify(runSummary{}))
+	viper.Set("notifyon", "updates")
+	assert.False(shouldNotify(runSummary{Outdated: 1}))
+	assert.True(shouldNotify(runSummary{Updated: 1}))
+	viper.Set("notifyon", "failures")
+	assert.False(shouldNotify(runSummary{Updated: 1}))
+	assert.True(shouldNotify(runSummary{Failed: 1}))
+	assert.True(shouldNotify(runSummary{Crashes: []string{"plug (10.0.0.1): Exception"}}))
+}
+
+func Test_notify(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	requests := make(map[string]*http.Request)
+	bodies := make(map[string]string)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests[r.URL.Path] = r
+		bodies[r.URL.Path] = string(body)
+	}))
+	defer srv.Close()
+	viper.Set("notifywebhook", srv.URL+"/hook")
+	viper.Set("notifyntfy", srv.URL+"/tasmogo")
+	viper.Set("notifygotify", srv.URL+"/")
+	viper.Set("notifygotifytoken", "secret")
+	s := runSummary{Devices: 2, Outdated: 1, Failed: 1, Failures: []string{"plug (10.0.0.1)"}}
+	notify(s)
+
+	var hook map[string]interface{}
+	assert.Nil(json.Unmarshal([]byte(bodies["/hook"]), &hook))
+	assert.Equal("tasmogo: 1 of 1 updates failed", hook["title"])
+	assert.Equal(float64(2), hook["devices"])
+	assert.Equal([]interface{}{"plug (10.0.0.1)"}, hook["failures"])
+
+	assert.Equal(s.message(), bodies["/tasmogo"])
+	assert.Equal("tasmogo: 1 of 1 updates failed", requests["/tasmogo"].Header.Get("Title"))
+	assert.Equal("high", requests["/tasmogo"].Header.Get("Priority"))
+
+	assert.Equal("secret", requests["/message"].Header.Get("X-Gotify-Key"))
+	assert.Contains(bodies["/message"], `"priority":8`)
+
+	// nothing is sent if the run isn't worth a notification
+	requests = make(map[string]*http.Request)
+	viper.Set("notifyon", "failures")
+	notify(runSummary{Devices: 2})
+	assert.Empty(requests)
+}
+
+func Test_mailMessage(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Date(2020, 12, 1, 3, 0, 0, 0, time.UTC)
+	msg := string(mailMessage("tasmogo@example.com", []string{"a@example.com", "b@example.com"}, notification{Title: "tasmogo: 1 of 1 updates failed", Message: "2 devices found, 0 outdated, 0 updated, 1 failed\nFailed: plug (10.0.0.1)"}, now))
+	assert.True(strings.HasPrefix(msg, "From: tasmogo@example.com\r\nTo: a@example.com, b@example.com\r\nSubject: tasmogo: 1 of 1 updates failed\r\n"))
+	assert.Contains(msg, "Date: Tue, 01 Dec 2020 03:00:00 +0000\r\n")
+	assert.True(strings.HasSuffix(msg, "\r\n\r\n2 devices found, 0 outdated, 0 updated, 1 failed\r\nFailed: plug (10.0.0.1)\r\n"))
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// otaServerEnabled reports if the devices get their firmware from the built-in OTA server
+func otaServerEnabled() bool {
+	return viper.GetString("otaserver") != ""
+}
+
+// firmwareFile returns the path of the firmware file of a device relative to the firmware directory.
+// Pinned and target versions are kept in a directory named after the version.
+func firmwareFile(device tasmoDevice) string {
+	name := unsafeFileChars.ReplaceAllString(firmwareName(device), "_")
+	if release := firmwareRelease(device); release != "" {
+		return path.Join(unsafeFileChars.ReplaceAllString(release, "_"), name)
+	}
+	return name
+}
+
+// localAddress returns the address of the interface through which the given IP is reached. No packets
+// are sent, dialing UDP only selects the route.
+func localAddress(remote net.IP) (net.IP, error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(remote.String(), "80"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// otaServerURL returns the base URL under which a device reaches the built-in OTA server. Unless it is
+// set with TASMOGO_OTASERVERURL, it is the address of the interface facing the device.
+func otaServerURL(device tasmoDevice) (string, error) {
+	if url := viper.GetString("otaserverurl"); url != "" {
+		return url, nil
+	}
+	if device.IP == nil {
+		return "", errors.New("the address of the device is unknown, set TASMOGO_OTASERVERURL")
+	}
+	_, port, err := net.SplitHostPort(viper.GetString("otaserver"))
+	if err != nil {
+		return "", err
+	}
+	local, err := localAddress(device.IP)
+	if err != nil {
+		return "", err
+	}
+	return "http://" + net.JoinHostPort(local.String(), port) + "/", nil
+}
+
+var (
+	otaServerOnce sync.Once
+	otaServerErr  error
+)
+
+// startOTAServer serves the firmware directory via HTTP on TASMOGO_OTASERVER until tasmogo exits. It
+// is started only once, so the daemon keeps using the same server.
+func startOTAServer() error {
+	otaServerOnce.Do(func() {
+		listener, err := net.Listen("tcp", viper.GetString("otaserver"))
+		if err != nil {
+			otaServerErr = err
+			return
+		}
+		dir := viper.GetString("firmwaredir")
+		logInfo("Serving the firmware files in " + dir + " on " + listener.Addr().String())
+		// the file server streams the files and supports range requests
+		go http.Serve(listener, http.FileServer(http.Dir(dir)))
+	})
+	return otaServerErr
+}
+
+// downloadFirmware fetches a firmware file into the firmware directory, unless the local copy is as
+// recent as the one on the server. The file is streamed to disk and only replaces the old copy once it
+// is complete.
+func downloadFirmware(url string, file string) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	setRequestHeader(req)
+	if info, err := os.Stat(file); err == nil {
+		req.Header.Set("If-Modified-Since", info.ModTime().UTC().Format(http.TimeFormat))
+	}
+	client := http.Client{
+		Timeout: 5 * time.Minute,
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusNotModified:
+		return nil
+	case http.StatusOK:
+	default:
+		return errors.New("Server answered with HTTP status " + strconv.Itoa(res.StatusCode))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".download-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, res.Body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return err
+	}
+	// remember the age of the file on the server for the next conditional request
+	if modified, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		return os.Chtimes(file, modified, modified)
+	}
+	return nil
+}
+
+// localFirmware returns the path of the firmware file of a device in the firmware directory. With
+// TASMOGO_OTADOWNLOAD the file is fetched from TASMOGO_OTAURL first.
+func localFirmware(device tasmoDevice) (string, error) {
+	file := filepath.Join(viper.GetString("firmwaredir"), filepath.FromSlash(firmwareFile(device)))
+	if viper.GetBool("otadownload") {
+		if err := downloadFirmware(remoteFirmwareURL(device), file); err != nil {
+			if _, statErr := os.Stat(file); statErr != nil {
+				return "", errors.New("Downloading the firmware failed: " + err.Error())
+			}
+			logWarn("Downloading the firmware failed, using the local copy of " + file + ": " + err.Error())
+		}
+	}
+	if _, err := os.Stat(file); err != nil {
+		return "", errors.New("Firmware file " + file + " is missing")
+	}
+	return file, nil
+}
+
+// provideFirmware makes sure the built-in OTA server has the firmware file of the device and is
+// running
+func provideFirmware(device tasmoDevice) error {
+	if !otaServerEnabled() {
+		return nil
+	}
+	if _, err := localFirmware(device); err != nil {
+		return err
+	}
+	return startOTAServer()
+}
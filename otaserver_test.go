@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_firmwareFile(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("tasmota.bin", firmwareFile(tasmoDevice{FirmwareType: "tasmota"}))
+	assert.Equal("tasmota-sensors.bin", firmwareFile(tasmoDevice{FirmwareType: "tasmota", TargetType: "sensors"}))
+	assert.Equal("9.1.0/tasmota-lite.bin", firmwareFile(tasmoDevice{FirmwareType: "lite", PinnedVersion: "9.1.0"}))
+	assert.Equal("tasmota-.._x.bin", firmwareFile(tasmoDevice{FirmwareType: "../x"}))
+}
+
+func Test_otaServerURL(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	viper.Set("otaserver", ":8266")
+	url, err := otaServerURL(tasmoDevice{IP: net.ParseIP("127.0.0.1")})
+	assert.Nil(err)
+	assert.Equal("http://127.0.0.1:8266/", url)
+	_, err = otaServerURL(tasmoDevice{Topic: "plug"})
+	assert.NotNil(err)
+
+	viper.Set("otaserverurl", "http://tasmogo.lan:8266/")
+	url, err = otaServerURL(tasmoDevice{Topic: "plug"})
+	assert.Nil(err)
+	assert.Equal("http://tasmogo.lan:8266/", url)
+	assert.Equal("http://tasmogo.lan:8266/tasmota-sensors.bin", otaURLForDevice(tasmoDevice{FirmwareType: "sensors"}))
+}
+
+func Test_downloadFirmware(t *testing.T) {
+	assert := assert.New(t)
+	modified := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	downloads := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+		w.Write([]byte("firmware"))
+	}))
+	defer srv.Close()
+
+	file := filepath.Join(t.TempDir(), "9.1.0", "tasmota.bin")
+	assert.Nil(downloadFirmware(srv.URL, file))
+	assert.Nil(downloadFirmware(srv.URL, file))
+	assert.Equal(1, downloads)
+	data, _ := ioutil.ReadFile(file)
+	assert.Equal("firmware", string(data))
+
+	assert.NotNil(downloadFirmware(srv.URL+"/missing", filepath.Join(t.TempDir(), "x.bin")))
+}
+
+func Test_provideFirmware(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	assert.Nil(provideFirmware(tasmoDevice{FirmwareType: "tasmota"}))
+
+	dir := t.TempDir()
+	viper.Set("otaserver", "127.0.0.1:0")
+	viper.Set("firmwaredir", dir)
+	assert.NotNil(provideFirmware(tasmoDevice{FirmwareType: "tasmota"}))
+	assert.Nil(ioutil.WriteFile(filepath.Join(dir, "tasmota.bin"), []byte("firmware"), 0644))
+	assert.Nil(provideFirmware(tasmoDevice{FirmwareType: "tasmota"}))
+}
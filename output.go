@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/spf13/viper"
+)
+
+// scanResult is the machine-readable state of a device after a run
+type scanResult struct {
+	IP            string    `json:"ip"`
+	MAC           string    `json:"mac"`
+	Name          string    `json:"name"`
+	NameSource    string    `json:"nameSource"`
+	Version       string    `json:"version"`
+	Variant       string    `json:"variant"`
+	Outdated      bool      `json:"outdated"`
+	UpdateResult  string    `json:"updateResult"`
+	Groups        []string  `json:"groups"`
+	FirstSeen     time.Time `json:"firstSeen"`
+	LastSeen      time.Time `json:"lastSeen"`
+	RestartReason string    `json:"restartReason"`
+	Crashed       bool      `json:"crashed"`
+	Hostname      string    `json:"hostname"`
+	DNSName       string    `json:"dnsName"`
+	Topic         string    `json:"topic"`
+	Module        int       `json:"module"`
+	// Uptime is given in seconds
+	Uptime int64 `json:"uptime"`
+	RSSI   int   `json:"rssi"`
+	// Online is only known in daemon mode with TASMOGO_LWT
+	Online     *bool `json:"online,omitempty"`
+	AuthFailed bool  `json:"authFailed"`
+	// Unrecognized devices report a version string of an unknown format as their version
+	Unrecognized bool `json:"unrecognized"`
+	// Archived devices have been missing for long and are listed from the inventory
+	Archived bool `json:"archived"`
+	// Sources are the discovery methods that found the device
+	Sources []string `json:"sources"`
+	// Sensors are the readings of the sensors, with TASMOGO_TELEMETRY
+	Sensors map[string]map[string]float64 `json:"sensors,omitempty"`
+	// Duplicates are the other addresses the device answered at
+	Duplicates []string `json:"duplicates,omitempty"`
+}
+
+// updateResult returns "verified" or "failed" for updated devices and an empty string for the others
+func updateResult(device tasmoDevice) string {
+	switch {
+	case device.UpdateURL == "":
+		return ""
+	case device.Verified:
+		return "verified"
+	}
+	return "failed"
+}
+
+// scanResults converts the devices to their machine-readable state
+func scanResults(devices []tasmoDevice) []scanResult {
+	results := make([]scanResult, 0, len(devices))
+	for _, device := range devices {
+		results = append(results, scanResult{
+			IP:            device.address(),
+			MAC:           device.MAC,
+			Name:          device.Name,
+			NameSource:    device.NameSource,
+			Version:       device.FirmwareVersion,
+			Variant:       device.FirmwareType,
+			Outdated:      device.Outdated,
+			UpdateResult:  updateResult(device),
+			Groups:        deviceGroups(device),
+			FirstSeen:     device.FirstSeen,
+			LastSeen:      device.LastSeen,
+			RestartReason: device.RestartReason,
+			Crashed:       device.Crashed,
+			Hostname:      device.Hostname,
+			DNSName:       device.DNSName,
+			Topic:         device.Topic,
+			Module:        device.Module,
+			Uptime:        int64(device.Uptime / time.Second),
+			RSSI:          device.RSSI,
+			AuthFailed:    device.AuthFailed,
+			Unrecognized:  device.Unrecognized,
+			Archived:      device.Archived,
+			Sensors:       device.Sensors,
+			Sources:       append([]string{}, device.Sources...),
+			Duplicates:    device.Duplicates,
+		})
+	}
+	return results
+}
+
+// timestamp formats a time for the CSV output, leaving it empty if it is unknown
+func timestamp(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// writeScanResults writes the results of a run in the given format: json, csv, yaml, knowndevices,
+// influx, markdown or table
+func writeScanResults(w io.Writer, format string, devices []tasmoDevice) error {
+	results := scanResults(devices)
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	case "csv":
+		out := csv.NewWriter(w)
+		out.Write([]string{"ip", "mac", "name", "version", "variant", "outdated", "updateResult", "firstSeen", "lastSeen", "hostname", "topic", "module", "uptime", "rssi", "sources", "dnsName"})
+		for _, r := range results {
+			out.Write([]string{r.IP, r.MAC, r.Name, r.Version, r.Variant, strconv.FormatBool(r.Outdated), r.UpdateResult, timestamp(r.FirstSeen), timestamp(r.LastSeen), r.Hostname, r.Topic, strconv.Itoa(r.Module), strconv.FormatInt(r.Uptime, 10), strconv.Itoa(r.RSSI), strings.Join(r.Sources, "+"), r.DNSName})
+		}
+		out.Flush()
+		return out.Error()
+	case "yaml":
+		return writeYAML(w, devices, false)
+	case "knowndevices":
+		return writeYAML(w, devices, true)
+	case "influx":
+		return writeInflux(w, devices, time.Now())
+	case "markdown", "table":
+		t := table.NewWriter()
+		t.AppendHeader(table.Row{"IP", "MAC", "Name", "Version", "Variant", "Outdated", "Update result", "First seen", "Last seen"})
+		for i, r := range results {
+			t.AppendRow(table.Row{devices[i].addressLabel(), r.MAC, r.Name, r.Version, r.Variant, r.Outdated, r.UpdateResult, formatSeen(r.FirstSeen), formatSeen(r.LastSeen)})
+		}
+		rendered := t.Render()
+		if format == "markdown" {
+			rendered = t.RenderMarkdown()
+		}
+		_, err := io.WriteString(w, rendered+"\n")
+		return err
+	}
+	return errors.New("Unknown output format " + format + ", expected json, csv, yaml, knowndevices, influx, markdown or table")
+}
+
+// outputResults writes the results of a run to TASMOGO_OUTPUTFILE or stdout in the format given by
+// TASMOGO_OUTPUT. The human readable table is already logged during the run, so it is only written
+// if a file is given.
+func outputResults(devices []tasmoDevice) error {
+	format := strings.ToLower(viper.GetString("output"))
+	path := viper.GetString("outputfile")
+	if format == "table" && path == "" {
+		return nil
+	}
+	if path == "" {
+		return writeScanResults(os.Stdout, format, devices)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeScanResults(f, format, devices); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
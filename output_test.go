@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// outputDevices are a device that was updated and one that was left alone
+var outputDevices = []tasmoDevice{
+	{Name: "plug", IP: net.ParseIP("10.0.0.1"), MAC: "DC:4F:22:00:12:34", FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true, UpdateURL: "http://ota/tasmota.bin", Verified: true,
+		FirstSeen: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC), LastSeen: time.Date(2021, 3, 8, 12, 0, 0, 0, time.UTC),
+		Hostname: "plug-1234", Topic: "plug", Module: 18, Uptime: 93784 * time.Second, RSSI: 80, Sources: []string{"cidr", "mqtt"}, DNSName: "plug-kitchen.lan"},
+	{Name: "lamp, hallway", IP: net.ParseIP("10.0.0.2"), FirmwareVersion: "9.2.0", FirmwareType: "sensors"},
+}
+
+func Test_writeScanResults(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	assert.Nil(writeScanResults(&buf, "json", outputDevices))
+	var results []scanResult
+	assert.Nil(json.Unmarshal(buf.Bytes(), &results))
+	assert.Equal("verified", results[0].UpdateResult)
+	assert.Equal("DC:4F:22:00:12:34", results[0].MAC)
+	assert.Equal(int64(93784), results[0].Uptime)
+	assert.Equal(80, results[0].RSSI)
+	assert.Empty(results[1].UpdateResult)
+	assert.Equal([]string{"cidr", "mqtt"}, results[0].Sources)
+
+	buf.Reset()
+	assert.Nil(writeScanResults(&buf, "csv", outputDevices))
+	assert.Equal("ip,mac,name,version,variant,outdated,updateResult,firstSeen,lastSeen,hostname,topic,module,uptime,rssi,sources,dnsName\n10.0.0.1,DC:4F:22:00:12:34,plug,9.1.0,tasmota,true,verified,2021-03-01T12:00:00Z,2021-03-08T12:00:00Z,plug-1234,plug,18,93784,80,cidr+mqtt,plug-kitchen.lan\n10.0.0.2,,\"lamp, hallway\",9.2.0,sensors,false,,,,,,0,0,0,,\n", buf.String())
+
+	buf.Reset()
+	assert.Nil(writeScanResults(&buf, "markdown", outputDevices))
+	assert.Contains(buf.String(), "| 10.0.0.1 (plug-kitchen.lan) | DC:4F:22:00:12:34 | plug | 9.1.0 | tasmota | true | verified | 2021-03-01 12:00 | 2021-03-08 12:00 |")
+
+	assert.NotNil(writeScanResults(&buf, "xml", outputDevices))
+}
+
+func Test_outputResults(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	path := filepath.Join(t.TempDir(), "results.csv")
+	viper.Set("output", "CSV")
+	viper.Set("outputfile", path)
+	assert.Nil(outputResults(outputDevices))
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+	assert.Contains(string(data), "10.0.0.2")
+}
+
+func Test_updateResult(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("", updateResult(tasmoDevice{}))
+	assert.Equal("failed", updateResult(tasmoDevice{UpdateURL: "http://ota/tasmota.bin"}))
+	assert.Equal("verified", updateResult(tasmoDevice{UpdateURL: "http://ota/tasmota.bin", Verified: true}))
+}
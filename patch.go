@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/merlinschumacher/tasmogo/pkg/tasmota"
+)
+
+// settingsPatch holds the desired settings of devices, keyed by IP or name, and the settings of all
+// devices under "*". The settings are keyed by the command that sets them, e.g.
+// {"*": {"TelePeriod": 60}, "plug": {"PowerOnState": 3}}.
+type settingsPatch map[string]map[string]string
+
+// loadPatch reads a settings patch from a JSON file. Numbers and booleans are accepted as values,
+// true and false are sent as 1 and 0.
+func loadPatch(path string) (settingsPatch, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, errors.New("Invalid settings patch " + path + ": " + err.Error())
+	}
+	p := make(settingsPatch)
+	for device, settings := range raw {
+		p[device] = make(map[string]string)
+		for command, value := range settings {
+			if strings.ContainsAny(command, " ;") {
+				return nil, errors.New("Invalid command " + command + " for " + device + ", expected a single command name")
+			}
+			switch v := value.(type) {
+			case string:
+				p[device][command] = v
+			case json.Number:
+				p[device][command] = v.String()
+			case bool:
+				p[device][command] = "0"
+				if v {
+					p[device][command] = "1"
+				}
+			default:
+				return nil, errors.New("Invalid value of " + command + " for " + device + ", expected a string, number or boolean")
+			}
+		}
+	}
+	return p, nil
+}
+
+// forDevice returns the desired settings of a device. Settings given for its IP or name override the
+// ones for all devices.
+func (p settingsPatch) forDevice(device tasmoDevice) map[string]string {
+	settings := make(map[string]string)
+	for _, key := range []string{"*", device.Name, device.IP.String()} {
+		for command, value := range p[key] {
+			settings[command] = value
+		}
+	}
+	return settings
+}
+
+// patchBacklog asks the device for the current value of every setting and returns the Backlog that sets
+// the deviating ones, or an empty string if the device already has all of them
+func patchBacklog(ctx context.Context, client tasmota.DeviceClient, device tasmoDevice, settings map[string]string) (string, []string, error) {
+	commands := make([]string, 0, len(settings))
+	for command := range settings {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	changes := make([]string, 0)
+	changed := make([]string, 0)
+	for _, command := range commands {
+		// sending a command without a value returns the current value
+		response, err := client.Command(ctx, device.IP.String(), command)
+		if err != nil {
+			return "", nil, err
+		}
+		current, ok := extractValue(response, command)
+		if !ok {
+			return "", nil, errors.New("Device does not know the setting " + command)
+		}
+		if !sameValue(current, settings[command]) {
+			changes = append(changes, command+" "+settings[command])
+			changed = append(changed, command)
+		}
+	}
+	if len(changes) == 0 {
+		return "", changed, nil
+	}
+	return "Backlog " + strings.Join(changes, "; "), changed, nil
+}
+
+// runPatch brings the devices with settings in the patch to the desired state. Only the deviating
+// settings are sent, as a single Backlog, so applying a patch again changes nothing. With apply false
+// the Backlog is only shown.
+func runPatch(ctx context.Context, p settingsPatch, devices []tasmoDevice, inv *inventory, apply bool) taskReport {
+	protectDevices(devices, inv)
+	targets := make([]*tasmoDevice, 0, len(devices))
+	for i := range devices {
+		if len(p.forDevice(devices[i])) > 0 {
+			targets = append(targets, &devices[i])
+		}
+	}
+	backlogs := make([]string, len(targets))
+	index := make(map[*tasmoDevice]int)
+	for i, device := range targets {
+		index[device] = i
+	}
+	client := newDeviceClient()
+	results := newEngine().run(ctx, targets, func(ctx context.Context, device *tasmoDevice) (string, error) {
+		backlog, changed, err := patchBacklog(ctx, client, *device, p.forDevice(*device))
+		backlogs[index[device]] = backlog
+		switch {
+		case err != nil:
+			return "", err
+		case backlog == "":
+			return "up to date", nil
+		case !apply:
+			return "would change " + strings.Join(changed, ", "), nil
+		case !mayModify(*device):
+			return "", errors.New("device may not be modified")
+		}
+		if _, err := client.Command(ctx, device.IP.String(), backlog); err != nil {
+			return "", err
+		}
+		audit("Sent \"" + backlog + "\" to " + device.Name + " (" + device.IP.String() + ")")
+		return "changed " + strings.Join(changed, ", "), nil
+	})
+	for i := range results {
+		results[i].Command = backlogs[i]
+	}
+	return newTaskReport("patch", results)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_loadPatch(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "patch.json")
+	assert.Nil(ioutil.WriteFile(path, []byte(`{"*": {"TelePeriod": 60, "SetOption19": true}, "plug": {"PowerOnState": "3", "Rule1": 0.5}}`), 0644))
+	p, err := loadPatch(path)
+	assert.Nil(err)
+	assert.Equal(settingsPatch{
+		"*":    {"TelePeriod": "60", "SetOption19": "1"},
+		"plug": {"PowerOnState": "3", "Rule1": "0.5"},
+	}, p)
+
+	assert.Nil(ioutil.WriteFile(path, []byte(`{"*": {"TelePeriod": [60]}}`), 0644))
+	_, err = loadPatch(path)
+	assert.NotNil(err)
+	assert.Nil(ioutil.WriteFile(path, []byte(`{"*": {"TelePeriod 60": 1}}`), 0644))
+	_, err = loadPatch(path)
+	assert.NotNil(err)
+	_, err = loadPatch(filepath.Join(t.TempDir(), "missing.json"))
+	assert.NotNil(err)
+}
+
+func Test_settingsPatch_forDevice(t *testing.T) {
+	p := settingsPatch{
+		"*":        {"TelePeriod": "60", "PowerOnState": "1"},
+		"plug":     {"PowerOnState": "3"},
+		"10.0.0.1": {"TelePeriod": "10"},
+	}
+	assert.Equal(t, map[string]string{"TelePeriod": "10", "PowerOnState": "3"}, p.forDevice(tasmoDevice{Name: "plug", IP: net.IPv4(10, 0, 0, 1)}))
+	assert.Equal(t, map[string]string{"TelePeriod": "60", "PowerOnState": "1"}, p.forDevice(tasmoDevice{Name: "lamp", IP: net.IPv4(10, 0, 0, 2)}))
+}
+
+func Test_runPatch(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	fake := fakeDevices(t, map[string]map[string]string{
+		"10.0.0.1": {"TelePeriod": `{"TelePeriod":300}`, "PowerOnState": `{"PowerOnState":3}`},
+		"10.0.0.2": {"TelePeriod": `{"TelePeriod":60}`, "PowerOnState": `{"PowerOnState":1}`},
+	})
+	devices := []tasmoDevice{{Name: "plug", IP: net.IPv4(10, 0, 0, 1)}, {Name: "lamp", IP: net.IPv4(10, 0, 0, 2)}}
+	p := settingsPatch{"*": {"TelePeriod": "60", "PowerOnState": "1"}}
+	inv, _ := loadInventory("")
+
+	// with dry run only the Backlog is shown
+	report := runPatch(context.Background(), p, devices, inv, false)
+	assert.Equal("Backlog PowerOnState 1; TelePeriod 60", report.Results[0].Command)
+	assert.Equal("would change PowerOnState, TelePeriod", report.Results[0].Output)
+	assert.Empty(report.Results[1].Command)
+	assert.Equal("up to date", report.Results[1].Output)
+	assert.NotContains(fake.Commands, "10.0.0.1: Backlog PowerOnState 1; TelePeriod 60")
+
+	report = runPatch(context.Background(), p, devices, inv, true)
+	assert.Equal(2, report.Succeeded)
+	assert.Equal("changed PowerOnState, TelePeriod", report.Results[0].Output)
+	assert.Contains(fake.Commands, "10.0.0.1: Backlog PowerOnState 1; TelePeriod 60")
+	for _, command := range fake.Commands {
+		assert.NotContains(command, "10.0.0.2: Backlog")
+	}
+
+	// protected devices are only reported
+	viper.Set("readonly", true)
+	report = runPatch(context.Background(), p, devices, inv, true)
+	assert.Equal(1, report.Failed)
+	assert.Equal("device may not be modified", report.Results[0].Error)
+
+	// devices without settings in the patch are left out
+	report = runPatch(context.Background(), settingsPatch{"lamp": {"TelePeriod": "60"}}, devices, inv, true)
+	assert.Len(report.Results, 1)
+	assert.Equal("lamp", report.Results[0].Name)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/merlinschumacher/tasmogo/pkg/tasmota"
+	"github.com/spf13/viper"
+	"github.com/tidwall/gjson"
+)
+
+// pingResult is the outcome of pinging a single device. State is "up", "auth failed", "timed out",
+// "unreachable" or "not tasmota". Uptime, RSSI and Heap are only known for devices that are up and
+// accepted the password.
+type pingResult struct {
+	IP      string        `json:"ip"`
+	Name    string        `json:"name"`
+	Up      bool          `json:"up"`
+	State   string        `json:"state"`
+	Latency time.Duration `json:"latency"`
+	Uptime  time.Duration `json:"uptime"`
+	RSSI    int           `json:"rssi"`
+	// Heap is the free heap in kB
+	Heap  int    `json:"heap"`
+	Err   error  `json:"-"`
+	Error string `json:"error,omitempty"`
+}
+
+// pingState describes the outcome of a ping
+func pingState(err error) string {
+	switch {
+	case err == nil:
+		return "up"
+	case errors.Is(err, tasmota.ErrUnauthorized):
+		return "auth failed"
+	case errors.Is(err, tasmota.ErrTimeout):
+		return "timed out"
+	case errors.Is(err, tasmota.ErrNotTasmota):
+		return "not tasmota"
+	}
+	return "unreachable"
+}
+
+// pingDevices asks all given devices, keyed by their IP, at once for their state with "Status 11" and
+// measures how long they take to answer. Only the uptime, Wi-Fi quality and free heap are taken from
+// the answer, the firmware isn't looked at. A device that rejects the password is up as well.
+func pingDevices(devices map[string]string, concurrency int, timeout time.Duration) []pingResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	client := newDeviceClient()
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		slots   = make(chan struct{}, concurrency)
+		results = make([]pingResult, 0, len(devices))
+	)
+	for ip, name := range devices {
+		wg.Add(1)
+		go func(ip string, name string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			start := time.Now()
+			answer, err := client.Command(ctx, ip, "Status 11")
+			result := pingResult{IP: ip, Name: name, Latency: time.Since(start), Err: err, State: pingState(err)}
+			result.Up = err == nil || errors.Is(err, tasmota.ErrUnauthorized)
+			if err != nil {
+				result.Error = err.Error()
+			}
+			if err == nil {
+				status := gjson.Get(answer, "StatusSTS")
+				result.Uptime = time.Duration(status.Get("UptimeSec").Int()) * time.Second
+				result.RSSI = int(status.Get("Wifi.RSSI").Int())
+				result.Heap = int(status.Get("Heap").Int())
+			}
+			mu.Lock()
+			results = append(results, result)
+			mu.Unlock()
+		}(ip, name)
+	}
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool {
+		return bytes.Compare(net.ParseIP(results[i].IP).To16(), net.ParseIP(results[j].IP).To16()) < 0
+	})
+	return results
+}
+
+// pingInventory pings all devices of the inventory
+func pingInventory(inv *inventory, timeout time.Duration) []pingResult {
+	devices := make(map[string]string, len(inv.Devices))
+	for ip, rec := range inv.Devices {
+		devices[ip] = rec.Name
+	}
+	return pingDevices(devices, viper.GetInt("concurrency"), timeout)
+}
+
+// renderPingResults generates the results as JSON or CSV if TASMOGO_OUTPUT asks for it, otherwise as
+// a table with the state, latency and health of every device
+func renderPingResults(results []pingResult) (string, error) {
+	switch viper.GetString("output") {
+	case "json":
+		data, err := json.MarshalIndent(results, "", "  ")
+		return string(data), err
+	case "csv":
+		var buf bytes.Buffer
+		out := csv.NewWriter(&buf)
+		out.Write([]string{"ip", "name", "up", "state", "latency", "uptime", "rssi", "heap"})
+		for _, r := range results {
+			out.Write([]string{r.IP, r.Name, strconv.FormatBool(r.Up), r.State, strconv.FormatInt(r.Latency.Milliseconds(), 10), strconv.FormatInt(int64(r.Uptime/time.Second), 10), strconv.Itoa(r.RSSI), strconv.Itoa(r.Heap)})
+		}
+		out.Flush()
+		return strings.TrimSuffix(buf.String(), "\n"), out.Error()
+	}
+	t := table.NewWriter()
+	t.AppendHeader(table.Row{"IP", "Name", "State", "Latency", "Uptime", "RSSI", "Heap"})
+	for _, result := range results {
+		if !result.Up {
+			t.AppendRow(table.Row{result.IP, result.Name, result.State, "-", "", "", ""})
+			continue
+		}
+		latency := strconv.FormatInt(result.Latency.Milliseconds(), 10) + "ms"
+		if result.State != "up" {
+			t.AppendRow(table.Row{result.IP, result.Name, result.State, latency, "", "", ""})
+			continue
+		}
+		t.AppendRow(table.Row{result.IP, result.Name, result.State, latency, formatUptime(result.Uptime), strconv.Itoa(result.RSSI) + "%", strconv.Itoa(result.Heap) + "k"})
+	}
+	if viper.GetString("output") == "markdown" {
+		return t.RenderMarkdown(), nil
+	}
+	return t.Render(), nil
+}
+
+// pingTimeout is how long a health check waits for each device, unless "tasmogo ping" is told otherwise
+const pingTimeout = 2 * time.Second
+
+// checkHealth pings the devices of the inventory and writes the results to TASMOGO_HEALTHMETRICSFILE
+func checkHealth(now time.Time) {
+	inv, err := loadInventory(viper.GetString("inventory"))
+	if err != nil {
+		logWarn("Loading the inventory failed: " + err.Error())
+		return
+	}
+	results := pingInventory(inv, pingTimeout)
+	down := 0
+	for _, result := range results {
+		if !result.Up {
+			down++
+		}
+	}
+	logDebug("Health check: " + strconv.Itoa(len(results)-down) + " devices up, " + strconv.Itoa(down) + " down")
+	if path := viper.GetString("healthmetricsfile"); path != "" {
+		if err := replaceFile(path, []byte(renderHealthMetrics(results, now))); err != nil {
+			logWarn("Writing the health metrics failed: " + err.Error())
+		}
+	}
+}
+
+// watchHealth checks the health of the known devices every TASMOGO_HEALTHINTERVAL between the scans of
+// the daemon until ctx is cancelled
+func watchHealth(ctx context.Context, interval time.Duration) {
+	logInfo("Checking the health of the devices every " + interval.String())
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		checkHealth(time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
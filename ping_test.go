@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_pingDevices(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	fake := fakeDevices(t, map[string]map[string]string{
+		"10.0.0.10": {"Status 11": `{"StatusSTS":{"UptimeSec":3723,"Heap":25,"Wifi":{"RSSI":80}}}`},
+		"10.0.0.2":  {},
+		"10.0.0.4":  {},
+	})
+	fake.Unauthorized = map[string]bool{"10.0.0.4": true}
+	results := pingDevices(map[string]string{"10.0.0.10": "lamp", "10.0.0.2": "plug", "10.0.0.3": "gone", "10.0.0.4": "locked"}, 2, time.Second)
+	assert.Len(results, 4)
+	assert.Equal("10.0.0.2", results[0].IP)
+	assert.True(results[0].Up)
+	assert.False(results[1].Up)
+	assert.Equal("unreachable", results[1].State)
+	assert.True(results[2].Up)
+	assert.Equal("auth failed", results[2].State)
+	assert.Equal("10.0.0.10", results[3].IP)
+	assert.Equal("up", results[3].State)
+	assert.Equal(3723*time.Second, results[3].Uptime)
+	assert.Equal(80, results[3].RSSI)
+	assert.Equal(25, results[3].Heap)
+	assert.Len(fake.Commands, 4)
+	assert.Contains(fake.Commands, "10.0.0.10: Status 11")
+
+	table, err := renderPingResults(results)
+	assert.Nil(err)
+	assert.Contains(table, "gone")
+	assert.Contains(table, "unreachable")
+	assert.Contains(table, "0d 01:02")
+
+	viper.Set("output", "csv")
+	csv, err := renderPingResults(results)
+	assert.Nil(err)
+	assert.Equal("ip,name,up,state,latency,uptime,rssi,heap", strings.Split(csv, "\n")[0])
+	assert.Contains(csv, "10.0.0.10,lamp,true,up,")
+	viper.Set("output", "json")
+	out, err := renderPingResults(results)
+	assert.Nil(err)
+	assert.Contains(out, `"state": "auth failed"`)
+}
+
+func Test_checkHealth(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	dir := t.TempDir()
+	inv := &inventory{Devices: map[string]*inventoryRecord{"10.0.0.1": {Name: "plug"}, "10.0.0.2": {Name: "gone"}}}
+	viper.Set("inventory", filepath.Join(dir, "inventory.json"))
+	assert.Nil(inv.save(viper.GetString("inventory")))
+	fakeDevices(t, map[string]map[string]string{"10.0.0.1": {}})
+	path := filepath.Join(dir, "health.prom")
+	viper.Set("healthmetricsfile", path)
+	checkHealth(time.Unix(1600000000, 0))
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+	assert.Contains(string(data), `tasmogo_health_up{ip="10.0.0.1",name="plug"} 1`)
+	assert.Contains(string(data), `tasmogo_health_up{ip="10.0.0.2",name="gone"} 0`)
+}
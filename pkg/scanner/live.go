@@ -0,0 +1,189 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// arpTable is where Linux lists the entries of the ARP table
+const arpTable = "/proc/net/arp"
+
+// arpComplete is the flag of the ARP entries whose hardware address is known
+const arpComplete = 0x2
+
+// Ping sends an ICMP echo request to every IPv4 address, one every interval, and returns the addresses
+// that answered within wait after the last request. Other addresses are ignored. It uses an
+// unprivileged ICMP socket where the system allows it and a raw socket otherwise.
+func Ping(ctx context.Context, ips []net.IP, interval time.Duration, wait time.Duration) ([]net.IP, error) {
+	conn, raw, err := listenICMP()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// closing the socket ends the reading when the scan is stopped
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	wanted := make(map[string]bool)
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			wanted[ip.To4().String()] = true
+		}
+	}
+	id := os.Getpid() & 0xffff
+	var mu sync.Mutex
+	alive := make([]net.IP, 0)
+	seen := make(map[string]bool)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 1500)
+		for {
+			n, peer, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			ip, ok := echoReply(buf[:n], peer, raw, id)
+			if !ok || !wanted[ip.String()] {
+				continue
+			}
+			mu.Lock()
+			if !seen[ip.String()] {
+				seen[ip.String()] = true
+				alive = append(alive, ip)
+			}
+			mu.Unlock()
+		}
+	}()
+
+	for seq, ip := range ips {
+		if ip.To4() == nil {
+			continue
+		}
+		if seq > 0 && interval > 0 && !sleep(ctx, interval) {
+			break
+		}
+		msg := icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: id, Seq: seq & 0xffff, Data: []byte("tasmogo")}}
+		data, err := msg.Marshal(nil)
+		if err != nil {
+			return nil, err
+		}
+		var dst net.Addr = &net.UDPAddr{IP: ip.To4()}
+		if raw {
+			dst = &net.IPAddr{IP: ip.To4()}
+		}
+		// unreachable hosts are the ones the sweep is looking for, not an error
+		_, _ = conn.WriteTo(data, dst)
+	}
+	if ctx.Err() != nil {
+		<-done
+		return nil, ctx.Err()
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(wait)); err != nil {
+		return nil, err
+	}
+	<-done
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return alive, nil
+}
+
+// listenICMP opens an unprivileged ICMP socket or, if the system doesn't allow them, a raw one. The
+// second return value tells if the socket is raw.
+func listenICMP() (*icmp.PacketConn, bool, error) {
+	conn, err := icmp.ListenPacket("udp4", "0.0.0.0")
+	if err == nil {
+		return conn, false, nil
+	}
+	conn, rawErr := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if rawErr != nil {
+		return nil, false, errors.New("Opening an ICMP socket failed, allow unprivileged pings with net.ipv4.ping_group_range or grant CAP_NET_RAW: " + err.Error())
+	}
+	return conn, true, nil
+}
+
+// echoReply returns the sender of an ICMP echo reply. Raw sockets receive the replies to every program,
+// so the ID has to match, unprivileged sockets only get their own.
+func echoReply(data []byte, peer net.Addr, raw bool, id int) (net.IP, bool) {
+	msg, err := icmp.ParseMessage(1, data)
+	if err != nil || msg.Type != ipv4.ICMPTypeEchoReply {
+		return nil, false
+	}
+	echo, ok := msg.Body.(*icmp.Echo)
+	if !ok || (raw && echo.ID != id) {
+		return nil, false
+	}
+	switch addr := peer.(type) {
+	case *net.UDPAddr:
+		return addr.IP.To4(), addr.IP.To4() != nil
+	case *net.IPAddr:
+		return addr.IP.To4(), addr.IP.To4() != nil
+	}
+	return nil, false
+}
+
+// sleep waits for the given time and reports if the context is still active
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Neighbors returns the IPv4 addresses of the system's ARP table whose hardware address is known, i.e.
+// the hosts it recently talked to. Only Linux is supported.
+func Neighbors() ([]net.IP, error) {
+	f, err := os.Open(arpTable)
+	if err != nil {
+		return nil, errors.New("Reading the ARP table failed: " + err.Error())
+	}
+	defer f.Close()
+	return parseARPTable(f)
+}
+
+// parseARPTable reads the addresses of the complete entries of an ARP table in the format of
+// /proc/net/arp
+func parseARPTable(r io.Reader) ([]net.IP, error) {
+	ips := make([]net.IP, 0)
+	lines := bufio.NewScanner(r)
+	// the first line holds the column names
+	lines.Scan()
+	for lines.Scan() {
+		fields := strings.Fields(lines.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		flags, err := strconv.ParseInt(fields[2], 0, 64)
+		if err != nil || flags&arpComplete == 0 || ip == nil {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	return ips, lines.Err()
+}
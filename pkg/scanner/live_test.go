@@ -0,0 +1,41 @@
+package scanner
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseARPTable(t *testing.T) {
+	assert := assert.New(t)
+	table := `IP address       HW type     Flags       HW address            Mask     Device
+192.168.0.1      0x1         0x2         02:fc:00:00:00:05     *        eth0
+192.168.0.23     0x1         0x0         00:00:00:00:00:00     *        eth0
+192.168.0.42     0x1         0x6         dc:4f:22:00:12:34     *        eth0
+`
+	ips, err := parseARPTable(strings.NewReader(table))
+	assert.Nil(err)
+	assert.Equal([]net.IP{net.ParseIP("192.168.0.1"), net.ParseIP("192.168.0.42")}, ips)
+}
+
+func Test_Ping(t *testing.T) {
+	assert := assert.New(t)
+	if conn, _, err := listenICMP(); err != nil {
+		t.Skip(err.Error())
+	} else {
+		conn.Close()
+	}
+	alive, err := Ping(context.Background(), []net.IP{net.IPv4(127, 0, 0, 1), net.ParseIP("::1")}, 0, 500*time.Millisecond)
+	assert.Nil(err)
+	assert.Equal([]net.IP{net.IPv4(127, 0, 0, 1).To4()}, alive)
+
+	// a stopped scan returns right away
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Ping(ctx, []net.IP{net.IPv4(127, 0, 0, 1)}, 0, time.Hour)
+	assert.NotNil(err)
+}
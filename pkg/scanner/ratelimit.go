@@ -0,0 +1,98 @@
+package scanner
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// throttleWindow is the number of probes after which the adaptive throttling adjusts the rate
+const throttleWindow = 20
+
+// rateLimiter is a token bucket that holds a single token, so the requests are spread evenly instead of
+// being sent in bursts. With adaptive throttling the rate is halved when more than a quarter of the
+// probes of a window time out and raised again towards the configured rate when none do.
+type rateLimiter struct {
+	mu       sync.Mutex
+	max      float64
+	rate     float64
+	adaptive bool
+	tokens   float64
+	last     time.Time
+	probes   int
+	timeouts int
+}
+
+// newRateLimiter creates a limiter for the given number of requests per second
+func newRateLimiter(rate float64, adaptive bool) *rateLimiter {
+	return &rateLimiter{max: rate, rate: rate, adaptive: adaptive, tokens: 1}
+}
+
+// reserve takes a token and returns how long to wait until it is available
+func (l *rateLimiter) reserve(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > 1 {
+			l.tokens = 1
+		}
+	}
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// wait blocks until the next request may be sent or the context is done
+func (l *rateLimiter) wait(ctx context.Context) error {
+	delay := l.reserve(time.Now())
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// record counts the outcome of a probe for the adaptive throttling. It returns the new rate and whether
+// it changed.
+func (l *rateLimiter) record(timedOut bool) (float64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.adaptive {
+		return l.rate, false
+	}
+	l.probes++
+	if timedOut {
+		l.timeouts++
+	}
+	if l.probes < throttleWindow {
+		return l.rate, false
+	}
+	rate := l.rate
+	switch {
+	case l.timeouts*4 > l.probes:
+		// never go below a tenth of the configured rate, so the scan still finishes
+		rate = l.rate / 2
+		if rate < l.max/10 {
+			rate = l.max / 10
+		}
+	case l.timeouts == 0:
+		rate = l.rate * 1.25
+		if rate > l.max {
+			rate = l.max
+		}
+	}
+	l.probes, l.timeouts = 0, 0
+	changed := rate != l.rate
+	l.rate = rate
+	return rate, changed
+}
@@ -0,0 +1,71 @@
+package scanner
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/merlinschumacher/tasmogo/pkg/tasmota/tasmotatest"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_rateLimiter_reserve(t *testing.T) {
+	assert := assert.New(t)
+	l := newRateLimiter(10, false)
+	now := time.Date(2021, 3, 8, 12, 0, 0, 0, time.UTC)
+	assert.Equal(time.Duration(0), l.reserve(now))
+	// the requests are spread evenly instead of sent in bursts
+	assert.Equal(100*time.Millisecond, l.reserve(now))
+	assert.Equal(200*time.Millisecond, l.reserve(now))
+	assert.Equal(100*time.Millisecond, l.reserve(now.Add(200*time.Millisecond)))
+	// a pause doesn't save up tokens for a burst
+	assert.Equal(time.Duration(0), l.reserve(now.Add(time.Minute)))
+	assert.Equal(100*time.Millisecond, l.reserve(now.Add(time.Minute)))
+}
+
+func Test_rateLimiter_record(t *testing.T) {
+	assert := assert.New(t)
+	l := newRateLimiter(100, true)
+	record := func(timeouts int) (float64, bool) {
+		var rate float64
+		var changed bool
+		for i := 0; i < throttleWindow; i++ {
+			rate, changed = l.record(i < timeouts)
+		}
+		return rate, changed
+	}
+	rate, changed := record(10)
+	assert.True(changed)
+	assert.Equal(50.0, rate)
+	// a few timeouts keep the rate
+	rate, changed = record(2)
+	assert.False(changed)
+	assert.Equal(50.0, rate)
+	for i := 0; i < 10; i++ {
+		rate, _ = record(20)
+	}
+	assert.Equal(10.0, rate)
+	// the rate recovers up to the configured one
+	for i := 0; i < 20; i++ {
+		rate, _ = record(0)
+	}
+	assert.Equal(100.0, rate)
+
+	// without adaptive throttling the rate stays
+	l = newRateLimiter(100, false)
+	rate, changed = record(20)
+	assert.False(changed)
+	assert.Equal(100.0, rate)
+}
+
+func Test_WithRateLimit(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(New(WithRateLimit(0, true)).limiter)
+
+	client := tasmotatest.NewClient(map[string]map[string]string{})
+	s := New(WithClient(client), WithRateLimit(50, false))
+	start := time.Now()
+	s.Scan(context.Background(), addresses(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")))
+	assert.GreaterOrEqual(time.Since(start), 40*time.Millisecond)
+}
@@ -0,0 +1,197 @@
+// Package scanner finds Tasmota devices by asking a list of addresses for their status.
+package scanner
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/merlinschumacher/tasmogo/pkg/tasmota"
+)
+
+// Device is a Tasmota device found by a scan
+type Device struct {
+	IP      net.IP
+	Status  tasmota.Status
+	Latency time.Duration
+}
+
+// Scanner probes addresses concurrently. It is safe for concurrent use.
+type Scanner struct {
+	client      tasmota.DeviceClient
+	concurrency int
+	timeout     time.Duration
+	retries     int
+	backoff     time.Duration
+	limiter     *rateLimiter
+	logger      *log.Logger
+	progress    func()
+	failed      func(ip net.IP, err error)
+}
+
+// Option configures a Scanner
+type Option func(*Scanner)
+
+// WithClient sets the client used to ask the devices, e.g. to provide their passwords
+func WithClient(client tasmota.DeviceClient) Option {
+	return func(s *Scanner) {
+		s.client = client
+	}
+}
+
+// WithConcurrency sets how many addresses are probed at the same time
+func WithConcurrency(concurrency int) Option {
+	return func(s *Scanner) {
+		if concurrency < 1 {
+			concurrency = 1
+		}
+		s.concurrency = concurrency
+	}
+}
+
+// WithTimeout limits how long to wait for the answer of a single address, 0 waits without a limit
+func WithTimeout(timeout time.Duration) Option {
+	return func(s *Scanner) {
+		s.timeout = timeout
+	}
+}
+
+// WithRetries probes addresses that timed out or sent a garbled answer again, up to retries times.
+// The pause before a retry starts at backoff and doubles with every attempt.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(s *Scanner) {
+		s.retries = retries
+		s.backoff = backoff
+	}
+}
+
+// WithRateLimit limits the requests of the scan to the given number per second, 0 doesn't limit them.
+// With adaptive set, the rate is lowered while many probes time out and raised again once they answer.
+func WithRateLimit(requestsPerSecond float64, adaptive bool) Option {
+	return func(s *Scanner) {
+		s.limiter = nil
+		if requestsPerSecond > 0 {
+			s.limiter = newRateLimiter(requestsPerSecond, adaptive)
+		}
+	}
+}
+
+// WithLogger sets a logger for the outcome of the scan. By default nothing is logged.
+func WithLogger(logger *log.Logger) Option {
+	return func(s *Scanner) {
+		s.logger = logger
+	}
+}
+
+// WithProgress sets a function that is called after each probed address. It is called from
+// several goroutines at once.
+func WithProgress(progress func()) Option {
+	return func(s *Scanner) {
+		s.progress = progress
+	}
+}
+
+// WithFailures sets a function that is called with every address that could not be probed and the
+// reason. It is called from several goroutines at once.
+func WithFailures(failed func(ip net.IP, err error)) Option {
+	return func(s *Scanner) {
+		s.failed = failed
+	}
+}
+
+// New creates a scanner with the given options. Without options it probes 256 addresses at once
+// with a timeout of 10 seconds each and no retries.
+func New(opts ...Option) *Scanner {
+	s := &Scanner{
+		client:      tasmota.NewClient(),
+		concurrency: 256,
+		timeout:     10 * time.Second,
+		logger:      log.New(ioutil.Discard, "", 0),
+		progress:    func() {},
+		failed:      func(net.IP, error) {},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Scan probes every address received from the channel until it is closed and returns the Tasmota
+// devices among them. Once the context is done, the remaining addresses are skipped.
+func (s *Scanner) Scan(ctx context.Context, addresses <-chan net.IP) []Device {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		devices = make([]Device, 0)
+	)
+	for w := 0; w < s.concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ip := range addresses {
+				device, err := s.Probe(ctx, ip)
+				switch {
+				case err == nil:
+					mu.Lock()
+					devices = append(devices, device)
+					mu.Unlock()
+				case ctx.Err() == nil:
+					s.failed(ip, err)
+				}
+				s.progress()
+			}
+		}()
+	}
+	wg.Wait()
+	s.logger.Printf("Scan finished, found %d devices", len(devices))
+	return devices
+}
+
+// Probe asks a single address for its status and retries transient failures
+func (s *Scanner) Probe(ctx context.Context, ip net.IP) (Device, error) {
+	delay := s.backoff
+	for attempt := 0; ; attempt++ {
+		device, err := s.probeOnce(ctx, ip)
+		if err == nil || attempt >= s.retries || !tasmota.Transient(err) {
+			return device, err
+		}
+		s.logger.Printf("Probing %s failed, retrying in %s: %s", ip, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return device, err
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// probeOnce asks a single address for its status
+func (s *Scanner) probeOnce(ctx context.Context, ip net.IP) (Device, error) {
+	if err := ctx.Err(); err != nil {
+		return Device{}, err
+	}
+	if s.limiter != nil {
+		if err := s.limiter.wait(ctx); err != nil {
+			return Device{}, err
+		}
+	}
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	status, err := s.client.Status(ctx, ip.String())
+	if s.limiter != nil {
+		if rate, changed := s.limiter.record(errors.Is(err, tasmota.ErrTimeout)); changed {
+			s.logger.Printf("Throttling the scan to %.1f requests per second", rate)
+		}
+	}
+	return Device{IP: ip, Status: status, Latency: time.Since(start)}, err
+}
@@ -0,0 +1,101 @@
+package scanner
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/merlinschumacher/tasmogo/pkg/tasmota"
+	"github.com/merlinschumacher/tasmogo/pkg/tasmota/tasmotatest"
+	"github.com/stretchr/testify/assert"
+)
+
+// addresses sends the given IPs through a channel
+func addresses(ips ...net.IP) <-chan net.IP {
+	ch := make(chan net.IP, len(ips))
+	for _, ip := range ips {
+		ch <- ip
+	}
+	close(ch)
+	return ch
+}
+
+func Test_New(t *testing.T) {
+	s := New(WithConcurrency(0))
+	assert.Equal(t, 1, s.concurrency)
+}
+
+func Test_Scan(t *testing.T) {
+	assert := assert.New(t)
+	client := tasmotatest.NewClient(map[string]map[string]string{
+		"10.0.0.1": {"Status 0": `{"StatusFWR": {"Version": "9.1.0(tasmota)"}}`},
+		"10.0.0.2": {"Status 0": `{"foo": "bar"}`},
+	})
+	var probed int32
+	s := New(WithClient(client), WithConcurrency(2), WithProgress(func() { atomic.AddInt32(&probed, 1) }))
+	devices := s.Scan(context.Background(), addresses(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")))
+	assert.Len(devices, 1)
+	assert.Equal("10.0.0.1", devices[0].IP.String())
+	assert.Equal("9.1.0", devices[0].Status.Version)
+	assert.Equal(int32(3), probed)
+
+	// the addresses that could not be probed are reported with the reason
+	var mu sync.Mutex
+	failed := make(map[string]error)
+	s = New(WithClient(client), WithFailures(func(ip net.IP, err error) {
+		mu.Lock()
+		failed[ip.String()] = err
+		mu.Unlock()
+	}))
+	s.Scan(context.Background(), addresses(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")))
+	assert.Len(failed, 2)
+	assert.ErrorIs(failed["10.0.0.2"], tasmota.ErrNotTasmota)
+	assert.ErrorIs(failed["10.0.0.3"], tasmota.ErrUnreachable)
+
+	// a cancelled scan skips all addresses
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Empty(s.Scan(ctx, addresses(net.ParseIP("10.0.0.1"))))
+}
+
+// flakyClient times out on the first requests for the status of a device
+type flakyClient struct {
+	*tasmotatest.Client
+	failures int32
+	calls    int32
+}
+
+func (c *flakyClient) Status(ctx context.Context, host string) (tasmota.Status, error) {
+	if atomic.AddInt32(&c.calls, 1) <= c.failures {
+		return tasmota.Status{}, &tasmota.DeviceError{Host: host, Command: "Status 0", Kind: tasmota.ErrTimeout}
+	}
+	return c.Client.Status(ctx, host)
+}
+
+func Test_Probe(t *testing.T) {
+	assert := assert.New(t)
+	devices := map[string]map[string]string{
+		"10.0.0.1": {"Status 0": `{"StatusFWR": {"Version": "9.1.0(tasmota)"}}`},
+		"10.0.0.2": {"Status 0": `{"foo": "bar"}`},
+	}
+	client := &flakyClient{Client: tasmotatest.NewClient(devices), failures: 2}
+	device, err := New(WithClient(client), WithRetries(2, time.Millisecond)).Probe(context.Background(), net.ParseIP("10.0.0.1"))
+	assert.Nil(err)
+	assert.Equal("9.1.0", device.Status.Version)
+	assert.Equal(int32(3), client.calls)
+
+	// without enough retries the timeout is reported
+	client = &flakyClient{Client: tasmotatest.NewClient(devices), failures: 2}
+	_, err = New(WithClient(client), WithRetries(1, time.Millisecond)).Probe(context.Background(), net.ParseIP("10.0.0.1"))
+	assert.ErrorIs(err, tasmota.ErrTimeout)
+	assert.Equal(int32(2), client.calls)
+
+	// hosts that answered, but aren't Tasmota devices, are not asked again
+	client = &flakyClient{Client: tasmotatest.NewClient(devices)}
+	_, err = New(WithClient(client), WithRetries(2, time.Millisecond)).Probe(context.Background(), net.ParseIP("10.0.0.2"))
+	assert.ErrorIs(err, tasmota.ErrNotTasmota)
+	assert.Equal(int32(1), client.calls)
+}
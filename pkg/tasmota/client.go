@@ -0,0 +1,134 @@
+package tasmota
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Credentials returns the web password of a device
+type Credentials func(host string) string
+
+// Endpoint returns the scheme and port of the web server of a device, e.g. "https" and "8443" for a
+// device with the TLS web server. An empty port is the default port of the scheme.
+type Endpoint func(host string) (scheme string, port string)
+
+// BasicAuth returns the user and password of the HTTP basic authentication in front of a device, e.g.
+// of an authenticating reverse proxy. ok is false for devices reached without it.
+type BasicAuth func(host string) (user string, password string, ok bool)
+
+// DeviceClient sends requests to Tasmota devices. It is implemented by Client and can be replaced
+// by a fake like the one of package tasmotatest, so code using it can be tested without devices.
+type DeviceClient interface {
+	// Command executes a console command and returns its JSON answer
+	Command(ctx context.Context, host string, command string) (string, error)
+	// Status requests the status of a device
+	Status(ctx context.Context, host string) (Status, error)
+	// Upgrade sets the OTA URL of a device and starts the upgrade
+	Upgrade(ctx context.Context, host string, otaURL string) error
+}
+
+// Client sends requests to Tasmota devices. It is safe for concurrent use.
+type Client struct {
+	http        *http.Client
+	timeout     time.Duration
+	credentials Credentials
+	endpoint    Endpoint
+	basicAuth   BasicAuth
+	logger      *log.Logger
+	header      http.Header
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithTimeout limits how long a single request may take. The context passed to the requests can
+// shorten it further.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithHTTPClient sets the HTTP client used for the requests, e.g. to use a custom transport
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) {
+		c.http = client
+	}
+}
+
+// WithCredentials sets a function that provides the password of each device
+func WithCredentials(credentials Credentials) Option {
+	return func(c *Client) {
+		c.credentials = credentials
+	}
+}
+
+// WithEndpoint sets a function that provides the scheme and port of each device. By default all
+// devices are reached via HTTP on port 80.
+func WithEndpoint(endpoint Endpoint) Option {
+	return func(c *Client) {
+		c.endpoint = endpoint
+	}
+}
+
+// WithBasicAuth sets a function that provides the basic authentication of each device. It is sent at
+// the HTTP level in addition to the password of the device, which is part of the query.
+func WithBasicAuth(auth BasicAuth) Option {
+	return func(c *Client) {
+		c.basicAuth = auth
+	}
+}
+
+// WithPassword uses the same password for all devices
+func WithPassword(password string) Option {
+	return WithCredentials(func(string) string {
+		return password
+	})
+}
+
+// WithHeader adds the given header fields to every request, e.g. an identifying User-Agent or the
+// credentials of a reverse proxy in front of the devices
+func WithHeader(header http.Header) Option {
+	return func(c *Client) {
+		for key, values := range header {
+			for _, value := range values {
+				c.header.Add(key, value)
+			}
+		}
+	}
+}
+
+// WithLogger sets a logger for the requests sent to the devices. By default nothing is logged.
+func WithLogger(logger *log.Logger) Option {
+	return func(c *Client) {
+		c.logger = logger
+	}
+}
+
+// NewClient creates a client with the given options. Without options it sends requests without a
+// password and gives up after 10 seconds.
+func NewClient(opts ...Option) *Client {
+	c := &Client{
+		http:    &http.Client{},
+		timeout: 10 * time.Second,
+		logger:  log.New(ioutil.Discard, "", 0),
+		header:  make(http.Header),
+	}
+	WithPassword("")(c)
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// baseURL returns the URL of the web server of a device
+func (c *Client) baseURL(host string) string {
+	if c.endpoint == nil {
+		return BaseURL(host)
+	}
+	scheme, port := c.endpoint(host)
+	return DeviceURL(scheme, host, port)
+}
@@ -0,0 +1,114 @@
+package tasmota
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NewClient(t *testing.T) {
+	assert := assert.New(t)
+	c := NewClient()
+	assert.Equal(10*time.Second, c.timeout)
+	assert.Equal("", c.credentials("10.0.0.1"))
+
+	var buf bytes.Buffer
+	c = NewClient(WithTimeout(time.Second), WithPassword("secret"), WithLogger(log.New(&buf, "", 0)))
+	assert.Equal(time.Second, c.timeout)
+	assert.Equal("secret", c.credentials("10.0.0.1"))
+}
+
+func Test_WithCredentials(t *testing.T) {
+	assert := assert.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("password") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{}`)
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	var buf bytes.Buffer
+	c := NewClient(WithLogger(log.New(&buf, "", 0)), WithCredentials(func(h string) string {
+		if h == host {
+			return "secret"
+		}
+		return ""
+	}))
+	_, err := c.Command(context.Background(), host, "Power")
+	assert.Nil(err)
+	assert.Contains(buf.String(), "Sending \"Power\" to "+host)
+
+	_, err = NewClient(WithPassword("wrong")).Command(context.Background(), host, "Power")
+	assert.ErrorIs(err, ErrUnauthorized)
+}
+
+func Test_WithEndpoint(t *testing.T) {
+	assert := assert.New(t)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{}`)
+	}))
+	defer srv.Close()
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(srv.URL, "https://"))
+	c := NewClient(WithHTTPClient(srv.Client()), WithEndpoint(func(h string) (string, string) {
+		return "https", port
+	}))
+	_, err := c.Command(context.Background(), host, "Power")
+	assert.Nil(err)
+
+	// plain HTTP is refused by the TLS web server
+	_, err = NewClient(WithHTTPClient(srv.Client())).Command(context.Background(), host+":"+port, "Power")
+	assert.NotNil(err)
+}
+
+func Test_WithHeader(t *testing.T) {
+	assert := assert.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"UserAgent": %q, "Proxy": %q}`, r.UserAgent(), r.Header.Get("X-Proxy-Token"))
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	header := http.Header{}
+	header.Set("User-Agent", "tasmogo/1.0")
+	header.Set("X-Proxy-Token", "secret")
+	response, err := NewClient(WithHeader(header)).Command(context.Background(), host, "Power")
+	assert.Nil(err)
+	assert.Equal(`{"UserAgent": "tasmogo/1.0", "Proxy": "secret"}`, response)
+}
+
+func Test_WithBasicAuth(t *testing.T) {
+	assert := assert.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"User": %q, "Password": %q, "WebPassword": %q}`, user, password, r.URL.Query().Get("password"))
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	c := NewClient(WithPassword("secret"), WithBasicAuth(func(h string) (string, string, bool) {
+		return "proxy", "pass", h == host
+	}))
+	response, err := c.Command(context.Background(), host, "Power")
+	assert.Nil(err)
+	assert.Equal(`{"User": "proxy", "Password": "pass", "WebPassword": "secret"}`, response)
+
+	_, err = NewClient().Command(context.Background(), host, "Power")
+	assert.True(errors.Is(err, ErrUnauthorized))
+}
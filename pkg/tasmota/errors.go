@@ -0,0 +1,51 @@
+package tasmota
+
+import "errors"
+
+// The errors of this package wrap one of these values, so the reason of a failure can be told apart
+// with errors.Is instead of matching the message.
+var (
+	// ErrUnauthorized means the device rejected the password
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrNotTasmota means the host answered, but not like a Tasmota device does
+	ErrNotTasmota = errors.New("not a Tasmota device")
+	// ErrTimeout means the device did not answer in time
+	ErrTimeout = errors.New("timeout")
+	// ErrParse means the answer of the device could not be understood
+	ErrParse = errors.New("unparsable response")
+	// ErrUnreachable means the connection to the host failed
+	ErrUnreachable = errors.New("unreachable")
+)
+
+// Transient reports if a failed request may succeed when it is repeated: the device didn't answer in
+// time or its answer was cut off. A host that answered like no Tasmota device does won't change its mind.
+func Transient(err error) bool {
+	return errors.Is(err, ErrTimeout) || errors.Is(err, ErrParse)
+}
+
+// DeviceError describes a failed request to a device. Kind is one of the Err values of this package,
+// Err is the underlying error, if there is one.
+type DeviceError struct {
+	Host    string
+	Command string
+	Kind    error
+	Err     error
+}
+
+func (e *DeviceError) Error() string {
+	msg := e.Host + ": " + e.Command + ": " + e.Kind.Error()
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Is reports if the error is of the given kind
+func (e *DeviceError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Unwrap returns the underlying error
+func (e *DeviceError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,115 @@
+package tasmota
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// firmwareVersion matches the version strings of Tasmota and its forks, e.g. "9.1.0(tasmota)",
+// "13.2.0(release-tasmota32)", "8.1.0.2(sonoff-sensors)" or a plain "v9.1.0"
+var firmwareVersion = regexp.MustCompile(`^[vV]?(\d+(?:\.\d+){0,3})\s*(?:\(([^()]*)\))?$`)
+
+// variantPrefixes are put in front of the variant by some builds, but are not part of the file name
+var variantPrefixes = []string{"release-", "development-", "tasmota-"}
+
+// plainVersion matches the version numbers a pattern of a FirmwareParser may return
+var plainVersion = regexp.MustCompile(`^\d+(?:\.\d+){0,3}$`)
+
+// ParseFirmwareVersion splits a version string like "9.1.0(tasmota)" into the version and the
+// variant. The variant is normalized to the name used in the firmware files, e.g. "sensors" for
+// "release-tasmota-sensors". Versions without a variant are assumed to be the default build.
+func ParseFirmwareVersion(v string) (string, string, error) {
+	res := firmwareVersion.FindStringSubmatch(strings.TrimSpace(v))
+	if res == nil {
+		return "", "", fmt.Errorf("%w: unknown firmware version format %q", ErrParse, v)
+	}
+	return res[1], normalizeVariant(res[2]), nil
+}
+
+// normalizeVariant strips the prefixes of a variant that aren't part of the file name
+func normalizeVariant(variant string) string {
+	variant = strings.ToLower(strings.TrimSpace(variant))
+	for trimmed := true; trimmed; {
+		trimmed = false
+		for _, prefix := range variantPrefixes {
+			if strings.HasPrefix(variant, prefix) && len(variant) > len(prefix) {
+				variant = variant[len(prefix):]
+				trimmed = true
+			}
+		}
+	}
+	if variant == "" {
+		variant = "tasmota"
+	}
+	return variant
+}
+
+// FirmwareParser splits version strings like ParseFirmwareVersion, but also knows the version strings
+// of forks that look different and maps the variants of forks to the ones of Tasmota
+type FirmwareParser struct {
+	patterns []*regexp.Regexp
+	aliases  map[string]string
+}
+
+// NewFirmwareParser creates a parser that tries the given patterns if a version string isn't one of
+// Tasmota. Every pattern needs a group named "version" with a version like 9.1.0 and may have one named
+// "variant", e.g. `^(?P<version>[\d.]+)-(?P<variant>\w+)$`. The aliases map variants to the names used in
+// the firmware files, e.g. "sonoff-sensors" to "sensors".
+func NewFirmwareParser(patterns []string, aliases map[string]string) (*FirmwareParser, error) {
+	p := &FirmwareParser{aliases: make(map[string]string)}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version pattern %q: %w", pattern, err)
+		}
+		if re.SubexpIndex("version") < 0 {
+			return nil, fmt.Errorf("invalid version pattern %q: it has no group named version", pattern)
+		}
+		p.patterns = append(p.patterns, re)
+	}
+	for alias, variant := range aliases {
+		p.aliases[normalizeVariant(alias)] = normalizeVariant(variant)
+	}
+	return p, nil
+}
+
+// Parse splits a version string into the version and the variant. The version strings of Tasmota are
+// recognized first, then the patterns are tried in their order.
+func (p *FirmwareParser) Parse(v string) (string, string, error) {
+	version, variant, err := ParseFirmwareVersion(v)
+	for i := 0; err != nil && i < len(p.patterns); i++ {
+		res := p.patterns[i].FindStringSubmatch(strings.TrimSpace(v))
+		if res == nil || !plainVersion.MatchString(res[p.patterns[i].SubexpIndex("version")]) {
+			continue
+		}
+		version, variant, err = res[p.patterns[i].SubexpIndex("version")], "", nil
+		if j := p.patterns[i].SubexpIndex("variant"); j >= 0 {
+			variant = res[j]
+		}
+		variant = normalizeVariant(variant)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if alias, ok := p.aliases[variant]; ok {
+		variant = alias
+	}
+	return version, variant, nil
+}
+
+// The chip families Tasmota runs on. They need different firmware files.
+const (
+	ChipESP8266 = "esp8266"
+	ChipESP32   = "esp32"
+)
+
+// ChipFamily tells the chip family of a device from the hardware reported in StatusFWR, e.g.
+// "ESP32-D0WD-V3" or "ESP8266EX". Older firmwares don't report the hardware, then the variant decides,
+// as all ESP32 builds are named "tasmota32...".
+func ChipFamily(hardware string, variant string) string {
+	if strings.HasPrefix(strings.ToUpper(hardware), "ESP32") || strings.HasPrefix(variant, "tasmota32") {
+		return ChipESP32
+	}
+	return ChipESP8266
+}
@@ -0,0 +1,96 @@
+package tasmota
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseFirmwareVersion(t *testing.T) {
+	assert := assert.New(t)
+	for v, expected := range map[string][2]string{
+		"9.1.0(tasmota)":                  {"9.1.0", "tasmota"},
+		"9.1.0(sensors)":                  {"9.1.0", "sensors"},
+		"13.2.0(release-tasmota)":         {"13.2.0", "tasmota"},
+		"13.2.0(release-tasmota32)":       {"13.2.0", "tasmota32"},
+		"13.2.0(release-tasmota-sensors)": {"13.2.0", "sensors"},
+		"9.1.0.2(tasmota)":                {"9.1.0.2", "tasmota"},
+		"8.1.0.2(sonoff-sensors)":         {"8.1.0.2", "sonoff-sensors"},
+		"6.7.1(Sonoff)":                   {"6.7.1", "sonoff"},
+		" 9.1.0 (lite) ":                  {"9.1.0", "lite"},
+		"v9.1.0":                          {"9.1.0", "tasmota"},
+		"9.1.0()":                         {"9.1.0", "tasmota"},
+	} {
+		version, variant, err := ParseFirmwareVersion(v)
+		assert.Nil(err, v)
+		assert.Equal(expected[0], version, v)
+		assert.Equal(expected[1], variant, v)
+	}
+	for _, v := range []string{"", "test", "(tasmota)", "9.1.0(tasmota", "9.1.0(a)(b)", "9.x(tasmota)"} {
+		version, variant, err := ParseFirmwareVersion(v)
+		assert.True(errors.Is(err, ErrParse), v)
+		assert.Empty(version)
+		assert.Empty(variant)
+	}
+}
+
+func FuzzParseFirmwareVersion(f *testing.F) {
+	for _, seed := range []string{"9.1.0(tasmota)", "13.2.0(release-tasmota32)", "8.1.0.2(sonoff-sensors)", "v9.1.0", "test", ""} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, v string) {
+		version, variant, err := ParseFirmwareVersion(v)
+		if err != nil {
+			if !errors.Is(err, ErrParse) || version != "" || variant != "" {
+				t.Fatalf("unexpected result for %q: %q, %q, %v", v, version, variant, err)
+			}
+			return
+		}
+		if version == "" || variant == "" {
+			t.Fatalf("empty version or variant for %q", v)
+		}
+		// the parsed parts have to survive another round trip
+		version2, variant2, err := ParseFirmwareVersion(version + "(" + variant + ")")
+		if err != nil || version2 != version || variant2 != variant {
+			t.Fatalf("round trip of %q failed: %q, %q, %v", v, version2, variant2, err)
+		}
+	})
+}
+
+func Test_ChipFamily(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(ChipESP32, ChipFamily("ESP32-D0WD-V3", "tasmota32"))
+	assert.Equal(ChipESP32, ChipFamily("ESP32-C3", "tasmota32c3"))
+	assert.Equal(ChipESP32, ChipFamily("", "tasmota32-bluetooth"))
+	assert.Equal(ChipESP8266, ChipFamily("ESP8266EX", "sensors"))
+	assert.Equal(ChipESP8266, ChipFamily("", "tasmota"))
+}
+
+func Test_FirmwareParser(t *testing.T) {
+	assert := assert.New(t)
+	p, err := NewFirmwareParser([]string{`^(?P<version>\d+\.\d+\.\d+)-(?P<variant>[a-z]+)-fork$`, `^Fork (?P<version>[\d.]+)$`}, map[string]string{"Sonoff-Sensors": "sensors", "de": "tasmota"})
+	assert.Nil(err)
+	for v, expected := range map[string][2]string{
+		"9.1.0(tasmota)":          {"9.1.0", "tasmota"},
+		"8.1.0.2(sonoff-sensors)": {"8.1.0.2", "sensors"},
+		"12.1.1-lite-fork":        {"12.1.1", "lite"},
+		"12.1.1-de-fork":          {"12.1.1", "tasmota"},
+		"Fork 3.2":                {"3.2", "tasmota"},
+	} {
+		version, variant, err := p.Parse(v)
+		assert.Nil(err, v)
+		assert.Equal(expected[0], version, v)
+		assert.Equal(expected[1], variant, v)
+	}
+	// the version has to be a version number, so it can be compared
+	for _, v := range []string{"Fork 3.x", "12.1.1-lite", "test"} {
+		_, _, err := p.Parse(v)
+		assert.True(errors.Is(err, ErrParse), v)
+	}
+
+	_, err = NewFirmwareParser([]string{`^(\d+)$`}, nil)
+	assert.NotNil(err)
+	_, err = NewFirmwareParser([]string{`^(?P<version>\d+`}, nil)
+	assert.NotNil(err)
+}
@@ -0,0 +1,247 @@
+// Package tasmota talks to devices running the Tasmota firmware through their HTTP command API.
+package tasmota
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// Status is the part of the answer to "Status 0" that describes the device
+type Status struct {
+	Name string
+	// FriendlyName is the first friendly name, the one of the first relay
+	FriendlyName string
+	Version      string
+	Variant      string
+	Heap         int
+	Signal       int
+	SSID         string
+	FlashSize    int
+	OtaURL       string
+	Topic        string
+	// GroupTopic is the topic the device listens to along with the other members of its group
+	GroupTopic string
+	Hostname   string
+	MAC        string
+	Hardware   string
+	Chip       string
+	// Module is the number of the configured module or template, RSSI the Wi-Fi quality in percent
+	Module int
+	Uptime time.Duration
+	RSSI   int
+	// BSSID is the MAC of the access point the device is connected to, Channel its Wi-Fi channel
+	BSSID   string
+	Channel int
+	// RestartReason is why the device restarted last, BootCount how often it has started so far
+	RestartReason string
+	BootCount     int
+	Response      string
+}
+
+// BaseURL returns the URL of the web server of a device. IPv6 addresses are put in brackets, the host
+// may also contain a port.
+func BaseURL(host string) string {
+	return DeviceURL("http", host, "")
+}
+
+// DeviceURL returns the URL of the web server of a device for the given scheme and port. An empty
+// port is the default port of the scheme, a port already contained in the host is kept.
+func DeviceURL(scheme string, host string, port string) string {
+	if scheme == "" {
+		scheme = "http"
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return scheme + "://" + host
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if port != "" {
+		return scheme + "://" + net.JoinHostPort(host, port)
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		host = "[" + host + "]"
+	}
+	return scheme + "://" + host
+}
+
+// commandQuery returns the URL query to execute a command, with the login if a password was given
+func commandQuery(password string, command string) url.Values {
+	query := url.Values{}
+	if password != "" {
+		query.Set("user", "admin")
+		query.Set("password", password)
+	}
+	query.Set("cmnd", command)
+	return query
+}
+
+// CommandURL returns the URL to execute the given console command on a device. All parameters are
+// escaped, so passwords and commands may contain any character.
+func CommandURL(host string, password string, command string) string {
+	return BaseURL(host) + CommandPath(password, command)
+}
+
+// passwordValue matches the value of a password set by a console command, like "Password1 secret", also
+// in its URL encoded form, and the password parameter of a command URL
+var passwordValue = regexp.MustCompile(`(?i)(password\d?(?:\s+|%20|\+|=))(?:[^;&"\s%]|%[0-9a-f]{2})+`)
+
+// MaskPasswords replaces the passwords set by console commands in a text, like a command, an URL or an
+// error containing them
+func MaskPasswords(text string) string {
+	return passwordValue.ReplaceAllString(text, "${1}****")
+}
+
+// CommandPath returns the path and query to execute the given console command, relative to the URL
+// of the web server of a device
+func CommandPath(password string, command string) string {
+	// spaces are written as %20, which older firmwares decode more reliably than "+"
+	return "/cm?" + strings.ReplaceAll(commandQuery(password, command).Encode(), "+", "%20")
+}
+
+// Command executes a console command on a device and returns its JSON answer
+func (c *Client) Command(ctx context.Context, host string, command string) (string, error) {
+	fail := func(kind error, err error) (string, error) {
+		return "", &DeviceError{Host: host, Command: command, Kind: kind, Err: err}
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL(host)+CommandPath(c.credentials(host), command), nil)
+	if err != nil {
+		return fail(ErrUnreachable, err)
+	}
+	for key, values := range c.header {
+		req.Header[key] = values
+	}
+	if c.basicAuth != nil {
+		if user, password, ok := c.basicAuth(host); ok {
+			req.SetBasicAuth(user, password)
+		}
+	}
+	// the debug log mustn't show the passwords set by a command
+	shown := MaskPasswords(command)
+	c.logger.Println("Sending \"" + shown + "\" to " + host)
+	res, err := c.http.Do(req)
+	if err != nil {
+		c.logger.Println("Sending \"" + shown + "\" to " + host + " failed: " + MaskPasswords(err.Error()))
+		return fail(networkErrorKind(err), err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		c.logger.Println("Reading the answer of " + host + " failed: " + err.Error())
+		return fail(networkErrorKind(err), err)
+	}
+	c.logger.Println("Answer of " + host + " to \"" + shown + "\": " + res.Status + " " + string(body))
+	switch {
+	case res.StatusCode == http.StatusUnauthorized:
+		return fail(ErrUnauthorized, nil)
+	case res.StatusCode != http.StatusOK:
+		return fail(ErrNotTasmota, errors.New("HTTP status "+res.Status))
+	case !gjson.ValidBytes(body):
+		return fail(ErrNotTasmota, errors.New("answer is no JSON"))
+	// older firmwares answer with status 200 and a warning if the password is wrong
+	case strings.HasPrefix(gjson.GetBytes(body, "WARNING").String(), "Need user="):
+		return fail(ErrUnauthorized, nil)
+	}
+	return string(body), nil
+}
+
+// networkErrorKind tells timeouts apart from other failed connections
+func networkErrorKind(err error) error {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return ErrTimeout
+	}
+	return ErrUnreachable
+}
+
+// Status requests the status of a device
+func (c *Client) Status(ctx context.Context, host string) (Status, error) {
+	response, err := c.Command(ctx, host, "Status 0")
+	if err != nil {
+		return Status{}, err
+	}
+	return ParseStatus(host, response)
+}
+
+// ParseStatus reads the answer of a device to "Status 0"
+func ParseStatus(host string, response string) (Status, error) {
+	var status Status
+	fw := gjson.Get(response, "StatusFWR.Version")
+	if !fw.Exists() {
+		return status, &DeviceError{Host: host, Command: "Status 0", Kind: ErrNotTasmota}
+	}
+	var err error
+	status.Version, status.Variant, err = ParseFirmwareVersion(fw.String())
+	if err != nil {
+		// a device with an unknown version format is still a device, it just can't be updated
+		status.Version, status.Variant = fw.String(), ""
+	}
+	status.Name = gjson.Get(response, "Status.DeviceName").String()
+	status.FriendlyName = gjson.Get(response, "Status.FriendlyName.0").String()
+	status.Heap = int(gjson.Get(response, "StatusSTS.Heap").Int())
+	status.Signal = int(gjson.Get(response, "StatusSTS.Wifi.Signal").Int())
+	status.RSSI = int(gjson.Get(response, "StatusSTS.Wifi.RSSI").Int())
+	status.BSSID = strings.ToUpper(gjson.Get(response, "StatusSTS.Wifi.BSSId").String())
+	status.Channel = int(gjson.Get(response, "StatusSTS.Wifi.Channel").Int())
+	status.Module = int(gjson.Get(response, "Status.Module").Int())
+	status.Uptime = parseUptime(response)
+	status.SSID = gjson.Get(response, "StatusSTS.Wifi.SSId").String()
+	status.FlashSize = int(gjson.Get(response, "StatusMEM.FlashSize").Int())
+	status.OtaURL = gjson.Get(response, "StatusPRM.OtaUrl").String()
+	status.Topic = gjson.Get(response, "Status.Topic").String()
+	status.GroupTopic = gjson.Get(response, "StatusPRM.GroupTopic").String()
+	status.Hostname = gjson.Get(response, "StatusNET.Hostname").String()
+	status.MAC = gjson.Get(response, "StatusNET.Mac").String()
+	status.Hardware = gjson.Get(response, "StatusFWR.Hardware").String()
+	status.Chip = ChipFamily(status.Hardware, status.Variant)
+	status.RestartReason = gjson.Get(response, "StatusPRM.RestartReason").String()
+	status.BootCount = int(gjson.Get(response, "StatusPRM.BootCount").Int())
+	status.Response = response
+	return status, nil
+}
+
+// parseUptime reads the uptime from the answer to "Status 0". Older firmwares only report it as text
+// like "1T02:03:04".
+func parseUptime(response string) time.Duration {
+	if sec := gjson.Get(response, "StatusSTS.UptimeSec"); sec.Exists() {
+		return time.Duration(sec.Int()) * time.Second
+	}
+	text := gjson.Get(response, "StatusSTS.Uptime").String()
+	days, clock := "0", text
+	if i := strings.Index(text, "T"); i >= 0 {
+		days, clock = text[:i], text[i+1:]
+	}
+	parts := strings.Split(clock, ":")
+	if len(parts) != 3 {
+		return 0
+	}
+	uptime := time.Duration(0)
+	for i, value := range append([]string{days}, parts...) {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return 0
+		}
+		uptime += time.Duration(n) * []time.Duration{24 * time.Hour, time.Hour, time.Minute, time.Second}[i]
+	}
+	return uptime
+}
+
+// Upgrade sets the OTA URL of a device and starts the upgrade. The device reboots once the firmware
+// has been flashed.
+func (c *Client) Upgrade(ctx context.Context, host string, otaURL string) error {
+	if _, err := c.Command(ctx, host, "OtaUrl "+otaURL); err != nil {
+		return err
+	}
+	_, err := c.Command(ctx, host, "Upgrade 1")
+	return err
+}
@@ -0,0 +1,185 @@
+package tasmota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const statusData = `{
+	"Status": {"DeviceName": "testdevice", "FriendlyName": ["Plug", "USB"], "Topic": "plug", "Module": 18},
+	"StatusNET": {"Hostname": "plug-1234", "Mac": "DC:4F:22:00:12:34"},
+	"StatusFWR": {"Version": "9.1.0(tasmota)", "Hardware": "ESP8266EX"},
+	"StatusPRM": {"GroupTopic": "kitchen", "OtaUrl": "lock", "RestartReason": "Software/System restart", "BootCount": 12},
+	"StatusSTS": {"Uptime": "1T02:03:04", "UptimeSec": 93784, "Heap": 25, "Wifi": {"SSId": "garage", "BSSId": "30:b5:c2:00:00:01", "Channel": 6, "RSSI": 80, "Signal": -60}}
+}`
+
+// serverMock answers every request with the given status and body
+func serverMock(status int, body string) (*httptest.Server, string) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+	return srv, strings.TrimPrefix(srv.URL, "http://")
+}
+
+func Test_BaseURL(t *testing.T) {
+	assert.Equal(t, "http://10.0.0.1", BaseURL("10.0.0.1"))
+	assert.Equal(t, "http://10.0.0.1:8080", BaseURL("10.0.0.1:8080"))
+	assert.Equal(t, "http://[fd00::1]", BaseURL("fd00::1"))
+	assert.Equal(t, "http://[fd00::1]", BaseURL("[fd00::1]"))
+}
+
+func Test_DeviceURL(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("https://10.0.0.1", DeviceURL("https", "10.0.0.1", ""))
+	assert.Equal("https://10.0.0.1:8443", DeviceURL("https", "10.0.0.1", "8443"))
+	assert.Equal("https://[fd00::1]:8443", DeviceURL("https", "fd00::1", "8443"))
+	assert.Equal("https://[fd00::1]:8443", DeviceURL("https", "[fd00::1]", "8443"))
+	// a port in the host wins
+	assert.Equal("http://10.0.0.1:8080", DeviceURL("", "10.0.0.1:8080", "8443"))
+}
+
+func Test_commandQuery(t *testing.T) {
+	assert.Equal(t, url.Values{"user": {"admin"}, "password": {"test"}, "cmnd": {"Status 0"}}, commandQuery("test", "Status 0"))
+	assert.Equal(t, url.Values{"cmnd": {"Status 0"}}, commandQuery("", "Status 0"))
+}
+
+func Test_CommandURL(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("http://testhost/cm?cmnd=Status%200", CommandURL("testhost", "", "Status 0"))
+	assert.Equal("http://testhost/cm?cmnd=Status%200&password=test&user=admin", CommandURL("testhost", "test", "Status 0"))
+	assert.Equal("http://[fd00::1]/cm?cmnd=Status%200", CommandURL("fd00::1", "", "Status 0"))
+	// special characters in the password and the command survive the round trip
+	for _, password := range []string{"a&b", "a+b", "a#b", "a b", "p%20w=d?"} {
+		u, err := url.Parse(CommandURL("testhost", password, "OtaUrl http://ota/tasmota.bin?a=1&b=2"))
+		if assert.Nil(err) {
+			assert.Equal(password, u.Query().Get("password"))
+			assert.Equal("OtaUrl http://ota/tasmota.bin?a=1&b=2", u.Query().Get("cmnd"))
+			assert.Equal("", u.Fragment)
+		}
+	}
+}
+
+func Test_MaskPasswords(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("Backlog SSId1 iot; Password1 ****", MaskPasswords("Backlog SSId1 iot; Password1 secret"))
+	assert.Equal("WebPassword ****; Restart 1", MaskPasswords("WebPassword secret; Restart 1"))
+	u := CommandURL("testhost", "s3cr%t", "Backlog SSId1 iot; Password1 se cret")
+	assert.NotContains(MaskPasswords(u), "s3cr")
+	assert.NotContains(MaskPasswords(u), "cret")
+	assert.Equal("Status 0", MaskPasswords("Status 0"))
+}
+
+func Test_Command(t *testing.T) {
+	assert := assert.New(t)
+	srv, host := serverMock(http.StatusOK, statusData)
+	response, err := NewClient().Command(context.Background(), host, "Status 0")
+	assert.Nil(err)
+	assert.Equal(statusData, response)
+	srv.Close()
+
+	srv, host = serverMock(http.StatusUnauthorized, "")
+	_, err = NewClient().Command(context.Background(), host, "Status 0")
+	assert.True(errors.Is(err, ErrUnauthorized))
+	srv.Close()
+
+	srv, host = serverMock(http.StatusOK, `{"WARNING":"Need user=<username>&password=<password>"}`)
+	_, err = NewClient().Command(context.Background(), host, "Status 0")
+	assert.True(errors.Is(err, ErrUnauthorized))
+	srv.Close()
+
+	srv, host = serverMock(http.StatusOK, "<html></html>")
+	_, err = NewClient().Command(context.Background(), host, "Status 0")
+	assert.True(errors.Is(err, ErrNotTasmota))
+	srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	_, err = NewClient().Command(ctx, host, "Status 0")
+	assert.True(errors.Is(err, ErrTimeout))
+	var deviceErr *DeviceError
+	assert.True(errors.As(err, &deviceErr))
+	assert.Equal(host, deviceErr.Host)
+}
+
+func Test_Status(t *testing.T) {
+	assert := assert.New(t)
+	srv, host := serverMock(http.StatusOK, statusData)
+	status, err := NewClient().Status(context.Background(), host)
+	assert.Nil(err)
+	assert.Equal("testdevice", status.Name)
+	assert.Equal("Plug", status.FriendlyName)
+	assert.Equal("9.1.0", status.Version)
+	assert.Equal("tasmota", status.Variant)
+	assert.Equal(25, status.Heap)
+	assert.Equal(-60, status.Signal)
+	assert.Equal("garage", status.SSID)
+	assert.Equal("lock", status.OtaURL)
+	assert.Equal("plug", status.Topic)
+	assert.Equal("kitchen", status.GroupTopic)
+	assert.Equal("plug-1234", status.Hostname)
+	assert.Equal("DC:4F:22:00:12:34", status.MAC)
+	assert.Equal("ESP8266EX", status.Hardware)
+	assert.Equal(ChipESP8266, status.Chip)
+	assert.Equal("Software/System restart", status.RestartReason)
+	assert.Equal(12, status.BootCount)
+	assert.Equal(18, status.Module)
+	assert.Equal(80, status.RSSI)
+	assert.Equal("30:B5:C2:00:00:01", status.BSSID)
+	assert.Equal(6, status.Channel)
+	assert.Equal(26*time.Hour+3*time.Minute+4*time.Second, status.Uptime)
+	srv.Close()
+
+	srv, host = serverMock(http.StatusOK, `{"foo": "bar"}`)
+	_, err = NewClient().Status(context.Background(), host)
+	assert.True(errors.Is(err, ErrNotTasmota))
+	srv.Close()
+
+	// unknown version formats are shown as they are
+	srv, host = serverMock(http.StatusOK, `{"StatusFWR": {"Version": "nightly"}}`)
+	status, err = NewClient().Status(context.Background(), host)
+	assert.Nil(err)
+	assert.Equal("nightly", status.Version)
+	assert.Empty(status.Variant)
+	srv.Close()
+}
+
+func Test_Upgrade(t *testing.T) {
+	assert := assert.New(t)
+	commands := make([]string, 0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		commands = append(commands, r.URL.Query().Get("cmnd"))
+		fmt.Fprint(w, `{}`)
+	}))
+	defer srv.Close()
+	err := NewClient().Upgrade(context.Background(), strings.TrimPrefix(srv.URL, "http://"), "http://ota/tasmota.bin")
+	assert.Nil(err)
+	assert.Equal([]string{"OtaUrl http://ota/tasmota.bin", "Upgrade 1"}, commands)
+}
+
+func Test_parseUptime(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(93784*time.Second, parseUptime(`{"StatusSTS": {"UptimeSec": 93784}}`))
+	// older firmwares only report the uptime as text
+	assert.Equal(26*time.Hour+3*time.Minute+4*time.Second, parseUptime(`{"StatusSTS": {"Uptime": "1T02:03:04"}}`))
+	assert.Equal(3*time.Minute, parseUptime(`{"StatusSTS": {"Uptime": "00:03:00"}}`))
+	assert.Equal(time.Duration(0), parseUptime(`{"StatusSTS": {"Uptime": "soon"}}`))
+	assert.Equal(time.Duration(0), parseUptime(`{}`))
+}
+
+func Test_Transient(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(Transient(&DeviceError{Host: "10.0.0.1", Command: "Status 0", Kind: ErrTimeout}))
+	assert.True(Transient(&DeviceError{Host: "10.0.0.1", Command: "Status 0", Kind: ErrParse}))
+	assert.False(Transient(&DeviceError{Host: "10.0.0.1", Command: "Status 0", Kind: ErrNotTasmota}))
+	assert.False(Transient(errors.New("other")))
+}
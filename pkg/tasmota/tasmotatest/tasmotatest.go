@@ -0,0 +1,66 @@
+// Package tasmotatest provides a fake tasmota.DeviceClient for tests.
+package tasmotatest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/merlinschumacher/tasmogo/pkg/tasmota"
+)
+
+// Client answers requests from canned responses instead of real devices and records every command
+// it receives. It is safe for concurrent use.
+type Client struct {
+	mu sync.Mutex
+	// Devices maps hosts to the answers of their commands. Hosts that are missing are unreachable,
+	// commands that are missing get the answer of Tasmota to unknown commands.
+	Devices map[string]map[string]string
+	// Unauthorized lists the hosts that reject the password
+	Unauthorized map[string]bool
+	// Commands lists the commands sent, as "host: command"
+	Commands []string
+}
+
+// NewClient creates a fake client for the given devices
+func NewClient(devices map[string]map[string]string) *Client {
+	return &Client{Devices: devices}
+}
+
+// Command returns the canned answer of the device to the command
+func (c *Client) Command(ctx context.Context, host string, command string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Commands = append(c.Commands, host+": "+command)
+	if err := ctx.Err(); err != nil {
+		return "", &tasmota.DeviceError{Host: host, Command: command, Kind: tasmota.ErrTimeout, Err: err}
+	}
+	if c.Unauthorized[host] {
+		return "", &tasmota.DeviceError{Host: host, Command: command, Kind: tasmota.ErrUnauthorized}
+	}
+	responses, ok := c.Devices[host]
+	if !ok {
+		return "", &tasmota.DeviceError{Host: host, Command: command, Kind: tasmota.ErrUnreachable}
+	}
+	if response, ok := responses[command]; ok {
+		return response, nil
+	}
+	return `{"Command":"Unknown"}`, nil
+}
+
+// Status parses the canned answer of the device to "Status 0"
+func (c *Client) Status(ctx context.Context, host string) (tasmota.Status, error) {
+	response, err := c.Command(ctx, host, "Status 0")
+	if err != nil {
+		return tasmota.Status{}, err
+	}
+	return tasmota.ParseStatus(host, response)
+}
+
+// Upgrade records the commands that start an upgrade
+func (c *Client) Upgrade(ctx context.Context, host string, otaURL string) error {
+	if _, err := c.Command(ctx, host, "OtaUrl "+otaURL); err != nil {
+		return err
+	}
+	_, err := c.Command(ctx, host, "Upgrade 1")
+	return err
+}
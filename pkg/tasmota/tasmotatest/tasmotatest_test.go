@@ -0,0 +1,45 @@
+package tasmotatest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/merlinschumacher/tasmogo/pkg/tasmota"
+	"github.com/stretchr/testify/assert"
+)
+
+// the fake has to stay usable wherever the real client is
+var _ tasmota.DeviceClient = &Client{}
+var _ tasmota.DeviceClient = &tasmota.Client{}
+
+func Test_Client(t *testing.T) {
+	assert := assert.New(t)
+	c := NewClient(map[string]map[string]string{
+		"10.0.0.1": {"Status 0": `{"Status": {"DeviceName": "plug"}, "StatusFWR": {"Version": "9.1.0(tasmota)"}}`},
+	})
+	status, err := c.Status(context.Background(), "10.0.0.1")
+	assert.Nil(err)
+	assert.Equal("plug", status.Name)
+	assert.Equal("9.1.0", status.Version)
+
+	response, err := c.Command(context.Background(), "10.0.0.1", "Power")
+	assert.Nil(err)
+	assert.Equal(`{"Command":"Unknown"}`, response)
+
+	_, err = c.Status(context.Background(), "10.0.0.2")
+	assert.True(errors.Is(err, tasmota.ErrUnreachable))
+	c.Unauthorized = map[string]bool{"10.0.0.2": true}
+	_, err = c.Status(context.Background(), "10.0.0.2")
+	assert.True(errors.Is(err, tasmota.ErrUnauthorized))
+
+	assert.Nil(c.Upgrade(context.Background(), "10.0.0.1", "http://ota/tasmota.bin"))
+	assert.Equal([]string{
+		"10.0.0.1: Status 0",
+		"10.0.0.1: Power",
+		"10.0.0.2: Status 0",
+		"10.0.0.2: Status 0",
+		"10.0.0.1: OtaUrl http://ota/tasmota.bin",
+		"10.0.0.1: Upgrade 1",
+	}, c.Commands)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/hashicorp/go-version"
+	"github.com/spf13/viper"
+)
+
+// devicePolicy is an entry of the devices section of the config. It matches devices by MAC, hostname,
+// topic and network group; all criteria that are set have to match. Update is "deny" to never update the devices or
+// "allow" to put them on the allow list: once any entry allows updates, all devices not allowed are
+// left alone. Version and variant pin the firmware the devices are updated to. Push uploads the
+// firmware to devices that can't reach any OTA URL.
+type devicePolicy struct {
+	MAC      string `mapstructure:"mac"`
+	Hostname string `mapstructure:"hostname"`
+	Topic    string `mapstructure:"topic"`
+	Group    string `mapstructure:"group"`
+	Update   string `mapstructure:"update"`
+	Version  string `mapstructure:"version"`
+	Variant  string `mapstructure:"variant"`
+	Push     bool   `mapstructure:"push"`
+}
+
+// loadPolicies reads the device policies from the configuration
+func loadPolicies() ([]devicePolicy, error) {
+	var policies []devicePolicy
+	if err := viper.UnmarshalKey("devices", &policies); err != nil {
+		return nil, err
+	}
+	for _, p := range policies {
+		if p.MAC == "" && p.Hostname == "" && p.Topic == "" && p.Group == "" {
+			return nil, errors.New("Device entry without mac, hostname, topic or group")
+		}
+		if p.Update != "" && p.Update != "allow" && p.Update != "deny" {
+			return nil, errors.New("Invalid update value " + p.Update + ", expected allow or deny")
+		}
+		if p.Version != "" {
+			if _, err := version.NewVersion(p.Version); err != nil {
+				return nil, errors.New("Invalid pinned version " + p.Version)
+			}
+		}
+	}
+	return policies, nil
+}
+
+// normalizeMAC removes the separators of a MAC address, as Tasmota reports it with colons in its
+// status, but without them in its discovery messages
+func normalizeMAC(mac string) string {
+	return strings.ToUpper(strings.NewReplacer(":", "", "-", "").Replace(mac))
+}
+
+// matches reports if the policy applies to the device
+func (p devicePolicy) matches(device tasmoDevice) bool {
+	if p.MAC != "" && normalizeMAC(p.MAC) != normalizeMAC(device.MAC) {
+		return false
+	}
+	if p.Hostname != "" && !strings.EqualFold(p.Hostname, device.Hostname) {
+		return false
+	}
+	if p.Topic != "" && p.Topic != device.Topic {
+		return false
+	}
+	if p.Group != "" && !inGroup(device, nil, p.Group) {
+		return false
+	}
+	return true
+}
+
+// applyPolicies marks the devices excluded from updates and sets their pinned version and variant and
+// whether the firmware is pushed to them
+func applyPolicies(devices []tasmoDevice, policies []devicePolicy) {
+	allowList := false
+	for _, p := range policies {
+		if p.Update == "allow" {
+			allowList = true
+		}
+	}
+	for i := range devices {
+		allowed := !allowList
+		for _, p := range policies {
+			if !p.matches(devices[i]) {
+				continue
+			}
+			switch p.Update {
+			case "allow":
+				allowed = true
+			case "deny":
+				devices[i].Excluded = true
+			}
+			if p.Version != "" {
+				devices[i].PinnedVersion = p.Version
+			}
+			if p.Variant != "" {
+				devices[i].TargetType = p.Variant
+			}
+			if p.Push {
+				devices[i].PushUpdate = true
+			}
+		}
+		if !allowed {
+			devices[i].Excluded = true
+		}
+	}
+}
+
+// classifyDevices marks the protected devices and applies the device policies of the config. If
+// TASMOGO_GROUPS is set, only the devices in one of these groups are updated.
+func classifyDevices(devices []tasmoDevice, inv *inventory) {
+	protectDevices(devices, inv)
+	quarantineDevices(devices, inv)
+	policies, err := loadPolicies()
+	if err != nil {
+		logWarn("Loading the device policies failed: " + err.Error())
+	}
+	applyPolicies(devices, policies)
+	groups := getList("groups")
+	if len(groups) == 0 {
+		return
+	}
+	for i := range devices {
+		member := false
+		for _, group := range groups {
+			if inGroup(devices[i], inv, group) {
+				member = true
+			}
+		}
+		if !member {
+			devices[i].Excluded = true
+		}
+	}
+}
+
+// targetVersion returns the version a device is updated to: the one of its build in the firmware
+// manifest, its pinned version or the latest release
+func targetVersion(device tasmoDevice, latest *version.Version) *version.Version {
+	if build, ok := customBuild(device); ok {
+		custom, _ := version.NewVersion(build.Version)
+		return custom
+	}
+	if device.PinnedVersion == "" {
+		return latest
+	}
+	pinned, err := version.NewVersion(device.PinnedVersion)
+	if err != nil {
+		return latest
+	}
+	return pinned
+}
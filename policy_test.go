@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/hashicorp/go-version"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_loadPolicies(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	viper.Set("devices", []map[string]interface{}{{"hostname": "garage", "update": "deny"}, {"topic": "plug", "version": "9.1.0"}})
+	policies, err := loadPolicies()
+	assert.Nil(err)
+	assert.Len(policies, 2)
+	assert.Equal("deny", policies[0].Update)
+	assert.Equal("9.1.0", policies[1].Version)
+
+	viper.Set("devices", []map[string]interface{}{{"update": "deny"}})
+	_, err = loadPolicies()
+	assert.NotNil(err)
+	viper.Set("devices", []map[string]interface{}{{"topic": "plug", "update": "never"}})
+	_, err = loadPolicies()
+	assert.NotNil(err)
+	viper.Set("devices", []map[string]interface{}{{"topic": "plug", "version": "latest"}})
+	_, err = loadPolicies()
+	assert.NotNil(err)
+}
+
+func Test_devicePolicy_matches(t *testing.T) {
+	assert := assert.New(t)
+	device := tasmoDevice{MAC: "DC:4F:22:00:12:34", Hostname: "Garage-Door", Topic: "garage"}
+	assert.True(devicePolicy{MAC: "dc4f22001234"}.matches(device))
+	assert.True(devicePolicy{Hostname: "garage-door"}.matches(device))
+	assert.True(devicePolicy{Topic: "garage", Hostname: "garage-door"}.matches(device))
+	assert.False(devicePolicy{Topic: "garage", Hostname: "kitchen"}.matches(device))
+	assert.False(devicePolicy{MAC: "DC:4F:22:00:12:35"}.matches(device))
+	device.SSID = "garage"
+	assert.True(devicePolicy{Group: "ssid:garage"}.matches(device))
+	assert.False(devicePolicy{Group: "ssid:kitchen"}.matches(device))
+}
+
+func Test_classifyDevices(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	inv, _ := loadInventory("")
+	inv.record("10.0.1.1").addTag("cellar")
+	devices := []tasmoDevice{
+		{IP: net.IPv4(10, 0, 0, 1), SSID: "garage"},
+		{IP: net.IPv4(10, 0, 0, 2), SSID: "house"},
+		{IP: net.IPv4(10, 0, 1, 1), SSID: "house"},
+	}
+	viper.Set("groups", "ssid:garage,cellar")
+	classifyDevices(devices, inv)
+	assert.False(devices[0].Excluded)
+	assert.True(devices[1].Excluded)
+	assert.False(devices[2].Excluded)
+}
+
+func Test_applyPolicies(t *testing.T) {
+	assert := assert.New(t)
+	devices := []tasmoDevice{{Topic: "garage"}, {Topic: "plug"}, {Topic: "lamp"}}
+	applyPolicies(devices, []devicePolicy{
+		{Topic: "garage", Update: "deny"},
+		{Topic: "plug", Version: "9.1.0", Variant: "sensors", Push: true},
+	})
+	assert.True(devices[0].Excluded)
+	assert.False(devices[1].Excluded)
+	assert.Equal("9.1.0", devices[1].PinnedVersion)
+	assert.Equal("sensors", devices[1].TargetType)
+	assert.True(devices[1].PushUpdate)
+	assert.False(devices[2].Excluded)
+	assert.False(devices[2].PushUpdate)
+
+	// with an allow list, all other devices are excluded
+	devices = []tasmoDevice{{Topic: "garage"}, {Topic: "plug"}}
+	applyPolicies(devices, []devicePolicy{{Topic: "plug", Update: "allow"}})
+	assert.True(devices[0].Excluded)
+	assert.False(devices[1].Excluded)
+}
+
+func Test_targetVersion(t *testing.T) {
+	latest, _ := version.NewVersion("9.2.0")
+	assert.Equal(t, "9.2.0", targetVersion(tasmoDevice{}, latest).String())
+	assert.Equal(t, "9.1.0", targetVersion(tasmoDevice{PinnedVersion: "9.1.0"}, latest).String())
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// The limits of TASMOGO_POLITE, for runs during the day on networks shared with latency-sensitive
+// traffic like video calls. tasmogo rather misses a slow device than keeps the Wi-Fi busy.
+const (
+	politeConcurrency       = 8
+	politeRequestsPerSecond = 5.0
+	politeScanTimeout       = 2 * time.Second
+	politeExecConcurrency   = 1
+	politeExecTimeout       = 10 * time.Second
+	politeDelay             = 500 * time.Millisecond
+)
+
+// polite reports if the politeness mode is on
+func polite() bool {
+	return viper.GetBool("polite")
+}
+
+// politeInt caps a limit at the one of the politeness mode. Values below 1 are unlimited and capped
+// as well.
+func politeInt(value int, limit int) int {
+	if polite() && (value < 1 || value > limit) {
+		return limit
+	}
+	return value
+}
+
+// politeDuration caps a timeout at the one of the politeness mode
+func politeDuration(value time.Duration, limit time.Duration) time.Duration {
+	if polite() && (value <= 0 || value > limit) {
+		return limit
+	}
+	return value
+}
+
+// scanRate returns the maximum number of requests per second of a scan, TASMOGO_REQUESTSPERSECOND or the
+// rate of the politeness mode if that is lower. 0 doesn't limit them.
+func scanRate() float64 {
+	rate := viper.GetFloat64("requestspersecond")
+	if polite() && (rate <= 0 || rate > politeRequestsPerSecond) {
+		return politeRequestsPerSecond
+	}
+	return rate
+}
+
+// pause waits for the given time and reports if tasmogo wasn't stopped in the meantime
+func pause(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
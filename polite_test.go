@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_politeLimits(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	// without the politeness mode the settings are used as they are
+	assert.Equal(256, politeInt(viper.GetInt("concurrency"), politeConcurrency))
+	assert.Equal(10*time.Second, politeDuration(viper.GetDuration("scantimeout"), politeScanTimeout))
+	assert.Equal(0.0, scanRate())
+	assert.Zero(newEngine().Delay)
+
+	viper.Set("polite", true)
+	assert.Equal(politeConcurrency, politeInt(viper.GetInt("concurrency"), politeConcurrency))
+	assert.Equal(4, politeInt(4, politeConcurrency))
+	assert.Equal(politeConcurrency, politeInt(0, politeConcurrency))
+	assert.Equal(politeScanTimeout, politeDuration(viper.GetDuration("scantimeout"), politeScanTimeout))
+	assert.Equal(time.Second, politeDuration(time.Second, politeScanTimeout))
+	assert.Equal(politeRequestsPerSecond, scanRate())
+	viper.Set("requestspersecond", 2)
+	assert.Equal(2.0, scanRate())
+
+	e := newEngine()
+	assert.Equal(politeExecConcurrency, e.Concurrency)
+	assert.Equal(politeExecTimeout, e.Timeout)
+	assert.Equal(politeDelay, e.Delay)
+}
+
+func Test_engine_run_delay(t *testing.T) {
+	assert := assert.New(t)
+	devices := []tasmoDevice{{Name: "lamp", IP: net.IPv4(1, 1, 1, 1)}, {Name: "plug", IP: net.IPv4(1, 1, 1, 2)}, {Name: "heater", IP: net.IPv4(1, 1, 1, 3)}}
+	e := engine{Concurrency: 3, Delay: 20 * time.Millisecond}
+	started := time.Now()
+	results := e.run(context.Background(), devicePointers(devices), func(ctx context.Context, device *tasmoDevice) (string, error) {
+		return "ok", nil
+	})
+	assert.Len(results, 3)
+	assert.GreaterOrEqual(int64(time.Since(started)), int64(40*time.Millisecond))
+
+	// a stopped run doesn't wait before skipping the remaining devices
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	e.Delay = time.Hour
+	results = e.run(ctx, devicePointers(devices), func(ctx context.Context, device *tasmoDevice) (string, error) {
+		return "ok", nil
+	})
+	assert.True(results[2].Skipped)
+}
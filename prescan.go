@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/merlinschumacher/tasmogo/pkg/scanner"
+	"github.com/spf13/viper"
+)
+
+// pingInterval is the pause between the echo requests of the ICMP pre-scan, unless
+// TASMOGO_REQUESTSPERSECOND or TASMOGO_POLITE ask for a longer one
+const pingInterval = time.Millisecond
+
+// liveHostFinders are the pre-scan methods, which return the addresses of the hosts that are alive
+var liveHostFinders = map[string]func(ctx context.Context, ips []net.IP) ([]net.IP, error){
+	"icmp": func(ctx context.Context, ips []net.IP) ([]net.IP, error) {
+		interval := pingInterval
+		if rate := scanRate(); rate > 0 && time.Duration(float64(time.Second)/rate) > interval {
+			interval = time.Duration(float64(time.Second) / rate)
+		}
+		return scanner.Ping(ctx, ips, interval, viper.GetDuration("prescantimeout"))
+	},
+	"neighbors": func(ctx context.Context, ips []net.IP) ([]net.IP, error) {
+		return scanner.Neighbors()
+	},
+}
+
+// prescanTargets narrows the addresses of the network sweep down to the hosts found alive by the methods
+// of TASMOGO_PRESCAN, in their order: "icmp" pings every address, "neighbors" reads the ARP table of the
+// system, which also lists the hosts that answered the ARP requests of the pings but not the pings
+// themselves. Only the IPv4 addresses are narrowed. If every method fails, all addresses are probed.
+func prescanTargets(ctx context.Context, ips []net.IP) []net.IP {
+	methods := getList("prescan")
+	if len(methods) == 0 || len(ips) == 0 {
+		return ips
+	}
+	alive := make(map[string]bool)
+	succeeded := false
+	for _, method := range methods {
+		find, ok := liveHostFinders[method]
+		if !ok {
+			logWarn("Unknown pre-scan method " + method)
+			continue
+		}
+		found, err := find(ctx, ips)
+		if err != nil {
+			logWarn("The " + method + " pre-scan failed: " + err.Error())
+			continue
+		}
+		succeeded = true
+		for _, ip := range found {
+			alive[ip.String()] = true
+		}
+	}
+	if !succeeded {
+		logWarn("Probing all addresses, as no pre-scan succeeded")
+		return ips
+	}
+	live := make([]net.IP, 0)
+	for _, ip := range ips {
+		if ip.To4() == nil || alive[ip.To4().String()] {
+			live = append(live, ip)
+		}
+	}
+	logInfo("Pre-scan found " + strconv.Itoa(len(live)) + " of " + strconv.Itoa(len(ips)) + " addresses alive")
+	return live
+}
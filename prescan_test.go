@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_prescanTargets(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	old := liveHostFinders
+	defer func() { liveHostFinders = old }()
+	liveHostFinders = map[string]func(ctx context.Context, ips []net.IP) ([]net.IP, error){
+		"icmp":      func(ctx context.Context, ips []net.IP) ([]net.IP, error) { return []net.IP{net.IPv4(10, 0, 0, 3)}, nil },
+		"neighbors": func(ctx context.Context, ips []net.IP) ([]net.IP, error) { return []net.IP{net.IPv4(10, 0, 0, 1)}, nil },
+		"broken":    func(ctx context.Context, ips []net.IP) ([]net.IP, error) { return nil, errors.New("no privileges") },
+	}
+	ips := []net.IP{net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 3), net.ParseIP("fd00::1")}
+
+	// without a pre-scan all addresses are probed
+	assert.Equal(ips, prescanTargets(context.Background(), ips))
+
+	// the hosts found by any method are kept, IPv6 addresses aren't narrowed
+	viper.Set("prescan", "icmp,neighbors")
+	assert.Equal([]net.IP{ips[0], ips[2], ips[3]}, prescanTargets(context.Background(), ips))
+
+	// a failing method doesn't stop the others
+	viper.Set("prescan", "broken,icmp")
+	assert.Equal([]net.IP{ips[2], ips[3]}, prescanTargets(context.Background(), ips))
+
+	// if no method works, all addresses are probed
+	viper.Set("prescan", "broken,unknown")
+	assert.Equal(ips, prescanTargets(context.Background(), ips))
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/spf13/viper"
+)
+
+// isProtected reports if a device must not be modified by tasmogo. A device is protected if it is
+// listed in TASMOGO_PROTECTED, tagged with TASMOGO_PROTECTTAG in the inventory or its OtaUrl was set
+// to TASMOGO_OTALOCK on the device itself.
+func isProtected(device tasmoDevice, inv *inventory) bool {
+	for _, entry := range getList("protected") {
+		if entry == device.IP.String() || entry == device.Name {
+			return true
+		}
+	}
+	if lock := viper.GetString("otalock"); lock != "" && device.OtaURL == lock {
+		return true
+	}
+	if tag := viper.GetString("protecttag"); tag != "" && inv != nil {
+		if rec, ok := inv.Devices[device.key()]; ok {
+			for _, t := range rec.Tags {
+				if t == tag {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// protectDevices marks all protected devices
+func protectDevices(devices []tasmoDevice, inv *inventory) {
+	for i := range devices {
+		devices[i].Protected = isProtected(devices[i], inv)
+	}
+}
+
+// mayModify reports if commands may be sent to the device. In read-only mode no device is modified,
+// protected devices are left alone unless TASMOGO_FORCE is set.
+func mayModify(device tasmoDevice) bool {
+	if viper.GetBool("readonly") {
+		return false
+	}
+	if !device.Protected {
+		return true
+	}
+	if viper.GetBool("force") {
+		deviceLogger(device, "modify").warn("Modifying protected device " + device.Name + " (" + device.address() + ") as forced")
+		return true
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_isProtected(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	viper.Set("protected", "boiler,10.0.0.4")
+	inv := &inventory{Devices: map[string]*inventoryRecord{
+		"10.0.0.2": {Tags: []string{"kitchen", "protected"}},
+		"10.0.0.3": {Tags: []string{"kitchen"}},
+	}}
+	assert.True(isProtected(tasmoDevice{Name: "boiler", IP: net.ParseIP("10.0.0.1")}, inv))
+	assert.True(isProtected(tasmoDevice{Name: "plug", IP: net.ParseIP("10.0.0.4")}, inv))
+	assert.True(isProtected(tasmoDevice{Name: "lamp", IP: net.ParseIP("10.0.0.2")}, inv))
+	assert.False(isProtected(tasmoDevice{Name: "lamp", IP: net.ParseIP("10.0.0.3")}, inv))
+	assert.True(isProtected(tasmoDevice{Name: "lamp", IP: net.ParseIP("10.0.0.3"), OtaURL: "lock"}, inv))
+	assert.False(isProtected(tasmoDevice{Name: "lamp", IP: net.ParseIP("10.0.0.3"), OtaURL: "http://ota/"}, nil))
+}
+
+func Test_mayModify(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	assert.True(mayModify(tasmoDevice{}))
+	assert.False(mayModify(tasmoDevice{Protected: true}))
+	viper.Set("force", true)
+	assert.True(mayModify(tasmoDevice{Protected: true}))
+
+	// read-only mode can't be overridden
+	viper.Set("readonly", true)
+	assert.False(mayModify(tasmoDevice{}))
+	assert.False(mayModify(tasmoDevice{Protected: true}))
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/merlinschumacher/tasmogo/pkg/tasmota"
+	"github.com/spf13/viper"
+	"github.com/tidwall/gjson"
+)
+
+// provisioningProfile is the configuration enforced on the devices matching its selector: a template, a
+// module and any commands that set a value, like SetOption19 1, Rule1 ON ... ENDON or MqttHost broker
+type provisioningProfile struct {
+	Name     string   `mapstructure:"name"`
+	Select   string   `mapstructure:"select"`
+	Template string   `mapstructure:"template"`
+	Module   string   `mapstructure:"module"`
+	Commands []string `mapstructure:"commands"`
+	selector *deviceSelector
+}
+
+// provisionSetting is a single setting of a profile: the command that sets it and its value
+type provisionSetting struct {
+	Command string
+	Value   string
+}
+
+// ruleCommand matches the commands that set the rule sets, whose text is reported under "Rules"
+var ruleCommand = regexp.MustCompile(`(?i)^rule[1-3]$`)
+
+// loadProvisioning reads the provisioning profiles from the config and checks their selectors, commands
+// and templates
+func loadProvisioning() ([]provisioningProfile, error) {
+	var profiles []provisioningProfile
+	if err := viper.UnmarshalKey("provisioning", &profiles); err != nil {
+		return nil, err
+	}
+	for i, p := range profiles {
+		selector, err := parseSelector(p.Select)
+		if err != nil {
+			return nil, errors.New("Profile " + p.Name + ": " + err.Error())
+		}
+		profiles[i].selector = selector
+		if p.Template != "" && !json.Valid([]byte(p.Template)) {
+			return nil, errors.New("Profile " + p.Name + ": the template is no valid JSON")
+		}
+		for _, command := range p.Commands {
+			if _, err := splitSetting(command); err != nil {
+				return nil, errors.New("Profile " + p.Name + ": " + err.Error())
+			}
+		}
+	}
+	return profiles, nil
+}
+
+// splitSetting splits a command like "SetOption19 1" into the command and its value
+func splitSetting(command string) (provisionSetting, error) {
+	fields := strings.SplitN(strings.TrimSpace(command), " ", 2)
+	if len(fields) != 2 || strings.TrimSpace(fields[1]) == "" {
+		return provisionSetting{}, errors.New("Invalid command " + command + ", expected a command and its value")
+	}
+	if strings.EqualFold(fields[0], "Backlog") {
+		return provisionSetting{}, errors.New("Invalid command " + command + ", list the commands one by one instead of a Backlog")
+	}
+	return provisionSetting{Command: fields[0], Value: strings.TrimSpace(fields[1])}, nil
+}
+
+// settings returns the settings of the profile in the order they are sent: the commands first, then
+// the template and the module, as changing the module restarts the device
+func (p provisioningProfile) settings() []provisionSetting {
+	settings := make([]provisionSetting, 0, len(p.Commands)+2)
+	for _, command := range p.Commands {
+		if s, err := splitSetting(command); err == nil {
+			settings = append(settings, s)
+		}
+	}
+	if p.Template != "" {
+		settings = append(settings, provisionSetting{Command: "Template", Value: p.Template})
+	}
+	if p.Module != "" {
+		settings = append(settings, provisionSetting{Command: "Module", Value: p.Module})
+	}
+	return settings
+}
+
+// provisionSettings returns the settings of all profiles matching the device. A setting of a later
+// profile overrides the same setting of an earlier one.
+func provisionSettings(profiles []provisioningProfile, device tasmoDevice, inv *inventory) []provisionSetting {
+	settings := make([]provisionSetting, 0)
+	index := make(map[string]int)
+	for _, p := range profiles {
+		if p.selector != nil && !p.selector.match(device, inv) {
+			continue
+		}
+		for _, s := range p.settings() {
+			key := strings.ToLower(s.Command)
+			if i, ok := index[key]; ok {
+				settings[i] = s
+				continue
+			}
+			index[key] = len(settings)
+			settings = append(settings, s)
+		}
+	}
+	// the template and the module still go last
+	ordered := make([]provisionSetting, 0, len(settings))
+	for _, last := range []bool{false, true} {
+		for _, s := range settings {
+			if isLast := strings.EqualFold(s.Command, "Template") || strings.EqualFold(s.Command, "Module"); isLast == last {
+				ordered = append(ordered, s)
+			}
+		}
+	}
+	return ordered
+}
+
+// currentSetting extracts the current value of a setting from the answer to its command. Templates
+// are answered as the bare JSON, modules as their number with the name and rules with their state
+// next to the text.
+func currentSetting(response string, command string) (string, bool) {
+	switch {
+	case gjson.Get(response, "Command").String() == "Unknown":
+		return "", false
+	case strings.EqualFold(command, "Template"):
+		if !gjson.Valid(response) {
+			return "", false
+		}
+		return response, true
+	case strings.EqualFold(command, "Module"):
+		value, ok := extractValue(response, command)
+		if !ok {
+			return "", false
+		}
+		module := ""
+		gjson.Parse(value).ForEach(func(k, v gjson.Result) bool {
+			module = k.String()
+			return false
+		})
+		return module, module != ""
+	case ruleCommand.MatchString(command):
+		if value, ok := extractValue(response, command); ok && gjson.Valid(value) && gjson.Parse(value).IsObject() {
+			return gjson.Get(value, "Rules").String(), true
+		}
+		rules := gjson.Get(response, "Rules")
+		return rules.String(), rules.Exists()
+	}
+	return extractValue(response, command)
+}
+
+// sameSetting compares the current value of a setting with the desired one. Templates are compared as
+// JSON, so the formatting doesn't matter.
+func sameSetting(command string, current string, desired string) bool {
+	if strings.EqualFold(command, "Template") {
+		var a, b interface{}
+		if json.Unmarshal([]byte(current), &a) != nil || json.Unmarshal([]byte(desired), &b) != nil {
+			return false
+		}
+		return reflect.DeepEqual(a, b)
+	}
+	return sameValue(current, desired)
+}
+
+// provisionDevice compares the settings of a device with the desired ones and, if apply is true, sends
+// the drifted ones one by one, as rules may contain semicolons that would break a Backlog
+func provisionDevice(ctx context.Context, client tasmota.DeviceClient, device tasmoDevice, settings []provisionSetting, apply bool) ([]deviation, error) {
+	deviations := make([]deviation, 0)
+	for _, s := range settings {
+		// sending a command without a value returns the current value
+		response, err := client.Command(ctx, device.IP.String(), s.Command)
+		if err != nil {
+			return deviations, err
+		}
+		current, ok := currentSetting(response, s.Command)
+		if !ok {
+			return deviations, errors.New("Device does not know the setting " + s.Command)
+		}
+		if sameSetting(s.Command, current, s.Value) {
+			continue
+		}
+		d := deviation{Device: device, Setting: s.Command, Current: current, Desired: s.Value}
+		if apply && mayAutomate(device) {
+			if _, err := client.Command(ctx, device.IP.String(), s.Command+" "+s.Value); err != nil {
+				return append(deviations, d), err
+			}
+			d.Corrected = true
+			audit("Provisioned " + s.Command + " of " + device.Name + " (" + device.IP.String() + ") from " + current + " to " + s.Value)
+		}
+		deviations = append(deviations, d)
+	}
+	return deviations, nil
+}
+
+// provisionDevices checks the devices against the provisioning profiles of the config and corrects the
+// drifted settings if apply is true. It returns the drifted settings of all devices.
+func provisionDevices(ctx context.Context, devices []tasmoDevice, inv *inventory, profiles []provisioningProfile, apply bool) []deviation {
+	targets := make([]*tasmoDevice, 0, len(devices))
+	settings := make([][]provisionSetting, 0, len(devices))
+	for i := range devices {
+		if devices[i].Cached || devices[i].AuthFailed || devices[i].IP == nil {
+			continue
+		}
+		if s := provisionSettings(profiles, devices[i], inv); len(s) > 0 {
+			targets = append(targets, &devices[i])
+			settings = append(settings, s)
+		}
+	}
+	index := make(map[*tasmoDevice]int)
+	for i, device := range targets {
+		index[device] = i
+	}
+	found := make([][]deviation, len(targets))
+	client := newDeviceClient()
+	newEngine().run(ctx, targets, func(ctx context.Context, device *tasmoDevice) (string, error) {
+		d, err := provisionDevice(ctx, client, *device, settings[index[device]], apply)
+		found[index[device]] = d
+		if err != nil {
+			deviceLogger(*device, "provision").warn("Provisioning " + device.Name + " (" + device.IP.String() + ") failed: " + err.Error())
+		}
+		return "", err
+	})
+	deviations := make([]deviation, 0)
+	for _, d := range found {
+		deviations = append(deviations, d...)
+	}
+	return deviations
+}
+
+// provisionFleet enforces the provisioning profiles of the config during a run. The drifted settings
+// are listed and the corrected devices are added to the history. With apply false they are only listed.
+func provisionFleet(ctx context.Context, inv *inventory, devices []tasmoDevice, apply bool) {
+	profiles, err := loadProvisioning()
+	if err != nil {
+		logWarn("Not provisioning any devices, the provisioning profiles are invalid: " + err.Error())
+		return
+	}
+	if len(profiles) == 0 {
+		return
+	}
+	deviations := provisionDevices(ctx, devices, inv, profiles, apply)
+	if len(deviations) == 0 {
+		logInfo("All devices match their provisioning profiles")
+		return
+	}
+	logInfo("Devices that drifted from their provisioning profiles:\n" + renderDeviations(deviations))
+	corrected := make(map[string][]string)
+	names := make(map[string]string)
+	order := make([]string, 0)
+	for _, d := range deviations {
+		if !d.Corrected {
+			continue
+		}
+		ip := d.Device.IP.String()
+		if _, ok := corrected[ip]; !ok {
+			order = append(order, ip)
+		}
+		corrected[ip] = append(corrected[ip], d.Setting)
+		names[ip] = d.Device.Name
+	}
+	now := time.Now()
+	for _, ip := range order {
+		inv.addEvent(now, ip, names[ip], "provisioned", "corrected "+strings.Join(corrected[ip], ", "))
+	}
+}
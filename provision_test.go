@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_loadProvisioning(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	viper.Set("provisioning", []map[string]interface{}{
+		{"name": "plugs", "select": `name~"plug"`, "module": 0, "commands": []string{"SetOption19 1"}},
+	})
+	profiles, err := loadProvisioning()
+	assert.Nil(err)
+	assert.Len(profiles, 1)
+	assert.Equal("0", profiles[0].Module)
+	assert.NotNil(profiles[0].selector)
+
+	for _, invalid := range []map[string]interface{}{
+		{"name": "selector", "select": "name=="},
+		{"name": "template", "template": `{"NAME":`},
+		{"name": "command", "commands": []string{"SetOption19"}},
+		{"name": "backlog", "commands": []string{"Backlog SetOption19 1; TelePeriod 60"}},
+	} {
+		viper.Set("provisioning", []map[string]interface{}{invalid})
+		_, err := loadProvisioning()
+		assert.NotNil(err, invalid["name"])
+	}
+}
+
+func Test_provisionSettings(t *testing.T) {
+	assert := assert.New(t)
+	all, _ := parseSelector("")
+	plugs, _ := parseSelector(`name~"plug"`)
+	profiles := []provisioningProfile{
+		{Name: "all", selector: all, Module: "0", Commands: []string{"TelePeriod 300", "MqttHost broker"}},
+		{Name: "plugs", selector: plugs, Template: `{"NAME":"Plug"}`, Commands: []string{"TelePeriod 60"}},
+	}
+	inv, _ := loadInventory("")
+	settings := provisionSettings(profiles, tasmoDevice{Name: "plug-1"}, inv)
+	assert.Equal([]provisionSetting{
+		{Command: "TelePeriod", Value: "60"},
+		{Command: "MqttHost", Value: "broker"},
+		{Command: "Module", Value: "0"},
+		{Command: "Template", Value: `{"NAME":"Plug"}`},
+	}, settings)
+	assert.Len(provisionSettings(profiles, tasmoDevice{Name: "lamp"}, inv), 3)
+}
+
+func Test_currentSetting(t *testing.T) {
+	assert := assert.New(t)
+	value, ok := currentSetting(`{"NAME":"Plug","GPIO":[0,1],"FLAG":0,"BASE":18}`, "Template")
+	assert.True(ok)
+	assert.True(sameSetting("Template", value, `{"BASE":18, "NAME":"Plug", "GPIO":[0, 1], "FLAG":0}`))
+	assert.False(sameSetting("Template", value, `{"NAME":"Lamp","GPIO":[0,1],"FLAG":0,"BASE":18}`))
+
+	value, ok = currentSetting(`{"Module":{"0":"Sonoff Basic"}}`, "Module")
+	assert.True(ok)
+	assert.Equal("0", value)
+
+	value, ok = currentSetting(`{"Rule1":{"State":"ON","Once":"OFF","StopOnError":"OFF","Length":29,"Free":482,"Rules":"ON Power1#State DO Power2 %value% ENDON"}}`, "Rule1")
+	assert.True(ok)
+	assert.Equal("ON Power1#State DO Power2 %value% ENDON", value)
+	// older versions report the rules next to the state
+	value, ok = currentSetting(`{"Rule1":"ON","Once":"OFF","Rules":"on power1#state do power2 %value% endon"}`, "Rule1")
+	assert.True(ok)
+	assert.True(sameSetting("Rule1", value, "ON Power1#State DO Power2 %value% ENDON"))
+
+	_, ok = currentSetting(`{"Command":"Unknown"}`, "Template")
+	assert.False(ok)
+}
+
+func Test_provisionDevices(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	fake := fakeDevices(t, map[string]map[string]string{
+		"10.0.0.1": {"SetOption19": `{"SetOption19":"OFF"}`, "Module": `{"Module":{"1":"Sonoff Basic"}}`},
+		"10.0.0.2": {"SetOption19": `{"SetOption19":"ON"}`, "Module": `{"Module":{"0":"Generic"}}`},
+	})
+	devices := []tasmoDevice{{Name: "plug", IP: net.IPv4(10, 0, 0, 1)}, {Name: "lamp", IP: net.IPv4(10, 0, 0, 2)}, {Name: "cached", IP: net.IPv4(10, 0, 0, 3), Cached: true}}
+	profiles := []provisioningProfile{{Name: "all", Module: "0", Commands: []string{"SetOption19 1"}}}
+	inv, _ := loadInventory("")
+
+	// drifted settings are only listed without apply
+	deviations := provisionDevices(context.Background(), devices, inv, profiles, false)
+	assert.Len(deviations, 2)
+	assert.Equal("SetOption19", deviations[0].Setting)
+	assert.Equal("Module", deviations[1].Setting)
+	assert.False(deviations[0].Corrected)
+	assert.NotContains(fake.Commands, "10.0.0.1: SetOption19 1")
+
+	deviations = provisionDevices(context.Background(), devices, inv, profiles, true)
+	assert.Len(deviations, 2)
+	assert.True(deviations[1].Corrected)
+	assert.Contains(fake.Commands, "10.0.0.1: SetOption19 1")
+	assert.Contains(fake.Commands, "10.0.0.1: Module 0")
+	for _, command := range fake.Commands {
+		assert.NotContains(command, "10.0.0.2: SetOption19 1")
+		assert.NotContains(command, "10.0.0.3")
+	}
+
+	// quarantined devices are left alone
+	devices[0].Quarantined = true
+	deviations = provisionDevices(context.Background(), devices, inv, profiles, true)
+	assert.False(deviations[0].Corrected)
+}
+
+func Test_provisionFleet(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	fakeDevices(t, map[string]map[string]string{
+		"10.0.0.1": {"TelePeriod": `{"TelePeriod":300}`},
+	})
+	viper.Set("provisioning", []map[string]interface{}{{"name": "all", "commands": []string{"TelePeriod 60"}}})
+	inv, _ := loadInventory("")
+	provisionFleet(context.Background(), inv, []tasmoDevice{{Name: "plug", IP: net.IPv4(10, 0, 0, 1)}}, true)
+	assert.Len(inv.History, 1)
+	assert.Equal("provisioned", inv.History[0].Kind)
+	assert.Equal("corrected TelePeriod", inv.History[0].Detail)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// publicStatus is what the public status page shows. It has no addresses or names of devices, so it
+// tells nothing about the network behind it.
+type publicStatus struct {
+	Devices  int       `json:"devices"`
+	Outdated int       `json:"outdated"`
+	Online   int       `json:"online"`
+	Offline  int       `json:"offline"`
+	LastScan time.Time `json:"lastScan"`
+	NextScan time.Time `json:"nextScan"`
+}
+
+// publicStatus returns the overview of the last scan for the public status page
+func (d *daemon) publicStatus() publicStatus {
+	s := d.summary()
+	return publicStatus{Devices: s.Devices, Outdated: s.Outdated, Online: s.Online, Offline: s.Offline, LastScan: s.LastScan, NextScan: s.NextScan}
+}
+
+// rateLimiter allows every client a number of requests per window
+type rateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	start  time.Time
+	counts map[string]int
+}
+
+// newRateLimiter creates a limiter that allows limit requests per window and client, any number if
+// limit is below 1
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, counts: make(map[string]int)}
+}
+
+// allow counts a request of the client and reports if it is within the limit. The counts start over
+// with every window.
+func (l *rateLimiter) allow(client string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit < 1 {
+		return true
+	}
+	if now.Sub(l.start) >= l.window {
+		l.start = now
+		l.counts = make(map[string]int)
+	}
+	l.counts[client]++
+	return l.counts[client] <= l.limit
+}
+
+// clientHost returns the address of the client of a request without the port
+func clientHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// publicStatusHandler serves the read-only status page on / and its data on /status.json. Every client
+// may send TASMOGO_PUBLICRATELIMIT requests per minute, as many as it likes if that is 0.
+func publicStatusHandler(d *daemon) http.Handler {
+	limiter := newRateLimiter(viper.GetInt("publicratelimit"), time.Minute)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status.json", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, d.publicStatus())
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := publicStatusTemplate.Execute(w, d.publicStatus()); err != nil {
+			logWarn("Rendering the status page failed: " + err.Error())
+		}
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeError(w, http.StatusMethodNotAllowed, "Use GET")
+			return
+		}
+		if !limiter.allow(clientHost(r), time.Now()) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(limiter.window.Seconds())))
+			writeError(w, http.StatusTooManyRequests, "Too many requests")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// servePublicStatus serves the public status page on the given address until tasmogo is stopped
+func servePublicStatus(addr string, d *daemon) {
+	logInfo("Serving the public status page on " + addr)
+	if err := http.ListenAndServe(addr, publicStatusHandler(d)); err != nil {
+		logWarn("Serving the status page failed: " + err.Error())
+	}
+}
+
+// publicStatusTemplate is the public status page. It reloads itself every minute.
+var publicStatusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return inScheduleZone(t).Format("2006-01-02 15:04 MST")
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta http-equiv="refresh" content="60">
+<title>tasmogo status</title>
+<style>
+body { font-family: sans-serif; font-size: 14pt; margin: 1.5em; }
+td { padding: 0.3em 1em 0.3em 0; }
+.outdated { color: #b00; }
+</style>
+</head>
+<body>
+<h1>tasmogo</h1>
+<table>
+<tr><td>Devices</td><td>{{.Devices}}</td></tr>
+<tr><td>Outdated</td><td{{if .Outdated}} class="outdated"{{end}}>{{.Outdated}}</td></tr>
+{{if or .Online .Offline}}<tr><td>Online</td><td>{{.Online}}</td></tr>
+<tr><td>Offline</td><td{{if .Offline}} class="outdated"{{end}}>{{.Offline}}</td></tr>
+{{end}}<tr><td>Last scan</td><td>{{time .LastScan}}</td></tr>
+<tr><td>Next scan</td><td>{{time .NextScan}}</td></tr>
+</table>
+</body>
+</html>
+`))
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_rateLimiter(t *testing.T) {
+	assert := assert.New(t)
+	l := newRateLimiter(2, time.Minute)
+	now := time.Date(2021, 3, 8, 12, 0, 0, 0, time.UTC)
+	assert.True(l.allow("10.0.0.1", now))
+	assert.True(l.allow("10.0.0.1", now))
+	assert.False(l.allow("10.0.0.1", now))
+	assert.True(l.allow("10.0.0.2", now))
+	// the counts start over after the window
+	assert.True(l.allow("10.0.0.1", now.Add(time.Minute)))
+
+	// without a limit every request is allowed
+	l = newRateLimiter(0, time.Minute)
+	for i := 0; i < 100; i++ {
+		assert.True(l.allow("10.0.0.1", now))
+	}
+}
+
+func Test_publicStatusHandler(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	viper.Set("publicratelimit", 3)
+	viper.Set("apitoken", "secret")
+	d := newDaemon(func(context.Context, scanOptions) []tasmoDevice { return nil })
+	d.devices = []tasmoDevice{{Name: "plug", IP: net.IPv4(10, 0, 0, 1), Outdated: true}, {Name: "lamp", IP: net.IPv4(10, 0, 0, 2)}}
+	handler := publicStatusHandler(d)
+	request := func(method string, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+
+	// no token is needed and no device is named
+	rec := request("GET", "/status.json")
+	assert.Equal(http.StatusOK, rec.Code)
+	var status publicStatus
+	assert.Nil(json.Unmarshal(rec.Body.Bytes(), &status))
+	assert.Equal(2, status.Devices)
+	assert.Equal(1, status.Outdated)
+	rec = request("GET", "/")
+	assert.Contains(rec.Body.String(), "<td>Outdated</td><td class=\"outdated\">1</td>")
+	assert.NotContains(rec.Body.String(), "10.0.0.1")
+	assert.NotContains(rec.Body.String(), "plug")
+
+	assert.Equal(http.StatusMethodNotAllowed, request("POST", "/").Code)
+	// the admin API isn't served on the status page
+	assert.Equal(http.StatusNotFound, request("GET", "/api/devices").Code)
+	rec = request("GET", "/")
+	assert.Equal(http.StatusTooManyRequests, rec.Code)
+	assert.Equal("60", rec.Header().Get("Retry-After"))
+}
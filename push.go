@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// uploadTimeout is how long a device may take to receive and flash an uploaded firmware
+const uploadTimeout = 5 * time.Minute
+
+// pushUpdate reports if the firmware is uploaded to the device, because it can't pull it from any OTA
+// URL. It is set for all devices with TASMOGO_PUSHUPDATE or for some by the device policies.
+func pushUpdate(device tasmoDevice) bool {
+	return device.PushUpdate || viper.GetBool("pushupdate")
+}
+
+// pushFirmware uploads the firmware file of a device from the firmware directory the way the
+// "Firmware Upgrade" page of the web UI does. The device flashes it and restarts afterwards, the
+// update is verified like one pulled from an OTA URL.
+func pushFirmware(device tasmoDevice) error {
+	if device.IP == nil {
+		return errors.New("Pushing the firmware needs the address of the device")
+	}
+	file, err := localFirmware(device)
+	if err != nil {
+		return err
+	}
+	l := deviceLogger(device, "update")
+	l.info("Updating " + device.Name + " (" + device.IP.String() + ") by uploading " + file)
+	next := int64(25)
+	return uploadFile(context.Background(), device.IP.String(), "/up", file, uploadTimeout, func(sent int64, total int64) {
+		for total > 0 && next <= 100 && sent*100/total >= next {
+			l.info("Uploaded " + strconv.FormatInt(next, 10) + "% of " + filepath.Base(file) + " to " + device.Name + " (" + device.IP.String() + ")")
+			next += 25
+		}
+	})
+}
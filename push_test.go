@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_pushFirmware(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	var opened bool
+	var uploaded string
+	answer := "Upload Successful"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/up":
+			opened = true
+		case "/u2":
+			f, _, err := r.FormFile("u2")
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			data, _ := ioutil.ReadAll(f)
+			uploaded = string(data)
+			w.Write([]byte(answer))
+		}
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	viper.Set("port", u.Port())
+	dir := t.TempDir()
+	viper.Set("firmwaredir", dir)
+	device := tasmoDevice{Name: "plug", IP: net.IPv4(127, 0, 0, 1), FirmwareType: "sensors"}
+
+	// the firmware has to be in the firmware directory
+	assert.NotNil(pushFirmware(device))
+	assert.Nil(ioutil.WriteFile(filepath.Join(dir, "tasmota-sensors.bin"), []byte("firmware"), 0644))
+	assert.Nil(pushFirmware(device))
+	assert.True(opened)
+	assert.Equal("firmware", uploaded)
+
+	answer = "Upload Failed"
+	assert.NotNil(pushFirmware(device))
+	assert.NotNil(pushFirmware(tasmoDevice{Name: "mqtt", FirmwareType: "sensors", ViaMQTT: true}))
+}
+
+func Test_pushUpdate(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	assert.False(pushUpdate(tasmoDevice{}))
+	assert.True(pushUpdate(tasmoDevice{PushUpdate: true}))
+	viper.Set("pushupdate", true)
+	assert.True(pushUpdate(tasmoDevice{}))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// quarantined reports if the record is tagged with TASMOGO_QUARANTINETAG
+func (rec *inventoryRecord) quarantined() bool {
+	tag := viper.GetString("quarantinetag")
+	for _, t := range rec.Tags {
+		if tag != "" && t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// quarantineDevices marks the devices whose inventory record is quarantined
+func quarantineDevices(devices []tasmoDevice, inv *inventory) {
+	for i := range devices {
+		if rec, ok := inv.Devices[devices[i].key()]; ok {
+			devices[i].Quarantined = rec.quarantined()
+		}
+	}
+}
+
+// mayAutomate reports if tasmogo may change the device on its own, i.e. update or restart it, run rules
+// and queued actions on it. Quarantined devices are only changed by explicit commands.
+func mayAutomate(device tasmoDevice) bool {
+	return !device.Quarantined && mayModify(device)
+}
+
+// trackFailures counts the runs in a row in which a device failed to answer or to update. Known devices
+// whose query failed with an error worth another try and devices whose update failed extend their
+// streak, devices that answered and weren't updated or were updated successfully end it. A device is
+// quarantined once its streak reaches TASMOGO_QUARANTINEAFTER, so a half-dead device isn't retried
+// forever.
+func trackFailures(inv *inventory, devices []tasmoDevice, failed []net.IP) {
+	now := time.Now()
+	for _, ip := range failed {
+		if rec, ok := inv.Devices[ip.String()]; ok {
+			extendStreak(inv, ip.String(), rec, "queries failed", now)
+		}
+	}
+	for _, device := range devices {
+		rec, ok := inv.Devices[device.key()]
+		if !ok || device.Cached || device.AuthFailed {
+			continue
+		}
+		if updateResult(device) == "failed" {
+			extendStreak(inv, device.key(), rec, "updates failed", now)
+			continue
+		}
+		rec.Failures = 0
+	}
+}
+
+// extendStreak counts another failed run of the device and quarantines it if the streak is long enough
+func extendStreak(inv *inventory, ip string, rec *inventoryRecord, reason string, now time.Time) {
+	rec.Failures++
+	limit := viper.GetInt("quarantineafter")
+	tag := viper.GetString("quarantinetag")
+	if limit <= 0 || tag == "" || rec.Failures < limit || !rec.addTag(tag) {
+		return
+	}
+	detail := strconv.Itoa(rec.Failures) + " runs in a row " + reason
+	logWarn(rec.Name + " (" + ip + ") was quarantined, " + detail)
+	inv.addEvent(now, ip, rec.Name, "quarantined", detail)
+}
+
+// liftQuarantine removes the quarantine of the device with the given IP or name and resets its failure
+// streak
+func (inv *inventory) liftQuarantine(device string) error {
+	tag := viper.GetString("quarantinetag")
+	for ip, rec := range inv.Devices {
+		if ip != device && rec.Name != device {
+			continue
+		}
+		if !rec.quarantined() {
+			return errors.New(device + " is not quarantined")
+		}
+		tags := make([]string, 0, len(rec.Tags))
+		for _, t := range rec.Tags {
+			if t != tag {
+				tags = append(tags, t)
+			}
+		}
+		rec.Tags, rec.Failures = tags, 0
+		inv.addEvent(time.Now(), ip, rec.Name, "released", "quarantine lifted")
+		return nil
+	}
+	return errors.New("Device " + device + " was not found in the inventory")
+}
+
+// quarantinedDevices lists the quarantined devices by their name and address
+func quarantinedDevices(devices []tasmoDevice) []string {
+	quarantined := make([]string, 0)
+	for _, device := range devices {
+		if device.Quarantined {
+			quarantined = append(quarantined, device.Name+" ("+device.address()+")")
+		}
+	}
+	return quarantined
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_trackFailures(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	viper.Set("quarantineafter", 2)
+	inv := &inventory{Devices: map[string]*inventoryRecord{
+		"10.0.0.1": {Name: "plug"},
+		"10.0.0.2": {Name: "lamp"},
+		"10.0.0.3": {Name: "heater", Failures: 3},
+	}}
+	devices := []tasmoDevice{
+		{IP: net.ParseIP("10.0.0.2"), Name: "lamp", UpdateURL: "http://ota/tasmota.bin.gz"},
+		{IP: net.ParseIP("10.0.0.3"), Name: "heater"},
+	}
+	failed := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.9")}
+
+	trackFailures(inv, devices, failed)
+	assert.Equal(1, inv.Devices["10.0.0.1"].Failures)
+	assert.Equal(1, inv.Devices["10.0.0.2"].Failures)
+	// a run without failures ends the streak
+	assert.Equal(0, inv.Devices["10.0.0.3"].Failures)
+	assert.False(inv.Devices["10.0.0.1"].quarantined())
+
+	trackFailures(inv, devices, failed)
+	assert.True(inv.Devices["10.0.0.1"].quarantined())
+	assert.True(inv.Devices["10.0.0.2"].quarantined())
+	assert.Len(inv.History, 2)
+	assert.Equal("quarantined", inv.History[0].Kind)
+
+	// the quarantine is only recorded once
+	trackFailures(inv, devices, failed)
+	assert.Len(inv.History, 2)
+	assert.Equal([]string{"quarantined"}, inv.Devices["10.0.0.1"].Tags)
+
+	// the quarantine can be disabled
+	viper.Set("quarantineafter", 0)
+	trackFailures(inv, devices, []net.IP{net.ParseIP("10.0.0.3")})
+	trackFailures(inv, devices, []net.IP{net.ParseIP("10.0.0.3")})
+	assert.False(inv.Devices["10.0.0.3"].quarantined())
+}
+
+func Test_quarantineDevices(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	inv := &inventory{Devices: map[string]*inventoryRecord{
+		"10.0.0.1": {Tags: []string{"kitchen", "quarantined"}},
+		"10.0.0.2": {Tags: []string{"kitchen"}},
+	}}
+	devices := []tasmoDevice{{IP: net.ParseIP("10.0.0.1"), Name: "plug"}, {IP: net.ParseIP("10.0.0.2"), Name: "lamp"}}
+	quarantineDevices(devices, inv)
+	assert.True(devices[0].Quarantined)
+	assert.False(devices[1].Quarantined)
+	assert.Equal([]string{"plug (10.0.0.1)"}, quarantinedDevices(devices))
+	assert.Contains(deviceStates(devices[0]), "quarantined")
+
+	// quarantined devices are only left alone by the automatic actions
+	assert.False(mayAutomate(devices[0]))
+	assert.True(mayModify(devices[0]))
+	assert.True(mayAutomate(devices[1]))
+}
+
+func Test_liftQuarantine(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	inv := &inventory{Devices: map[string]*inventoryRecord{
+		"10.0.0.1": {Name: "plug", Tags: []string{"kitchen", "quarantined"}, Failures: 5},
+		"10.0.0.2": {Name: "lamp"},
+	}}
+	assert.Nil(inv.liftQuarantine("plug"))
+	assert.Equal([]string{"kitchen"}, inv.Devices["10.0.0.1"].Tags)
+	assert.Equal(0, inv.Devices["10.0.0.1"].Failures)
+	assert.Equal("released", inv.History[0].Kind)
+
+	assert.NotNil(inv.liftQuarantine("10.0.0.2"))
+	assert.NotNil(inv.liftQuarantine("10.0.0.9"))
+}
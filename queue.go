@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/jedib0t/go-pretty/v6/table"
+)
+
+// queuedAction is an action that is deferred until its device can be reached and the given time has passed
+type queuedAction struct {
+	ID        int       `json:"id"`
+	Device    string    `json:"device"`
+	Action    string    `json:"action"`
+	Command   string    `json:"command,omitempty"`
+	NotBefore time.Time `json:"notBefore"`
+	Created   time.Time `json:"created"`
+	Attempts  int       `json:"attempts"`
+}
+
+// enqueue adds an action for the device with the given IP to the queue and returns its ID.
+// Valid actions are "update" and "command".
+func (inv *inventory) enqueue(device string, action string, command string, notBefore time.Time) int {
+	inv.NextID++
+	inv.Queue = append(inv.Queue, queuedAction{
+		ID:        inv.NextID,
+		Device:    device,
+		Action:    action,
+		Command:   command,
+		NotBefore: notBefore,
+		Created:   time.Now(),
+	})
+	return inv.NextID
+}
+
+// cancel removes the action with the given ID from the queue
+func (inv *inventory) cancel(id int) error {
+	for i, action := range inv.Queue {
+		if action.ID == id {
+			inv.Queue = append(inv.Queue[:i], inv.Queue[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("No queued action with ID " + strconv.Itoa(id))
+}
+
+// executeAction runs a queued command on the given device
+func executeAction(ctx context.Context, action queuedAction, device *tasmoDevice, inv *inventory) error {
+	if device.Quarantined {
+		return errors.New("device is quarantined")
+	}
+	if !mayModify(*device) {
+		return errors.New("device may not be modified")
+	}
+	switch action.Action {
+	case "command":
+		_, err := sendCommand(device.IP.String(), action.Command)
+		return err
+	}
+	return errors.New("Unknown action " + action.Action)
+}
+
+// processQueue executes all queued commands whose devices were found in the scan and whose time has
+// come. Successful commands are removed from the queue, failed ones are tried again on the next run.
+// Queued updates are left to the rollout, see dropCurrentUpdates.
+func processQueue(ctx context.Context, inv *inventory, devices []tasmoDevice) {
+	found := make(map[string]*tasmoDevice)
+	for i := range devices {
+		found[devices[i].key()] = &devices[i]
+	}
+	remaining := make([]queuedAction, 0, len(inv.Queue))
+	for _, action := range inv.Queue {
+		device, ok := found[action.Device]
+		if !ok || action.Action == "update" || time.Now().Before(action.NotBefore) {
+			remaining = append(remaining, action)
+			continue
+		}
+		action.Attempts++
+		if err := executeAction(ctx, action, device, inv); err != nil {
+			audit("Queued action " + strconv.Itoa(action.ID) + " (" + action.Action + ") on " + action.Device + " failed: " + err.Error())
+			remaining = append(remaining, action)
+			continue
+		}
+		audit("Queued action " + strconv.Itoa(action.ID) + " (" + action.Action + ") on " + action.Device + " executed")
+	}
+	inv.Queue = remaining
+}
+
+// queuedUpdate reports if an update of the device is queued
+func (inv *inventory) queuedUpdate(device string) bool {
+	for _, action := range inv.Queue {
+		if action.Device == device && action.Action == "update" {
+			return true
+		}
+	}
+	return false
+}
+
+// dequeueUpdates removes the queued updates of the device
+func (inv *inventory) dequeueUpdates(device string) {
+	remaining := make([]queuedAction, 0, len(inv.Queue))
+	for _, action := range inv.Queue {
+		if action.Device != device || action.Action != "update" {
+			remaining = append(remaining, action)
+		}
+	}
+	inv.Queue = remaining
+}
+
+// dropCurrentUpdates removes the queued updates of the found devices that are no longer outdated, e.g.
+// as a late update arrived after all or the device was updated by hand. The updates of outdated devices
+// stay queued until a rollout updated them, which applies the same gates as to any other device.
+// Devices whose target version is unknown keep their updates.
+func dropCurrentUpdates(inv *inventory, devices []tasmoDevice, latest *version.Version) {
+	for _, device := range devices {
+		if device.Outdated || device.Unrecognized || targetVersion(device, latest) == nil || !inv.queuedUpdate(device.key()) {
+			continue
+		}
+		if deviceVersion, _ := version.NewVersion(device.FirmwareVersion); deviceVersion == nil {
+			continue
+		}
+		inv.dequeueUpdates(device.key())
+		audit("Dropped the queued update of " + device.key() + ", it already runs " + device.FirmwareVersion)
+	}
+}
+
+// renderQueue generates a table of all queued actions
+func renderQueue(queue []queuedAction) string {
+	t := table.NewWriter()
+	t.AppendHeader(table.Row{"ID", "Device", "Action", "Not before", "Attempts"})
+	for _, action := range queue {
+		description := action.Action
+		if action.Command != "" {
+			description += " \"" + action.Command + "\""
+		}
+		notBefore := ""
+		if !action.NotBefore.IsZero() {
+			notBefore = action.NotBefore.Local().Format("2006-01-02 15:04")
+		}
+		t.AppendRow(table.Row{action.ID, action.Device, description, notBefore, action.Attempts})
+	}
+	return t.Render()
+}
+
+// parseNotBefore converts either a duration from now (e.g. "2h") or an RFC 3339 timestamp to a time
+func parseNotBefore(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_enqueueAndCancel(t *testing.T) {
+	assert := assert.New(t)
+	inv, _ := loadInventory("")
+	first := inv.enqueue("1.1.1.1", "update", "", time.Time{})
+	second := inv.enqueue("1.1.1.2", "command", "Restart 1", time.Time{})
+	assert.Equal(1, first)
+	assert.Equal(2, second)
+	assert.Nil(inv.cancel(first))
+	assert.NotNil(inv.cancel(first))
+	assert.Len(inv.Queue, 1)
+	assert.Equal("Restart 1", inv.Queue[0].Command)
+}
+
+func Test_processQueue(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("auditlog", "")
+	inv, _ := loadInventory("")
+	inv.enqueue("1.1.1.1", "command", "Power On", time.Time{})
+	inv.enqueue("127.0.0.1", "command", "Power Off", time.Now().Add(time.Hour))
+	inv.enqueue("127.0.0.1", "reboot", "", time.Time{})
+
+	// only the due action of the found device is attempted and kept for a retry as it fails
+	processQueue(context.Background(), inv, []tasmoDevice{{IP: net.IPv4(127, 0, 0, 1)}})
+	assert.Len(inv.Queue, 3)
+	assert.Equal(0, inv.Queue[0].Attempts)
+	assert.Equal(0, inv.Queue[1].Attempts)
+	assert.Equal(1, inv.Queue[2].Attempts)
+
+	// updates are left to the rollout
+	inv, _ = loadInventory("")
+	inv.enqueue("127.0.0.1", "update", "", time.Time{})
+	processQueue(context.Background(), inv, []tasmoDevice{{IP: net.IPv4(127, 0, 0, 1), FirmwareType: "tasmota"}})
+	assert.Len(inv.Queue, 1)
+	assert.Equal(0, inv.Queue[0].Attempts)
+}
+
+func Test_dropCurrentUpdates(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	viper.Set("auditlog", "")
+	target, _ := version.NewVersion("9.2.0")
+	inv, _ := loadInventory("")
+	inv.enqueue("10.0.0.1", "update", "", time.Time{})
+	inv.enqueue("10.0.0.1", "command", "Power On", time.Time{})
+	inv.enqueue("10.0.0.2", "update", "", time.Time{})
+	inv.enqueue("10.0.0.3", "update", "", time.Time{})
+	inv.enqueue("10.0.0.4", "update", "", time.Time{})
+	devices := []tasmoDevice{
+		// updated after the verification gave up
+		{IP: net.ParseIP("10.0.0.1"), FirmwareType: "tasmota", FirmwareVersion: "9.2.0"},
+		{IP: net.ParseIP("10.0.0.2"), FirmwareType: "tasmota", FirmwareVersion: "9.1.0"},
+		{IP: net.ParseIP("10.0.0.3"), FirmwareType: "tasmota", FirmwareVersion: "9.2.0", Unrecognized: true},
+	}
+	checkDevices(devices, target)
+	dropCurrentUpdates(inv, devices, target)
+	assert.Len(inv.Queue, 4)
+	assert.Equal("command", inv.Queue[0].Action)
+	assert.Equal("10.0.0.2", inv.Queue[1].Device)
+	assert.Equal("10.0.0.3", inv.Queue[2].Device)
+	assert.Equal("10.0.0.4", inv.Queue[3].Device)
+	// without a target version nothing is known to be current
+	inv.enqueue("10.0.0.1", "update", "", time.Time{})
+	dropCurrentUpdates(inv, devices, nil)
+	assert.Len(inv.Queue, 5)
+}
+
+func Test_runScanQueuedUpdate(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	viper.Set("auditlog", "")
+	viper.Set("progress", false)
+	viper.Set("output", "json")
+	viper.Set("discovery", "cidr")
+	viper.Set("cidr", "127.0.0.1/32")
+	viper.Set("targetversion", "9.2.0")
+	dir := t.TempDir()
+	path := filepath.Join(dir, "inventory.json")
+	viper.Set("inventory", path)
+	viper.Set("rolloutfile", filepath.Join(dir, "rollout.json"))
+	viper.Set("backupdir", filepath.Join(dir, "backups"))
+	inv, _ := loadInventory("")
+	inv.enqueue("127.0.0.1", "update", "", time.Time{})
+	assert.Nil(inv.save(path))
+	fake := fakeDevices(t, map[string]map[string]string{
+		"127.0.0.1": {"Status 0": `{"StatusFWR": {"Version": "9.1.0(tasmota)"}}`},
+	})
+
+	// a scan doesn't update the device, the update stays queued
+	devices, _ := runScan(context.Background(), scanOptions{})
+	assert.Len(devices, 1)
+	assert.True(devices[0].Outdated)
+	assert.NotContains(fake.Commands, "127.0.0.1: Upgrade 1")
+	inv, _ = loadInventory(path)
+	assert.Len(inv.Queue, 1)
+
+	// once the device is current, the queued update is dropped without touching it
+	fake.Devices["127.0.0.1"]["Status 0"] = `{"StatusFWR": {"Version": "9.2.0(tasmota)"}}`
+	runScan(context.Background(), scanOptions{Update: true})
+	assert.NotContains(fake.Commands, "127.0.0.1: Upgrade 1")
+	inv, _ = loadInventory(path)
+	assert.Empty(inv.Queue)
+}
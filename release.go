@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/spf13/viper"
+)
+
+// versionLookup is a lookup of the latest release running in the background, so a slow GitHub doesn't
+// hold up the discovery of the devices
+type versionLookup struct {
+	done    chan struct{}
+	version *version.Version
+	err     error
+}
+
+// startVersionLookup runs the given lookup in the background
+func startVersionLookup(lookup func() (*version.Version, error)) *versionLookup {
+	l := &versionLookup{done: make(chan struct{})}
+	go func() {
+		l.version, l.err = lookup()
+		close(l.done)
+	}()
+	return l
+}
+
+// wait returns the result of the lookup once it finished, but gives up at the deadline. A zero deadline
+// waits as long as the lookup takes.
+func (l *versionLookup) wait(deadline time.Time) (*version.Version, error) {
+	if deadline.IsZero() {
+		<-l.done
+		return l.version, l.err
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-l.done:
+		return l.version, l.err
+	case <-timer.C:
+		return nil, errors.New("no answer within " + viper.GetDuration("versiontimeout").String())
+	}
+}
+
+// resolveRelease waits for the lookup of the latest release until TASMOGO_VERSIONTIMEOUT after the
+// start of the run and remembers the result in the inventory. If the lookup fails or takes too long, the
+// release found by the last successful lookup is used instead. Without one, only the custom builds and
+// the pinned devices are checked. The second return value tells if the release is a fallback.
+func resolveRelease(l *versionLookup, started time.Time, inv *inventory) (*version.Version, bool) {
+	var deadline time.Time
+	if timeout := viper.GetDuration("versiontimeout"); timeout > 0 {
+		deadline = started.Add(timeout)
+	}
+	current, err := l.wait(deadline)
+	if err == nil {
+		inv.Release, inv.ReleaseChecked = current.String(), time.Now()
+		return current, false
+	}
+	if previous, perr := version.NewVersion(inv.Release); inv.Release != "" && perr == nil {
+		logWarn("Getting current Tasmota version failed, using " + previous.String() + " from " + formatSeen(inv.ReleaseChecked) + " instead: " + err.Error())
+		return previous, true
+	}
+	logWarn("Getting current Tasmota version failed, only checking the custom builds and pinned devices: " + err.Error())
+	return nil, true
+}
+
+// versionString returns the version for display, "unknown" if there is none
+func versionString(v *version.Version) string {
+	if v == nil {
+		return "unknown"
+	}
+	return v.String()
+}
+
+// describeRelease notes the release the devices were checked against if it isn't the result of a
+// lookup in this run
+func describeRelease(current *version.Version, fallback bool, inv *inventory) string {
+	switch {
+	case !fallback:
+		return ""
+	case current == nil:
+		return "The latest release is unknown, devices running an official build weren't checked for updates"
+	}
+	return "The latest release couldn't be looked up, devices were checked against " + current.String() + " from " + formatSeen(inv.ReleaseChecked)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_resolveRelease(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	viper.Set("versiontimeout", 50*time.Millisecond)
+	inv := &inventory{Devices: make(map[string]*inventoryRecord)}
+
+	// a successful lookup is remembered
+	l := startVersionLookup(func() (*version.Version, error) { return version.NewVersion("12.1.1") })
+	v, fallback := resolveRelease(l, time.Now(), inv)
+	assert.Equal("12.1.1", v.String())
+	assert.False(fallback)
+	assert.Equal("12.1.1", inv.Release)
+	assert.False(inv.ReleaseChecked.IsZero())
+	assert.Equal("", describeRelease(v, fallback, inv))
+
+	// a failed lookup falls back to the remembered release
+	l = startVersionLookup(func() (*version.Version, error) { return nil, errors.New("rate limited") })
+	v, fallback = resolveRelease(l, time.Now(), inv)
+	assert.Equal("12.1.1", v.String())
+	assert.True(fallback)
+	assert.Contains(describeRelease(v, fallback, inv), "checked against 12.1.1")
+
+	// a slow lookup isn't waited for
+	block := make(chan struct{})
+	defer close(block)
+	l = startVersionLookup(func() (*version.Version, error) {
+		<-block
+		return version.NewVersion("13.0.0")
+	})
+	start := time.Now()
+	v, fallback = resolveRelease(l, start, inv)
+	assert.Equal("12.1.1", v.String())
+	assert.True(fallback)
+	assert.Less(int64(time.Since(start)), int64(time.Second))
+
+	// without a remembered release no official builds are checked
+	inv.Release = ""
+	l = startVersionLookup(func() (*version.Version, error) { return nil, errors.New("offline") })
+	v, fallback = resolveRelease(l, time.Now(), inv)
+	assert.Nil(v)
+	assert.True(fallback)
+	assert.Contains(describeRelease(v, fallback, inv), "unknown")
+}
+
+func Test_versionLookup_wait(t *testing.T) {
+	assert := assert.New(t)
+	// a zero deadline waits for the lookup
+	l := startVersionLookup(func() (*version.Version, error) {
+		time.Sleep(10 * time.Millisecond)
+		return version.NewVersion("12.0.0")
+	})
+	v, err := l.wait(time.Time{})
+	assert.Nil(err)
+	assert.Equal("12.0.0", v.String())
+
+	// a deadline in the past gives up immediately
+	block := make(chan struct{})
+	defer close(block)
+	l = startVersionLookup(func() (*version.Version, error) {
+		<-block
+		return nil, nil
+	})
+	_, err = l.wait(time.Now().Add(-time.Second))
+	assert.NotNil(err)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-version"
+	"github.com/spf13/viper"
+)
+
+// releaseSections are the sections of the Tasmota changelog in the order they are summarized, with the
+// word used in the summary
+var releaseSections = []struct {
+	Heading string
+	Word    string
+}{
+	{"breaking changed", "breaking"},
+	{"added", "added"},
+	{"changed", "changed"},
+	{"fixed", "fixed"},
+	{"removed", "removed"},
+}
+
+// releaseNotes is the condensed changelog of a release: the number of entries per section and the
+// breaking changes, which are the ones worth reading before an update
+type releaseNotes struct {
+	Version  *version.Version
+	Counts   map[string]int
+	Breaking []string
+}
+
+// summary returns the release notes in a single line like "9.3.0: 12 added, 3 fixed; breaking: ..."
+func (n releaseNotes) summary() string {
+	counts := make([]string, 0, len(releaseSections))
+	for _, section := range releaseSections {
+		if count := n.Counts[section.Heading]; count > 0 {
+			counts = append(counts, strconv.Itoa(count)+" "+section.Word)
+		}
+	}
+	line := n.Version.String() + ": "
+	if len(counts) == 0 {
+		line += "no changelog"
+	} else {
+		line += strings.Join(counts, ", ")
+	}
+	if len(n.Breaking) > 0 {
+		line += "; breaking: " + strings.Join(n.Breaking, "; ")
+	}
+	return line
+}
+
+// parseReleaseNotes counts the entries of the "### Added", "### Fixed" ... sections of a release body
+// and keeps the text of the breaking changes
+func parseReleaseNotes(v *version.Version, body string) releaseNotes {
+	n := releaseNotes{Version: v, Counts: make(map[string]int), Breaking: make([]string, 0)}
+	section := ""
+	lines := bufio.NewScanner(strings.NewReader(body))
+	for lines.Scan() {
+		line := strings.TrimSpace(lines.Text())
+		switch {
+		case strings.HasPrefix(line, "#"):
+			section = strings.ToLower(strings.TrimSpace(strings.TrimLeft(line, "#")))
+		case section != "" && (strings.HasPrefix(line, "- ") || strings.HasPrefix(line, "* ")):
+			n.Counts[section]++
+			if section == "breaking changed" {
+				n.Breaking = append(n.Breaking, strings.TrimSpace(line[2:]))
+			}
+		}
+	}
+	return n
+}
+
+// githubReleases lists the release notes of a GitHub repository with conditional requests
+type githubReleases struct {
+	Owner      string
+	Repository string
+	// URL is the base URL of the API, it defaults to https://api.github.com
+	URL    string
+	getter func() *conditionalGetter
+}
+
+// releaseNotesSource is where the release notes of Tasmota are read from
+var releaseNotesSource = &githubReleases{
+	Owner:      versionData.Owner,
+	Repository: versionData.Repository,
+	getter:     sharedHTTPCache,
+}
+
+// Fetch returns the condensed notes of the releases, oldest first. Drafts, pre-releases and tags that
+// are no version are ignored.
+func (g *githubReleases) Fetch(ctx context.Context) ([]releaseNotes, error) {
+	base := g.URL
+	if base == "" {
+		base = "https://api.github.com"
+	}
+	body, err := g.getter().get(ctx, strings.TrimSuffix(base, "/")+"/repos/"+g.Owner+"/"+g.Repository+"/releases?per_page=100")
+	if err != nil {
+		return nil, err
+	}
+	var releases []struct {
+		TagName    string `json:"tag_name"`
+		Body       string `json:"body"`
+		Draft      bool   `json:"draft"`
+		Prerelease bool   `json:"prerelease"`
+	}
+	if err := json.Unmarshal(body, &releases); err != nil {
+		return nil, err
+	}
+	notes := make([]releaseNotes, 0, len(releases))
+	for _, release := range releases {
+		v, err := version.NewVersion(strings.TrimPrefix(release.TagName, "v"))
+		if err != nil || release.Draft || release.Prerelease {
+			continue
+		}
+		notes = append(notes, parseReleaseNotes(v, release.Body))
+	}
+	sort.Slice(notes, func(i, j int) bool { return notes[i].Version.LessThan(notes[j].Version) })
+	return notes, nil
+}
+
+// upgradeNotes are the release notes between the firmware of some devices and their target version
+type upgradeNotes struct {
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	Devices  []string `json:"devices"`
+	Releases []string `json:"releases"`
+}
+
+// notesBetween returns the summaries of the releases newer than from, up to and including to
+func notesBetween(notes []releaseNotes, from *version.Version, to *version.Version) []string {
+	summaries := make([]string, 0)
+	for _, n := range notes {
+		if n.Version.GreaterThan(from) && !n.Version.GreaterThan(to) {
+			summaries = append(summaries, n.summary())
+		}
+	}
+	return summaries
+}
+
+// upgradePaths groups the outdated devices by their firmware and target version and adds the release
+// notes in between, the oldest firmware first
+func upgradePaths(devices []tasmoDevice, latest *version.Version, notes []releaseNotes) []upgradeNotes {
+	paths := make([]upgradeNotes, 0)
+	index := make(map[string]int)
+	versions := make(map[string]*version.Version)
+	for _, device := range devices {
+		if !device.Outdated {
+			continue
+		}
+		from, err := version.NewVersion(device.FirmwareVersion)
+		to := targetVersion(device, latest)
+		if err != nil || to == nil {
+			continue
+		}
+		key := from.String() + " " + to.String()
+		if i, ok := index[key]; ok {
+			paths[i].Devices = append(paths[i].Devices, device.Name)
+			continue
+		}
+		index[key] = len(paths)
+		versions[from.String()] = from
+		paths = append(paths, upgradeNotes{From: from.String(), To: to.String(), Devices: []string{device.Name}, Releases: notesBetween(notes, from, to)})
+	}
+	sort.SliceStable(paths, func(i, j int) bool {
+		return versions[paths[i].From].LessThan(versions[paths[j].From])
+	})
+	return paths
+}
+
+// whatsNew returns the release notes between the firmware of the outdated devices and their target if
+// TASMOGO_RELEASENOTES is set. Without them, nothing is returned.
+func whatsNew(ctx context.Context, devices []tasmoDevice, latest *version.Version) []upgradeNotes {
+	if !viper.GetBool("releasenotes") {
+		return nil
+	}
+	outdated := false
+	for _, device := range devices {
+		outdated = outdated || device.Outdated
+	}
+	if !outdated {
+		return nil
+	}
+	notes, err := releaseNotesSource.Fetch(ctx)
+	if err != nil {
+		logWarn("Fetching the release notes failed: " + err.Error())
+		return nil
+	}
+	return upgradePaths(devices, latest, notes)
+}
+
+// renderWhatsNew lists the release notes of each upgrade path as text
+func renderWhatsNew(paths []upgradeNotes) string {
+	var b strings.Builder
+	for i, p := range paths {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString("From " + p.From + " to " + p.To + " (" + strings.Join(p.Devices, ", ") + "):")
+		for _, release := range p.Releases {
+			b.WriteString("\n  " + release)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hashicorp/go-version"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseReleaseNotes(t *testing.T) {
+	assert := assert.New(t)
+	body := "## Changelog v9.3.0\n### Added\n- Command ``SetOption120``\n- Support for BL0939\n### Breaking Changed\n- ESP32 switch from default SPIFFS to default LittleFS\n### Fixed\n* Energy total counters\n"
+	n := parseReleaseNotes(version.Must(version.NewVersion("9.3.0")), body)
+	assert.Equal(map[string]int{"added": 2, "breaking changed": 1, "fixed": 1}, n.Counts)
+	assert.Equal("9.3.0: 1 breaking, 2 added, 1 fixed; breaking: ESP32 switch from default SPIFFS to default LittleFS", n.summary())
+
+	n = parseReleaseNotes(version.Must(version.NewVersion("9.2.1")), "Bugfix release")
+	assert.Equal("9.2.1: no changelog", n.summary())
+}
+
+func Test_githubReleases(t *testing.T) {
+	assert := assert.New(t)
+	releases, _ := json.Marshal([]map[string]interface{}{
+		{"tag_name": "v9.4.0-rc1", "prerelease": true, "body": "### Added\n- Preview"},
+		{"tag_name": "v9.3.0", "body": "### Added\n- Command SetOption120\n### Fixed\n- Energy"},
+		{"tag_name": "v9.2.0", "body": "### Changed\n- Core 2.7.4.9"},
+		{"tag_name": "v9.1.0", "body": "### Fixed\n- Wi-Fi"},
+		{"tag_name": "nightly", "body": "### Fixed\n- Everything"},
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/repos/arendst/tasmota/releases", r.URL.Path)
+		_, _ = w.Write(releases)
+	}))
+	defer srv.Close()
+
+	g := newConditionalGetter("")
+	source := &githubReleases{Owner: "arendst", Repository: "tasmota", URL: srv.URL, getter: func() *conditionalGetter { return g }}
+	notes, err := source.Fetch(context.Background())
+	assert.Nil(err)
+	assert.Len(notes, 3)
+	assert.Equal("9.1.0", notes[0].Version.String())
+
+	latest := version.Must(version.NewVersion("9.3.0"))
+	devices := []tasmoDevice{
+		{Name: "plug", IP: net.IPv4(10, 0, 0, 1), FirmwareVersion: "9.2.0", Outdated: true},
+		{Name: "lamp", IP: net.IPv4(10, 0, 0, 2), FirmwareVersion: "9.1.0", Outdated: true},
+		{Name: "fan", IP: net.IPv4(10, 0, 0, 3), FirmwareVersion: "9.1.0", Outdated: true},
+		{Name: "heater", IP: net.IPv4(10, 0, 0, 4), FirmwareVersion: "9.3.0"},
+	}
+	paths := upgradePaths(devices, latest, notes)
+	assert.Equal([]upgradeNotes{
+		{From: "9.1.0", To: "9.3.0", Devices: []string{"lamp", "fan"}, Releases: []string{"9.2.0: 1 changed", "9.3.0: 1 added, 1 fixed"}},
+		{From: "9.2.0", To: "9.3.0", Devices: []string{"plug"}, Releases: []string{"9.3.0: 1 added, 1 fixed"}},
+	}, paths)
+	assert.Equal("From 9.1.0 to 9.3.0 (lamp, fan):\n  9.2.0: 1 changed\n  9.3.0: 1 added, 1 fixed\nFrom 9.2.0 to 9.3.0 (plug):\n  9.3.0: 1 added, 1 fixed", renderWhatsNew(paths))
+
+	// the release notes are only fetched if asked for
+	defer viper.Reset()
+	setDefaults()
+	assert.Nil(whatsNew(context.Background(), devices, latest))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"html/template"
+	"io"
+	"strings"
+	"time"
+)
+
+// reportTemplate is a printable HTML page, so the report can be saved as PDF from any browser
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; font-size: 11pt; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border: 1px solid #999; padding: 0.3em 0.5em; text-align: left; }
+th { background: #eee; }
+tr { page-break-inside: avoid; }
+.outdated { color: #b00; }
+@page { size: A4 landscape; margin: 1.5cm; }
+@media print { body { margin: 0; } }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Generated on {{.Generated.Format "2006-01-02 15:04 MST"}}. The latest Tasmota release is {{.Latest}}.</p>
+<p>{{len .Devices}} devices, {{.UpToDate}} up to date, {{.Outdated}} outdated{{if .Unknown}}, {{.Unknown}} with an unknown firmware version{{end}}.</p>
+<table>
+<tr><th>Name</th><th>IP</th><th>MAC</th><th>Firmware</th><th>Variant</th><th>Groups</th><th>Status</th><th>Last update</th></tr>
+{{range .Devices}}<tr>
+<td>{{.Name}}</td><td>{{.IP}}</td><td>{{.MAC}}</td><td>{{.Firmware}}</td><td>{{.Variant}}</td><td>{{.Groups}}</td>
+<td{{if .Outdated}} class="outdated"{{end}}>{{.Status}}</td><td>{{.LastUpdate}}</td>
+</tr>
+{{end}}</table>
+{{if .WhatsNew}}<h2>What's new</h2>
+{{range .WhatsNew}}<h3>From {{.From}} to {{.To}}</h3>
+<p>{{range $i, $d := .Devices}}{{if $i}}, {{end}}{{$d}}{{end}}</p>
+<ul>
+{{range .Releases}}<li>{{.}}</li>
+{{end}}</ul>
+{{end}}{{end}}</body>
+</html>
+`))
+
+// reportDevice is a row of the fleet report
+type reportDevice struct {
+	Name       string
+	IP         string
+	MAC        string
+	Firmware   string
+	Variant    string
+	Groups     string
+	Outdated   bool
+	Status     string
+	LastUpdate string
+}
+
+// report is the data of the fleet report
+type report struct {
+	Title     string
+	Generated time.Time
+	Latest    string
+	Devices   []reportDevice
+	UpToDate  int
+	Outdated  int
+	Unknown   int
+	WhatsNew  []upgradeNotes
+}
+
+// writeReport writes a printable HTML report of the devices, their firmware and the time of their last
+// update by tasmogo to w, followed by the release notes between the firmware of the outdated devices
+// and their target
+func writeReport(w io.Writer, title string, devices []tasmoDevice, inv *inventory, latest string, whatsNew []upgradeNotes) error {
+	r := report{Title: title, Generated: inScheduleZone(time.Now()), Latest: latest, Devices: make([]reportDevice, 0, len(devices)), WhatsNew: whatsNew}
+	for _, device := range devices {
+		row := reportDevice{
+			Name:       device.Name,
+			IP:         device.address(),
+			MAC:        device.MAC,
+			Firmware:   device.FirmwareVersion,
+			Variant:    device.FirmwareType,
+			Groups:     strings.Join(deviceGroups(device), ", "),
+			Outdated:   device.Outdated,
+			Status:     strings.Join(deviceStates(device), ", "),
+			LastUpdate: "unknown",
+		}
+		switch {
+		case device.Outdated:
+			r.Outdated++
+		case device.Unrecognized:
+			// the version can't be compared, so the device may just as well be outdated
+			row.Status = strings.Join(append([]string{"unknown"}, deviceStates(device)...), ", ")
+			r.Unknown++
+		default:
+			row.Status = strings.Join(append([]string{"up to date"}, deviceStates(device)...), ", ")
+			r.UpToDate++
+		}
+		if rec, ok := inv.Devices[device.key()]; ok && !rec.LastUpdate.IsZero() {
+			row.LastUpdate = inScheduleZone(rec.LastUpdate).Format("2006-01-02")
+		}
+		r.Devices = append(r.Devices, row)
+	}
+	return reportTemplate.Execute(w, r)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_writeReport(t *testing.T) {
+	assert := assert.New(t)
+	inv := &inventory{Devices: map[string]*inventoryRecord{
+		"10.0.0.1": {LastUpdate: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)},
+	}}
+	devices := []tasmoDevice{
+		{Name: "plug", IP: net.ParseIP("10.0.0.1"), FirmwareVersion: "9.2.0", FirmwareType: "tasmota"},
+		{Name: "<garage>", IP: net.ParseIP("10.0.0.2"), FirmwareVersion: "9.1.0", FirmwareType: "sensors", Outdated: true, Protected: true},
+	}
+	var buf bytes.Buffer
+	assert.Nil(writeReport(&buf, "Main street 1", devices, inv, "9.2.0", nil))
+	html := buf.String()
+	assert.Contains(html, "<h1>Main street 1</h1>")
+	assert.Contains(html, "2 devices, 1 up to date, 1 outdated.")
+	assert.Contains(html, "<td>up to date</td><td>2021-03-01</td>")
+	assert.Contains(html, `<td class="outdated">outdated, protected</td><td>unknown</td>`)
+	// device names are escaped
+	assert.Contains(html, "&lt;garage&gt;")
+	assert.NotContains(html, "What's new")
+	assert.NotContains(html, "unknown firmware version")
+
+	// devices with a version of an unknown format are neither up to date nor outdated
+	unrecognized := append(devices, tasmoDevice{Name: "clone", IP: net.ParseIP("10.0.0.3"), FirmwareVersion: "v2-beta", FirmwareType: "tasmota", Unrecognized: true})
+	buf.Reset()
+	assert.Nil(writeReport(&buf, "Main street 1", unrecognized, inv, "9.2.0", nil))
+	assert.Contains(buf.String(), "3 devices, 1 up to date, 1 outdated, 1 with an unknown firmware version.")
+	assert.Contains(buf.String(), "<td>unknown, unrecognized</td><td>unknown</td>")
+
+	buf.Reset()
+	notes := []upgradeNotes{{From: "9.1.0", To: "9.2.0", Devices: []string{"<garage>"}, Releases: []string{"9.2.0: 3 added"}}}
+	assert.Nil(writeReport(&buf, "Main street 1", devices, inv, "9.2.0", notes))
+	assert.Contains(buf.String(), "<h3>From 9.1.0 to 9.2.0</h3>\n<p>&lt;garage&gt;</p>\n<ul>\n<li>9.2.0: 3 added</li>")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+
+	"github.com/merlinschumacher/tasmogo/pkg/tasmota"
+)
+
+// retryable reports if probing an address failed in a way that might go away with another try, e.g.
+// during Wi-Fi trouble. Hosts that refuse the connection or aren't Tasmota devices are not retried.
+func retryable(err error) bool {
+	return errors.Is(err, tasmota.ErrTimeout) || errors.Is(err, tasmota.ErrUnauthorized) || errors.Is(err, tasmota.ErrParse)
+}
+
+// ipStrings converts IPs to strings
+func ipStrings(ips []net.IP) []string {
+	addresses := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addresses = append(addresses, ip.String())
+	}
+	return addresses
+}
+
+// rescanTargets returns the addresses that failed in the last run and the known devices that were
+// missing in it, unless they are archived
+func rescanTargets(inv *inventory) []net.IP {
+	keys := append([]string{}, inv.Errors...)
+	for ip, rec := range inv.Devices {
+		if rec.Missed > 0 && !rec.Archived {
+			keys = append(keys, ip)
+		}
+	}
+	sort.Strings(keys)
+	ips := make([]net.IP, 0, len(keys))
+	for _, key := range keys {
+		if ip := net.ParseIP(key); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// deviceFromRecord restores a device found by the last run from the inventory
+func deviceFromRecord(ip string, rec *inventoryRecord) tasmoDevice {
+	return tasmoDevice{
+		Name:            rec.Name,
+		IP:              net.ParseIP(ip),
+		MAC:             rec.MAC,
+		FirmwareVersion: rec.Version,
+		FirmwareType:    rec.Variant,
+		Signal:          rec.Signal,
+		FirstSeen:       rec.FirstSeen,
+		LastSeen:        rec.LastSeen,
+		Sources:         []string{"cache"},
+		Cached:          true,
+	}
+}
+
+// rescanErrors probes only the addresses that failed in the last run and merges the devices found with
+// the ones the last run found. It returns the devices and the addresses that failed again.
+func rescanErrors(ctx context.Context, inv *inventory) ([]tasmoDevice, []net.IP) {
+	var targets targetList
+	targets.add("rescan", rescanTargets(inv))
+	devices := targets.probe(ctx)
+	found := make(map[string]bool)
+	for _, device := range devices {
+		found[device.IP.String()] = true
+	}
+	for ip, rec := range inv.Devices {
+		if rec.Missed == 0 && !found[ip] && net.ParseIP(ip) != nil {
+			devices = append(devices, deviceFromRecord(ip, rec))
+		}
+	}
+	sortDevices(devices)
+	return devices, targets.failed
+}
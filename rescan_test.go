@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/merlinschumacher/tasmogo/pkg/tasmota"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_retryable(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(retryable(&tasmota.DeviceError{Kind: tasmota.ErrTimeout}))
+	assert.True(retryable(&tasmota.DeviceError{Kind: tasmota.ErrUnauthorized}))
+	assert.False(retryable(&tasmota.DeviceError{Kind: tasmota.ErrUnreachable}))
+	assert.False(retryable(&tasmota.DeviceError{Kind: tasmota.ErrNotTasmota}))
+}
+
+func Test_rescanTargets(t *testing.T) {
+	assert := assert.New(t)
+	inv, _ := loadInventory("")
+	inv.Errors = []string{"10.0.0.9", "10.0.0.3"}
+	inv.record("10.0.0.5").Missed = 1
+	inv.record("10.0.0.1")
+	assert.Equal([]string{"10.0.0.3", "10.0.0.5", "10.0.0.9"}, ipStrings(rescanTargets(inv)))
+}
+
+func Test_rescanErrors(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	viper.Set("progress", false)
+	inv, _ := loadInventory("")
+	inv.Errors = []string{"10.0.0.3"}
+	rec := inv.record("10.0.0.1")
+	rec.Name, rec.Version, rec.Variant = "plug", "9.1.0", "tasmota"
+	inv.record("10.0.0.2").Missed = 2
+	fake := fakeDevices(t, map[string]map[string]string{
+		"10.0.0.1": {"Status 0": `{"Status": {"DeviceName": "plug"}, "StatusFWR": {"Version": "9.2.0(tasmota)"}}`},
+		"10.0.0.3": {"Status 0": `{"Status": {"DeviceName": "lamp"}, "StatusFWR": {"Version": "9.2.0(tasmota)"}}`},
+	})
+	devices, failed := rescanErrors(context.Background(), inv)
+	assert.Empty(failed)
+	// the plug worked in the last run, so it isn't asked again
+	assert.ElementsMatch([]string{"10.0.0.2: Status 0", "10.0.0.3: Status 0"}, fake.Commands)
+	assert.NotContains(fake.Commands, "10.0.0.1: Status 0")
+	assert.Len(devices, 2)
+	assert.Equal("plug", devices[0].Name)
+	assert.True(devices[0].Cached)
+	assert.Equal("9.1.0", devices[0].FirmwareVersion)
+	assert.Equal("lamp", devices[1].Name)
+	assert.False(devices[1].Cached)
+
+	// cached devices are neither tracked nor updated
+	trackDevices(inv, devices)
+	assert.Equal(0, inv.Devices["10.0.0.1"].Missed)
+	assert.True(inv.Devices["10.0.0.1"].LastSeen.IsZero())
+	assert.Equal(3, inv.Devices["10.0.0.2"].Missed)
+	devices[0].Outdated = true
+	assert.Empty(pendingUpdates(devices))
+	assert.Contains(deviceStates(devices[0]), "cached")
+}
+
+func Test_deviceFromRecord(t *testing.T) {
+	assert := assert.New(t)
+	device := deviceFromRecord("10.0.0.1", &inventoryRecord{Name: "plug", MAC: "DC:4F:22:00:12:34", Version: "9.1.0", Variant: "sensors"})
+	assert.Equal(net.ParseIP("10.0.0.1"), device.IP)
+	assert.Equal("sensors", device.FirmwareType)
+	assert.Equal([]string{"cache"}, device.Sources)
+}
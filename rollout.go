@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/spf13/viper"
+)
+
+// updateBatch updates and verifies the devices with the given indices and returns the outcome of the
+// update commands and the number of devices that failed. Their progress is recorded in the rollout
+// state.
+func updateBatch(ctx context.Context, devices []tasmoDevice, indices []int, target *version.Version, inv *inventory, state *rolloutState) ([]taskResult, int) {
+	batch := make([]tasmoDevice, 0, len(indices))
+	for _, i := range indices {
+		batch = append(batch, devices[i])
+	}
+	results := updateDevices(ctx, batch, inv, state)
+	verifyUpdates(ctx, batch, target, inv)
+	skipped := make(map[string]bool)
+	for _, result := range results {
+		skipped[result.IP] = result.Skipped
+	}
+	failures := 0
+	for k, i := range indices {
+		devices[i] = batch[k]
+		// the devices that weren't told to update stay pending, the ones that were stay commanded if the
+		// verification was stopped
+		switch {
+		case batch[k].Verified:
+			state.set(batch[k], rolloutVerified)
+		case skipped[batch[k].address()], ctx.Err() != nil && batch[k].UpdateURL != "":
+		default:
+			state.set(batch[k], rolloutFailed)
+		}
+		if batch[k].Outdated && !batch[k].Verified && !skipped[batch[k].address()] {
+			failures++
+		}
+	}
+	return results, failures
+}
+
+// pendingUpdates returns the indices of the outdated devices. Devices that were already told to update
+// are not updated twice, excluded, quarantined and unrecognized ones never and protected ones only if
+// forced.
+func pendingUpdates(devices []tasmoDevice) []int {
+	pending := make([]int, 0)
+	for i, device := range devices {
+		if device.Outdated && device.UpdateURL == "" && !device.Excluded && !device.Cached && !device.Unrecognized && mayAutomate(device) {
+			pending = append(pending, i)
+		}
+	}
+	return pending
+}
+
+// confirmUpdates asks for every device if it should be updated and returns the indices of the
+// confirmed ones. "a" confirms all remaining devices, "q" skips them.
+func confirmUpdates(devices []tasmoDevice, pending []int, in io.Reader, out io.Writer) []int {
+	reader := bufio.NewReader(in)
+	confirmed := make([]int, 0, len(pending))
+	for n, i := range pending {
+		device := devices[i]
+		for {
+			fmt.Fprintf(out, "Update %s (%s) from %s with %s? [y/n/a/q] ", device.Name, device.address(), device.FirmwareVersion, otaURLForDevice(device))
+			answer, err := reader.ReadString('\n')
+			if err != nil && answer == "" {
+				// without input nothing else is updated
+				fmt.Fprintln(out)
+				return confirmed
+			}
+			switch strings.ToLower(strings.TrimSpace(answer)) {
+			case "y", "yes":
+				confirmed = append(confirmed, i)
+			case "n", "no":
+			case "a", "all":
+				return append(confirmed, pending[n:]...)
+			case "q", "quit":
+				return confirmed
+			default:
+				continue
+			}
+			break
+		}
+	}
+	return confirmed
+}
+
+// renderUpdatePlan generates a table of the pending devices that would be updated and the firmware they
+// would get
+func renderUpdatePlan(devices []tasmoDevice, pending []int) string {
+	t := table.NewWriter()
+	t.AppendHeader(table.Row{"IP", "Name", "Version", "OTA URL"})
+	for _, i := range pending {
+		device := devices[i]
+		t.AppendRow(table.Row{device.address(), device.Name, device.FirmwareVersion, otaURLForDevice(device)})
+	}
+	return t.Render()
+}
+
+// rolloutUpdates updates the outdated devices in batches of TASMOGO_BATCHSIZE. Every batch has to
+// come back with the new firmware before the next one starts. Once more than TASMOGO_MAXFAILURES
+// devices failed, the remaining devices are left alone. No more than TASMOGO_MAXUPDATES devices are
+// updated per run. No further batch is started once ctx is cancelled. New releases go to the canaries
+// first, the devices with the best Wi-Fi quality before the others.
+func rolloutUpdates(ctx context.Context, devices []tasmoDevice, target *version.Version, inv *inventory) {
+	pending := signalOrder(devices, canaryGate(devices, pendingUpdates(devices), target, inv, time.Now()))
+	if viper.GetBool("interactive") {
+		pending = confirmUpdates(devices, pending, os.Stdin, os.Stdout)
+	}
+	if maxUpdates := viper.GetInt("maxupdates"); maxUpdates > 0 && len(pending) > maxUpdates {
+		logInfo("Updating only " + strconv.Itoa(maxUpdates) + " of " + strconv.Itoa(len(pending)) + " outdated devices in this run")
+		pending = pending[:maxUpdates]
+	}
+	state, pending := startRollout(devices, pending, target, time.Now())
+	batches := rolloutBatches(devices, pending, viper.GetInt("batchsize"))
+	maxFailures := viper.GetInt("maxfailures")
+	failures := 0
+	results := make([]taskResult, 0, len(pending))
+	defer func() {
+		if len(results) > 0 {
+			logInfo("Update commands:\n" + renderUpdateCommands(results))
+		}
+	}()
+	started := 0
+	for n, batch := range batches {
+		if ctx.Err() != nil {
+			logInfo("Stopping the rollout, " + strconv.Itoa(len(pending)-started) + " devices were not updated")
+			return
+		}
+		// the rollout is left unfinished, so it can be resumed in the next window
+		if reason, held := updatesHeld(time.Now()); held {
+			logInfo("Stopping the rollout, " + reason + ", " + strconv.Itoa(len(pending)-started) + " devices were not updated")
+			return
+		}
+		if maxFailures > 0 && failures > maxFailures {
+			audit("Aborted the rollout after " + strconv.Itoa(failures) + " failed updates, " + strconv.Itoa(len(pending)-started) + " devices were not updated")
+			return
+		}
+		if len(batches) > 1 {
+			logInfo("Updating batch " + strconv.Itoa(n+1) + " of " + strconv.Itoa(len(batches)))
+		}
+		batchResults, batchFailures := updateBatch(ctx, devices, batch, target, inv, state)
+		results = append(results, batchResults...)
+		failures += batchFailures
+		started += len(batch)
+	}
+	// a rollout stopped during the last batch is left for TASMOGO_RESUME
+	if ctx.Err() == nil {
+		state.finish()
+	}
+}
+
+// defaultGroupTopics are the group topics of Tasmota out of the box, which every device shares
+var defaultGroupTopics = map[string]bool{"tasmotas": true, "sonoffs": true}
+
+// updateGroups returns the groups a device shares with others over MQTT: its topic and its group
+// topic, unless that is the default one. Members of a group may control each other, e.g. a switch and
+// the relay it drives, so they aren't updated at the same time.
+func updateGroups(device tasmoDevice) []string {
+	groups := make([]string, 0, 2)
+	if device.Topic != "" {
+		groups = append(groups, "topic:"+strings.ToLower(device.Topic))
+	}
+	if topic := strings.ToLower(device.GroupTopic); topic != "" && !defaultGroupTopics[topic] {
+		groups = append(groups, "grouptopic:"+topic)
+	}
+	return groups
+}
+
+// rolloutBatches splits the pending updates into batches of at most size devices, all of them in one
+// batch if size is below 1. Every device goes into the first batch that has room and no other member
+// of its groups, so at most one member of a group is updated at a time.
+func rolloutBatches(devices []tasmoDevice, pending []int, size int) [][]int {
+	if size < 1 {
+		size = len(pending)
+	}
+	batches := make([][]int, 0)
+	members := make([]map[string]bool, 0)
+	for _, i := range pending {
+		groups := updateGroups(devices[i])
+		placed := false
+		for b := range batches {
+			if len(batches[b]) >= size || sharesGroup(members[b], groups) {
+				continue
+			}
+			batches[b] = append(batches[b], i)
+			for _, g := range groups {
+				members[b][g] = true
+			}
+			placed = true
+			break
+		}
+		if placed {
+			continue
+		}
+		batches = append(batches, []int{i})
+		members = append(members, make(map[string]bool))
+		for _, g := range groups {
+			members[len(members)-1][g] = true
+		}
+	}
+	return batches
+}
+
+// sharesGroup reports if one of the groups is already in the set
+func sharesGroup(set map[string]bool, groups []string) bool {
+	for _, g := range groups {
+		if set[g] {
+			return true
+		}
+	}
+	return false
+}
+
+// renderUpdateCommands generates a table of how the devices took the update command: accepted, timed
+// out, failed authentication or skipped because tasmogo was stopped
+func renderUpdateCommands(results []taskResult) string {
+	report := newTaskReport("update", results)
+	t := table.NewWriter()
+	t.AppendHeader(table.Row{"IP", "Name", "Duration", "Result"})
+	for _, result := range report.Results {
+		outcome := result.Output
+		switch {
+		case result.Skipped:
+			outcome = "skipped"
+		case result.Error != "":
+			outcome = result.Error
+		}
+		t.AppendRow(table.Row{result.IP, result.Name, result.Duration, outcome})
+	}
+	t.AppendFooter(table.Row{"", "", "", strconv.Itoa(report.Succeeded) + " accepted, " + strconv.Itoa(report.Failed) + " failed, " + strconv.Itoa(report.Skipped) + " skipped"})
+	return t.Render()
+}
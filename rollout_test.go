@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_rolloutUpdates(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	viper.Set("otaurl", "http://ota/")
+	viper.Set("verifytimeout", 10*time.Millisecond)
+	viper.Set("verifydelay", time.Millisecond)
+	viper.Set("verifymaxdelay", time.Millisecond)
+	viper.Set("batchsize", 3)
+	viper.Set("maxfailures", 1)
+	// the second and the third device never come back with the new version
+	fakeDevices(t, map[string]map[string]string{
+		"10.0.0.1": {"Status 0": `{"StatusFWR": {"Version": "9.2.0(tasmota)"}}`},
+		"10.0.0.2": {"Status 0": `{"StatusFWR": {"Version": "9.1.0(tasmota)"}}`},
+		"10.0.0.3": {"Status 0": `{"StatusFWR": {"Version": "9.2.0(tasmota)"}}`},
+		"10.0.0.4": {"Status 0": `{"StatusFWR": {"Version": "9.1.0(tasmota)"}}`},
+	})
+	target, _ := version.NewVersion("9.2.0")
+	inv := &inventory{Devices: map[string]*inventoryRecord{}}
+	devices := []tasmoDevice{
+		{Name: "a", IP: net.ParseIP("10.0.0.1"), FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true},
+		{Name: "b", IP: net.ParseIP("10.0.0.2"), FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true},
+		{Name: "d", IP: net.ParseIP("10.0.0.4"), FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true},
+		{Name: "c", IP: net.ParseIP("10.0.0.3"), FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true},
+	}
+	rolloutUpdates(context.Background(), devices, target, inv)
+	assert.True(devices[0].Verified)
+	assert.NotEmpty(devices[1].UpdateURL)
+	assert.False(devices[1].Verified)
+	// the rollout was aborted before the second batch, as two failures exceed the limit
+	assert.Empty(devices[3].UpdateURL)
+
+	// a single failure doesn't exceed the limit
+	devices = []tasmoDevice{
+		{Name: "a", IP: net.ParseIP("10.0.0.1"), FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true},
+		{Name: "b", IP: net.ParseIP("10.0.0.2"), FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true},
+		{Name: "c", IP: net.ParseIP("10.0.0.3"), FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true},
+	}
+	viper.Set("batchsize", 2)
+	rolloutUpdates(context.Background(), devices, target, inv)
+	assert.True(devices[2].Verified)
+
+	// without a failure limit all batches are updated
+	viper.Set("maxfailures", 0)
+	viper.Set("batchsize", 3)
+	devices = []tasmoDevice{
+		{Name: "a", IP: net.ParseIP("10.0.0.1"), FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true},
+		{Name: "b", IP: net.ParseIP("10.0.0.2"), FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true},
+		{Name: "d", IP: net.ParseIP("10.0.0.4"), FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true},
+		{Name: "c", IP: net.ParseIP("10.0.0.3"), FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true},
+	}
+	rolloutUpdates(context.Background(), devices, target, inv)
+	assert.True(devices[3].Verified)
+
+	// only the first devices are updated if the updates per run are limited
+	viper.Set("maxupdates", 1)
+	devices = []tasmoDevice{
+		{Name: "a", IP: net.ParseIP("10.0.0.1"), FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true},
+		{Name: "c", IP: net.ParseIP("10.0.0.3"), FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true},
+	}
+	rolloutUpdates(context.Background(), devices, target, inv)
+	assert.True(devices[0].Verified)
+	assert.Empty(devices[1].UpdateURL)
+}
+
+func Test_confirmUpdates(t *testing.T) {
+	assert := assert.New(t)
+	devices := []tasmoDevice{
+		{Name: "a", Outdated: true, FirmwareType: "tasmota"},
+		{Name: "b", Outdated: true, FirmwareType: "tasmota"},
+		{Name: "c", Outdated: true, FirmwareType: "tasmota"},
+		{Name: "d", Outdated: true, FirmwareType: "tasmota"},
+	}
+	pending := pendingUpdates(devices)
+	var out bytes.Buffer
+	// invalid answers are asked again
+	assert.Equal([]int{0, 2, 3}, confirmUpdates(devices, pending, strings.NewReader("y\nmaybe\nn\nall\n"), &out))
+	assert.Contains(out.String(), "Update b")
+	assert.Equal([]int{1}, confirmUpdates(devices, pending, strings.NewReader("n\ny\nq\n"), &out))
+	// running out of input updates nothing else
+	assert.Equal([]int{0}, confirmUpdates(devices, pending, strings.NewReader("y\n"), &out))
+}
+
+func Test_rolloutBatches(t *testing.T) {
+	assert := assert.New(t)
+	devices := []tasmoDevice{
+		{Name: "switch", Topic: "hall", GroupTopic: "hall-lights"},
+		{Name: "relay", Topic: "hall-relay", GroupTopic: "hall-lights"},
+		{Name: "plug", Topic: "plug", GroupTopic: "tasmotas"},
+		{Name: "lamp", Topic: "lamp", GroupTopic: "tasmotas"},
+		{Name: "copy", Topic: "Plug"},
+	}
+	pending := []int{0, 1, 2, 3, 4}
+	// the default group topic doesn't tie devices together, a shared topic does
+	assert.Equal([][]int{{0, 2, 3}, {1, 4}}, rolloutBatches(devices, pending, 0))
+	assert.Equal([][]int{{0, 2}, {1, 3}, {4}}, rolloutBatches(devices, pending, 2))
+	assert.Equal([][]int{{0}, {1}, {2}, {3}, {4}}, rolloutBatches(devices, pending, 1))
+	assert.Empty(rolloutBatches(devices, nil, 0))
+}
+
+func Test_renderUpdatePlan(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("otaurl", "http://ota/")
+	devices := []tasmoDevice{
+		{Name: "old", IP: net.ParseIP("10.0.0.1"), FirmwareType: "sensors", Outdated: true},
+		{Name: "current", IP: net.ParseIP("10.0.0.2"), FirmwareType: "tasmota"},
+		{Name: "boiler", IP: net.ParseIP("10.0.0.3"), FirmwareType: "tasmota", Outdated: true, Protected: true},
+	}
+	plan := renderUpdatePlan(devices, pendingUpdates(devices))
+	assert.Contains(t, plan, "http://ota/tasmota-sensors.bin")
+	assert.NotContains(t, plan, "current")
+	assert.NotContains(t, plan, "boiler")
+}
+
+func Test_renderUpdateCommands(t *testing.T) {
+	assert := assert.New(t)
+	text := renderUpdateCommands([]taskResult{
+		{IP: "10.0.0.1", Name: "plug", Output: "command accepted", Attempts: 1},
+		{IP: "10.0.0.2", Name: "lamp", Error: "timed out", Attempts: 1},
+		{IP: "10.0.0.3", Name: "fan", Skipped: true},
+	})
+	assert.Contains(text, "command accepted")
+	assert.Contains(text, "timed out")
+	assert.Contains(text, "skipped")
+	assert.Contains(text, "1 ACCEPTED, 1 FAILED, 1 SKIPPED")
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/spf13/viper"
+)
+
+// The states of a device during a rollout
+const (
+	rolloutPending   = "pending"
+	rolloutCommanded = "commanded"
+	rolloutVerified  = "verified"
+	rolloutFailed    = "failed"
+)
+
+// rolloutDevice is the state of a device in the rollout file
+type rolloutDevice struct {
+	Name    string    `json:"name"`
+	State   string    `json:"state"`
+	Changed time.Time `json:"changed"`
+}
+
+// rolloutState is the content of TASMOGO_ROLLOUTFILE: the devices of the current rollout and how far
+// each of them got. It is written after every change, so an interrupted rollout can be resumed.
+type rolloutState struct {
+	mu       sync.Mutex
+	path     string
+	Target   string                    `json:"target"`
+	Started  time.Time                 `json:"started"`
+	Finished bool                      `json:"finished"`
+	Devices  map[string]*rolloutDevice `json:"devices"`
+}
+
+// loadRolloutState reads the rollout file. Without one, nil is returned.
+func loadRolloutState(path string) (*rolloutState, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &rolloutState{path: path}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	if s.Devices == nil {
+		s.Devices = make(map[string]*rolloutDevice)
+	}
+	return s, nil
+}
+
+// save replaces the rollout file. It is called with the lock held.
+func (s *rolloutState) save() {
+	if s.path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err == nil {
+		err = replaceFile(s.path, data)
+	}
+	if err != nil {
+		logWarn("Writing the rollout file failed: " + err.Error())
+	}
+}
+
+// set changes the state of a device and saves the rollout file. A nil state records nothing.
+func (s *rolloutState) set(device tasmoDevice, state string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Devices[device.address()] = &rolloutDevice{Name: device.Name, State: state, Changed: time.Now()}
+	s.save()
+}
+
+// finish marks the rollout as complete, so it isn't resumed. A rollout with devices that are still
+// pending or were told to update but not verified stays open.
+func (s *rolloutState) finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.count(rolloutPending) > 0 || s.count(rolloutCommanded) > 0 {
+		return
+	}
+	s.Finished = true
+	s.save()
+}
+
+// count returns the number of devices in the given state
+func (s *rolloutState) count(state string) int {
+	n := 0
+	for _, d := range s.Devices {
+		if d.State == state {
+			n++
+		}
+	}
+	return n
+}
+
+// resumeRollout returns the pending devices that are still pending in the interrupted rollout. The
+// devices that were told to update before the interruption aren't told again: the ones that came back
+// with a new firmware are verified, the others are marked failed and left for a look.
+func resumeRollout(s *rolloutState, devices []tasmoDevice, pending []int) []int {
+	for _, device := range devices {
+		d, ok := s.Devices[device.address()]
+		if !ok || d.State != rolloutCommanded {
+			continue
+		}
+		if device.Outdated {
+			deviceLogger(device, "update").warn(device.Name + " (" + device.address() + ") was told to update before the rollout was interrupted, but is still on " + device.FirmwareVersion)
+			s.set(device, rolloutFailed)
+			continue
+		}
+		s.set(device, rolloutVerified)
+	}
+	resumed := make([]int, 0, len(pending))
+	for _, i := range pending {
+		if d, ok := s.Devices[devices[i].address()]; ok && d.State == rolloutPending {
+			resumed = append(resumed, i)
+		}
+	}
+	return resumed
+}
+
+// startRollout records a rollout of the pending devices in TASMOGO_ROLLOUTFILE. With TASMOGO_RESUME an
+// interrupted rollout to the same target is continued instead and only its pending devices are
+// returned. If there is none, no device is updated. Without the file, nothing is recorded.
+func startRollout(devices []tasmoDevice, pending []int, target *version.Version, now time.Time) (*rolloutState, []int) {
+	path := viper.GetString("rolloutfile")
+	if path == "" {
+		return nil, pending
+	}
+	targetName := ""
+	if target != nil {
+		targetName = target.String()
+	}
+	previous, err := loadRolloutState(path)
+	if err != nil {
+		logWarn("Reading the rollout file failed: " + err.Error())
+	}
+	if previous != nil && !previous.Finished {
+		left := previous.count(rolloutPending)
+		switch {
+		case !viper.GetBool("resume"):
+			logWarn("The rollout started at " + previous.Started.Format("2006-01-02 15:04") + " was interrupted with " + strconv.Itoa(left) + " devices left, use --resume to continue it")
+		case previous.Target != targetName:
+			logWarn("Not resuming the rollout to " + previous.Target + ", the target is now " + targetName)
+			return nil, []int{}
+		default:
+			logInfo("Resuming the rollout started at " + previous.Started.Format("2006-01-02 15:04") + " with " + strconv.Itoa(left) + " devices left")
+			return previous, resumeRollout(previous, devices, pending)
+		}
+	} else if viper.GetBool("resume") {
+		logInfo("No interrupted rollout to resume")
+		return nil, []int{}
+	}
+	s := &rolloutState{path: path, Target: targetName, Started: now, Devices: make(map[string]*rolloutDevice)}
+	for _, i := range pending {
+		s.Devices[devices[i].address()] = &rolloutDevice{Name: devices[i].Name, State: rolloutPending, Changed: now}
+	}
+	s.save()
+	return s, pending
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/merlinschumacher/tasmogo/pkg/tasmota"
+	"github.com/merlinschumacher/tasmogo/pkg/tasmota/tasmotatest"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_resumeRollout(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	path := filepath.Join(t.TempDir(), "rollout.json")
+	viper.Set("rolloutfile", path)
+	viper.Set("otaurl", "http://ota/")
+	viper.Set("verifytimeout", 10*time.Millisecond)
+	viper.Set("verifydelay", time.Millisecond)
+	viper.Set("verifymaxdelay", time.Millisecond)
+	viper.Set("batchsize", 3)
+	viper.Set("maxfailures", 1)
+	// the second and the third device never come back with the new version
+	fake := fakeDevices(t, map[string]map[string]string{
+		"10.0.0.1": {"Status 0": `{"StatusFWR": {"Version": "9.2.0(tasmota)"}}`},
+		"10.0.0.2": {"Status 0": `{"StatusFWR": {"Version": "9.1.0(tasmota)"}}`},
+		"10.0.0.3": {"Status 0": `{"StatusFWR": {"Version": "9.2.0(tasmota)"}}`},
+		"10.0.0.4": {"Status 0": `{"StatusFWR": {"Version": "9.1.0(tasmota)"}}`},
+	})
+	target, _ := version.NewVersion("9.2.0")
+	inv := &inventory{Devices: map[string]*inventoryRecord{}}
+	outdated := func() []tasmoDevice {
+		return []tasmoDevice{
+			{Name: "a", IP: net.ParseIP("10.0.0.1"), FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true},
+			{Name: "b", IP: net.ParseIP("10.0.0.2"), FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true},
+			{Name: "d", IP: net.ParseIP("10.0.0.4"), FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true},
+			{Name: "c", IP: net.ParseIP("10.0.0.3"), FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true},
+		}
+	}
+	// the rollout is aborted after the first batch
+	rolloutUpdates(context.Background(), outdated(), target, inv)
+	s, err := loadRolloutState(path)
+	assert.Nil(err)
+	assert.False(s.Finished)
+	assert.Equal("9.2.0", s.Target)
+	assert.Equal(rolloutVerified, s.Devices["10.0.0.1"].State)
+	assert.Equal(rolloutFailed, s.Devices["10.0.0.2"].State)
+	assert.Equal(rolloutFailed, s.Devices["10.0.0.4"].State)
+	assert.Equal(rolloutPending, s.Devices["10.0.0.3"].State)
+
+	// resuming only updates the device that is left
+	viper.Set("resume", true)
+	fake.Commands = nil
+	devices := outdated()
+	rolloutUpdates(context.Background(), devices, target, inv)
+	assert.Empty(devices[1].UpdateURL)
+	assert.Empty(devices[2].UpdateURL)
+	assert.True(devices[3].Verified)
+	assert.NotContains(fake.Commands, "10.0.0.2: Upgrade 1")
+	s, _ = loadRolloutState(path)
+	assert.True(s.Finished)
+	assert.Equal(rolloutVerified, s.Devices["10.0.0.3"].State)
+
+	// there is nothing left to resume
+	devices = outdated()
+	rolloutUpdates(context.Background(), devices, target, inv)
+	assert.Empty(devices[0].UpdateURL)
+
+	// without --resume a new rollout starts
+	viper.Set("resume", false)
+	viper.Set("maxfailures", 0)
+	devices = outdated()
+	rolloutUpdates(context.Background(), devices, target, inv)
+	assert.True(devices[0].Verified)
+	assert.True(devices[3].Verified)
+}
+
+// cancelingClient stops the run once the first device was told to update
+type cancelingClient struct {
+	*tasmotatest.Client
+	cancel context.CancelFunc
+}
+
+func (c cancelingClient) Upgrade(ctx context.Context, host string, otaURL string) error {
+	defer c.cancel()
+	return c.Client.Upgrade(ctx, host, otaURL)
+}
+
+func Test_rolloutUpdates_cancelled(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	path := filepath.Join(t.TempDir(), "rollout.json")
+	viper.Set("rolloutfile", path)
+	viper.Set("otaurl", "http://ota/")
+	viper.Set("verifytimeout", 10*time.Millisecond)
+	viper.Set("verifydelay", time.Millisecond)
+	viper.Set("verifymaxdelay", time.Millisecond)
+	viper.Set("updateconcurrency", 1)
+	fake := fakeDevices(t, map[string]map[string]string{
+		"10.0.0.1": {"Status 0": `{"StatusFWR": {"Version": "9.2.0(tasmota)"}}`},
+		"10.0.0.2": {"Status 0": `{"StatusFWR": {"Version": "9.2.0(tasmota)"}}`},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	newDeviceClient = func() tasmota.DeviceClient { return cancelingClient{fake, cancel} }
+	target, _ := version.NewVersion("9.2.0")
+	inv := &inventory{Devices: map[string]*inventoryRecord{}}
+	devices := []tasmoDevice{
+		{Name: "a", IP: net.ParseIP("10.0.0.1"), FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true},
+		{Name: "b", IP: net.ParseIP("10.0.0.2"), FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true},
+	}
+	// the run is stopped during the only batch
+	rolloutUpdates(ctx, devices, target, inv)
+	s, err := loadRolloutState(path)
+	assert.Nil(err)
+	assert.False(s.Finished)
+	assert.Equal(rolloutCommanded, s.Devices["10.0.0.1"].State)
+	assert.Equal(rolloutPending, s.Devices["10.0.0.2"].State)
+
+	// the next run resumes it
+	viper.Set("resume", true)
+	devices = []tasmoDevice{
+		{Name: "a", IP: net.ParseIP("10.0.0.1"), FirmwareVersion: "9.2.0", FirmwareType: "tasmota"},
+		{Name: "b", IP: net.ParseIP("10.0.0.2"), FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true},
+	}
+	rolloutUpdates(context.Background(), devices, target, inv)
+	assert.True(devices[1].Verified)
+	s, _ = loadRolloutState(path)
+	assert.True(s.Finished)
+	assert.Equal(rolloutVerified, s.Devices["10.0.0.1"].State)
+}
+
+func Test_startRollout(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	path := filepath.Join(t.TempDir(), "rollout.json")
+	viper.Set("rolloutfile", path)
+	target, _ := version.NewVersion("9.2.0")
+	devices := []tasmoDevice{
+		{Name: "a", IP: net.ParseIP("10.0.0.1"), FirmwareVersion: "9.2.0"},
+		{Name: "b", IP: net.ParseIP("10.0.0.2"), FirmwareVersion: "9.1.0", Outdated: true},
+		{Name: "c", IP: net.ParseIP("10.0.0.3"), FirmwareVersion: "9.1.0", Outdated: true},
+	}
+	s, pending := startRollout(devices, []int{0, 1, 2}, target, time.Now())
+	assert.Equal([]int{0, 1, 2}, pending)
+	s.set(devices[0], rolloutCommanded)
+	s.set(devices[1], rolloutCommanded)
+
+	// the commanded device that came back with the new firmware is verified, the other one isn't told again
+	viper.Set("resume", true)
+	s, pending = startRollout(devices, []int{1, 2}, target, time.Now())
+	assert.Equal([]int{2}, pending)
+	assert.Equal(rolloutVerified, s.Devices["10.0.0.1"].State)
+	assert.Equal(rolloutFailed, s.Devices["10.0.0.2"].State)
+
+	// a rollout to another target isn't resumed
+	other, _ := version.NewVersion("9.3.0")
+	s, pending = startRollout(devices, []int{1, 2}, other, time.Now())
+	assert.Nil(s)
+	assert.Empty(pending)
+
+	// without the file nothing is recorded
+	viper.Set("rolloutfile", "")
+	s, pending = startRollout(devices, []int{1, 2}, target, time.Now())
+	assert.Nil(s)
+	assert.Equal([]int{1, 2}, pending)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// rule describes an automatic remediation that is executed whenever its condition matches a device.
+// Conditions have the form "<metric> <operator> <value>", e.g. "heap < 15".
+type rule struct {
+	Name      string `mapstructure:"name"`
+	Condition string `mapstructure:"condition"`
+	Action    string `mapstructure:"action"`
+	Command   string `mapstructure:"command"`
+	Tag       string `mapstructure:"tag"`
+}
+
+// loadRules reads the remediation rules from the configuration
+func loadRules() ([]rule, error) {
+	var rules []rule
+	err := viper.UnmarshalKey("rules", &rules)
+	return rules, err
+}
+
+// parseCondition splits a rule condition into the metric, the comparison operator and the value
+func parseCondition(condition string) (string, string, float64, error) {
+	fields := strings.Fields(condition)
+	if len(fields) != 3 {
+		return "", "", 0, errors.New("Invalid condition: " + condition)
+	}
+	switch fields[1] {
+	case "<", "<=", ">", ">=", "==", "!=":
+	default:
+		return "", "", 0, errors.New("Invalid operator in condition: " + condition)
+	}
+	value, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil {
+		return "", "", 0, errors.New("Invalid value in condition: " + condition)
+	}
+	return fields[0], fields[1], value, nil
+}
+
+// metricValue returns the current value of a metric for an inventory record. The second return value
+// is false if the device never reported the metric.
+func metricValue(rec *inventoryRecord, metric string) (float64, bool, error) {
+	switch metric {
+	case "missed":
+		return float64(rec.Missed), true, nil
+	case "heap":
+		if len(rec.Heaps) == 0 {
+			return 0, false, nil
+		}
+		return float64(rec.Heaps[len(rec.Heaps)-1]), true, nil
+	case "signal":
+		// the signal strength is given in dBm and therefore always negative if known
+		return float64(rec.Signal), rec.Signal != 0, nil
+	case "latency":
+		if len(rec.Latencies) == 0 {
+			return 0, false, nil
+		}
+		return float64(rec.Latencies[len(rec.Latencies)-1].Milliseconds()), true, nil
+	}
+	return 0, false, errors.New("Unknown metric: " + metric)
+}
+
+// matches evaluates the condition of the rule against an inventory record
+func (r rule) matches(rec *inventoryRecord) (bool, error) {
+	metric, operator, value, err := parseCondition(r.Condition)
+	if err != nil {
+		return false, err
+	}
+	current, known, err := metricValue(rec, metric)
+	if err != nil || !known {
+		return false, err
+	}
+	switch operator {
+	case "<":
+		return current < value, nil
+	case "<=":
+		return current <= value, nil
+	case ">":
+		return current > value, nil
+	case ">=":
+		return current >= value, nil
+	case "==":
+		return current == value, nil
+	}
+	return current != value, nil
+}
+
+// execute runs the action of the rule for the device with the given IP and records it in the audit log.
+// No commands are sent to protected or quarantined devices.
+func (r rule) execute(ip string, rec *inventoryRecord, protected bool) {
+	prefix := "Rule \"" + r.Name + "\" matched " + rec.Name + " (" + ip + "): "
+	switch r.Action {
+	case "notify":
+		audit(prefix + "condition " + r.Condition + " is met")
+	case "command":
+		if rec.quarantined() {
+			audit(prefix + "not sending command \"" + r.Command + "\" to quarantined device")
+			return
+		}
+		if !mayModify(tasmoDevice{IP: net.ParseIP(ip), Name: rec.Name, Protected: protected}) {
+			audit(prefix + "not sending command \"" + r.Command + "\" to protected device")
+			return
+		}
+		if viper.GetBool("dryrun") {
+			logInfo(prefix + "would send command \"" + r.Command + "\"")
+			return
+		}
+		_, err := sendCommand(ip, r.Command)
+		if err != nil {
+			audit(prefix + "sending command \"" + r.Command + "\" failed: " + err.Error())
+			return
+		}
+		audit(prefix + "sent command \"" + r.Command + "\"")
+	case "tag":
+		if rec.addTag(r.Tag) {
+			audit(prefix + "tagged as " + r.Tag)
+		}
+	default:
+		audit(prefix + "unknown action " + r.Action)
+	}
+}
+
+// applyRules checks all devices in the inventory against the given rules and executes the matching ones
+func applyRules(inv *inventory, rules []rule) {
+	for ip, rec := range inv.Devices {
+		for _, r := range rules {
+			match, err := r.matches(rec)
+			if err != nil {
+				audit("Rule \"" + r.Name + "\" is invalid: " + err.Error())
+				continue
+			}
+			if match {
+				r.execute(ip, rec, isProtected(tasmoDevice{IP: net.ParseIP(ip), Name: rec.Name}, inv))
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseCondition(t *testing.T) {
+	assert := assert.New(t)
+	metric, operator, value, err := parseCondition("heap < 15")
+	assert.Nil(err)
+	assert.Equal("heap", metric)
+	assert.Equal("<", operator)
+	assert.Equal(15.0, value)
+	_, _, _, err = parseCondition("heap <15")
+	assert.NotNil(err)
+	_, _, _, err = parseCondition("heap ~ 15")
+	assert.NotNil(err)
+	_, _, _, err = parseCondition("heap < low")
+	assert.NotNil(err)
+}
+
+func Test_ruleMatches(t *testing.T) {
+	assert := assert.New(t)
+	rec := &inventoryRecord{Missed: 3, Heaps: []int{20, 12}, Latencies: []time.Duration{40 * time.Millisecond}}
+	match, err := rule{Condition: "missed >= 3"}.matches(rec)
+	assert.Nil(err)
+	assert.True(match)
+	match, err = rule{Condition: "heap < 15"}.matches(rec)
+	assert.Nil(err)
+	assert.True(match)
+	match, err = rule{Condition: "latency > 50"}.matches(rec)
+	assert.Nil(err)
+	assert.False(match)
+	// devices without a known signal never match
+	match, err = rule{Condition: "signal < -85"}.matches(rec)
+	assert.Nil(err)
+	assert.False(match)
+	_, err = rule{Condition: "uptime > 5"}.matches(rec)
+	assert.NotNil(err)
+}
+
+func Test_applyRules(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	viper.Set("auditlog", path)
+	defer viper.Set("auditlog", "")
+
+	inv, _ := loadInventory("")
+	inv.record("1.1.1.1").Signal = -90
+	inv.record("1.1.1.2").Signal = -50
+	rules := []rule{{Name: "weak", Condition: "signal < -85", Action: "tag", Tag: "weak-wifi"}}
+	applyRules(inv, rules)
+	applyRules(inv, rules)
+	assert.Equal([]string{"weak-wifi"}, inv.Devices["1.1.1.1"].Tags)
+	assert.Empty(inv.Devices["1.1.1.2"].Tags)
+
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+	assert.Equal(1, strings.Count(string(data), "tagged as weak-wifi"))
+}
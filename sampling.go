@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/tidwall/gjson"
+)
+
+// sampleSections are the parts of the answer to "Status 0" that hold settings. The other parts
+// change all the time, like the uptime or the sensor readings.
+var sampleSections = []string{"Status", "StatusLOG", "StatusMQT", "StatusNET"}
+
+// volatileSettings change during normal operation and are not compared
+var volatileSettings = map[string]bool{"Status.Power": true}
+
+// sampleDevices picks up to n random devices that can be asked via HTTP
+func sampleDevices(devices []tasmoDevice, n int, rng *rand.Rand) []tasmoDevice {
+	candidates := make([]tasmoDevice, 0, len(devices))
+	for _, device := range devices {
+		if device.IP != nil {
+			candidates = append(candidates, device)
+		}
+	}
+	rng.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if n < len(candidates) {
+		candidates = candidates[:n]
+	}
+	return candidates
+}
+
+// flattenSettings extracts the settings of the answer to "Status 0" as "Section.Key" and value
+func flattenSettings(response string) map[string]string {
+	settings := make(map[string]string)
+	for _, section := range sampleSections {
+		gjson.Get(response, section).ForEach(func(key, value gjson.Result) bool {
+			name := section + "." + key.String()
+			if !volatileSettings[name] {
+				settings[name] = value.Raw
+			}
+			return true
+		})
+	}
+	return settings
+}
+
+// diffSettings returns the settings of a device that differ from its baseline, ordered by name
+func diffSettings(device tasmoDevice, baseline map[string]string, current map[string]string) []deviation {
+	names := make(map[string]bool)
+	for name := range baseline {
+		names[name] = true
+	}
+	for name := range current {
+		names[name] = true
+	}
+	deviations := make([]deviation, 0)
+	for name := range names {
+		if baseline[name] != current[name] {
+			deviations = append(deviations, deviation{Device: device, Setting: name, Current: current[name], Desired: baseline[name]})
+		}
+	}
+	sort.Slice(deviations, func(i, j int) bool {
+		return deviations[i].Setting < deviations[j].Setting
+	})
+	return deviations
+}
+
+// auditSample inspects a random sample of the devices in depth and reports every setting that changed
+// since the device was sampled before. The first sample of a device becomes its baseline, later
+// changes are written to the audit log and become the new baseline.
+func auditSample(inv *inventory, devices []tasmoDevice, n int) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	client := newDeviceClient()
+	drift := make([]deviation, 0)
+	for _, device := range sampleDevices(devices, n, rng) {
+		status, err := client.Status(context.Background(), device.IP.String())
+		if err != nil {
+			deviceLogger(device, "inspect").warn("Inspecting " + device.Name + " (" + device.IP.String() + ") failed: " + err.Error())
+			continue
+		}
+		current := flattenSettings(status.Response)
+		rec := inv.record(device.key())
+		if rec.Baseline != nil {
+			for _, d := range diffSettings(device, rec.Baseline, current) {
+				audit("Setting " + d.Setting + " of " + device.Name + " (" + device.IP.String() + ") changed from " + d.Desired + " to " + d.Current)
+				drift = append(drift, d)
+			}
+		}
+		rec.Baseline = current
+	}
+	if len(drift) > 0 {
+		logInfo("Changed settings:\n" + renderDrift(drift))
+	}
+}
+
+// renderDrift generates a table of the settings that changed since the last sample
+func renderDrift(drift []deviation) string {
+	t := table.NewWriter()
+	t.AppendHeader(table.Row{"IP", "Name", "Setting", "Before", "Now"})
+	for _, d := range drift {
+		t.AppendRow(table.Row{d.Device.address(), d.Device.Name, d.Setting, d.Desired, d.Current})
+	}
+	return t.Render()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_sampleDevices(t *testing.T) {
+	assert := assert.New(t)
+	devices := []tasmoDevice{
+		{Name: "a", IP: net.ParseIP("10.0.0.1")},
+		{Name: "b", IP: net.ParseIP("10.0.0.2")},
+		{Name: "c", IP: net.ParseIP("10.0.0.3")},
+		{Name: "mqtt", Topic: "plug"},
+	}
+	rng := rand.New(rand.NewSource(1))
+	assert.Len(sampleDevices(devices, 2, rng), 2)
+	// devices without an IP can't be inspected
+	assert.Len(sampleDevices(devices, 10, rng), 3)
+	assert.Equal("a", devices[0].Name)
+}
+
+func Test_flattenSettings(t *testing.T) {
+	settings := flattenSettings(`{"Status": {"Topic": "plug", "Power": 1}, "StatusMQT": {"MqttHost": "broker"}, "StatusSTS": {"Heap": 25}}`)
+	assert.Equal(t, map[string]string{"Status.Topic": `"plug"`, "StatusMQT.MqttHost": `"broker"`}, settings)
+}
+
+func Test_diffSettings(t *testing.T) {
+	baseline := map[string]string{"Status.Topic": `"plug"`, "StatusMQT.MqttHost": `"broker"`}
+	current := map[string]string{"Status.Topic": `"plug"`, "StatusMQT.MqttHost": `"other"`, "StatusLOG.SysLog": "0"}
+	deviations := diffSettings(tasmoDevice{Name: "plug"}, baseline, current)
+	assert.Len(t, deviations, 2)
+	assert.Equal(t, "StatusLOG.SysLog", deviations[0].Setting)
+	assert.Equal(t, "", deviations[0].Desired)
+	assert.Equal(t, "StatusMQT.MqttHost", deviations[1].Setting)
+	assert.Equal(t, `"other"`, deviations[1].Current)
+}
+
+func Test_auditSample(t *testing.T) {
+	assert := assert.New(t)
+	fake := fakeDevices(t, map[string]map[string]string{
+		"10.0.0.1": {"Status 0": `{"Status": {"Topic": "plug"}, "StatusFWR": {"Version": "9.1.0(tasmota)"}}`},
+	})
+	inv := &inventory{Devices: map[string]*inventoryRecord{}}
+	devices := []tasmoDevice{{Name: "plug", IP: net.ParseIP("10.0.0.1")}}
+	auditSample(inv, devices, 1)
+	assert.Equal(`"plug"`, inv.Devices["10.0.0.1"].Baseline["Status.Topic"])
+
+	fake.Devices["10.0.0.1"]["Status 0"] = `{"Status": {"Topic": "lamp"}, "StatusFWR": {"Version": "9.1.0(tasmota)"}}`
+	auditSample(inv, devices, 1)
+	assert.Equal(`"lamp"`, inv.Devices["10.0.0.1"].Baseline["Status.Topic"])
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	// the container image has no time zone database
+	_ "time/tzdata"
+
+	"github.com/spf13/viper"
+)
+
+// schedule tells when the daemon scans next
+type schedule interface {
+	// next returns the time of the first scan after the given time
+	next(after time.Time) time.Time
+}
+
+// intervalSchedule scans in a fixed interval. The interval is real time, so a daily scan moves by an
+// hour on the wall clock when the clocks change.
+type intervalSchedule struct {
+	every time.Duration
+}
+
+func (s intervalSchedule) next(after time.Time) time.Time {
+	return after.Add(s.every)
+}
+
+// cronSchedule scans at the times matching a cron expression. Every field is a set of the allowed
+// values, indexed by the value.
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays []bool
+	// anyDay and anyWeekday are set if the field is "*". If both fields are restricted, a day matching
+	// either of them is used, like cron does.
+	anyDay, anyWeekday bool
+}
+
+// cronDescriptors are the shortcuts for common cron expressions
+var cronDescriptors = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+}
+
+// scheduleLocation returns the time zone of TASMOGO_TIMEZONE, in which the cron expressions are evaluated,
+// or the local one of the system if it isn't set
+func scheduleLocation() (*time.Location, error) {
+	name := viper.GetString("timezone")
+	if name == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, errors.New("Invalid time zone " + name + ", expected a name like Europe/Berlin")
+	}
+	return loc, nil
+}
+
+// inScheduleZone converts a time to the time zone of TASMOGO_TIMEZONE, so the times shown match the
+// schedule, or to the local one if the zone is invalid
+func inScheduleZone(t time.Time) time.Time {
+	loc, err := scheduleLocation()
+	if err != nil {
+		loc = time.Local
+	}
+	return t.In(loc)
+}
+
+// parseSchedule reads the schedule of the daemon, either a duration like "24h" or a cron expression
+// with five fields like "0 3 * * *"
+func parseSchedule(spec string) (schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if d, err := time.ParseDuration(spec); err == nil {
+		if d <= 0 {
+			return nil, errors.New("The scan interval has to be positive")
+		}
+		return intervalSchedule{every: d}, nil
+	}
+	if expr, ok := cronDescriptors[spec]; ok {
+		spec = expr
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, errors.New("Invalid schedule " + spec + ", expected a duration or a cron expression with five fields")
+	}
+	var s cronSchedule
+	var err error
+	limits := []struct {
+		set      *[]bool
+		min, max int
+	}{{&s.minutes, 0, 59}, {&s.hours, 0, 23}, {&s.days, 1, 31}, {&s.months, 1, 12}, {&s.weekdays, 0, 7}}
+	for i, limit := range limits {
+		if *limit.set, err = parseCronField(fields[i], limit.min, limit.max); err != nil {
+			return nil, errors.New("Invalid schedule " + spec + ": " + err.Error())
+		}
+	}
+	// Sunday is 0 or 7
+	s.weekdays[0] = s.weekdays[0] || s.weekdays[7]
+	s.anyDay, s.anyWeekday = fields[2] == "*", fields[4] == "*"
+	if s.next(time.Now()).IsZero() {
+		return nil, errors.New("The schedule " + spec + " never matches")
+	}
+	return s, nil
+}
+
+// parseCronField converts a comma separated list of values, ranges like 1-5 and steps like */15 or
+// 0-30/10 to the set of allowed values
+func parseCronField(field string, min int, max int) ([]bool, error) {
+	set := make([]bool, max+1)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return nil, errors.New("invalid step in " + part)
+			}
+			part = part[:i]
+		}
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, errors.New("invalid value " + part)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, errors.New("invalid range " + part)
+				}
+			} else if step > 1 {
+				// 5/15 means every 15 starting at 5
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return nil, errors.New(part + " is out of range " + strconv.Itoa(min) + "-" + strconv.Itoa(max))
+		}
+		for v := from; v <= to; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+// dayMatches reports if a scan may happen on the day of the given time
+func (s cronSchedule) dayMatches(t time.Time) bool {
+	day, weekday := s.days[t.Day()], s.weekdays[int(t.Weekday())]
+	switch {
+	case s.anyDay && s.anyWeekday:
+		return true
+	case s.anyDay:
+		return weekday
+	case s.anyWeekday:
+		return day
+	}
+	return day || weekday
+}
+
+// next returns the first matching time after the given one in its time zone. The search runs on the
+// wall clock: a time skipped when the clocks go forward is run at the same time after the change, a time
+// repeated when they go back is only run once.
+func (s cronSchedule) next(after time.Time) time.Time {
+	loc := after.Location()
+	t := time.Date(after.Year(), after.Month(), after.Day(), after.Hour(), after.Minute(), 0, 0, time.UTC).Add(time.Minute)
+	// the expression might never match, e.g. on February 30th, so the search ends after five years
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !s.months[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case !s.hours[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, time.UTC)
+		case !s.minutes[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			if at := wallTime(t, loc); at.After(after) {
+				return at
+			}
+			t = t.Add(time.Minute)
+		}
+	}
+	return time.Time{}
+}
+
+// wallTime converts a time on the wall clock, given in UTC, to the location. A time skipped when the
+// clocks go forward is moved past the change by the offset that was in effect before it.
+func wallTime(t time.Time, loc *time.Location) time.Time {
+	at := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, loc)
+	if at.Hour() == t.Hour() && at.Minute() == t.Minute() {
+		return at
+	}
+	_, offset := at.Add(-24 * time.Hour).Zone()
+	return t.Add(-time.Duration(offset) * time.Second).In(loc)
+}
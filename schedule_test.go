@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseSchedule(t *testing.T) {
+	assert := assert.New(t)
+	s, err := parseSchedule("6h")
+	assert.Nil(err)
+	start := time.Date(2021, 3, 8, 12, 0, 0, 0, time.UTC)
+	assert.Equal(start.Add(6*time.Hour), s.next(start))
+
+	for _, invalid := range []string{"-1h", "0 3 * *", "60 * * * *", "0 3 * * 8", "*/0 * * * *", "5-1 * * * *", "0 0 30 2 *"} {
+		_, err = parseSchedule(invalid)
+		assert.NotNil(err, invalid)
+	}
+}
+
+func Test_parseCronField(t *testing.T) {
+	assert := assert.New(t)
+	values := func(set []bool) []int {
+		v := make([]int, 0)
+		for i, ok := range set {
+			if ok {
+				v = append(v, i)
+			}
+		}
+		return v
+	}
+	set, err := parseCronField("*/15", 0, 59)
+	assert.Nil(err)
+	assert.Equal([]int{0, 15, 30, 45}, values(set))
+	set, _ = parseCronField("1-5,10", 0, 23)
+	assert.Equal([]int{1, 2, 3, 4, 5, 10}, values(set))
+	set, _ = parseCronField("5/20", 0, 59)
+	assert.Equal([]int{5, 25, 45}, values(set))
+	set, _ = parseCronField("0-30/10", 0, 59)
+	assert.Equal([]int{0, 10, 20, 30}, values(set))
+	_, err = parseCronField("a", 0, 59)
+	assert.NotNil(err)
+}
+
+func Test_cronSchedule_next(t *testing.T) {
+	assert := assert.New(t)
+	// Monday, March 8th 2021
+	start := time.Date(2021, 3, 8, 12, 34, 56, 0, time.UTC)
+	next := func(spec string, after time.Time) time.Time {
+		s, err := parseSchedule(spec)
+		assert.Nil(err, spec)
+		return s.next(after)
+	}
+	assert.Equal(time.Date(2021, 3, 9, 3, 0, 0, 0, time.UTC), next("0 3 * * *", start))
+	assert.Equal(time.Date(2021, 3, 8, 12, 45, 0, 0, time.UTC), next("*/15 * * * *", start))
+	assert.Equal(time.Date(2021, 3, 8, 13, 0, 0, 0, time.UTC), next("@hourly", start))
+	assert.Equal(time.Date(2021, 3, 14, 0, 0, 0, 0, time.UTC), next("@weekly", start))
+	assert.Equal(time.Date(2021, 3, 13, 8, 0, 0, 0, time.UTC), next("0 8 * * 6,7", start))
+	assert.Equal(time.Date(2021, 4, 1, 0, 0, 0, 0, time.UTC), next("@monthly", start))
+	assert.Equal(time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC), next("0 0 29 2 *", start))
+	// with both days restricted, either of them matches
+	assert.Equal(time.Date(2021, 3, 10, 0, 0, 0, 0, time.UTC), next("0 0 15 * 3", start))
+	// a slot at the very minute is not run again
+	assert.Equal(time.Date(2021, 3, 9, 12, 34, 0, 0, time.UTC), next("34 12 * * *", time.Date(2021, 3, 8, 12, 34, 0, 0, time.UTC)))
+}
+
+func Test_cronSchedule_next_dst(t *testing.T) {
+	assert := assert.New(t)
+	loc, err := time.LoadLocation("America/New_York")
+	assert.Nil(err)
+	s, _ := parseSchedule("30 2 * * *")
+	// 2:30 doesn't exist when the clocks go forward, the scan runs at 3:30 instead
+	spring := s.next(time.Date(2021, 3, 14, 0, 0, 0, 0, loc))
+	assert.Equal(time.Date(2021, 3, 14, 7, 30, 0, 0, time.UTC), spring.UTC())
+	assert.Equal("03:30 EDT", spring.Format("15:04 MST"))
+	assert.Equal(time.Date(2021, 3, 15, 2, 30, 0, 0, loc), s.next(spring))
+
+	// 1:30 happens twice when they go back, the scan only runs once
+	s, _ = parseSchedule("30 1 * * *")
+	first := s.next(time.Date(2021, 11, 7, 0, 0, 0, 0, loc))
+	assert.Equal(1, first.Hour())
+	assert.Equal(time.Date(2021, 11, 8, 1, 30, 0, 0, loc), s.next(first))
+	assert.Equal(time.Date(2021, 11, 8, 1, 30, 0, 0, loc), s.next(first.Add(time.Hour)))
+
+	// daily scans keep their time on the wall clock across the change
+	s, _ = parseSchedule("0 3 * * *")
+	assert.Equal(time.Date(2021, 11, 8, 3, 0, 0, 0, loc), s.next(time.Date(2021, 11, 7, 3, 0, 0, 0, loc)))
+}
+
+func Test_scheduleLocation(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	loc, err := scheduleLocation()
+	assert.Nil(err)
+	assert.Equal(time.Local, loc)
+	viper.Set("timezone", "Europe/Berlin")
+	loc, err = scheduleLocation()
+	assert.Nil(err)
+	assert.Equal("Europe/Berlin", loc.String())
+	viper.Set("timezone", "Mars/Olympus")
+	_, err = scheduleLocation()
+	assert.NotNil(err)
+}
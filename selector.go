@@ -0,0 +1,433 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/hashicorp/go-version"
+)
+
+// deviceSelector is a compiled selector expression like `name~"bedroom" && variant=="tasmota" && outdated`
+type deviceSelector struct {
+	text  string
+	match func(device tasmoDevice, inv *inventory) bool
+	// fields are the fields the expression refers to
+	fields map[string]bool
+}
+
+// uses reports if the expression refers to the field
+func (s *deviceSelector) uses(field string) bool {
+	return s != nil && s.fields[field]
+}
+
+// selectorStrings are the text fields of a device a selector can compare
+var selectorStrings = map[string]func(tasmoDevice) string{
+	"name":       func(d tasmoDevice) string { return d.Name },
+	"ip":         func(d tasmoDevice) string { return d.address() },
+	"mac":        func(d tasmoDevice) string { return d.MAC },
+	"hostname":   func(d tasmoDevice) string { return d.Hostname },
+	"topic":      func(d tasmoDevice) string { return d.Topic },
+	"grouptopic": func(d tasmoDevice) string { return d.GroupTopic },
+	"variant":    func(d tasmoDevice) string { return d.FirmwareType },
+	"chip":       func(d tasmoDevice) string { return d.Chip },
+	"ssid":       func(d tasmoDevice) string { return d.SSID },
+}
+
+// selectorNumbers are the numeric fields of a device a selector can compare
+var selectorNumbers = map[string]func(tasmoDevice) float64{
+	"module": func(d tasmoDevice) float64 { return float64(d.Module) },
+	"rssi":   func(d tasmoDevice) float64 { return float64(d.RSSI) },
+	"heap":   func(d tasmoDevice) float64 { return float64(d.Heap) },
+	"uptime": func(d tasmoDevice) float64 { return d.Uptime.Seconds() },
+}
+
+// selectorFlags are the states of a device a selector can test on their own, e.g. `outdated`
+var selectorFlags = map[string]func(tasmoDevice) bool{
+	"outdated":     func(d tasmoDevice) bool { return d.Outdated },
+	"protected":    func(d tasmoDevice) bool { return d.Protected },
+	"excluded":     func(d tasmoDevice) bool { return d.Excluded },
+	"quarantined":  func(d tasmoDevice) bool { return d.Quarantined },
+	"unrecognized": func(d tasmoDevice) bool { return d.Unrecognized },
+	"minimal":      func(d tasmoDevice) bool { return d.FirmwareType == minimalVariant },
+	"safeboot":     func(d tasmoDevice) bool { return d.FirmwareType == safebootVariant },
+	"pinned":       func(d tasmoDevice) bool { return d.PinnedVersion != "" },
+	"cached":       func(d tasmoDevice) bool { return d.Cached },
+	"archived":     func(d tasmoDevice) bool { return d.Archived },
+	"crashed":      func(d tasmoDevice) bool { return d.Crashed },
+	"mqtt":         func(d tasmoDevice) bool { return d.ViaMQTT },
+	"authfailed":   func(d tasmoDevice) bool { return d.AuthFailed },
+	"duplicate":    func(d tasmoDevice) bool { return len(d.Duplicates) > 0 },
+}
+
+// selectorToken is a piece of a selector expression. Values are the quoted or bare texts compared with.
+type selectorToken struct {
+	kind string
+	text string
+	pos  int
+}
+
+// tokenizeSelector splits an expression into identifiers, operators and values. The text after a
+// comparison operator is always a value, so bare values like 10.0.0.0/24 or 12.1 need no quotes.
+func tokenizeSelector(text string) ([]selectorToken, error) {
+	tokens := make([]selectorToken, 0)
+	afterComparison := false
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+			continue
+		case c == '"':
+			value, end, err := readQuoted(text, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, selectorToken{"value", value, i})
+			i, afterComparison = end, false
+			continue
+		case afterComparison:
+			end := i
+			for end < len(text) && !strings.ContainsRune(" \t()&|!", rune(text[end])) {
+				end++
+			}
+			if end == i {
+				return nil, selectorError(i, "expected a value")
+			}
+			tokens = append(tokens, selectorToken{"value", text[i:end], i})
+			i, afterComparison = end, false
+			continue
+		}
+		matched := false
+		for _, op := range []string{"&&", "||", "==", "!=", "!~", "<=", ">=", "~", "<", ">", "!", "(", ")"} {
+			if strings.HasPrefix(text[i:], op) {
+				tokens = append(tokens, selectorToken{op, op, i})
+				afterComparison = op == "==" || op == "!=" || op == "!~" || op == "<=" || op == ">=" || op == "~" || op == "<" || op == ">"
+				i += len(op)
+				matched = true
+				break
+			}
+		}
+		if matched {
+			continue
+		}
+		if !unicode.IsLetter(rune(c)) {
+			return nil, selectorError(i, "unexpected "+string(c))
+		}
+		end := i
+		for end < len(text) && (unicode.IsLetter(rune(text[end])) || unicode.IsDigit(rune(text[end])) || text[end] == '_') {
+			end++
+		}
+		tokens = append(tokens, selectorToken{"ident", strings.ToLower(text[i:end]), i})
+		i = end
+	}
+	return tokens, nil
+}
+
+// readQuoted reads the quoted string starting at start and returns it and the position after it.
+// A backslash escapes the next character.
+func readQuoted(text string, start int) (string, int, error) {
+	var b strings.Builder
+	for i := start + 1; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			if i+1 < len(text) {
+				i++
+				b.WriteByte(text[i])
+			}
+		case '"':
+			return b.String(), i + 1, nil
+		default:
+			b.WriteByte(text[i])
+		}
+	}
+	return "", 0, selectorError(start, "unterminated string")
+}
+
+// selectorError describes a problem at a position of the expression
+func selectorError(pos int, problem string) error {
+	return errors.New("Invalid selector at position " + strconv.Itoa(pos+1) + ": " + problem)
+}
+
+// selectorParser builds the matching function from the tokens by recursive descent. && binds
+// stronger than ||, ! negates the following term and parentheses group.
+type selectorParser struct {
+	tokens []selectorToken
+	pos    int
+	end    int
+	fields map[string]bool
+}
+
+// matcher tests a device
+type matcher func(device tasmoDevice, inv *inventory) bool
+
+// parseSelector compiles a selector expression. An empty expression selects all devices and returns nil.
+func parseSelector(text string) (*deviceSelector, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+	tokens, err := tokenizeSelector(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &selectorParser{tokens: tokens, end: len(text), fields: make(map[string]bool)}
+	m, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := p.peek(); ok {
+		return nil, selectorError(t.pos, "unexpected "+t.text)
+	}
+	return &deviceSelector{text: text, match: m, fields: p.fields}, nil
+}
+
+// peek returns the next token without consuming it
+func (p *selectorParser) peek() (selectorToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return selectorToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+// accept consumes the next token if it is of the given kind
+func (p *selectorParser) accept(kind string) bool {
+	if t, ok := p.peek(); ok && t.kind == kind {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// position returns where the next token starts, or the end of the expression
+func (p *selectorParser) position() int {
+	if t, ok := p.peek(); ok {
+		return t.pos
+	}
+	return p.end
+}
+
+func (p *selectorParser) or() (matcher, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		a, b := left, right
+		left = func(d tasmoDevice, inv *inventory) bool { return a(d, inv) || b(d, inv) }
+	}
+	return left, nil
+}
+
+func (p *selectorParser) and() (matcher, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		a, b := left, right
+		left = func(d tasmoDevice, inv *inventory) bool { return a(d, inv) && b(d, inv) }
+	}
+	return left, nil
+}
+
+func (p *selectorParser) unary() (matcher, error) {
+	if p.accept("!") {
+		m, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(d tasmoDevice, inv *inventory) bool { return !m(d, inv) }, nil
+	}
+	if p.accept("(") {
+		m, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, selectorError(p.position(), "expected )")
+		}
+		return m, nil
+	}
+	return p.comparison()
+}
+
+// comparison parses a field on its own, like `outdated`, or compared with a value, like `rssi<40`
+func (p *selectorParser) comparison() (matcher, error) {
+	t, ok := p.peek()
+	if !ok || t.kind != "ident" {
+		return nil, selectorError(p.position(), "expected a field")
+	}
+	p.pos++
+	field := t.text
+	p.fields[field] = true
+	op, ok := p.peek()
+	if !ok || op.kind == "value" || op.kind == "ident" || op.kind == "&&" || op.kind == "||" || op.kind == "!" || op.kind == "(" || op.kind == ")" {
+		flag, known := selectorFlags[field]
+		if !known {
+			return nil, selectorError(t.pos, field+" needs to be compared with a value")
+		}
+		return func(d tasmoDevice, inv *inventory) bool { return flag(d) }, nil
+	}
+	p.pos++
+	value, ok := p.peek()
+	if !ok || value.kind != "value" {
+		return nil, selectorError(p.position(), "expected a value")
+	}
+	p.pos++
+	m, err := compareField(field, op.kind, value.text)
+	if err != nil {
+		return nil, selectorError(t.pos, err.Error())
+	}
+	return m, nil
+}
+
+// compareField returns the matcher that compares a field with a value
+func compareField(field string, op string, value string) (matcher, error) {
+	negate := op == "!=" || op == "!~"
+	not := func(m matcher) matcher {
+		if !negate {
+			return m
+		}
+		return func(d tasmoDevice, inv *inventory) bool { return !m(d, inv) }
+	}
+	switch {
+	case field == "tag" || field == "group":
+		if op != "==" && op != "!=" {
+			return nil, errors.New(field + " can only be compared with == and !=")
+		}
+		return not(func(d tasmoDevice, inv *inventory) bool { return inGroup(d, inv, value) }), nil
+	case field == "version":
+		return compareVersion(op, value)
+	case selectorFlags[field] != nil:
+		want, err := strconv.ParseBool(value)
+		if err != nil || (op != "==" && op != "!=") {
+			return nil, errors.New(field + " can only be compared with true or false")
+		}
+		flag := selectorFlags[field]
+		return not(func(d tasmoDevice, inv *inventory) bool { return flag(d) == want }), nil
+	case selectorNumbers[field] != nil:
+		return compareNumber(selectorNumbers[field], op, value)
+	case selectorStrings[field] != nil:
+		get := selectorStrings[field]
+		switch op {
+		case "==", "!=":
+			return not(func(d tasmoDevice, inv *inventory) bool { return strings.EqualFold(get(d), value) }), nil
+		case "~", "!~":
+			like, err := likeMatcher(field, value)
+			if err != nil {
+				return nil, err
+			}
+			return not(func(d tasmoDevice, inv *inventory) bool { return like(get(d)) }), nil
+		}
+		return nil, errors.New(field + " can't be compared with " + op)
+	}
+	return nil, errors.New("unknown field " + field + ", known fields are " + strings.Join(selectorFields(), ", "))
+}
+
+// selectorFields returns the names of all fields a selector can use, sorted
+func selectorFields() []string {
+	fields := []string{"tag", "group", "version"}
+	for field := range selectorStrings {
+		fields = append(fields, field)
+	}
+	for field := range selectorNumbers {
+		fields = append(fields, field)
+	}
+	for field := range selectorFlags {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// likeMatcher returns the test of the ~ operator: a glob pattern if the value contains wildcards, a
+// network for IPs given in CIDR notation, otherwise a substring. Case doesn't matter.
+func likeMatcher(field string, value string) (func(string) bool, error) {
+	if field == "ip" {
+		if _, network, err := net.ParseCIDR(value); err == nil {
+			return func(s string) bool {
+				ip := net.ParseIP(s)
+				return ip != nil && network.Contains(ip)
+			}, nil
+		}
+	}
+	pattern := strings.ToLower(value)
+	if strings.ContainsAny(pattern, "*?[") {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, errors.New("invalid pattern " + value)
+		}
+		return func(s string) bool {
+			ok, _ := filepath.Match(pattern, strings.ToLower(s))
+			return ok
+		}, nil
+	}
+	return func(s string) bool { return strings.Contains(strings.ToLower(s), pattern) }, nil
+}
+
+// compareVersion compares the firmware version. Devices with an unknown version never match.
+func compareVersion(op string, value string) (matcher, error) {
+	if op == "~" || op == "!~" {
+		return nil, errors.New("version can't be compared with " + op)
+	}
+	want, err := version.NewVersion(value)
+	if err != nil {
+		return nil, errors.New("invalid version " + value)
+	}
+	return func(d tasmoDevice, inv *inventory) bool {
+		v, err := version.NewVersion(d.FirmwareVersion)
+		return err == nil && compareOrder(v.Compare(want), op)
+	}, nil
+}
+
+// compareNumber compares a numeric field
+func compareNumber(get func(tasmoDevice) float64, op string, value string) (matcher, error) {
+	if op == "~" || op == "!~" {
+		return nil, errors.New("numbers can't be compared with " + op)
+	}
+	want, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, errors.New("invalid number " + value)
+	}
+	return func(d tasmoDevice, inv *inventory) bool {
+		n := get(d)
+		order := 0
+		switch {
+		case n < want:
+			order = -1
+		case n > want:
+			order = 1
+		}
+		return compareOrder(order, op)
+	}, nil
+}
+
+// compareOrder applies an operator to the result of a comparison
+func compareOrder(order int, op string) bool {
+	switch op {
+	case "==":
+		return order == 0
+	case "!=":
+		return order != 0
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	case ">=":
+		return order >= 0
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseSelector(t *testing.T) {
+	assert := assert.New(t)
+	s, err := parseSelector("  ")
+	assert.Nil(err)
+	assert.Nil(s)
+	for _, text := range []string{
+		`name~"bedroom" && variant=="tasmota" && outdated`,
+		`!(ip~10.0.0.0/24 || tag==garage)`,
+		`version>=9.1.0 && rssi<40`,
+		`name=="Plug \"A\""`,
+		`outdated==false`,
+	} {
+		_, err := parseSelector(text)
+		assert.Nil(err, text)
+	}
+	for _, text := range []string{
+		`name`,
+		`name==`,
+		`name~"bedroom`,
+		`outdated &&`,
+		`(outdated`,
+		`outdated)`,
+		`color=="red"`,
+		`version~9`,
+		`version<"newest"`,
+		`rssi>strong`,
+		`tag<garage`,
+		`outdated==maybe`,
+		`name~"["`,
+		`outdated $ protected`,
+	} {
+		_, err := parseSelector(text)
+		assert.NotNil(err, text)
+	}
+	_, err = parseSelector(`outdated && color=="red"`)
+	assert.Contains(err.Error(), "Invalid selector at position 13: unknown field color, known fields are archived, authfailed")
+	// every field a selector accepts is named
+	for _, field := range []string{"grouptopic", "quarantined", "unrecognized", "minimal", "safeboot", "duplicate", "version", "tag"} {
+		assert.Contains(selectorFields(), field)
+	}
+}
+
+func Test_deviceSelector_match(t *testing.T) {
+	assert := assert.New(t)
+	inv := &inventory{Devices: map[string]*inventoryRecord{"10.0.1.3": {Tags: []string{"garage"}}}}
+	devices := []tasmoDevice{
+		{Name: "Bedroom Lamp", IP: net.IPv4(10, 0, 0, 1), FirmwareVersion: "9.2.0", FirmwareType: "tasmota", Outdated: true, RSSI: 80},
+		{Name: "Bedroom Plug", IP: net.IPv4(10, 0, 0, 2), FirmwareVersion: "12.1.1", FirmwareType: "tasmota", RSSI: 30, Uptime: 2 * time.Hour},
+		{Name: "Garage Door", IP: net.IPv4(10, 0, 1, 3), FirmwareVersion: "9.2.0", FirmwareType: "sensors", Outdated: true, Protected: true},
+	}
+	selected := func(text string) []string {
+		s, err := parseSelector(text)
+		assert.Nil(err, text)
+		names := make([]string, 0)
+		for _, device := range devices {
+			if s.match(device, inv) {
+				names = append(names, device.Name)
+			}
+		}
+		return names
+	}
+	assert.Equal([]string{"Bedroom Lamp"}, selected(`name~"bedroom" && variant=="Tasmota" && outdated`))
+	assert.Equal([]string{"Bedroom Lamp", "Garage Door"}, selected(`name~"*lamp" || tag==garage`))
+	assert.Equal([]string{"Bedroom Plug", "Garage Door"}, selected(`!(ip~10.0.0.0/31 || ip==10.0.0.1)`))
+	assert.Equal([]string{"Bedroom Lamp", "Bedroom Plug"}, selected(`ip~10.0.0.0/24`))
+	assert.Equal([]string{"Bedroom Plug"}, selected(`version>=10 && rssi<40 && uptime>3600`))
+	assert.Equal([]string{"Bedroom Plug", "Garage Door"}, selected(`name!~lamp`))
+	// && binds stronger than ||
+	assert.Equal([]string{"Bedroom Lamp", "Garage Door"}, selected(`protected || outdated && variant==tasmota`))
+	assert.Equal([]string{"Bedroom Plug"}, selected(`outdated==false`))
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/spf13/viper"
+)
+
+// signalOrder skips the pending devices whose Wi-Fi quality is below TASMOGO_MINRSSI and sorts the
+// others by their signal, the strongest first, as a flash over a weak link is the most likely to
+// fail. Devices that don't report a Wi-Fi quality, like the ones found via MQTT or on Ethernet, are
+// never skipped and go last.
+func signalOrder(devices []tasmoDevice, pending []int) []int {
+	minRSSI := viper.GetInt("minrssi")
+	ordered := make([]int, 0, len(pending))
+	for _, i := range pending {
+		device := devices[i]
+		if device.RSSI > 0 && device.RSSI < minRSSI {
+			deviceLogger(device, "update").warn("Not updating " + device.Name + " (" + device.address() + "), its Wi-Fi quality of " + strconv.Itoa(device.RSSI) + "% is below " + strconv.Itoa(minRSSI) + "%")
+			continue
+		}
+		ordered = append(ordered, i)
+	}
+	sort.SliceStable(ordered, func(a, b int) bool {
+		return devices[ordered[a]].RSSI > devices[ordered[b]].RSSI
+	})
+	return ordered
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_signalOrder(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	devices := []tasmoDevice{
+		{Name: "garage", RSSI: 30},
+		{Name: "mqtt"},
+		{Name: "kitchen", RSSI: 90},
+		{Name: "hall", RSSI: 60},
+	}
+	assert.Equal([]int{2, 3, 0, 1}, signalOrder(devices, []int{0, 1, 2, 3}))
+	assert.Equal([]int{3, 0}, signalOrder(devices, []int{0, 3}))
+
+	viper.Set("minrssi", 50)
+	assert.Equal([]int{2, 3, 1}, signalOrder(devices, []int{0, 1, 2, 3}))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// listenSocket creates the unix socket of the control API with the permissions of
+// TASMOGO_SOCKETMODE. Requests on the socket need no token, whoever may open the file may control the
+// daemon.
+func listenSocket(path string) (net.Listener, error) {
+	mode, err := strconv.ParseUint(viper.GetString("socketmode"), 8, 32)
+	if err != nil {
+		return nil, errors.New("Invalid socket mode " + viper.GetString("socketmode"))
+	}
+	// a daemon that was killed leaves its socket behind, anything else at the path is kept
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// serveSocket serves the API on the unix socket at the given path until the returned server is closed,
+// which also removes the socket
+func serveSocket(path string, d *daemon) (*http.Server, error) {
+	l, err := listenSocket(path)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: apiHandler(d)}
+	logInfo("Serving the API on " + path)
+	go func() {
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			logWarn("Serving the API on the socket failed: " + err.Error())
+		}
+	}()
+	return srv, nil
+}
+
+// daemonClient returns the base URL of the API of a running daemon and a client to reach it, via the
+// unix socket of TASMOGO_SOCKET unless TASMOGO_DAEMONURL is set
+func daemonClient() (string, *http.Client, error) {
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+	path := viper.GetString("socket")
+	if path == "" || viper.GetString("daemonurl") != "" {
+		base, err := daemonURL()
+		return base, client, err
+	}
+	client.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", path)
+		},
+	}
+	// the host is ignored, every request goes to the socket
+	return "http://tasmogo", client, nil
+}
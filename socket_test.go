@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_serveSocket(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	path := filepath.Join(t.TempDir(), "tasmogo.sock")
+	d := newDaemon(nil)
+	d.devices = []tasmoDevice{{Name: "plug", IP: net.IPv4(10, 0, 0, 1), Outdated: true}}
+	srv, err := serveSocket(path, d)
+	assert.Nil(err)
+	info, err := os.Stat(path)
+	assert.Nil(err)
+	assert.Equal(os.FileMode(0600), info.Mode().Perm())
+
+	// the socket needs no token, even if the API has one
+	viper.Set("apitoken", "secret")
+	viper.Set("socket", path)
+	s, err := fetchDaemonSummary()
+	assert.Nil(err)
+	assert.Equal(1, s.Outdated)
+	assert.Nil(daemonRequest("POST", "/api/pause", &s))
+	assert.True(s.Paused)
+	assert.True(d.isPaused())
+
+	// closing the server removes the socket
+	srv.Close()
+	_, err = os.Stat(path)
+	assert.True(os.IsNotExist(err))
+	_, err = fetchDaemonSummary()
+	assert.NotNil(err)
+}
+
+func Test_listenSocket(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	dir := t.TempDir()
+
+	// a socket left behind by a killed daemon is replaced
+	path := filepath.Join(dir, "stale.sock")
+	stale, err := net.Listen("unix", path)
+	assert.Nil(err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	l, err := listenSocket(path)
+	assert.Nil(err)
+	l.Close()
+
+	// other files are kept
+	path = filepath.Join(dir, "file")
+	assert.Nil(ioutil.WriteFile(path, []byte("data"), 0600))
+	_, err = listenSocket(path)
+	assert.NotNil(err)
+
+	viper.Set("socketmode", "rw")
+	_, err = listenSocket(filepath.Join(dir, "other.sock"))
+	assert.NotNil(err)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/spf13/viper"
+)
+
+// restartAllowance is the time a device takes to flash the downloaded firmware and restart
+const restartAllowance = 30 * time.Second
+
+// downloadMeasurement is the download of a firmware file from the OTA source
+type downloadMeasurement struct {
+	URL      string        `json:"url"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// throughput returns the measured speed in bytes per second
+func (m downloadMeasurement) throughput() float64 {
+	if m.Error != "" || m.Duration <= 0 {
+		return 0
+	}
+	return float64(m.Bytes) / m.Duration.Seconds()
+}
+
+// measureDownload downloads a file and measures how long it takes. The file is thrown away.
+func measureDownload(ctx context.Context, url string) downloadMeasurement {
+	m := downloadMeasurement{URL: url}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+	err := func() error {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return err
+		}
+		setRequestHeader(req)
+		start := time.Now()
+		res, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return errors.New("Server answered with HTTP status " + strconv.Itoa(res.StatusCode))
+		}
+		m.Bytes, err = io.Copy(ioutil.Discard, res.Body)
+		m.Duration = time.Since(start)
+		return err
+	}()
+	if err != nil {
+		m.Error = err.Error()
+	}
+	return m
+}
+
+// rolloutEstimate is how long updating the pending devices takes, based on the measured downloads.
+// TooSlow is set if it takes longer than TASMOGO_UPDATEWINDOW.
+type rolloutEstimate struct {
+	Devices      int                   `json:"devices"`
+	Batches      int                   `json:"batches"`
+	Duration     time.Duration         `json:"duration"`
+	Window       time.Duration         `json:"window"`
+	TooSlow      bool                  `json:"tooSlow"`
+	Measurements []downloadMeasurement `json:"measurements"`
+}
+
+// estimateRollout downloads the firmware of every pending device once and estimates how long the
+// rollout takes. The devices of a batch share the bandwidth of the OTA source, so their downloads add
+// up; every batch also waits for the devices to flash and restart. Devices whose firmware couldn't be
+// downloaded are left out of the estimate.
+func estimateRollout(ctx context.Context, devices []tasmoDevice, pending []int) rolloutEstimate {
+	e := rolloutEstimate{Devices: len(pending), Window: viper.GetDuration("updatewindow"), Measurements: make([]downloadMeasurement, 0)}
+	measured := make(map[string]downloadMeasurement)
+	for _, i := range pending {
+		url := otaURLForDevice(devices[i])
+		if _, ok := measured[url]; ok || ctx.Err() != nil {
+			continue
+		}
+		m := measureDownload(ctx, url)
+		measured[url] = m
+		e.Measurements = append(e.Measurements, m)
+	}
+	batchSize := viper.GetInt("batchsize")
+	if batchSize < 1 {
+		batchSize = len(pending)
+	}
+	for start := 0; start < len(pending); start += batchSize {
+		end := start + batchSize
+		if end > len(pending) {
+			end = len(pending)
+		}
+		e.Batches++
+		e.Duration += restartAllowance
+		for _, i := range pending[start:end] {
+			m := measured[otaURLForDevice(devices[i])]
+			if speed := m.throughput(); speed > 0 {
+				e.Duration += time.Duration(float64(m.Bytes) / speed * float64(time.Second))
+			}
+		}
+	}
+	e.Duration = e.Duration.Truncate(time.Second)
+	e.TooSlow = e.Window > 0 && e.Duration > e.Window
+	return e
+}
+
+// describe summarizes the estimate in a sentence
+func (e rolloutEstimate) describe() string {
+	text := "Updating " + strconv.Itoa(e.Devices) + " devices in " + strconv.Itoa(e.Batches) + " batches takes about " + e.Duration.String()
+	if e.TooSlow {
+		text += ", longer than the update window of " + e.Window.String()
+	}
+	return text
+}
+
+// warnSlowRollout measures the OTA source before a rollout and warns if the rollout takes longer than
+// the update window
+func warnSlowRollout(ctx context.Context, devices []tasmoDevice) {
+	pending := pendingUpdates(devices)
+	if len(pending) == 0 {
+		return
+	}
+	e := estimateRollout(ctx, devices, pending)
+	for _, m := range e.Measurements {
+		if m.Error != "" {
+			logWarn("Measuring the download of " + m.URL + " failed: " + m.Error)
+		}
+	}
+	if e.TooSlow {
+		logWarn(e.describe())
+		return
+	}
+	logInfo(e.describe())
+}
+
+// renderRolloutEstimate generates the estimate as JSON if TASMOGO_OUTPUT is "json", otherwise as a
+// table of the measured downloads
+func renderRolloutEstimate(e rolloutEstimate) (string, error) {
+	if viper.GetString("output") == "json" {
+		data, err := json.MarshalIndent(e, "", "  ")
+		return string(data), err
+	}
+	t := table.NewWriter()
+	t.AppendHeader(table.Row{"Firmware", "Size", "Time", "Speed"})
+	for _, m := range e.Measurements {
+		if m.Error != "" {
+			t.AppendRow(table.Row{m.URL, "", "", "failed: " + m.Error})
+			continue
+		}
+		t.AppendRow(table.Row{m.URL, strconv.FormatInt(m.Bytes/1024, 10) + "k", m.Duration.Truncate(time.Millisecond), strconv.FormatFloat(m.throughput()/1024, 'f', 0, 64) + "k/s"})
+	}
+	t.AppendFooter(table.Row{e.describe(), "", "", ""})
+	return t.Render(), nil
+}
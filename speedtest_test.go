@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_measureDownload(t *testing.T) {
+	assert := assert.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/tasmota.bin" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(strings.Repeat("x", 4096)))
+	}))
+	defer srv.Close()
+	m := measureDownload(context.Background(), srv.URL+"/tasmota.bin")
+	assert.Empty(m.Error)
+	assert.Equal(int64(4096), m.Bytes)
+	assert.True(m.throughput() > 0)
+
+	m = measureDownload(context.Background(), srv.URL+"/missing.bin")
+	assert.Equal("Server answered with HTTP status 404", m.Error)
+	assert.Equal(0.0, m.throughput())
+}
+
+func Test_estimateRollout(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 1024)))
+	}))
+	defer srv.Close()
+	setDefaults()
+	viper.Set("otaurl", srv.URL+"/")
+	viper.Set("batchsize", 2)
+	devices := []tasmoDevice{
+		{Name: "a", IP: net.IPv4(10, 0, 0, 1), FirmwareType: "tasmota", Outdated: true},
+		{Name: "b", IP: net.IPv4(10, 0, 0, 2), FirmwareType: "tasmota", Outdated: true},
+		{Name: "c", IP: net.IPv4(10, 0, 0, 3), FirmwareType: "sensors", Outdated: true},
+		{Name: "d", IP: net.IPv4(10, 0, 0, 4), FirmwareType: "sensors"},
+	}
+	e := estimateRollout(context.Background(), devices, pendingUpdates(devices))
+	assert.Equal(3, e.Devices)
+	assert.Equal(2, e.Batches)
+	// every firmware file is downloaded once
+	assert.Len(e.Measurements, 2)
+	assert.True(e.Duration >= 2*restartAllowance)
+	assert.False(e.TooSlow)
+
+	viper.Set("updatewindow", 30*time.Second)
+	e = estimateRollout(context.Background(), devices, pendingUpdates(devices))
+	assert.True(e.TooSlow)
+	assert.Contains(e.describe(), "longer than the update window of 30s")
+	out, err := renderRolloutEstimate(e)
+	assert.Nil(err)
+	assert.Contains(out, srv.URL+"/tasmota.bin")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// fleetState is the content of TASMOGO_STATEFILE: the totals a dashboard shows and the state of every
+// device
+type fleetState struct {
+	Time     time.Time    `json:"time"`
+	Total    int          `json:"total"`
+	Outdated int          `json:"outdated"`
+	Updated  int          `json:"updated"`
+	Failed   int          `json:"failed"`
+	Online   int          `json:"online"`
+	Offline  int          `json:"offline"`
+	Devices  []scanResult `json:"devices"`
+}
+
+// newFleetState counts the devices of the results. Online and offline are only counted for the devices
+// whose last will was seen.
+func newFleetState(results []scanResult, now time.Time) fleetState {
+	s := fleetState{Time: now, Total: len(results), Devices: results}
+	for _, r := range results {
+		if r.Outdated {
+			s.Outdated++
+		}
+		switch r.UpdateResult {
+		case "verified":
+			s.Updated++
+		case "failed":
+			s.Failed++
+		}
+		switch {
+		case r.Online == nil:
+		case *r.Online:
+			s.Online++
+		default:
+			s.Offline++
+		}
+	}
+	return s
+}
+
+// replaceFile writes data to a temporary file next to path and renames it, so readers never see a
+// partial file
+func replaceFile(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tasmogo-"+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// writeState replaces the state file with the given results
+func writeState(path string, results []scanResult, now time.Time) error {
+	data, err := json.MarshalIndent(newFleetState(results, now), "", "  ")
+	if err != nil {
+		return err
+	}
+	return replaceFile(path, data)
+}
+
+// saveState writes the results to TASMOGO_STATEFILE if it is set
+func saveState(results []scanResult) {
+	path := viper.GetString("statefile")
+	if path == "" {
+		return
+	}
+	if err := writeState(path, results, time.Now()); err != nil {
+		logWarn("Writing the state file failed: " + err.Error())
+	}
+}
+
+// saveState writes the devices of the last scan with their current availability to the state file
+func (d *daemon) saveState() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	saveState(d.deviceResults(d.devices))
+}
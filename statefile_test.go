@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newFleetState(t *testing.T) {
+	assert := assert.New(t)
+	online, offline := true, false
+	now := time.Now()
+	s := newFleetState([]scanResult{
+		{Name: "plug", Outdated: true, Online: &online},
+		{Name: "lamp", UpdateResult: "verified", Online: &offline},
+		{Name: "fan", UpdateResult: "failed"},
+	}, now)
+	assert.Equal(now, s.Time)
+	assert.Equal(3, s.Total)
+	assert.Equal(1, s.Outdated)
+	assert.Equal(1, s.Updated)
+	assert.Equal(1, s.Failed)
+	assert.Equal(1, s.Online)
+	assert.Equal(1, s.Offline)
+	assert.Len(s.Devices, 3)
+}
+
+func Test_writeState(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	assert.Nil(writeState(path, scanResults([]tasmoDevice{{Name: "plug", IP: net.IPv4(10, 0, 0, 1), Outdated: true}}), time.Now()))
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+	var s fleetState
+	assert.Nil(json.Unmarshal(data, &s))
+	assert.Equal(1, s.Outdated)
+	assert.Equal("plug", s.Devices[0].Name)
+	// no temporary files are left behind
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(files, 1)
+	assert.NotNil(writeState(filepath.Join(dir, "missing", "state.json"), nil, time.Now()))
+}
+
+func Test_daemon_saveState(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	path := filepath.Join(t.TempDir(), "state.json")
+	viper.Set("statefile", path)
+	d := newDaemon(nil)
+	d.devices = []tasmoDevice{{Name: "plug", IP: net.IPv4(10, 0, 0, 1), Topic: "plug"}}
+	// a device going offline updates the state file
+	d.handleLWT("plug", "Online", time.Now())
+	d.handleLWT("plug", "Offline", time.Now())
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+	var s fleetState
+	assert.Nil(json.Unmarshal(data, &s))
+	assert.Equal(1, s.Offline)
+	if assert.NotNil(s.Devices[0].Online) {
+		assert.False(*s.Devices[0].Online)
+	}
+}
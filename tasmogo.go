@@ -1,61 +1,144 @@
 package main
 
 import (
-	"encoding/binary"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
+	"math/big"
 	"net"
-	"net/http"
 	"os"
 	"os/signal"
-	"regexp"
-	"sort"
+	"path"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/hashicorp/go-version"
 	"github.com/jedib0t/go-pretty/v6/progress"
 	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/merlinschumacher/tasmogo/pkg/scanner"
+	"github.com/merlinschumacher/tasmogo/pkg/tasmota"
 	"github.com/spf13/viper"
 	"github.com/tcnksm/go-latest"
-	"github.com/tidwall/gjson"
 )
 
 // default definition for latest, to get the current version of Tasmota from GitHub
-var versionData = &latest.GithubTag{
-	Owner:             "arendst",
-	Repository:        "tasmota",
-	FixVersionStrFunc: latest.DeleteFrontV(),
+var versionData = &githubTags{
+	Owner:      "arendst",
+	Repository: "tasmota",
+	getter:     sharedHTTPCache,
 }
 
 // tasmoDevice holds basic information about a found device
 type tasmoDevice struct {
-	Name            string
+	Name string
+	// DeviceName and FriendlyName are the names the device reports, NameSource tells which of its
+	// names the displayed one is, see TASMOGO_NAMEFALLBACK
+	DeviceName      string
+	FriendlyName    string
+	NameSource      string
 	FirmwareVersion string
 	FirmwareType    string
 	Outdated        bool
 	IP              net.IP
+	Latency         time.Duration
+	LatencyDegraded bool
+	Heap            int
+	HeapDropping    bool
+	Signal          int
+	SSID            string
+	UpdateURL       string
+	Verified        bool
+	Topic           string
+	FullTopic       string
+	GroupTopic      string
+	ViaMQTT         bool
+	FlashSize       int
+	Chip            string
+	TargetType      string
+	UpdateAttempts  int
+	Sources         []string
+	OtaURL          string
+	Protected       bool
+	Hostname        string
+	MAC             string
+	Excluded        bool
+	// Quarantined devices failed too many runs in a row and are left to manual attention
+	Quarantined bool
+	// Unrecognized devices answer like Tasmota, but their version string has an unknown format
+	Unrecognized bool
+	// Canary devices get new releases before the rest of the fleet
+	Canary bool
+	// Archived devices have been missing for long and are only listed with --include-archived
+	Archived bool
+	// DNSName is the name of TASMOGO_HOSTS or TASMOGO_HOSTSFILE the device was found by
+	DNSName string
+	// Sensors are the readings of the sensors by sensor and reading, with TASMOGO_TELEMETRY
+	Sensors       map[string]map[string]float64
+	PinnedVersion string
+	FirstSeen     time.Time
+	LastSeen      time.Time
+	Cached        bool
+	// LastUpdate is the time tasmogo last updated the device, FailedUpdates the failed attempts since
+	LastUpdate    time.Time
+	FailedUpdates int
+	// RestartReason is why the device restarted last, Crashed is set if that was a crash since the
+	// last scan
+	RestartReason string
+	BootCount     int
+	Crashed       bool
+	// Module is the configured module or template, Uptime the time since the last restart and RSSI
+	// the Wi-Fi quality in percent
+	Module int
+	Uptime time.Duration
+	RSSI   int
+	// BSSID is the access point the device is connected to and Channel its Wi-Fi channel
+	BSSID   string
+	Channel int
+	// AuthFailed is set if the device rejected the password, during the scan or the update
+	AuthFailed bool
+	// PushUpdate is set if the firmware is uploaded to the device instead of pulled from an OTA URL
+	PushUpdate bool
+	// Duplicates are the other addresses the device answered at with the same MAC, e.g. over Ethernet
+	Duplicates []string
 }
 
-// ip2int converts a given IP of type net.IP to an integer.
-func ip2int(ip net.IP) uint32 {
-	if len(ip) == 16 {
-		return binary.BigEndian.Uint32(ip[12:16])
+// address returns the IP of the device for display. Devices discovered via MQTT might not report one.
+func (d tasmoDevice) address() string {
+	if d.IP == nil {
+		return "-"
 	}
-	return binary.BigEndian.Uint32(ip)
+	return d.IP.String()
 }
 
-// getPasswordQuery checks if a login password was given and returns the needed URL query part
-func getPasswordQuery(password string) string {
-	auth := ""
-	if password != "" {
-		auth = "user=admin&password=" + password + "&"
+// nextIP returns the address following the given one
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
 	}
-	return auth
+	return next
+}
+
+// networkSize returns the number of addresses in a network. Networks with more addresses than
+// TASMOGO_MAXADDRESSES are refused, as a single IPv6 subnet could never be scanned completely.
+func networkSize(network *net.IPNet) (int64, error) {
+	ones, bits := network.Mask.Size()
+	maxAddresses := viper.GetInt64("maxaddresses")
+	if bits-ones >= 63 || int64(1)<<uint(bits-ones) > maxAddresses {
+		return 0, fmt.Errorf("%s contains more than %d addresses", network.String(), maxAddresses)
+	}
+	return int64(1) << uint(bits-ones), nil
 }
 
 // set up the progress bar for the scan
@@ -70,130 +153,409 @@ func initProgressBar() progress.Writer {
 	return pw
 }
 
-// scanNetwork is the central scan function of tasmogo. It walks through the address space specified by the given CIDR and makes requests to the IPs.
-func scanNetwork() []tasmoDevice {
-	// convert string to IPNet struct
-	_, ipv4Net, err := net.ParseCIDR(viper.GetString("cidr"))
+// startProgress draws a progress bar for the given number of steps if showProgress allows it. The bar
+// is rendered by a single goroutine, which the returned function stops and waits for, so nothing else
+// is logged in the middle of it.
+func startProgress(total int64) (*progress.Tracker, func()) {
+	tracker := &progress.Tracker{Total: total}
+	rendered := make(chan struct{})
+	if showProgress() {
+		pb := initProgressBar()
+		pb.AppendTracker(tracker)
+		go func() {
+			pb.Render()
+			close(rendered)
+		}()
+	} else {
+		close(rendered)
+	}
+	return tracker, func() {
+		tracker.MarkAsDone()
+		<-rendered
+	}
+}
+
+// showProgress reports if the progress bar should be drawn. It is only shown on terminals, as it would
+// clutter the output of scripts and log files.
+func showProgress() bool {
+	if !viper.GetBool("progress") {
+		return false
+	}
+	file, ok := log.Writer().(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// networkTargets lists the addresses of the networks given by TASMOGO_CIDR, except the ones given by
+// TASMOGO_EXCLUDE
+func networkTargets() []net.IP {
+	// convert the strings to IPNet structs, this works for IPv4 and IPv6 alike
+	networks, err := parseNetworks(getList("cidr"))
+	if err != nil {
+		logFatal(err.Error())
+	}
+	// addresses like the router or cameras are never probed
+	excluded, err := parseNetworks(getList("exclude"))
 	if err != nil {
-		log.Fatal(err)
-	}
-	// convert IPNet struct mask and address to uint32
-	// network is BigEndian
-	mask := binary.BigEndian.Uint32(ipv4Net.Mask)
-	// find the first address
-	start := binary.BigEndian.Uint32(ipv4Net.IP)
-	// find the final address
-	finish := (start & mask) | (mask ^ 0xffffffff)
-	// show a message and a nice progress bar.
-	log.Println("Starting scan of " + strconv.Itoa(int(finish-start)) + " ip addresses (" + ipv4Net.String() + ")")
+		logFatal(err.Error())
+	}
+	ips, err := networkAddresses(networks, excluded)
+	if err != nil {
+		logWarn("Not scanning, " + err.Error())
+		return []net.IP{}
+	}
+	logInfo("Found " + strconv.Itoa(len(ips)) + " ip addresses in " + strings.Join(getList("cidr"), ", "))
+	return ips
+}
+
+// parseNetworks converts a list of CIDRs, single IPs and ranges like 192.168.0.10-192.168.0.60 to
+// networks. The end of an IPv4 range may also be given as its last number only, e.g. 192.168.0.10-60.
+func parseNetworks(entries []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		if strings.Contains(entry, "-") {
+			ranged, err := parseRange(entry)
+			if err != nil {
+				return nil, err
+			}
+			networks = append(networks, ranged...)
+			continue
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
 
+// parseRange converts a range of addresses to the smallest list of networks covering exactly that range
+func parseRange(entry string) ([]*net.IPNet, error) {
+	parts := strings.SplitN(entry, "-", 2)
+	start, end := net.ParseIP(strings.TrimSpace(parts[0])), net.ParseIP(strings.TrimSpace(parts[1]))
+	// a range within a /24 may end with the last number of the address only
+	if last, err := strconv.Atoi(strings.TrimSpace(parts[1])); err == nil && start != nil && start.To4() != nil && last >= 0 && last <= 255 {
+		end = append(net.IP{}, start.To4()...)
+		end[3] = byte(last)
+	}
+	if start == nil || end == nil || (start.To4() == nil) != (end.To4() == nil) {
+		return nil, errors.New("invalid address range " + entry)
+	}
+	bits := 8 * net.IPv6len
+	if start.To4() != nil {
+		start, end = start.To4(), end.To4()
+		bits = 8 * net.IPv4len
+	}
+	from, to := new(big.Int).SetBytes(start), new(big.Int).SetBytes(end)
+	if from.Cmp(to) > 0 {
+		return nil, errors.New("invalid address range " + entry + ", the start is after the end")
+	}
+	networks := make([]*net.IPNet, 0)
+	one := big.NewInt(1)
+	for from.Cmp(to) <= 0 {
+		// the largest block that starts at the current address and doesn't reach past the end
+		size := 0
+		for size < bits && from.Bit(size) == 0 {
+			last := new(big.Int).Lsh(one, uint(size+1))
+			last.Add(last, from).Sub(last, one)
+			if last.Cmp(to) > 0 {
+				break
+			}
+			size++
+		}
+		ip := make(net.IP, bits/8)
+		from.FillBytes(ip)
+		networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits-size, bits)})
+		from.Add(from, new(big.Int).Lsh(one, uint(size)))
+	}
+	return networks, nil
+}
+
+// networkAddresses lists all addresses of the networks, except the excluded ones. Addresses of
+// overlapping networks are only listed once. The networks may together contain no more than
+// TASMOGO_MAXADDRESSES addresses.
+func networkAddresses(networks []*net.IPNet, excluded []*net.IPNet) ([]net.IP, error) {
+	sizes := make([]int64, len(networks))
+	total := int64(0)
+	for i, network := range networks {
+		size, err := networkSize(network)
+		if err != nil {
+			return nil, err
+		}
+		sizes[i] = size
+		total += size
+	}
+	if maxAddresses := viper.GetInt64("maxaddresses"); total > maxAddresses {
+		return nil, fmt.Errorf("the networks contain more than %d addresses", maxAddresses)
+	}
+	ips := make([]net.IP, 0, total)
+	for i, network := range networks {
+		// the range includes the network and broadcast addresses
+		ip := network.IP
+		for n := int64(0); n < sizes[i]; n++ {
+			if !containsIP(excluded, ip) && !containsIP(networks[:i], ip) {
+				ips = append(ips, ip)
+			}
+			ip = nextIP(ip)
+		}
+	}
+	return ips, nil
+}
+
+// containsIP reports if one of the networks contains the IP
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveHosts converts a list of addresses and hostnames to IPs. Hostnames are resolved to a single
+// address, preferring IPv4, so a device isn't found twice.
+func resolveHosts(hosts []string) []net.IP {
+	ips := make([]net.IP, 0, len(hosts))
+	for _, host := range hosts {
+		host = strings.Trim(host, "[]")
+		if ip := net.ParseIP(host); ip != nil {
+			ips = append(ips, ip)
+			continue
+		}
+		resolved, err := net.LookupIP(host)
+		if err != nil || len(resolved) == 0 {
+			logWarn("Resolving " + host + " failed")
+			continue
+		}
+		ip := resolved[0]
+		for _, candidate := range resolved {
+			if candidate.To4() != nil {
+				ip = candidate
+				break
+			}
+		}
+		rememberHostName(ip, host)
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// probeAddresses requests the data of all addresses the feed function sends and returns the Tasmota
+// devices among them and the addresses whose errors are worth another try. Addresses that rejected the
+// password are returned as devices marked AuthFailed. total is the number of
+// addresses and only used for the progress bar.
+func probeAddresses(ctx context.Context, total int64, feed func(addresses chan<- net.IP)) ([]tasmoDevice, []net.IP) {
 	// create a progress bar and a tracker for it to follow the progress
-	pb := initProgressBar()
-	tracker := progress.Tracker{Total: int64(finish - start)}
-	pb.AppendTracker(&tracker)
-
-	// The network scan is higly parallelized. So we need a wait group for the goroutines.
-	var wg sync.WaitGroup
-	// Writing to a slice like foundDevices with multiple goroutines results in a race condition. A mutex fixes this
-	var (
-		mu           = &sync.Mutex{}
-		foundDevices = make([]tasmoDevice, 0)
-	)
-	// loop through addresses as uint32
-	for i := start; i <= finish; i++ {
-		wg.Add(1)
-		go func(i uint32) {
-			defer wg.Done()
-			ip := make(net.IP, 4)
-			// convert the int back to net.IP
-			binary.BigEndian.PutUint32(ip, i)
-			// get the device data
-			device, err := getDeviceData(ip)
-			if err == nil {
-				// lock the mutex before writing the slice of foundDevices
+	tracker, stopProgress := startProgress(total)
+
+	// The network scan is parallelized with a fixed number of workers, so large networks don't
+	// exhaust the file descriptors. The channel blocks as soon as all workers are busy.
+	var mu sync.Mutex
+	failed := make([]net.IP, 0)
+	rejected := make([]net.IP, 0)
+	timeouts := 0
+	concurrency := viper.GetInt("concurrency")
+	if viper.GetBool("slowscan") && concurrency > slowScanConcurrency {
+		concurrency = slowScanConcurrency
+	}
+	concurrency = politeInt(concurrency, politeConcurrency)
+	s := scanner.New(append(probeOptions(),
+		scanner.WithFailures(func(ip net.IP, err error) {
+			if retryable(err) {
 				mu.Lock()
-				// write and unlock
-				foundDevices = append(foundDevices, device)
+				failed = append(failed, ip)
+				if errors.Is(err, tasmota.ErrTimeout) {
+					timeouts++
+				}
+				if errors.Is(err, tasmota.ErrUnauthorized) {
+					rejected = append(rejected, ip)
+				}
 				mu.Unlock()
 			}
-			// increment the tracker progress
-			tracker.Increment(1)
-			// forcibly update the progressbar
-			pb.Render()
-		}(i)
+		}),
+		scanner.WithConcurrency(concurrency),
+		scanner.WithRateLimit(scanRate(), viper.GetBool("adaptivethrottle")),
+		scanner.WithProgress(func() { tracker.Increment(1) }),
+	)...)
+	addresses := make(chan net.IP)
+	go func() {
+		feed(addresses)
+		close(addresses)
+	}()
+	foundDevices := make([]tasmoDevice, 0)
+	for _, found := range s.Scan(ctx, addresses) {
+		rememberDevice(found.IP.String(), found.Status.Hostname, found.Status.MAC)
+		foundDevices = append(foundDevices, deviceFromScan(found))
+	}
+	stopProgress()
+	logInfo("Scan finished, found " + strconv.Itoa(len(foundDevices)) + " devices")
+	// the devices that rejected the password are listed, so they don't go unnoticed
+	for _, ip := range rejected {
+		logWarn(ip.String() + " rejected the password, check TASMOGO_PASSWORD and TASMOGO_CREDENTIALS")
+		foundDevices = append(foundDevices, tasmoDevice{IP: ip, AuthFailed: true})
 	}
-	wg.Wait()
-	tracker.MarkAsDone()
-	return foundDevices
+	if len(failed) > 0 {
+		logWarn(strconv.Itoa(len(failed)) + " addresses failed with errors, " + strconv.Itoa(timeouts) + " of them timed out, use --rescan-errors or --slow-scan to probe them again")
+	}
+	return foundDevices, failed
 }
 
-func buildDeviceURL(hostname string, password string) string {
-	auth := getPasswordQuery(password)
-	return "http://" + hostname + "/cm?" + auth + "cmnd=Status%200"
+// newDeviceClient creates a client for the device API with the password, scheme and port from the
+// config. The requests and answers are logged at the debug level. Tests replace it with a fake.
+var newDeviceClient = func() tasmota.DeviceClient {
+	return tasmota.NewClient(
+		tasmota.WithCredentials(devicePassword),
+		tasmota.WithBasicAuth(deviceBasicAuth),
+		tasmota.WithEndpoint(deviceEndpoint),
+		tasmota.WithHTTPClient(deviceHTTPClient(0)),
+		tasmota.WithHeader(deviceHeader()),
+		tasmota.WithLogger(debugLogger()),
+	)
 }
 
-func parseFirmwareVersion(v string) (string, string, error) {
-	re, _ := regexp.Compile(`(.*)\((.*)\)`)
-	res := re.FindAllStringSubmatch(v, 1)
-	if len(res) != 1 {
-		return "", "", errors.New("Regex parser failed\n" + v)
+// slowScanConcurrency is the number of addresses probed at the same time with TASMOGO_SLOWSCAN
+const slowScanConcurrency = 32
+
+// probeOptions configures how a single address is probed: with the timeout of TASMOGO_SCANTIMEOUT and
+// retried TASMOGO_SCANRETRIES times. TASMOGO_SLOWSCAN triples the timeout and retries at least twice,
+// for congested networks and devices with a weak signal. TASMOGO_POLITE cuts the timeout short and
+// doesn't retry at all.
+func probeOptions() []scanner.Option {
+	timeout, retries := viper.GetDuration("scantimeout"), viper.GetInt("scanretries")
+	if viper.GetBool("slowscan") {
+		timeout *= 3
+		if retries < 2 {
+			retries = 2
+		}
+	}
+	if polite() {
+		timeout, retries = politeDuration(timeout, politeScanTimeout), 0
+	}
+	return []scanner.Option{
+		scanner.WithClient(newDeviceClient()),
+		scanner.WithTimeout(timeout),
+		scanner.WithRetries(retries, viper.GetDuration("scanbackoff")),
+		scanner.WithLogger(debugLogger()),
 	}
-	return res[0][1], res[0][2], nil
 }
 
-// getDeviceData loads the data from a given device ip
-func getDeviceData(ip net.IP) (tasmoDevice, error) {
-	var device tasmoDevice
-	password := viper.GetString("password")
-	// build the URL for our device request
-	data, _ := getURL(buildDeviceURL(ip.String(), password))
-
-	// Extract the firmware version
-	fw := gjson.Get(data, "StatusFWR.Version").String()
-	version, variant, err := parseFirmwareVersion(fw)
-	if err != nil {
-		return device, errors.New("Incompatible device")
+// deviceFromScan converts a device found by the scanner
+func deviceFromScan(found scanner.Device) tasmoDevice {
+	// the version strings of forks are only known to the config
+	raw := found.Status.Version
+	if found.Status.Variant != "" {
+		raw += "(" + found.Status.Variant + ")"
 	}
-	// Extract the split version and type
-	device.IP = ip
-	device.FirmwareVersion = version
-	device.FirmwareType = variant
-	device.Name = gjson.Get(data, "Status.DeviceName").String()
-	return device, nil
+	version, variant, ok := recognizeFirmware(raw)
+	var sensors map[string]map[string]float64
+	if collectTelemetry() {
+		sensors = sensorReadings(found.Status.Response)
+	}
+	return nameDevice(tasmoDevice{
+		Sensors:         sensors,
+		DeviceName:      found.Status.Name,
+		FriendlyName:    found.Status.FriendlyName,
+		FirmwareVersion: version,
+		FirmwareType:    variant,
+		Unrecognized:    !ok,
+		IP:              found.IP,
+		Latency:         found.Latency,
+		Heap:            found.Status.Heap,
+		Signal:          found.Status.Signal,
+		SSID:            found.Status.SSID,
+		FlashSize:       found.Status.FlashSize,
+		Chip:            tasmota.ChipFamily(found.Status.Hardware, variant),
+		OtaURL:          found.Status.OtaURL,
+		Topic:           found.Status.Topic,
+		GroupTopic:      found.Status.GroupTopic,
+		Hostname:        found.Status.Hostname,
+		DNSName:         hostName(found.IP),
+		MAC:             found.Status.MAC,
+		RestartReason:   found.Status.RestartReason,
+		BootCount:       found.Status.BootCount,
+		Module:          found.Status.Module,
+		Uptime:          found.Status.Uptime,
+		RSSI:            found.Status.RSSI,
+		BSSID:           found.Status.BSSID,
+		Channel:         found.Status.Channel,
+	})
 }
 
-// getURL is a simple helper function to execute a HTTP GET request
-func getURL(url string) (string, error) {
-	client := http.Client{
-		Timeout: 10 * time.Second,
+// getDeviceData loads the data from a given device ip, retrying timeouts like a scan does. The request
+// is aborted when the context is done.
+func getDeviceData(ctx context.Context, ip net.IP) (tasmoDevice, error) {
+	found, err := scanner.New(probeOptions()...).Probe(ctx, ip)
+	if errors.Is(err, tasmota.ErrUnauthorized) {
+		return tasmoDevice{IP: ip, AuthFailed: true}, fmt.Errorf("%w, check TASMOGO_PASSWORD and TASMOGO_CREDENTIALS", err)
 	}
-	req, err := http.NewRequest("GET", url, nil)
-
-	res, err := client.Do(req)
 	if err != nil {
-		return "", errors.New("JSON download failed")
+		return tasmoDevice{}, err
 	}
+	return deviceFromScan(found), nil
+}
 
-	body, err := ioutil.ReadAll(res.Body)
+// sendCommand executes a console command on a device and returns its JSON answer
+func sendCommand(host string, command string) (string, error) {
+	return newDeviceClient().Command(context.Background(), host, command)
+}
+
+// getCurrentTasmotaVersion loads the current version of tasmota with help of latest
+func getCurrentTasmotaVersion(v latest.Source) *version.Version {
+	currentVersion, err := lookupTasmotaVersion(v)
 	if err != nil {
-		panic(err.Error())
+		logFatal("Getting current Tasmota version failed: " + err.Error())
 	}
-	return string(body), nil
+	return currentVersion
 }
 
-// getCurrentTasmotaVersion loads the current version of tasmota with help of latest
-func getCurrentTasmotaVersion(v *latest.GithubTag) *version.Version {
+// lookupTasmotaVersion returns the current version of tasmota from the given source. If
+// TASMOGO_TARGETVERSION is set, that version is used and the source isn't asked at all.
+func lookupTasmotaVersion(v latest.Source) (*version.Version, error) {
+	if target := viper.GetString("targetversion"); target != "" {
+		targetVersion, err := version.NewVersion(target)
+		if err != nil {
+			return nil, errors.New("Invalid target version " + target)
+		}
+		return targetVersion, nil
+	}
 	res, err := latest.Check(v, "0.1.0")
+	if err != nil {
+		return nil, err
+	}
+	return version.NewVersion(res.Current)
+}
 
+// releaseVersion returns the current version of the release channel. With a firmware manifest the
+// devices running custom builds can be checked without it, so a failed lookup isn't fatal.
+func releaseVersion() *version.Version {
+	if viper.GetString("firmwaremanifest") == "" {
+		return getCurrentTasmotaVersion(channelSource())
+	}
+	currentVersion, err := lookupTasmotaVersion(channelSource())
 	if err != nil {
-		log.Fatal("FATAL: Getting current Tasmota version failed.\n" + err.Error())
+		logWarn("Getting current Tasmota version failed, only checking the custom builds: " + err.Error())
 	}
-	currentVersion, err := version.NewVersion(res.Current)
 	return currentVersion
 }
 
 // checkDeviceVersion compares two version strings to evaluate if an update is needed.
 func checkDeviceVersion(v *version.Version, device tasmoDevice) (tasmoDevice, error) {
+	if v == nil {
+		return device, errors.New("Target version unknown")
+	}
 	deviceVersion, _ := version.NewVersion(device.FirmwareVersion)
 	if deviceVersion == nil {
 		return device, errors.New("Version could not be determined")
@@ -204,6 +566,73 @@ func checkDeviceVersion(v *version.Version, device tasmoDevice) (tasmoDevice, er
 	return device, nil
 }
 
+// deviceStates returns "outdated" if the device needs an update, followed by the reasons why tasmogo
+// might leave it alone
+func deviceStates(device tasmoDevice) []string {
+	states := make([]string, 0)
+	if device.Outdated {
+		states = append(states, "outdated")
+	}
+	if device.Protected {
+		states = append(states, "protected")
+	}
+	if device.Excluded {
+		states = append(states, "excluded")
+	}
+	if device.Quarantined {
+		states = append(states, "quarantined")
+	}
+	if device.Unrecognized {
+		states = append(states, "unrecognized")
+	}
+	if device.FirmwareType == minimalVariant {
+		states = append(states, "minimal")
+	}
+	if device.FirmwareType == safebootVariant {
+		states = append(states, "safeboot")
+	}
+	if device.Canary {
+		states = append(states, "canary")
+	}
+	if device.Archived {
+		states = append(states, "archived")
+	}
+	if device.PinnedVersion != "" {
+		states = append(states, "pinned to "+device.PinnedVersion)
+	}
+	if device.Cached {
+		states = append(states, "cached")
+	}
+	if device.Crashed {
+		states = append(states, "crashed")
+	}
+	if device.AuthFailed {
+		states = append(states, "password rejected")
+	}
+	if len(device.Duplicates) > 0 {
+		states = append(states, "also at "+strings.Join(device.Duplicates, ", "))
+	}
+	return states
+}
+
+// checkDevices marks the devices that are older than the latest release, the version they are pinned
+// to or the version of their custom build as outdated. Without a latest release, only the custom
+// builds are checked.
+func checkDevices(devices []tasmoDevice, latest *version.Version) {
+	for i, device := range devices {
+		target := targetVersion(device, latest)
+		// the version string of an unrecognized device might still parse as some version
+		if target == nil || device.Unrecognized {
+			continue
+		}
+		dev, err := checkDeviceVersion(target, device)
+		if err != nil {
+			continue
+		}
+		devices[i] = dev
+	}
+}
+
 // renderDeviceTable generates a table of all found devices and their status.
 func renderDeviceTable(devices []tasmoDevice) string {
 	// create a table output
@@ -236,117 +665,659 @@ func renderDeviceTable(devices []tasmoDevice) string {
 			SeparateRows:    false,
 		},
 	})
+	columns := deviceColumns()
 	// walk through device list
 	for _, device := range devices {
 		// modify output to show "outdated" only if the device needs an update
-		outdated := ""
-		if device.Outdated {
-			outdated = "outdated"
+		outdated := strings.Join(deviceStates(device), ", ")
+		// mark devices that answer notably slower than they used to
+		latency := strconv.FormatInt(device.Latency.Milliseconds(), 10) + "ms"
+		if device.LatencyDegraded {
+			latency += " (degraded)"
+		}
+		// mark devices that are running out of memory
+		heap := strconv.Itoa(device.Heap) + "k"
+		if device.HeapDropping {
+			heap += " (dropping)"
 		}
 		//append the data as a row to the table
-		t.AppendRow([]interface{}{device.IP.String(), device.Name, device.FirmwareVersion, device.FirmwareType, outdated})
+		row := []interface{}{device.addressLabel(), device.Name, device.FirmwareVersion, device.FirmwareType, latency, heap, outdated, strings.Join(device.Sources, "+")}
+		if viper.GetBool("seencolumns") {
+			row = append(row, "first seen "+formatSeen(device.FirstSeen), "last seen "+formatSeen(device.LastSeen))
+		}
+		if viper.GetBool("updatecolumn") {
+			row = append(row, formatLastUpdate(device))
+		}
+		for _, column := range columns {
+			row = append(row, detailColumns[column](device))
+		}
+		t.AppendRow(row)
 	}
 	// print the table
-	log.Println("Scan results:")
+	logInfo("Scan results:")
+	return t.Render()
+}
+
+// renderDeviceStatus generates a table with the details of a single device
+func renderDeviceStatus(device tasmoDevice) string {
+	t := table.NewWriter()
+	t.AppendRows([]table.Row{
+		{"Name", device.Name},
+		{"IP", device.addressLabel()},
+		{"Firmware", device.FirmwareVersion},
+		{"Variant", device.FirmwareType},
+		{"Chip", device.Chip},
+		{"Outdated", device.Outdated},
+		{"Latency", strconv.FormatInt(device.Latency.Milliseconds(), 10) + "ms"},
+		{"Free heap", strconv.Itoa(device.Heap) + "k"},
+		{"Wi-Fi signal", strconv.Itoa(device.Signal) + "dBm"},
+		{"Groups", strings.Join(deviceGroups(device), ", ")},
+	})
 	return t.Render()
 }
 
-// updateDevices sets the OTA url of the devices and triggers an OTA update
-func updateDevices(devices []tasmoDevice) {
-	otaBaseURL := viper.GetString("otaurl")
-	password := viper.GetString("password")
-	auth := getPasswordQuery(password)
+// otaURLForDevice returns the URL of the firmware file matching the variant of the device, or the
+// variant it is supposed to get
+func otaURLForDevice(device tasmoDevice) string {
+	if otaServerEnabled() {
+		base, err := otaServerURL(device)
+		if err == nil {
+			return otaSafeURL(device, base+firmwareFile(device))
+		}
+		deviceLogger(device, "update").warn("Not using the built-in OTA server for " + device.Name + ": " + err.Error())
+	}
+	return otaSafeURL(device, remoteFirmwareURL(device))
+}
+
+// firmwareURLData is what the template of TASMOGO_OTATEMPLATE can use: the folder of the OTA server,
+// the variant and chip family of the device, the version it is pinned to and the usual file name
+type firmwareURLData struct {
+	Base    string
+	Variant string
+	Chip    string
+	Version string
+	File    string
+}
+
+// remoteFirmwareURL returns the URL of the firmware file of a device on the OTA server, built with the
+// template of TASMOGO_OTATEMPLATE. If the template is broken, the usual file name is used. Custom builds
+// are downloaded from the URL of the firmware manifest.
+func remoteFirmwareURL(device tasmoDevice) string {
+	if build, ok := customBuild(device); ok {
+		return build.URL
+	}
+	data := firmwareURLData{
+		Base:    channelOTAURL(device),
+		Variant: device.FirmwareType,
+		Chip:    device.Chip,
+		Version: firmwareRelease(device),
+		File:    firmwareName(device),
+	}
+	if device.TargetType != "" {
+		data.Variant = device.TargetType
+	}
+	text := viper.GetString("otatemplate")
+	if text == "" {
+		return data.Base + data.File
+	}
+	url, err := renderFirmwareURL(text, data)
+	if err != nil {
+		logWarn("Invalid OTA URL template, using the default: " + err.Error())
+		return data.Base + data.File
+	}
+	return url
+}
+
+// renderFirmwareURL fills in the template of a firmware URL
+func renderFirmwareURL(text string, data firmwareURLData) (string, error) {
+	tmpl, err := template.New("otatemplate").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
 
-	// append tasmota to the url as files should be in the scheme "tasmota-sensors.bin"
-	otaBaseURL = otaBaseURL + "tasmota"
+// firmwareName returns the name of the OTA image of the variant a device has or is supposed to get,
+// e.g. "tasmota-sensors.bin" for an ESP8266 or "tasmota32-bluetooth.bin" for an ESP32. The
+// ".factory.bin" images of the ESP32 are meant for flashing via serial and never used.
+func firmwareName(device tasmoDevice) string {
+	if build, ok := customBuild(device); ok {
+		return path.Base(build.URL)
+	}
+	variant := device.FirmwareType
+	if device.TargetType != "" {
+		variant = device.TargetType
+	}
+	if device.Chip == tasmota.ChipESP32 {
+		switch {
+		case strings.HasPrefix(variant, "tasmota32"):
+			return variant + ".bin"
+		case variant == "tasmota":
+			return "tasmota32.bin"
+		}
+		return "tasmota32-" + variant + ".bin"
+	}
+	// select filename for the default build and special variants
+	if variant == "tasmota" {
+		return "tasmota.bin"
+	}
+	return "tasmota-" + variant + ".bin"
+}
+
+// updateDevice sets the OTA url of a device and triggers an OTA update. The backups before the update
+// are stopped with ctx.
+func updateDevice(ctx context.Context, device *tasmoDevice, inv *inventory) (err error) {
+	// devices with an unknown version format don't tell which firmware file they need
+	if device.FirmwareType == "" && device.TargetType == "" {
+		return errors.New("Unknown firmware variant")
+	}
+	if err := safebootTarget(device, inv); err != nil {
+		return err
+	}
+	device.UpdateAttempts++
+	// prepare the device for the reboot, e.g. by disabling rules
+	if err := runHooks(*device, "before"); err != nil {
+		return err
+	}
+	// undo the preparation if the update doesn't start
+	defer func() {
+		if err != nil {
+			runAfterHooks(*device)
+		}
+	}()
+	// keep the settings in case the update resets them, retries don't need another backup
+	if viper.GetBool("backupbeforeupdate") && device.UpdateAttempts == 1 && device.IP != nil {
+		path, err := backupDevice(ctx, *device, viper.GetString("backupdir"))
+		if err != nil {
+			return errors.New("Backing up the configuration failed: " + err.Error())
+		}
+		deviceLogger(*device, "backup").info("Backed up " + device.Name + " (" + device.IP.String() + ") to " + path)
+	}
+	// the Berry scripts and files of an ESP32 don't survive a mixup of its images
+	if device.UpdateAttempts == 1 {
+		if err := checkFilesystem(ctx, *device, viper.GetString("backupdir"), viper.GetBool("backupfilesystem")); err != nil {
+			return err
+		}
+	}
+	if needsTwoStep(*device) {
+		return updateTwoStep(device, inv)
+	}
+	otaURL := otaURLForDevice(*device)
+	if err := flashDevice(*device, otaURL); err != nil {
+		return err
+	}
+	device.UpdateURL = otaURL
+	return nil
+}
+
+// flashDevice sets the OTA url of a device and triggers an OTA upgrade. Devices that can't reach the
+// OTA URL get the firmware uploaded instead.
+func flashDevice(device tasmoDevice, otaURL string) error {
+	if pushUpdate(device) {
+		return pushFirmware(device)
+	}
+	if err := provideFirmware(device); err != nil {
+		return err
+	}
+	deviceLogger(device, "update").info("Updating " + device.Name + " (" + device.IP.String() + ") from URL: " + otaURL)
+	// devices discovered via MQTT get their commands through the broker, as they might not be reachable directly
+	if device.ViaMQTT {
+		if err := sendMQTTCommand(device, "OtaUrl", otaURL); err != nil {
+			return err
+		}
+		return sendMQTTCommand(device, "Upgrade", "1")
+	}
+	return newDeviceClient().Upgrade(context.Background(), device.IP.String(), otaURL)
+}
+
+// updateDevices triggers an OTA update on all outdated devices, TASMOGO_UPDATECONCURRENCY at the same
+// time. Once ctx is cancelled, the remaining devices are skipped, but the running updates are finished.
+// The batches of the rollout limit how many devices are rebooting at once. The devices that accepted the
+// command are recorded in the rollout state.
+func updateDevices(ctx context.Context, devices []tasmoDevice, inv *inventory, state *rolloutState) []taskResult {
+	outdated := make([]*tasmoDevice, 0, len(devices))
+	for i := range devices {
+		if devices[i].Outdated {
+			outdated = append(outdated, &devices[i])
+		}
+	}
+	tracker, stopProgress := startProgress(int64(len(outdated)))
+	// the two-step updates keep their state in the inventory, so only one of them runs at a time
+	var twoStep sync.Mutex
+	// retrying is up to the verification, which knows if an update did arrive
+	// the backups before an update take as long as they need, only a stopped run cancels them
+	e := newEngine()
+	e.Concurrency, e.Timeout, e.Retries = politeInt(viper.GetInt("updateconcurrency"), politeExecConcurrency), 0, 0
+	results := e.run(ctx, outdated, func(ctx context.Context, device *tasmoDevice) (string, error) {
+		defer tracker.Increment(1)
+		// a batch may run into a blackout period or past the end of the update window, its remaining
+		// devices stay pending
+		if reason, held := updatesHeld(time.Now()); held {
+			deviceLogger(*device, "update").info("Not updating " + device.Name + " (" + device.IP.String() + "), " + reason)
+			return "", errSkipped
+		}
+		if needsTwoStep(*device) {
+			twoStep.Lock()
+			defer twoStep.Unlock()
+		}
+		if err := updateDevice(ctx, device, inv); err != nil {
+			device.AuthFailed = errors.Is(err, tasmota.ErrUnauthorized)
+			deviceLogger(*device, "update").error("Updating " + device.Name + " (" + device.IP.String() + ") failed: " + err.Error())
+			runFailureHooks(*device, err.Error())
+			return "", errors.New(updateFailure(err))
+		}
+		state.set(*device, rolloutCommanded)
+		return "command accepted", nil
+	})
+	stopProgress()
+	for _, result := range results {
+		if result.Skipped && ctx.Err() != nil {
+			logInfo("Stopping, skipped the update of " + result.Name + " (" + result.IP + ")")
+		}
+	}
+	return results
+}
+
+// updateFailure describes why the update command didn't reach a device. The details are logged.
+func updateFailure(err error) string {
+	switch {
+	case errors.Is(err, tasmota.ErrTimeout):
+		return "timed out"
+	case errors.Is(err, tasmota.ErrUnauthorized):
+		return "auth failed"
+	case errors.Is(err, tasmota.ErrUnreachable):
+		return "unreachable"
+	}
+	return err.Error()
+}
+
+// restartDevices restarts all devices whose free heap is dropping towards the crash threshold
+func restartDevices(devices []tasmoDevice) {
+	client := newDeviceClient()
 	for _, device := range devices {
-		if device.Outdated == true {
-			var otaURL string
-			// select filename for the default build and special variants
-			if device.FirmwareType == "tasmota" {
-				otaURL = otaBaseURL + ".bin"
-			} else {
-				otaURL = otaBaseURL + "-" + device.FirmwareType + ".bin"
+		if device.HeapDropping && mayAutomate(device) {
+			deviceLogger(device, "restart").info("Restarting " + device.Name + " (" + device.IP.String() + ") because it is running out of memory")
+			if _, err := client.Command(context.Background(), device.IP.String(), "Restart 1"); err != nil {
+				deviceLogger(device, "restart").warn("Restarting " + device.Name + " (" + device.IP.String() + ") failed: " + err.Error())
 			}
-			log.Println("Updating " + device.Name + " (" + device.IP.String() + ") from URL: " + otaURL)
-			// set the ota url
-			url := "http://" + device.IP.String() + "/cm?" + auth + "cmnd=OtaUrl%20" + otaURL
-			getURL(url)
-			// trigger an ota upgrade
-			url = "http://" + device.IP.String() + "/cm?" + auth + "cmnd=Upgrade%201"
-			getURL(url)
 		}
 	}
 }
 
+// scanOptions control a single run: Update updates the outdated devices and Only limits the updates to
+// the devices with the given IPs, if it isn't empty
+type scanOptions struct {
+	Update bool
+	Only   []string
+}
+
 // scanAndUpdate searches the given IP range for tasmota devices and triggers an update if enabled
 func scanAndUpdate() {
-	currentVersion := getCurrentTasmotaVersion(versionData)
-	knownDevices := scanNetwork()
+	ctx, stop := signalContext()
+	defer stop()
+	devices, _ := runScan(ctx, scanOptions{Update: viper.GetBool("doupdates")})
+	// a wrong password must not look like a successful run to cron or CI
+	if viper.GetBool("doupdates") && !viper.GetBool("dryrun") {
+		if rejected := rejectedUpdates(devices); len(rejected) > 0 {
+			logFatal("Updates were requested, but " + strings.Join(rejected, ", ") + " rejected the password")
+		}
+	}
+}
 
-	// sort the devices by their IP address because of the parallelized run of the scan they come in a random manner
-	sort.Slice(knownDevices, func(i, j int) bool {
-		return ip2int(knownDevices[i].IP) < ip2int(knownDevices[j].IP)
-	})
+// recordUpdates adds the outcome of the updates to the history and runs the hooks after them. Failed
+// updates are tried again on the next run, the ones whose verification was stopped are left alone.
+func recordUpdates(ctx context.Context, inv *inventory, devices []tasmoDevice, latest *version.Version) {
+	for _, device := range devices {
+		if device.UpdateURL == "" {
+			continue
+		}
+		attempts := strconv.Itoa(device.UpdateAttempts) + " attempts"
+		// the verification was stopped, the update may still arrive
+		if !device.Verified && ctx.Err() != nil {
+			continue
+		}
+		if !device.Verified {
+			inv.addEvent(time.Now(), device.key(), device.Name, "update failed", "to "+versionString(targetVersion(device, latest))+", "+attempts)
+			runAfterHooks(device)
+			runFailureHooks(device, "Not running "+versionString(targetVersion(device, latest))+" after "+attempts)
+			// try the failed updates again on the next run
+			if !inv.queuedUpdate(device.key()) {
+				inv.enqueue(device.key(), "update", "", time.Time{})
+			}
+			continue
+		}
+		inv.dequeueUpdates(device.key())
+		inv.addEvent(time.Now(), device.key(), device.Name, "updated", device.FirmwareVersion+" -> "+versionString(targetVersion(device, latest))+", "+attempts)
+		finishTwoStep(inv, device)
+		inv.record(device.key()).LastUpdate = time.Now()
+		runAfterHooks(device)
+	}
+}
+
+// rejectedUpdates lists the devices that should have been updated, but rejected the password
+func rejectedUpdates(devices []tasmoDevice) []string {
+	rejected := make([]string, 0)
+	for _, device := range devices {
+		if device.AuthFailed && !device.Excluded && mayAutomate(device) {
+			rejected = append(rejected, strings.TrimSpace(device.Name+" ("+device.address()+")"))
+		}
+	}
+	return rejected
+}
+
+// signalContext returns a context that is cancelled on SIGINT or SIGTERM, so a run can stop cleanly
+// instead of in the middle of an update. A second signal exits right away.
+func signalContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			logInfo("Caught " + sig.String() + ", stopping after the current device. Send it again to exit immediately.")
+			cancel()
+		case <-done:
+			return
+		}
+		select {
+		case <-signals:
+			logInfo("Exiting immediately")
+			os.Exit(1)
+		case <-done:
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		close(done)
+		cancel()
+	}
+}
+
+// runScan searches for tasmota devices, updates them as requested and returns them and the latest
+// release they were checked against, nil if it is unknown. If ctx is cancelled, outstanding requests
+// are aborted and no further devices are changed, but the results of the run are still written and
+// saved.
+func runScan(ctx context.Context, opts scanOptions) ([]tasmoDevice, *version.Version) {
+	started := time.Now()
+	// the latest release is looked up while the devices are discovered
+	lookup := startVersionLookup(func() (*version.Version, error) { return lookupTasmotaVersion(channelSource()) })
+	inventoryPath := viper.GetString("inventory")
+	inv, err := loadInventory(inventoryPath)
+	if err != nil {
+		logWarn("Loading the inventory failed: " + err.Error())
+	}
+	rememberInventory(inv)
+
+	// after a run with many errors, only the failed hosts are probed again
+	var knownDevices []tasmoDevice
+	var failed []net.IP
+	if viper.GetBool("rescanerrors") {
+		knownDevices, failed = rescanErrors(ctx, inv)
+	} else {
+		// between the sweeps of the networks only the known devices are asked again
+		known := incrementalTargets(inv, started)
+		knownDevices, failed = discover(ctx, known)
+		// a stopped sweep didn't reach every address, so the next run sweeps again
+		if known == nil && ctx.Err() == nil {
+			inv.LastSweep = started
+		}
+	}
+	// a stopped discovery found only some of the devices, the others aren't missing or failing
+	interrupted := ctx.Err() != nil
+	if !interrupted {
+		inv.Errors = ipStrings(failed)
+	}
+	// a device answering at several addresses is updated only once
+	knownDevices = mergeDevices(knownDevices, nil)
+	warnDuplicates(knownDevices)
+	currentVersion, fallback := resolveRelease(lookup, started, inv)
+
+	// remember the health data of every device and check if it got worse over time
+	if !interrupted {
+		trackDevices(inv, knownDevices)
+	}
+	// archived devices are listed from the inventory, like the cached ones they are left alone
+	if viper.GetBool("includearchived") {
+		knownDevices = append(knownDevices, archivedDevices(inv)...)
+		sortDevices(knownDevices)
+	}
+	classifyDevices(knownDevices, inv)
+	markCanaries(knownDevices, inv, started)
+	// only the devices passing the filters are shown and updated, the inventory still knows all of them
+	filter, err := loadFilter()
+	switch {
+	case err != nil:
+		logWarn("Not updating any devices, the device filter is invalid: " + err.Error())
+		opts.Update = false
+	case !filter.empty():
+		// the selector may ask for the outdated devices, which are checked again after the queue ran
+		if filter.Selector.uses("outdated") {
+			checkDevices(knownDevices, currentVersion)
+		}
+		knownDevices = filterDevices(knownDevices, inv, filter)
+		logInfo(strconv.Itoa(len(knownDevices)) + " devices match the filters")
+	}
+	if len(opts.Only) > 0 {
+		excludeOthers(knownDevices, opts.Only)
+	}
+
+	// run the remediation rules defined in the config
+	if !scanOnly {
+		rules, err := loadRules()
+		if err != nil {
+			logWarn("Loading the rules failed: " + err.Error())
+		}
+		applyRules(inv, rules)
+	}
+
+	// inspect some devices in depth to catch changed settings over time
+	if n := viper.GetInt("auditsample"); n > 0 {
+		auditSample(inv, knownDevices, n)
+	}
+
+	// run the commands that were deferred until the devices could be reached again
+	dryRun := viper.GetBool("dryrun")
+	if !scanOnly && !dryRun && ctx.Err() == nil {
+		processQueue(ctx, inv, knownDevices)
+	}
+
+	// enforce the configuration of the provisioning profiles, a dry run only lists the drifted settings
+	if !scanOnly && viper.GetBool("provision") && ctx.Err() == nil {
+		provisionFleet(ctx, inv, knownDevices, !dryRun)
+	}
 
 	// check if the devices need an update
-	for i, device := range knownDevices {
-		dev, err := checkDeviceVersion(currentVersion, device)
+	checkDevices(knownDevices, currentVersion)
+	// devices stuck on the minimal firmware, e.g. by an interrupted update, still need their variant
+	resumeTwoStep(inv, knownDevices)
+	// queued updates of outdated devices are left to the rollout, the ones of current devices are done
+	if !scanOnly && !dryRun {
+		dropCurrentUpdates(inv, knownDevices, currentVersion)
+	}
+
+	// show all devices, unless they are written in a machine-readable format at the end of the run
+	if strings.ToLower(viper.GetString("output")) == "table" {
+		logInfo(renderDeviceTable(knownDevices))
+	}
+	if note := describeRelease(currentVersion, fallback, inv); note != "" {
+		logWarn(note)
+	}
+
+	// list the devices that silently disappeared
+	if viper.GetBool("seencolumns") {
+		if missing := renderMissingDevices(inv); missing != "" {
+			logInfo("Known devices that were not found:\n" + missing)
+		}
+	}
+	// quarantined devices are left alone until someone had a look at them
+	if quarantined := quarantinedDevices(knownDevices); len(quarantined) > 0 {
+		logWarn("Quarantined devices need manual attention: " + strings.Join(quarantined, ", "))
+	}
+
+	// restart devices before they crash on their own
+	if !scanOnly && viper.GetBool("restartlowheap") && !dryRun && ctx.Err() == nil {
+		restartDevices(knownDevices)
+	}
+
+	// if we're supposed to du updates, do them, unless the scan ran into a blackout period or happens
+	// outside of the update window. A dry run still shows what it would update.
+	reason, held := updatesHeld(time.Now())
+	switch {
+	case scanOnly:
+		logInfo("Not updating any devices, this build of tasmogo only scans")
+	case ctx.Err() != nil:
+		logInfo("Stopping, not updating any devices")
+	case dryRun:
+		if opts.Update && held {
+			logInfo("Dry run, the updates would wait, " + reason)
+		}
+		logInfo("Dry run, these devices would be updated:\n" + renderUpdatePlan(knownDevices, signalOrder(knownDevices, canaryGate(knownDevices, pendingUpdates(knownDevices), currentVersion, inv, time.Now()))))
+	case opts.Update && held:
+		logInfo("Not updating any devices, " + reason)
+	case opts.Update:
+		if viper.GetBool("speedtest") {
+			warnSlowRollout(ctx, knownDevices)
+		}
+		rolloutUpdates(ctx, knownDevices, currentVersion, inv)
+	default:
+		logInfo("Not updating any devices. Set TASMOGO_DOUPDATES to 'true' enable automatic updates.")
+	}
+
+	if !scanOnly {
+		recordUpdates(ctx, inv, knownDevices, currentVersion)
+	}
+
+	// quarantine the devices that keep failing, the ones of a stopped run didn't get their chance
+	if ctx.Err() == nil {
+		trackFailures(inv, knownDevices, failed)
+	}
+
+	// show the outcome of the updates
+	for _, device := range knownDevices {
+		if device.UpdateURL != "" {
+			logInfo("Update results:\n" + renderUpdateSummary(knownDevices, currentVersion))
+			break
+		}
+	}
+	if err := outputResults(knownDevices); err != nil {
+		logWarn("Writing the scan results failed: " + err.Error())
+	}
+	if path := viper.GetString("metricsfile"); path != "" {
+		if err := writeMetrics(path, knownDevices, time.Now()); err != nil {
+			logWarn("Writing the metrics failed: " + err.Error())
+		}
+	}
+	saveState(scanResults(knownDevices))
+	summary := summarizeRun(knownDevices)
+	summary.WhatsNew = whatsNew(ctx, knownDevices, currentVersion)
+	if len(summary.WhatsNew) > 0 {
+		logInfo("What's new for the outdated devices:\n" + renderWhatsNew(summary.WhatsNew))
+	}
+	notify(summary)
+	if viper.GetBool("hassdiscovery") {
+		publishHass(knownDevices, inv, currentVersion)
+	}
+
+	// document the run, so it can be traced later what was flashed when
+	if dir := viper.GetString("manifestdir"); dir != "" {
+		release := ""
+		if currentVersion != nil {
+			release = currentVersion.String()
+		}
+		manifest := newRunManifest(started, release, knownDevices)
+		path, err := writeManifest(manifest, dir, viper.GetString("signingkey"))
 		if err != nil {
-			continue
+			logWarn("Writing the run manifest failed: " + err.Error())
+		} else {
+			logInfo("Run manifest written to " + path)
 		}
-		knownDevices[i] = dev
 	}
 
-	// show all devices
-	log.Println(renderDeviceTable(knownDevices))
+	if err := inv.save(inventoryPath); err != nil {
+		logWarn("Saving the inventory failed: " + err.Error())
+	}
+	return knownDevices, currentVersion
+}
 
-	// if we're supposed to du updates, do them
-	if viper.GetBool("doupdates") {
-		updateDevices(knownDevices)
-	} else {
-		log.Println("Not updating any devices. Set TASMOGO_DOUPDATES to 'true' enable automatic updates.")
+// excludeOthers keeps all devices but the ones with the given IPs from being updated
+func excludeOthers(devices []tasmoDevice, ips []string) {
+	for i := range devices {
+		selected := false
+		for _, ip := range ips {
+			if ip == devices[i].IP.String() {
+				selected = true
+			}
+			// a device found twice is selected by any of its addresses
+			for _, duplicate := range devices[i].Duplicates {
+				if ip == duplicate {
+					selected = true
+				}
+			}
+		}
+		if !selected {
+			devices[i].Excluded = true
+		}
 	}
+}
 
+// runDaemon scans for updates on the schedule of TASMOGO_SCHEDULE until tasmogo is stopped. If
+// TASMOGO_WEBUI is set, the web UI is served on that address, if TASMOGO_SOCKET is set, the API is
+// served on that unix socket. TASMOGO_PUBLICSTATUS serves the public status page.
+func runDaemon() {
+	s, err := parseSchedule(viper.GetString("schedule"))
+	if err != nil {
+		logFatal(err.Error())
+	}
+	loc, err := scheduleLocation()
+	if err != nil {
+		logFatal(err.Error())
+	}
+	// scans that fall into a blackout period are moved to its end
+	if windows, _ := blackoutWindows(); len(windows) > 0 {
+		s = blackoutSchedule{s}
+	}
+	d := newDaemon(func(ctx context.Context, opts scanOptions) []tasmoDevice {
+		devices, _ := runScan(ctx, opts)
+		return devices
+	})
+	d.schedule, d.location = viper.GetString("schedule"), loc
+	if viper.GetString("webui") != "" || viper.GetString("socket") != "" {
+		log.SetOutput(io.MultiWriter(os.Stderr, d.log))
+	}
+	if addr := viper.GetString("webui"); addr != "" {
+		go serveWebUI(addr, d)
+	}
+	if addr := viper.GetString("publicstatus"); addr != "" {
+		go servePublicStatus(addr, d)
+	}
+	if path := viper.GetString("socket"); path != "" {
+		srv, err := serveSocket(path, d)
+		if err != nil {
+			logFatal("Creating the socket failed: " + err.Error())
+		}
+		defer srv.Close()
+	}
+	// stop after the current device if requested
+	ctx, stop := signalContext()
+	defer stop()
+	if viper.GetBool("lwt") {
+		go watchAvailability(ctx, d)
+	}
+	if interval := viper.GetDuration("healthinterval"); interval > 0 {
+		go watchHealth(ctx, interval)
+	}
+	// do the scheduled scans and the ones requested via the web UI inbetween
+	d.run(ctx, s, viper.GetBool("scanonstart"), scanOptions{Update: viper.GetBool("doupdates")})
+	logInfo("Stopped")
 }
 
 func main() {
-	// load configuration data
-	viper.SetConfigName("tasmogo")
-	viper.AutomaticEnv()
-	viper.SetEnvPrefix("tasmogo")
-	viper.SetDefault("daemon", false)
-	viper.SetDefault("doupdates", false)
-	viper.SetDefault("otaurl", "http://ota.tasmota.com/tasmota/release/")
-	viper.SetDefault("password", "")
-	viper.SetDefault("cidr", "192.168.0.0/24")
-
-	// tasmogo will run every 24h if TASMOGO_DAEMON is true.
-	if viper.GetBool("daemon") {
-		// do an initial scan
-		scanAndUpdate()
-		nextScanTime := time.Now().Local().Add(time.Hour * time.Duration(24))
-		log.Println("Next scan at: " + nextScanTime.String())
-		// gracefully die if requested
-		var gracefulStop = make(chan os.Signal)
-		signal.Notify(gracefulStop, syscall.SIGTERM)
-		signal.Notify(gracefulStop, syscall.SIGINT)
-		go func() {
-			// gracefully die if requested
-			sig := <-gracefulStop
-			fmt.Println()
-			fmt.Printf("caught sig: %+v", sig)
-			os.Exit(0)
-		}()
-		// do scans every 24h and sleep inbetween
-		for {
-			time.Sleep(24 * time.Hour)
-			scanAndUpdate()
-			nextScanTime := time.Now().Local().Add(time.Hour * time.Duration(24))
-			log.Println("Next scan at: " + nextScanTime.String())
-		}
-	} else {
-		// tasmogo will run just once if TASMOGO_DAEMON is false.
-		scanAndUpdate()
+	if err := newRootCmd().Execute(); err != nil {
+		logFatal(err.Error())
 	}
 }
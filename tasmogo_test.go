@@ -1,15 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/go-version"
 	"github.com/jedib0t/go-pretty/v6/progress"
+	"github.com/merlinschumacher/tasmogo/pkg/tasmota"
+	"github.com/merlinschumacher/tasmogo/pkg/tasmota/tasmotatest"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -20,38 +27,111 @@ const deviceData = `
 		},
 		"StatusFWR": {
 			"Version": "9.1.0(tasmota)"
+		},
+		"StatusSTS": {
+			"Heap": 25,
+			"Wifi": {
+				"Signal": -60
+			}
 		}
 	}`
 
-func Test_ip2int(t *testing.T) {
-	i := ip2int(net.IPv4(0, 0, 0, 0))
-	assert.Equal(t, uint32(0), i)
-	i = ip2int(net.IPv4(255, 255, 255, 255))
-	assert.Equal(t, uint32(0xFFFFFFFF), i)
+func Test_nextIP(t *testing.T) {
+	assert.Equal(t, "10.0.1.0", nextIP(net.ParseIP("10.0.0.255").To4()).String())
+	assert.Equal(t, "fd00::1:0", nextIP(net.ParseIP("fd00::ffff")).String())
+	// the original address stays untouched
+	ip := net.ParseIP("fd00::1")
+	nextIP(ip)
+	assert.Equal(t, "fd00::1", ip.String())
 }
 
-func Test_initProgressBar(t *testing.T) {
-	pb := initProgressBar()
-	assert.IsType(t, &progress.Progress{}, pb)
+func Test_networkSize(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("maxaddresses", 65536)
+	defer viper.Reset()
+	_, network, _ := net.ParseCIDR("192.168.0.0/24")
+	size, err := networkSize(network)
+	assert.Nil(err)
+	assert.Equal(int64(256), size)
+	_, network, _ = net.ParseCIDR("fd00::/112")
+	size, err = networkSize(network)
+	assert.Nil(err)
+	assert.Equal(int64(65536), size)
+	_, network, _ = net.ParseCIDR("fd00::/64")
+	_, err = networkSize(network)
+	assert.NotNil(err)
 }
 
-func Test_buildDeviceURL(t *testing.T) {
-	url := buildDeviceURL("testhost", "")
-	assert.Equal(t, "http://testhost/cm?cmnd=Status%200", url)
-	url = buildDeviceURL("testhost", "test")
-	assert.Equal(t, "http://testhost/cm?user=admin&password=test&cmnd=Status%200", url)
+func Test_parseNetworks(t *testing.T) {
+	assert := assert.New(t)
+	networks, err := parseNetworks([]string{"10.0.0.0/24", "10.0.1.1", "fd00::1"})
+	assert.Nil(err)
+	assert.Equal([]string{"10.0.0.0/24", "10.0.1.1/32", "fd00::1/128"}, []string{networks[0].String(), networks[1].String(), networks[2].String()})
+	_, err = parseNetworks([]string{"10.0.0.0/33"})
+	assert.NotNil(err)
+
+	networks, err = parseNetworks([]string{"10.0.0.10-10.0.0.20", "10.0.1.5-5"})
+	assert.Nil(err)
+	assert.Len(networks, 5)
+	assert.Equal("10.0.1.5/32", networks[4].String())
 }
 
-func Test_parseFirmwareVersion(t *testing.T) {
+func Test_parseRange(t *testing.T) {
 	assert := assert.New(t)
-	version, variant, err := parseFirmwareVersion("9.1.0(tasmota)")
+	networkStrings := func(networks []*net.IPNet) []string {
+		s := make([]string, 0, len(networks))
+		for _, network := range networks {
+			s = append(s, network.String())
+		}
+		return s
+	}
+	networks, err := parseRange("192.168.0.10-192.168.0.60")
+	assert.Nil(err)
+	assert.Equal([]string{"192.168.0.10/31", "192.168.0.12/30", "192.168.0.16/28", "192.168.0.32/28", "192.168.0.48/29", "192.168.0.56/30", "192.168.0.60/32"}, networkStrings(networks))
+	networks, err = parseRange("192.168.0.0 - 255")
+	assert.Nil(err)
+	assert.Equal([]string{"192.168.0.0/24"}, networkStrings(networks))
+	networks, err = parseRange("192.168.0.255-192.168.1.0")
 	assert.Nil(err)
-	assert.Equal("9.1.0", version)
-	assert.Equal("tasmota", variant)
-	version, variant, err = parseFirmwareVersion("test")
+	assert.Equal([]string{"192.168.0.255/32", "192.168.1.0/32"}, networkStrings(networks))
+	networks, err = parseRange("fd00::1-fd00::3")
+	assert.Nil(err)
+	assert.Equal([]string{"fd00::1/128", "fd00::2/127"}, networkStrings(networks))
+
+	for _, invalid := range []string{"192.168.0.60-192.168.0.10", "192.168.0.10-fd00::1", "192.168.0.10-300", "foo-bar"} {
+		_, err = parseRange(invalid)
+		assert.NotNil(err, invalid)
+	}
+}
+
+func Test_networkAddresses(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("maxaddresses", 8)
+	defer viper.Reset()
+	networks, _ := parseNetworks([]string{"10.0.0.0/30", "10.0.1.0/30"})
+	excluded, _ := parseNetworks([]string{"10.0.0.1", "10.0.1.2/31"})
+	ips, err := networkAddresses(networks, excluded)
+	assert.Nil(err)
+	assert.Equal([]string{"10.0.0.0", "10.0.0.2", "10.0.0.3", "10.0.1.0", "10.0.1.1"}, ipStrings(ips))
+
+	networks, _ = parseNetworks([]string{"10.0.0.0/30", "10.0.1.0/29"})
+	_, err = networkAddresses(networks, excluded)
 	assert.NotNil(err)
-	assert.Empty(version)
-	assert.Empty(variant)
+}
+
+func Test_resolveHosts(t *testing.T) {
+	ips := resolveHosts([]string{"10.0.0.1", "[fd00::1]", "10.0.0.2"})
+	assert.Equal(t, []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1"), net.ParseIP("10.0.0.2")}, ips)
+}
+
+func Test_address(t *testing.T) {
+	assert.Equal(t, "fd00::1", tasmoDevice{IP: net.ParseIP("fd00::1")}.address())
+	assert.Equal(t, "-", tasmoDevice{Topic: "plug"}.address())
+}
+
+func Test_initProgressBar(t *testing.T) {
+	pb := initProgressBar()
+	assert.IsType(t, &progress.Progress{}, pb)
 }
 
 func Test_checkDeviceVersion(t *testing.T) {
@@ -76,6 +156,10 @@ func Test_checkDeviceVersion(t *testing.T) {
 	testDevice.FirmwareVersion = ""
 	outDevice, err = checkDeviceVersion(vequal, testDevice)
 	assert.NotNil(err)
+	// without a target, e.g. if the release lookup failed, nothing is compared
+	testDevice.FirmwareVersion = "1.0.1"
+	_, err = checkDeviceVersion(nil, testDevice)
+	assert.NotNil(err)
 }
 
 func Test_getCurrentTasmotaVersion(t *testing.T) {
@@ -83,31 +167,95 @@ func Test_getCurrentTasmotaVersion(t *testing.T) {
 	assert.IsType(t, &version.Version{}, v)
 }
 
-// func Test_getDeviceData(t *testing.T) {
-// 	assert := assert.New(t)
-// 	ip := net.IPv4(127, 0, 0, 1)
-// 	// old := getURL
-// 	// defer func() { getURL = old }()
-// 	var data = func() string {
-// 		return deviceData
-// 	}
-// 	d, err := getDeviceData(ip)
-// 	assert.Nil(err)
-// 	assert.Equal("9.1.0", d.FirmwareVersion)
-// 	assert.Equal(d.IP, net.IPv4(127, 0, 0, 1))
+func Test_lookupTasmotaVersion(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	// the source is never asked if a target version is set
+	viper.Set("targetversion", "12.1.1")
+	v, err := lookupTasmotaVersion(nil)
+	assert.Nil(err)
+	assert.Equal("12.1.1", v.String())
+
+	viper.Set("targetversion", "latest")
+	_, err = lookupTasmotaVersion(nil)
+	assert.NotNil(err)
+}
 
-// }
+// fakeDevices replaces the device client with a fake for the given devices until the test ends
+func fakeDevices(t *testing.T, devices map[string]map[string]string) *tasmotatest.Client {
+	fake := tasmotatest.NewClient(devices)
+	old := newDeviceClient
+	newDeviceClient = func() tasmota.DeviceClient { return fake }
+	t.Cleanup(func() { newDeviceClient = old })
+	return fake
+}
 
-func Test_getURL(t *testing.T) {
+func Test_getDeviceData(t *testing.T) {
 	assert := assert.New(t)
-	srv := serverMock()
-	defer srv.Close()
-	urlData, err := getURL(srv.URL)
+	fakeDevices(t, map[string]map[string]string{"127.0.0.1": {"Status 0": deviceData}})
+	d, err := getDeviceData(context.Background(), net.IPv4(127, 0, 0, 1))
 	assert.Nil(err)
-	assert.Equal(deviceData, urlData)
+	assert.Equal("9.1.0", d.FirmwareVersion)
+	assert.Equal(d.IP, net.IPv4(127, 0, 0, 1))
 
-	urlData, err = getURL("test")
-	assert.NotNil(err)
+	_, err = getDeviceData(context.Background(), net.IPv4(127, 0, 0, 2))
+	assert.True(errors.Is(err, tasmota.ErrUnreachable))
+}
+
+func Test_getDeviceData_authFailed(t *testing.T) {
+	assert := assert.New(t)
+	fake := fakeDevices(t, map[string]map[string]string{"127.0.0.1": {"Status 0": deviceData}})
+	fake.Unauthorized = map[string]bool{"127.0.0.1": true}
+	d, err := getDeviceData(context.Background(), net.IPv4(127, 0, 0, 1))
+	assert.True(errors.Is(err, tasmota.ErrUnauthorized))
+	assert.Contains(err.Error(), "TASMOGO_PASSWORD")
+	assert.True(d.AuthFailed)
+	assert.Contains(deviceStates(d), "password rejected")
+}
+
+func Test_rejectedUpdates(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	devices := []tasmoDevice{
+		{Name: "plug", IP: net.IPv4(10, 0, 0, 1), AuthFailed: true},
+		{IP: net.IPv4(10, 0, 0, 2), AuthFailed: true},
+		{Name: "ignored", IP: net.IPv4(10, 0, 0, 3), AuthFailed: true, Excluded: true},
+		{Name: "lamp", IP: net.IPv4(10, 0, 0, 4)},
+	}
+	assert.Equal([]string{"plug (10.0.0.1)", "(10.0.0.2)"}, rejectedUpdates(devices))
+}
+
+func Test_updateDevice(t *testing.T) {
+	assert := assert.New(t)
+	fake := fakeDevices(t, map[string]map[string]string{"127.0.0.1": {}})
+	viper.Set("otaurl", "http://ota.tasmota.com/tasmota/release/")
+	defer viper.Reset()
+	device := tasmoDevice{Name: "plug", IP: net.IPv4(127, 0, 0, 1), FirmwareType: "tasmota"}
+	assert.Nil(updateDevice(context.Background(), &device, &inventory{Devices: map[string]*inventoryRecord{}}))
+	assert.Equal([]string{
+		"127.0.0.1: OtaUrl " + device.UpdateURL,
+		"127.0.0.1: Upgrade 1",
+	}, fake.Commands)
+}
+
+func Test_restartDevices(t *testing.T) {
+	fake := fakeDevices(t, map[string]map[string]string{"127.0.0.1": {}, "127.0.0.2": {}})
+	restartDevices([]tasmoDevice{
+		{Name: "low", IP: net.IPv4(127, 0, 0, 1), HeapDropping: true},
+		{Name: "fine", IP: net.IPv4(127, 0, 0, 2)},
+	})
+	assert.Equal(t, []string{"127.0.0.1: Restart 1"}, fake.Commands)
+}
+
+func Test_networkTargets(t *testing.T) {
+	assert := assert.New(t)
+	viper.Set("cidr", "127.0.0.0/30,127.0.0.2/31,127.0.0.3")
+	viper.Set("exclude", "127.0.0.0")
+	viper.Set("maxaddresses", 8)
+	defer viper.Reset()
+	assert.Equal([]string{"127.0.0.1", "127.0.0.2", "127.0.0.3"}, ipStrings(networkTargets()))
+	viper.Set("maxaddresses", 4)
+	assert.Empty(networkTargets())
 }
 
 func serverMock() *httptest.Server {
@@ -117,11 +265,6 @@ func serverMock() *httptest.Server {
 	return srv
 }
 
-func Test_getPasswordQuery(t *testing.T) {
-	auth := getPasswordQuery("test")
-	assert.Equal(t, "user=admin&password=test&", auth)
-}
-
 func Test_renderDeviceTable(t *testing.T) {
 	devices := []tasmoDevice{
 		{
@@ -130,6 +273,9 @@ func Test_renderDeviceTable(t *testing.T) {
 			FirmwareType:    "test",
 			Outdated:        false,
 			IP:              net.IPv4(1, 1, 1, 1),
+			Latency:         12 * time.Millisecond,
+			Heap:            25,
+			Sources:         []string{"cidr", "mdns"},
 		},
 		{
 			Name:            "testdev2",
@@ -137,11 +283,71 @@ func Test_renderDeviceTable(t *testing.T) {
 			FirmwareType:    "test2",
 			Outdated:        true,
 			IP:              net.IPv4(1, 1, 1, 2),
+			Latency:         250 * time.Millisecond,
+			LatencyDegraded: true,
+			Heap:            9,
+			HeapDropping:    true,
+			Sources:         []string{"mqtt"},
 		},
 	}
 
 	tab := renderDeviceTable(devices)
-	assert.Equal(t, "1.1.1.1 testdev  0.0.1 test          \n1.1.1.2 testdev2 0.0.2 test2 outdated", tab)
+	assert.Equal(t, "1.1.1.1 testdev  0.0.1 test  12ms             25k                    cidr+mdns\n1.1.1.2 testdev2 0.0.2 test2 250ms (degraded) 9k (dropping) outdated mqtt     ", tab)
+
+	defer viper.Reset()
+	viper.Set("seencolumns", true)
+	devices[0].LastSeen = time.Date(2021, 3, 8, 12, 0, 0, 0, time.UTC)
+	tab = renderDeviceTable(devices)
+	assert.Contains(t, tab, "first seen -")
+	assert.Contains(t, tab, "last seen 2021-03-08 12:00")
+
+	viper.Set("updatecolumn", true)
+	devices[1].FailedUpdates = 3
+	tab = renderDeviceTable(devices)
+	assert.Contains(t, tab, "never updated, 3 failed attempts")
+
+	viper.Set("columns", "mac,rssi")
+	devices[0].MAC = "DC:4F:22:00:12:34"
+	devices[0].RSSI = 80
+	tab = renderDeviceTable(devices)
+	assert.Contains(t, tab, "DC:4F:22:00:12:34 80%")
+}
+
+func Test_otaURLForDevice(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	assert.Equal("http://ota.tasmota.com/tasmota/release/tasmota.bin", otaURLForDevice(tasmoDevice{FirmwareType: "tasmota"}))
+	assert.Equal("http://ota.tasmota.com/tasmota/release/tasmota-sensors.bin", otaURLForDevice(tasmoDevice{FirmwareType: "tasmota", TargetType: "sensors"}))
+	assert.Equal("http://ota.tasmota.com/tasmota/release-9.1.0/tasmota-lite.bin", otaURLForDevice(tasmoDevice{FirmwareType: "lite", PinnedVersion: "9.1.0"}))
+	assert.Equal("http://ota.tasmota.com/tasmota32/release/tasmota32-bluetooth.bin", otaURLForDevice(tasmoDevice{FirmwareType: "tasmota32-bluetooth", Chip: "esp32"}))
+}
+
+func Test_remoteFirmwareURL(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	device := tasmoDevice{FirmwareType: "tasmota", TargetType: "sensors", Chip: "esp8266"}
+	assert.Equal("http://ota.tasmota.com/tasmota/release/tasmota-sensors.bin", remoteFirmwareURL(device))
+
+	viper.Set("otatemplate", "http://firmware.lan/{{.Chip}}/{{.Variant}}/firmware.bin")
+	assert.Equal("http://firmware.lan/esp8266/sensors/firmware.bin", remoteFirmwareURL(device))
+	viper.Set("otatemplate", "{{.Base}}{{.Version}}/{{.File}}")
+	assert.Equal("http://ota.tasmota.com/tasmota/release-9.1.0/9.1.0/tasmota-sensors.bin", remoteFirmwareURL(tasmoDevice{FirmwareType: "sensors", PinnedVersion: "9.1.0"}))
+
+	// a broken template falls back to the usual file name
+	viper.Set("otatemplate", "{{.Unknown}}")
+	assert.Equal("http://ota.tasmota.com/tasmota/release/tasmota-sensors.bin", remoteFirmwareURL(device))
+}
+
+func Test_firmwareName(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("tasmota.bin", firmwareName(tasmoDevice{FirmwareType: "tasmota"}))
+	assert.Equal("tasmota-sensors.bin", firmwareName(tasmoDevice{FirmwareType: "sensors", Chip: "esp8266"}))
+	assert.Equal("tasmota32.bin", firmwareName(tasmoDevice{FirmwareType: "tasmota32", Chip: "esp32"}))
+	assert.Equal("tasmota32c3.bin", firmwareName(tasmoDevice{FirmwareType: "tasmota32c3", Chip: "esp32"}))
+	assert.Equal("tasmota32.bin", firmwareName(tasmoDevice{FirmwareType: "tasmota", Chip: "esp32"}))
+	assert.Equal("tasmota32-sensors.bin", firmwareName(tasmoDevice{FirmwareType: "tasmota32", TargetType: "sensors", Chip: "esp32"}))
 }
 
 func TestMain(m *testing.M) {
@@ -150,5 +356,56 @@ func TestMain(m *testing.M) {
 	os.Exit(exitVal)
 }
 func Test_Main(t *testing.T) {
+	// run without a subcommand, as the test flags are no arguments of tasmogo
+	os.Args = []string{"tasmogo"}
+	// keep the inventory of the run out of the checkout
+	t.Setenv("TASMOGO_INVENTORY", filepath.Join(t.TempDir(), "tasmogo-inventory.json"))
 	main()
 }
+
+func Test_updateDeviceUnknownVariant(t *testing.T) {
+	fake := fakeDevices(t, map[string]map[string]string{"127.0.0.1": {}})
+	device := tasmoDevice{Name: "plug", IP: net.IPv4(127, 0, 0, 1), FirmwareVersion: "nightly"}
+	assert.NotNil(t, updateDevice(context.Background(), &device, &inventory{Devices: map[string]*inventoryRecord{}}))
+	assert.Empty(t, fake.Commands)
+}
+
+func Test_excludeOthers(t *testing.T) {
+	assert := assert.New(t)
+	devices := []tasmoDevice{{IP: net.IPv4(10, 0, 0, 1)}, {IP: net.IPv4(10, 0, 0, 2)}}
+	excludeOthers(devices, []string{"10.0.0.2"})
+	assert.True(devices[0].Excluded)
+	assert.False(devices[1].Excluded)
+}
+
+func Test_recordUpdates(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	target, _ := version.NewVersion("9.2.0")
+	devices := []tasmoDevice{
+		{Name: "a", IP: net.ParseIP("10.0.0.1"), FirmwareVersion: "9.1.0", UpdateURL: "http://ota/tasmota.bin", UpdateAttempts: 1},
+	}
+	// the update of a stopped run may still arrive
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	inv := &inventory{Devices: map[string]*inventoryRecord{}}
+	recordUpdates(ctx, inv, devices, target)
+	assert.Empty(inv.History)
+	assert.Empty(inv.Queue)
+
+	// the after hooks undo the preparation of a failed update, too
+	viper.Set("auditlog", "")
+	viper.Set("hooks", []map[string]interface{}{{"before": []string{"Rule1 0"}, "after": []string{"Rule1 1"}}})
+	fake := fakeDevices(t, map[string]map[string]string{"10.0.0.1": {}})
+	recordUpdates(context.Background(), inv, devices, target)
+	assert.Len(inv.History, 1)
+	assert.Equal("update failed", inv.History[0].Kind)
+	assert.Len(inv.Queue, 1)
+	assert.Equal([]string{"10.0.0.1: Rule1 1"}, fake.Commands)
+	// a failing device is queued only once, and no longer once its update arrived
+	recordUpdates(context.Background(), inv, devices, target)
+	assert.Len(inv.Queue, 1)
+	devices[0].Verified = true
+	recordUpdates(context.Background(), inv, devices, target)
+	assert.Empty(inv.Queue)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tidwall/gjson"
+)
+
+// sensorReadings extracts the numeric readings of the sensors from the answer to "Status 0", whose
+// StatusSNS is the answer to "Status 8" or "Status 10": the ENERGY of power monitoring plugs and the
+// values of sensors like an AM2301, keyed by the sensor and the reading. The readings of several
+// channels, like the power of a dual plug, are numbered from 1.
+func sensorReadings(response string) map[string]map[string]float64 {
+	sensors := make(map[string]map[string]float64)
+	add := func(sensor string, reading string, value gjson.Result) {
+		if sensors[sensor] == nil {
+			sensors[sensor] = make(map[string]float64)
+		}
+		sensors[sensor][reading] = value.Float()
+	}
+	gjson.Get(response, "StatusSNS").ForEach(func(sensor, data gjson.Result) bool {
+		switch {
+		case data.Type == gjson.Number:
+			add(sensor.String(), "Value", data)
+		case data.IsObject():
+			data.ForEach(func(reading, value gjson.Result) bool {
+				if value.Type == gjson.Number {
+					add(sensor.String(), reading.String(), value)
+				}
+				if value.IsArray() {
+					for i, channel := range value.Array() {
+						if channel.Type == gjson.Number {
+							add(sensor.String(), reading.String()+strconv.Itoa(i+1), channel)
+						}
+					}
+				}
+				return true
+			})
+		}
+		return true
+	})
+	if len(sensors) == 0 {
+		return nil
+	}
+	return sensors
+}
+
+// collectTelemetry reports if the sensor readings are kept for the outputs, TASMOGO_TELEMETRY
+func collectTelemetry() bool {
+	return viper.GetBool("telemetry")
+}
+
+// sortedKeys returns the keys of a map in order, so the outputs don't change between runs
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sensorNames returns the sensors of a device in order
+func sensorNames(sensors map[string]map[string]float64) []string {
+	names := make([]string, 0, len(sensors))
+	for name := range sensors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// escapeInflux escapes the commas, equal signs and spaces of a measurement, tag or field key of the
+// InfluxDB line protocol
+func escapeInflux(value string) string {
+	return strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `).Replace(value)
+}
+
+// writeInflux writes the sensor readings of the devices in the InfluxDB line protocol: a line of the
+// measurement "tasmota" per sensor, tagged with the IP, name and sensor of the device
+func writeInflux(w io.Writer, devices []tasmoDevice, now time.Time) error {
+	for _, device := range devices {
+		for _, sensor := range sensorNames(device.Sensors) {
+			readings := device.Sensors[sensor]
+			fields := make([]string, 0, len(readings))
+			for _, reading := range sortedKeys(readings) {
+				fields = append(fields, escapeInflux(reading)+"="+strconv.FormatFloat(readings[reading], 'f', -1, 64))
+			}
+			line := "tasmota,ip=" + escapeInflux(device.address()) + ",name=" + escapeInflux(device.Name) + ",sensor=" + escapeInflux(sensor) +
+				" " + strings.Join(fields, ",") + " " + strconv.FormatInt(now.UnixNano(), 10) + "\n"
+			if _, err := io.WriteString(w, line); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const sensorData = `{
+	"StatusSNS": {
+		"Time": "2021-03-01T03:00:00",
+		"Counter": 12,
+		"AM2301": {"Temperature": 21.5, "Humidity": 48.1},
+		"ENERGY": {"TotalStartTime": "2021-01-01T00:00:00", "Total": 3.25, "Power": [12, 0], "Voltage": 230},
+		"TempUnit": "C"
+	}
+}`
+
+func Test_sensorReadings(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(map[string]map[string]float64{
+		"Counter": {"Value": 12},
+		"AM2301":  {"Temperature": 21.5, "Humidity": 48.1},
+		"ENERGY":  {"Total": 3.25, "Power1": 12, "Power2": 0, "Voltage": 230},
+	}, sensorReadings(sensorData))
+	assert.Nil(sensorReadings(deviceData))
+}
+
+func Test_writeInflux(t *testing.T) {
+	assert := assert.New(t)
+	devices := []tasmoDevice{
+		{Name: "Kitchen plug", IP: net.ParseIP("10.0.0.1"), Sensors: map[string]map[string]float64{"ENERGY": {"Total": 3.25, "Power": 12}}},
+		{Name: "lamp", IP: net.ParseIP("10.0.0.2")},
+	}
+	var buf bytes.Buffer
+	assert.Nil(writeInflux(&buf, devices, time.Unix(1614567600, 0)))
+	assert.Equal("tasmota,ip=10.0.0.1,name=Kitchen\\ plug,sensor=ENERGY Power=12,Total=3.25 1614567600000000000\n", buf.String())
+
+	assert.Contains(renderMetrics(devices, time.Now()), `tasmogo_device_sensor{ip="10.0.0.1",name="Kitchen plug",sensor="ENERGY",reading="Power"} 12`)
+}
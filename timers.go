@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"sort"
+
+	"github.com/spf13/viper"
+	"github.com/tidwall/gjson"
+	"gopkg.in/yaml.v3"
+)
+
+// timerKey matches the names of the timers in the response of the Timers command
+var timerKey = regexp.MustCompile(`^Timer\d+$`)
+
+// timerConfig is the configuration of a single Tasmota timer
+type timerConfig struct {
+	Enable int    `yaml:"enable" json:"Enable"`
+	Mode   int    `yaml:"mode" json:"Mode"`
+	Time   string `yaml:"time" json:"Time"`
+	Window int    `yaml:"window" json:"Window"`
+	Days   string `yaml:"days" json:"Days"`
+	Repeat int    `yaml:"repeat" json:"Repeat"`
+	Output int    `yaml:"output" json:"Output"`
+	Action int    `yaml:"action" json:"Action"`
+}
+
+// deviceTimers holds all timers of a device
+type deviceTimers struct {
+	Name   string                 `yaml:"name"`
+	Timers map[string]timerConfig `yaml:"timers"`
+}
+
+// parseTimers extracts the timers from the response of the Timers command. Older firmwares group
+// them in blocks of four ("Timers1": {"Timer1": ...}), newer ones list them at the top level.
+func parseTimers(response string) (map[string]timerConfig, error) {
+	timers := make(map[string]timerConfig)
+	var walk func(result gjson.Result) error
+	walk = func(result gjson.Result) error {
+		var err error
+		result.ForEach(func(key, value gjson.Result) bool {
+			switch {
+			case timerKey.MatchString(key.String()):
+				var timer timerConfig
+				err = json.Unmarshal([]byte(value.Raw), &timer)
+				timers[key.String()] = timer
+			case value.IsObject():
+				err = walk(value)
+			}
+			return err == nil
+		})
+		return err
+	}
+	if err := walk(gjson.Parse(response)); err != nil {
+		return nil, err
+	}
+	if len(timers) == 0 {
+		return nil, errors.New("Device reported no timers")
+	}
+	return timers, nil
+}
+
+// getTimers reads the timers of a device
+func getTimers(ip string) (map[string]timerConfig, error) {
+	response, err := sendCommand(ip, "Timers")
+	if err != nil {
+		return nil, err
+	}
+	return parseTimers(response)
+}
+
+// exportTimers writes the timers of all given devices, keyed by their IP, to a YAML file
+func exportTimers(devices []tasmoDevice, path string) error {
+	export := make(map[string]deviceTimers)
+	for _, device := range devices {
+		timers, err := getTimers(device.IP.String())
+		if err != nil {
+			deviceLogger(device, "timers").warn("Reading the timers of " + device.Name + " (" + device.IP.String() + ") failed: " + err.Error())
+			continue
+		}
+		export[device.IP.String()] = deviceTimers{Name: device.Name, Timers: timers}
+	}
+	data, err := yaml.Marshal(export)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// changedTimers returns the names of all timers whose desired configuration differs from the current one
+func changedTimers(current map[string]timerConfig, desired map[string]timerConfig) []string {
+	changed := make([]string, 0)
+	for name, timer := range desired {
+		if current[name] != timer {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// importTimers reads a YAML file created by exportTimers and sets all timers that were changed in it.
+// If devices are given, only these IPs are updated.
+func importTimers(path string, devices []string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var desired map[string]deviceTimers
+	if err := yaml.Unmarshal(data, &desired); err != nil {
+		return err
+	}
+	selected := make(map[string]bool)
+	for _, ip := range devices {
+		selected[ip] = true
+	}
+	inv, err := loadInventory(viper.GetString("inventory"))
+	if err != nil {
+		return err
+	}
+	for ip, device := range desired {
+		if len(selected) > 0 && !selected[ip] {
+			continue
+		}
+		target := tasmoDevice{IP: net.ParseIP(ip), Name: device.Name}
+		target.Protected = isProtected(target, inv)
+		if !mayModify(target) {
+			deviceLogger(target, "timers").warn("Not setting the timers of protected device " + device.Name + " (" + ip + ")")
+			continue
+		}
+		current, err := getTimers(ip)
+		if err != nil {
+			deviceLogger(target, "timers").warn("Reading the timers of " + device.Name + " (" + ip + ") failed: " + err.Error())
+			continue
+		}
+		for _, name := range changedTimers(current, device.Timers) {
+			payload, _ := json.Marshal(device.Timers[name])
+			if _, err := sendCommand(ip, name+" "+string(payload)); err != nil {
+				deviceLogger(target, "timers").warn("Setting " + name + " of " + device.Name + " (" + ip + ") failed: " + err.Error())
+				continue
+			}
+			audit("Set " + name + " of " + device.Name + " (" + ip + ") to " + string(payload))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseTimers(t *testing.T) {
+	assert := assert.New(t)
+	timers, err := parseTimers(`{"Timers":"ON","Timer1":{"Enable":1,"Mode":0,"Time":"06:30","Window":0,"Days":"-MTWTF-","Repeat":1,"Output":1,"Action":1},"Timer2":{"Enable":0,"Mode":1,"Time":"00:00","Window":0,"Days":"SMTWTFS","Repeat":0,"Output":1,"Action":0}}`)
+	assert.Nil(err)
+	assert.Len(timers, 2)
+	assert.Equal("06:30", timers["Timer1"].Time)
+	assert.Equal(1, timers["Timer2"].Mode)
+
+	// older firmwares group the timers
+	timers, err = parseTimers(`{"Timers1":{"Timer1":{"Arm":1,"Time":"07:00"},"Timer2":{"Arm":0,"Time":"08:00"}}}`)
+	assert.Nil(err)
+	assert.Equal("08:00", timers["Timer2"].Time)
+
+	_, err = parseTimers(`{"Command":"Unknown"}`)
+	assert.NotNil(err)
+}
+
+func Test_changedTimers(t *testing.T) {
+	current := map[string]timerConfig{
+		"Timer1": {Enable: 1, Time: "06:30"},
+		"Timer2": {Enable: 0, Time: "00:00"},
+	}
+	desired := map[string]timerConfig{
+		"Timer1": {Enable: 1, Time: "06:30"},
+		"Timer2": {Enable: 1, Time: "22:00"},
+	}
+	assert.Equal(t, []string{"Timer2"}, changedTimers(current, desired))
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/net/websocket"
+)
+
+// agentRetryDelay is how long an agent waits before it connects to the controller again
+const agentRetryDelay = 10 * time.Second
+
+// tunnelRequest is a request to a device sent by the controller to the agent
+type tunnelRequest struct {
+	ID     uint64      `json:"id"`
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+// tunnelResponse is the answer of a device, or the error reaching it, sent back by the agent
+type tunnelResponse struct {
+	ID     uint64      `json:"id"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// tunnel relays the requests to the devices through the agent connected to the controller. It
+// implements http.RoundTripper, so it replaces the transport of the device client.
+type tunnel struct {
+	mu      sync.Mutex
+	conn    *websocket.Conn
+	nextID  uint64
+	pending map[uint64]chan tunnelResponse
+}
+
+// agentTunnel is the tunnel of the daemon, the agents connect to it via /api/tunnel
+var agentTunnel = &tunnel{}
+
+// connected reports if an agent is connected
+func (t *tunnel) connected() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.conn != nil
+}
+
+// serve relays the requests through a newly connected agent until it disconnects. An agent that was
+// connected before is replaced.
+func (t *tunnel) serve(conn *websocket.Conn) {
+	t.mu.Lock()
+	if t.conn != nil {
+		t.conn.Close()
+	}
+	t.conn = conn
+	t.mu.Unlock()
+	logInfo("Agent connected from " + conn.Request().RemoteAddr)
+	for {
+		var res tunnelResponse
+		if err := websocket.JSON.Receive(conn, &res); err != nil {
+			break
+		}
+		t.mu.Lock()
+		if answer, ok := t.pending[res.ID]; ok {
+			answer <- res
+			delete(t.pending, res.ID)
+		}
+		t.mu.Unlock()
+	}
+	t.mu.Lock()
+	// the requests waiting for the agent fail right away, unless it was already replaced
+	if t.conn == conn {
+		t.conn = nil
+		for id, answer := range t.pending {
+			answer <- tunnelResponse{ID: id, Error: "the agent disconnected"}
+			delete(t.pending, id)
+		}
+	}
+	t.mu.Unlock()
+	conn.Close()
+	logWarn("Agent disconnected from " + conn.Request().RemoteAddr)
+}
+
+// RoundTrip sends a request through the agent and waits for the answer of the device
+func (t *tunnel) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	answer := make(chan tunnelResponse, 1)
+	t.mu.Lock()
+	conn := t.conn
+	if conn == nil {
+		t.mu.Unlock()
+		return nil, errors.New("No agent is connected to the tunnel")
+	}
+	t.nextID++
+	id := t.nextID
+	if t.pending == nil {
+		t.pending = make(map[uint64]chan tunnelResponse)
+	}
+	t.pending[id] = answer
+	// the frames of concurrent requests must not interleave
+	err := websocket.JSON.Send(conn, tunnelRequest{ID: id, Method: req.Method, URL: req.URL.String(), Header: req.Header, Body: body})
+	t.mu.Unlock()
+	if err != nil {
+		t.forget(id)
+		return nil, errors.New("Sending the request to the agent failed: " + err.Error())
+	}
+	select {
+	case <-req.Context().Done():
+		t.forget(id)
+		return nil, req.Context().Err()
+	case res := <-answer:
+		if res.Error != "" {
+			return nil, errors.New(res.Error)
+		}
+		return &http.Response{
+			Status:        http.StatusText(res.Status),
+			StatusCode:    res.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        res.Header,
+			Body:          ioutil.NopCloser(bytes.NewReader(res.Body)),
+			ContentLength: int64(len(res.Body)),
+			Request:       req,
+		}, nil
+	}
+}
+
+// forget stops waiting for the answer to a request
+func (t *tunnel) forget(id uint64) {
+	t.mu.Lock()
+	delete(t.pending, id)
+	t.mu.Unlock()
+}
+
+// tunnelHandler accepts the agents. As the agent sees the passwords of the devices, it is only accepted
+// with the token of TASMOGO_APITOKEN.
+func tunnelHandler(t *tunnel) http.Handler {
+	accept := websocket.Server{Handler: t.serve}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if viper.GetString("apitoken") == "" {
+			writeError(w, http.StatusForbidden, "Set TASMOGO_APITOKEN to accept agents")
+			return
+		}
+		accept.ServeHTTP(w, r)
+	})
+}
+
+// tunnelURL returns the address of the tunnel endpoint of the controller at the given URL
+func tunnelURL(controller string) (string, error) {
+	u, err := url.Parse(strings.TrimRight(controller, "/"))
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http", "ws":
+		u.Scheme = "ws"
+	case "https", "wss":
+		u.Scheme = "wss"
+	default:
+		return "", errors.New("Invalid controller URL " + controller + ", expected http:// or https://")
+	}
+	u.Path += "/api/tunnel"
+	return u.String(), nil
+}
+
+// agentAllowed reports if the agent may forward a request to the host: only the addresses of
+// TASMOGO_CIDR and the hosts of TASMOGO_HOSTS are reachable through it, so the controller can't use
+// it to reach anything else on the network
+func agentAllowed(host string, networks []*net.IPNet, hosts []string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		for _, network := range networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	for _, h := range hosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// relayClient returns the client to relay a request with. Uploading a pushed firmware to /u2 may take
+// as long as the device needs to receive and flash it, everything else as long as a command.
+func relayClient(method string, u *url.URL, commands *http.Client, uploads *http.Client) *http.Client {
+	if method == http.MethodPost && u.Path == "/u2" {
+		return uploads
+	}
+	return commands
+}
+
+// relay sends a request of the controller to the device and returns its answer
+func relay(commands *http.Client, uploads *http.Client, req tunnelRequest, networks []*net.IPNet, hosts []string) tunnelResponse {
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return tunnelResponse{ID: req.ID, Error: err.Error()}
+	}
+	if !agentAllowed(u.Hostname(), networks, hosts) {
+		return tunnelResponse{ID: req.ID, Error: "The agent doesn't reach " + u.Hostname() + ", it is not part of its networks"}
+	}
+	httpReq, err := http.NewRequest(req.Method, req.URL, bytes.NewReader(req.Body))
+	if err != nil {
+		return tunnelResponse{ID: req.ID, Error: err.Error()}
+	}
+	httpReq.Header = req.Header
+	res, err := relayClient(req.Method, u, commands, uploads).Do(httpReq)
+	if err != nil {
+		return tunnelResponse{ID: req.ID, Error: err.Error()}
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return tunnelResponse{ID: req.ID, Error: err.Error()}
+	}
+	return tunnelResponse{ID: req.ID, Status: res.StatusCode, Header: res.Header, Body: body}
+}
+
+// runAgent connects to the controller at the given URL and relays its requests to the devices on this
+// network until ctx is cancelled. A lost connection is opened again.
+func runAgent(ctx context.Context, controller string) error {
+	if viper.GetBool("tunnel") {
+		return errors.New("An agent reaches the devices itself, unset TASMOGO_TUNNEL")
+	}
+	address, err := tunnelURL(controller)
+	if err != nil {
+		return err
+	}
+	networks, err := parseNetworks(getList("cidr"))
+	if err != nil {
+		return err
+	}
+	config, err := websocket.NewConfig(address, controller)
+	if err != nil {
+		return err
+	}
+	config.Header.Set("Authorization", "Bearer "+viper.GetString("apitoken"))
+	config.Header.Set("User-Agent", userAgent())
+	commands := deviceHTTPClient(viper.GetDuration("exectimeout"))
+	uploads := deviceHTTPClient(uploadTimeout)
+	for ctx.Err() == nil {
+		conn, err := config.DialContext(ctx)
+		if err != nil {
+			logWarn("Connecting to the controller failed: " + err.Error())
+			pause(ctx, agentRetryDelay)
+			continue
+		}
+		logInfo("Connected to the controller at " + address)
+		agentSession(ctx, conn, commands, uploads, networks, configuredHosts())
+		logWarn("Lost the connection to the controller")
+		pause(ctx, agentRetryDelay)
+	}
+	return nil
+}
+
+// agentSession relays the requests of a connection to the controller until it is closed
+func agentSession(ctx context.Context, conn *websocket.Conn, commands *http.Client, uploads *http.Client, networks []*net.IPNet, hosts []string) {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	var mu sync.Mutex
+	for {
+		var req tunnelRequest
+		if err := websocket.JSON.Receive(conn, &req); err != nil {
+			conn.Close()
+			return
+		}
+		go func() {
+			res := relay(commands, uploads, req, networks, hosts)
+			mu.Lock()
+			defer mu.Unlock()
+			if err := websocket.JSON.Send(conn, res); err != nil {
+				logDebug("Answering the controller failed: " + err.Error())
+			}
+		}()
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_tunnel(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	setDefaults()
+	device := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"Command":"` + r.URL.Query().Get("cmnd") + `"}`))
+	}))
+	defer device.Close()
+	tun := &tunnel{}
+	controller := httptest.NewServer(requireToken(tunnelHandler(tun)))
+	defer controller.Close()
+	client := &http.Client{Transport: tun, Timeout: 5 * time.Second}
+
+	// without an agent the devices can't be reached
+	_, err := client.Get(device.URL + "/cm?cmnd=Status")
+	assert.NotNil(err)
+
+	// agents are only accepted with a token
+	res, err := http.Get(controller.URL)
+	assert.Nil(err)
+	assert.Equal(http.StatusForbidden, res.StatusCode)
+	res.Body.Close()
+
+	viper.Set("apitoken", "secret")
+	viper.Set("cidr", "127.0.0.1/32")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- runAgent(ctx, controller.URL) }()
+	for i := 0; i < 100 && !tun.connected(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(tun.connected())
+
+	res, err = client.Get(device.URL + "/cm?cmnd=Status")
+	if assert.Nil(err) {
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(http.StatusOK, res.StatusCode)
+		assert.Equal(`{"Command":"Status"}`, string(body))
+	}
+	// the agent only reaches its own networks
+	_, err = client.Get("http://10.0.0.1/cm?cmnd=Status")
+	assert.NotNil(err)
+
+	cancel()
+	assert.Nil(<-done)
+}
+
+func Test_tunnelURL(t *testing.T) {
+	assert := assert.New(t)
+	u, err := tunnelURL("https://tasmogo.example.com/")
+	assert.Nil(err)
+	assert.Equal("wss://tasmogo.example.com/api/tunnel", u)
+	u, _ = tunnelURL("http://10.0.0.5:8080/tasmogo")
+	assert.Equal("ws://10.0.0.5:8080/tasmogo/api/tunnel", u)
+	_, err = tunnelURL("ftp://tasmogo")
+	assert.NotNil(err)
+}
+
+func Test_relayClient(t *testing.T) {
+	assert := assert.New(t)
+	commands, uploads := &http.Client{Timeout: time.Second}, &http.Client{Timeout: time.Minute}
+	u, _ := url.Parse("http://192.168.0.23/u2")
+	assert.Same(uploads, relayClient(http.MethodPost, u, commands, uploads))
+	u, _ = url.Parse("http://192.168.0.23/cm?cmnd=Status%200")
+	assert.Same(commands, relayClient(http.MethodGet, u, commands, uploads))
+	u, _ = url.Parse("http://192.168.0.23/up")
+	assert.Same(commands, relayClient(http.MethodGet, u, commands, uploads))
+}
+
+func Test_agentAllowed(t *testing.T) {
+	assert := assert.New(t)
+	networks, _ := parseNetworks([]string{"192.168.0.0/24"})
+	assert.True(agentAllowed("192.168.0.23", networks, nil))
+	assert.False(agentAllowed("192.168.1.1", networks, nil))
+	assert.False(agentAllowed("router.local", networks, nil))
+	assert.True(agentAllowed("plug.local", networks, []string{"PLUG.local"}))
+	assert.False(agentAllowed("", []*net.IPNet{}, nil))
+}
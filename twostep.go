@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// minimalVariant is the variant reported by the minimal firmware
+const minimalVariant = "minimal"
+
+// needsTwoStep reports if a device has too little flash to receive its firmware directly, or is
+// running the minimal firmware of an unfinished two-step update
+func needsTwoStep(device tasmoDevice) bool {
+	if device.FirmwareType == minimalVariant {
+		return device.TargetType != ""
+	}
+	return viper.GetBool("twostepota") && device.FlashSize > 0 && device.FlashSize <= viper.GetInt("twostepflashsize")
+}
+
+// updateTwoStep first flashes the minimal firmware, which leaves enough room for the full image on
+// devices with 1MB of flash, waits for the device to come back and then flashes the target variant.
+// The target variant is kept in the inventory, so an interrupted update is finished on the next run.
+// A device that already runs the minimal firmware only gets the target variant.
+func updateTwoStep(device *tasmoDevice, inv *inventory) error {
+	rec := inv.record(device.key())
+	if device.FirmwareType == minimalVariant && rec.OTAVariant == "" {
+		rec.OTAVariant = device.TargetType
+	}
+	if device.FirmwareType != minimalVariant {
+		rec.OTAVariant = device.FirmwareType
+		if device.TargetType != "" {
+			rec.OTAVariant = device.TargetType
+		}
+		if err := flashMinimal(*device, inv); err != nil {
+			return err
+		}
+	}
+	device.TargetType = rec.OTAVariant
+	otaURL := otaURLForDevice(*device)
+	if err := flashDevice(*device, otaURL); err != nil {
+		return err
+	}
+	device.UpdateURL = otaURL
+	return nil
+}
+
+// flashMinimal flashes the minimal firmware until the device comes back with it or the retries are used up
+func flashMinimal(device tasmoDevice, inv *inventory) error {
+	rec := inv.record(device.key())
+	minimal := device
+	minimal.TargetType = minimalVariant
+	minimalURL := otaURLForDevice(minimal)
+	isMinimal := func(d tasmoDevice) bool {
+		return d.FirmwareType == minimalVariant
+	}
+	for attempt := 0; attempt <= viper.GetInt("twostepretries"); attempt++ {
+		rec.OTAAttempts++
+		// the state must survive a crash in the middle of the update
+		if err := inv.save(viper.GetString("inventory")); err != nil {
+			logWarn("Saving the inventory failed: " + err.Error())
+		}
+		if err := flashDevice(minimal, minimalURL); err != nil {
+			deviceLogger(device, "update").error("Flashing the minimal firmware on " + device.Name + " (" + device.IP.String() + ") failed: " + err.Error())
+			continue
+		}
+		deadline := time.Now().Add(viper.GetDuration("verifytimeout"))
+		if waitForDevice(context.Background(), deviceProbe(device), isMinimal, viper.GetDuration("verifydelay"), viper.GetDuration("verifymaxdelay"), deadline) {
+			audit("Flashed the minimal firmware on " + device.Name + " (" + device.IP.String() + ")")
+			return nil
+		}
+	}
+	return errors.New("Device did not come back with the minimal firmware")
+}
+
+// resumeTwoStep marks devices that are stuck on the minimal firmware as outdated, so they get their
+// full variant back: the target of an unfinished two-step update, the variant they are pinned to or
+// the last one the inventory saw them running. Devices whose variant isn't known are only reported.
+func resumeTwoStep(inv *inventory, devices []tasmoDevice) {
+	for i, device := range devices {
+		if device.FirmwareType != minimalVariant || device.Cached {
+			continue
+		}
+		variant := device.TargetType
+		if rec, ok := inv.Devices[device.key()]; ok && rec.OTAVariant != "" {
+			variant = rec.OTAVariant
+		} else if ok && variant == "" {
+			variant = rec.FullVariant
+		}
+		if variant == "" || variant == minimalVariant {
+			deviceLogger(device, "update").warn(device.Name + " (" + device.address() + ") is stuck on the minimal firmware and its full variant is unknown, pin it in the devices section of the config")
+			continue
+		}
+		devices[i].TargetType = variant
+		devices[i].Outdated = true
+	}
+}
+
+// finishTwoStep forgets the state of a two-step update once the device was verified
+func finishTwoStep(inv *inventory, device tasmoDevice) {
+	if rec, ok := inv.Devices[device.key()]; ok {
+		rec.OTAVariant = ""
+		rec.OTAAttempts = 0
+	}
+}
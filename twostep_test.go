@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_needsTwoStep(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	viper.Set("twostepflashsize", 1024)
+	device := tasmoDevice{FirmwareType: "sensors", FlashSize: 1024}
+	assert.False(needsTwoStep(device))
+	viper.Set("twostepota", true)
+	assert.True(needsTwoStep(device))
+	device.FlashSize = 4096
+	assert.False(needsTwoStep(device))
+	// an unfinished update is finished regardless of the setting
+	viper.Set("twostepota", false)
+	assert.True(needsTwoStep(tasmoDevice{FirmwareType: "minimal", TargetType: "sensors"}))
+}
+
+func Test_updateTwoStep(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	viper.Set("otaurl", "http://ota/")
+	viper.Set("verifytimeout", time.Second)
+	viper.Set("verifydelay", time.Millisecond)
+	viper.Set("verifymaxdelay", time.Millisecond)
+	// the fake device already reports the minimal firmware, as if it was flashed
+	fake := fakeDevices(t, map[string]map[string]string{
+		"10.0.0.1": {"Status 0": `{"StatusFWR": {"Version": "9.1.0(minimal)"}}`},
+	})
+	inv := &inventory{Devices: map[string]*inventoryRecord{}}
+	device := tasmoDevice{Name: "plug", IP: net.ParseIP("10.0.0.1"), FirmwareType: "sensors"}
+	assert.Nil(updateTwoStep(&device, inv))
+	assert.Equal("http://ota/tasmota-sensors.bin", device.UpdateURL)
+	assert.Equal([]string{
+		"10.0.0.1: OtaUrl http://ota/tasmota-minimal.bin",
+		"10.0.0.1: Upgrade 1",
+		"10.0.0.1: Status 0",
+		"10.0.0.1: OtaUrl http://ota/tasmota-sensors.bin",
+		"10.0.0.1: Upgrade 1",
+	}, fake.Commands)
+	assert.Equal("sensors", inv.Devices["10.0.0.1"].OTAVariant)
+
+	finishTwoStep(inv, device)
+	assert.Empty(inv.Devices["10.0.0.1"].OTAVariant)
+}
+
+func Test_resumeTwoStep(t *testing.T) {
+	inv := &inventory{Devices: map[string]*inventoryRecord{"10.0.0.1": {OTAVariant: "sensors"}}}
+	devices := []tasmoDevice{
+		{IP: net.ParseIP("10.0.0.1"), FirmwareType: "minimal"},
+		{IP: net.ParseIP("10.0.0.2"), FirmwareType: "minimal"},
+	}
+	resumeTwoStep(inv, devices)
+	assert.True(t, devices[0].Outdated)
+	assert.Equal(t, "sensors", devices[0].TargetType)
+	assert.False(t, devices[1].Outdated)
+}
+
+func Test_resumeTwoStep_stuck(t *testing.T) {
+	assert := assert.New(t)
+	inv := &inventory{Devices: map[string]*inventoryRecord{
+		"10.0.0.1": {Variant: "minimal", FullVariant: "sensors"},
+		"10.0.0.2": {Variant: "minimal", FullVariant: "sensors"},
+	}}
+	devices := []tasmoDevice{
+		{IP: net.ParseIP("10.0.0.1"), FirmwareType: "minimal"},
+		// a pinned variant wins over the last one seen
+		{IP: net.ParseIP("10.0.0.2"), FirmwareType: "minimal", TargetType: "lite"},
+		{IP: net.ParseIP("10.0.0.3"), FirmwareType: "minimal"},
+	}
+	resumeTwoStep(inv, devices)
+	assert.True(devices[0].Outdated)
+	assert.Equal("sensors", devices[0].TargetType)
+	assert.True(devices[1].Outdated)
+	assert.Equal("lite", devices[1].TargetType)
+	assert.False(devices[2].Outdated)
+	assert.Equal([]string{"minimal"}, deviceStates(devices[2]))
+}
+
+func Test_updateTwoStep_stuck(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	viper.Set("otaurl", "http://ota/")
+	fake := fakeDevices(t, map[string]map[string]string{"10.0.0.1": {}})
+	inv := &inventory{Devices: map[string]*inventoryRecord{}}
+	device := tasmoDevice{Name: "plug", IP: net.ParseIP("10.0.0.1"), FirmwareType: "minimal", TargetType: "sensors"}
+	assert.True(needsTwoStep(device))
+	assert.Nil(updateTwoStep(&device, inv))
+	// the minimal firmware is not flashed again
+	assert.Equal([]string{
+		"10.0.0.1: OtaUrl http://ota/tasmota-sensors.bin",
+		"10.0.0.1: Upgrade 1",
+	}, fake.Commands)
+	assert.Equal("sensors", inv.Devices["10.0.0.1"].OTAVariant)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/spf13/viper"
+)
+
+// probeDevice is called repeatedly to check if an updated device is back online
+type probeDevice func() (tasmoDevice, error)
+
+// waitForVersion probes a device with exponentially growing pauses until it reports at least the
+// target version and, unless it is empty, the given variant or the deadline has passed. It reports
+// if the device reached the target version.
+func waitForVersion(ctx context.Context, probe probeDevice, target *version.Version, variant string, delay time.Duration, maxDelay time.Duration, deadline time.Time) bool {
+	return waitForDevice(ctx, probe, func(device tasmoDevice) bool {
+		device, err := checkDeviceVersion(target, device)
+		return err == nil && !device.Outdated && (variant == "" || device.FirmwareType == variant)
+	}, delay, maxDelay, deadline)
+}
+
+// waitForDevice probes a device with exponentially growing pauses until the check accepts it or the
+// deadline has passed. It reports if the device was accepted. Waiting ends early once ctx is cancelled.
+func waitForDevice(ctx context.Context, probe probeDevice, check func(tasmoDevice) bool, delay time.Duration, maxDelay time.Duration, deadline time.Time) bool {
+	for {
+		// don't sleep past the deadline, but probe one last time when it is reached
+		if wait := time.Until(deadline); wait < delay {
+			delay = wait
+		}
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return false
+			case <-timer.C:
+			}
+		}
+		if device, err := probe(); err == nil && check(device) {
+			return true
+		}
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		delay *= 2
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+// deviceProbe returns a probe that requests the current data of a device
+func deviceProbe(device tasmoDevice) probeDevice {
+	return func() (tasmoDevice, error) {
+		if device.ViaMQTT {
+			return getDeviceDataMQTT(device)
+		}
+		return getDeviceData(context.Background(), device.IP)
+	}
+}
+
+// verifyDevices concurrently waits for all updated devices that aren't verified yet to come back with
+// the target version, or the version they are pinned to, and variant and marks them as verified
+func verifyDevices(ctx context.Context, devices []tasmoDevice, target *version.Version) {
+	deadline := time.Now().Add(viper.GetDuration("verifytimeout"))
+	delay := viper.GetDuration("verifydelay")
+	maxDelay := viper.GetDuration("verifymaxdelay")
+
+	var wg sync.WaitGroup
+	pending := make([]*tasmoDevice, 0)
+	for i := range devices {
+		if devices[i].UpdateURL == "" || devices[i].Verified {
+			continue
+		}
+		pending = append(pending, &devices[i])
+	}
+	for _, device := range pending {
+		wg.Add(1)
+		go func(device *tasmoDevice) {
+			defer wg.Done()
+			// a device still running the minimal firmware of a two-step update has the right version,
+			// but not the right variant
+			variant := device.FirmwareType
+			if device.TargetType != "" {
+				variant = device.TargetType
+			}
+			device.Verified = waitForVersion(ctx, deviceProbe(*device), targetVersion(*device, target), variant, delay, maxDelay, deadline)
+		}(device)
+	}
+	wg.Wait()
+
+	for _, device := range pending {
+		if device.Verified {
+			deviceLogger(*device, "verify").info("Verified update of " + device.Name + " (" + device.IP.String() + ")")
+		} else {
+			deviceLogger(*device, "verify").error(device.Name + " (" + device.IP.String() + ") did not come back with the new version in time")
+		}
+	}
+}
+
+// verifyUpdates verifies all updated devices and updates the ones that did not come back with the
+// target version again, up to TASMOGO_UPDATERETRIES times. Nothing is retried once ctx is cancelled, in
+// a blackout period or outside of the update window.
+func verifyUpdates(ctx context.Context, devices []tasmoDevice, target *version.Version, inv *inventory) {
+	verifyDevices(ctx, devices, target)
+	for retry := 0; retry < viper.GetInt("updateretries") && ctx.Err() == nil; retry++ {
+		if _, held := updatesHeld(time.Now()); held {
+			return
+		}
+		retried := false
+		for i := range devices {
+			device := &devices[i]
+			// without a target the device can't be verified, so it isn't told to update again
+			if device.UpdateURL == "" || device.Verified || targetVersion(*device, target) == nil {
+				continue
+			}
+			deviceLogger(*device, "update").info("Retrying the update of " + device.Name + " (" + device.IP.String() + ")")
+			if err := updateDevice(ctx, device, inv); err != nil {
+				deviceLogger(*device, "update").error("Updating " + device.Name + " (" + device.IP.String() + ") failed: " + err.Error())
+				continue
+			}
+			retried = true
+		}
+		if !retried {
+			return
+		}
+		verifyDevices(ctx, devices, target)
+	}
+}
+
+// renderUpdateSummary generates a table with the outcome of every update of the run
+func renderUpdateSummary(devices []tasmoDevice, target *version.Version) string {
+	t := table.NewWriter()
+	t.AppendHeader(table.Row{"IP", "Name", "From", "To", "Attempts", "Result"})
+	for _, device := range devices {
+		if device.UpdateURL == "" {
+			continue
+		}
+		t.AppendRow(table.Row{device.address(), device.Name, device.FirmwareVersion, versionString(targetVersion(device, target)), device.UpdateAttempts, updateResult(device)})
+	}
+	return t.Render()
+}
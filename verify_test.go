@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/merlinschumacher/tasmogo/pkg/tasmota"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_waitForVersion(t *testing.T) {
+	assert := assert.New(t)
+	target, _ := version.NewVersion("9.2.0")
+
+	// the device is offline twice, reports the old version once and then the new one
+	probes := 0
+	probe := func() (tasmoDevice, error) {
+		probes++
+		switch probes {
+		case 1, 2:
+			return tasmoDevice{}, errors.New("offline")
+		case 3:
+			return tasmoDevice{FirmwareVersion: "9.1.0"}, nil
+		}
+		return tasmoDevice{FirmwareVersion: "9.2.0"}, nil
+	}
+	ok := waitForVersion(context.Background(), probe, target, "", time.Millisecond, 4*time.Millisecond, time.Now().Add(time.Second))
+	assert.True(ok)
+	assert.Equal(4, probes)
+
+	// a device that never comes back fails after the deadline
+	probe = func() (tasmoDevice, error) {
+		return tasmoDevice{}, errors.New("offline")
+	}
+	start := time.Now()
+	ok = waitForVersion(context.Background(), probe, target, "", time.Millisecond, 10*time.Millisecond, start.Add(50*time.Millisecond))
+	assert.False(ok)
+	assert.True(time.Since(start) >= 50*time.Millisecond)
+
+	// waiting ends right away once tasmogo is stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start = time.Now()
+	ok = waitForVersion(ctx, probe, target, "", time.Second, time.Second, start.Add(time.Minute))
+	assert.False(ok)
+	assert.True(time.Since(start) < time.Second)
+}
+
+func Test_verifyUpdates(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	viper.Set("otaurl", "http://ota/")
+	viper.Set("updateretries", 1)
+	viper.Set("verifytimeout", 10*time.Millisecond)
+	viper.Set("verifydelay", time.Millisecond)
+	viper.Set("verifymaxdelay", time.Millisecond)
+	// the first device comes back with the new version, the second one keeps the old one
+	fake := fakeDevices(t, map[string]map[string]string{
+		"10.0.0.1": {"Status 0": `{"StatusFWR": {"Version": "9.2.0(tasmota)"}}`},
+		"10.0.0.2": {"Status 0": `{"StatusFWR": {"Version": "9.1.0(tasmota)"}}`},
+	})
+	target, _ := version.NewVersion("9.2.0")
+	inv := &inventory{Devices: map[string]*inventoryRecord{}}
+	devices := []tasmoDevice{
+		{Name: "good", IP: net.ParseIP("10.0.0.1"), FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true},
+		{Name: "bad", IP: net.ParseIP("10.0.0.2"), FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true},
+		{Name: "current", IP: net.ParseIP("10.0.0.3"), FirmwareVersion: "9.2.0", FirmwareType: "tasmota"},
+	}
+	updateDevices(context.Background(), devices[:2], inv, nil)
+	verifyUpdates(context.Background(), devices, target, inv)
+	assert.True(devices[0].Verified)
+	assert.False(devices[1].Verified)
+	assert.Equal(1, devices[0].UpdateAttempts)
+	assert.Equal(2, devices[1].UpdateAttempts)
+
+	upgrades := 0
+	for _, command := range fake.Commands {
+		if command == "10.0.0.2: Upgrade 1" {
+			upgrades++
+		}
+	}
+	assert.Equal(2, upgrades)
+
+	summary := renderUpdateSummary(devices, target)
+	assert.Contains(summary, "good")
+	assert.Contains(summary, "verified")
+	assert.Contains(summary, "failed")
+	assert.NotContains(summary, "current")
+}
+
+func Test_updateDevices(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	viper.Set("otaurl", "http://ota/")
+	fake := fakeDevices(t, map[string]map[string]string{
+		"10.0.0.1": {},
+		"10.0.0.2": {},
+	})
+	inv := &inventory{Devices: map[string]*inventoryRecord{}}
+	devices := []tasmoDevice{
+		{Name: "plug", IP: net.ParseIP("10.0.0.1"), FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true},
+		{Name: "lamp", IP: net.ParseIP("10.0.0.2"), FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true},
+	}
+
+	// no device is touched once tasmogo is stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	updateDevices(ctx, devices, inv, nil)
+	assert.Empty(fake.Commands)
+	assert.Equal("", devices[0].UpdateURL)
+
+	viper.Set("updateconcurrency", 2)
+	devices = append(devices, tasmoDevice{Name: "gone", IP: net.ParseIP("10.0.0.9"), FirmwareVersion: "9.1.0", FirmwareType: "tasmota", Outdated: true})
+	results := updateDevices(context.Background(), devices, inv, nil)
+	assert.Contains(fake.Commands, "10.0.0.1: Upgrade 1")
+	assert.Contains(fake.Commands, "10.0.0.2: Upgrade 1")
+	assert.Equal("command accepted", results[0].Output)
+	assert.Equal("command accepted", results[1].Output)
+	assert.Equal("unreachable", results[2].Error)
+	assert.Equal("", devices[2].UpdateURL)
+	assert.False(devices[2].AuthFailed)
+
+	// a rejected password is reported as such
+	fake.Unauthorized = map[string]bool{"10.0.0.1": true}
+	results = updateDevices(context.Background(), devices[:1], inv, nil)
+	assert.Equal("auth failed", results[0].Error)
+	assert.True(devices[0].AuthFailed)
+}
+
+func Test_updateFailure(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("timed out", updateFailure(&tasmota.DeviceError{Kind: tasmota.ErrTimeout}))
+	assert.Equal("auth failed", updateFailure(&tasmota.DeviceError{Kind: tasmota.ErrUnauthorized}))
+	assert.Equal("Unknown firmware variant", updateFailure(errors.New("Unknown firmware variant")))
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// maxLogLines is the number of log lines the web UI shows
+const maxLogLines = 200
+
+// logTail keeps the last lines written to the log, so the web UI can show the progress of a run
+type logTail struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+// Write implements io.Writer, so the tail can be added to the output of the logger
+func (l *logTail) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		l.lines = append(l.lines, line)
+	}
+	if len(l.lines) > maxLogLines {
+		l.lines = l.lines[len(l.lines)-maxLogLines:]
+	}
+	return len(p), nil
+}
+
+// snapshot returns a copy of the kept lines
+func (l *logTail) snapshot() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string{}, l.lines...)
+}
+
+// writeJSON answers a request with the given value as JSON
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logWarn("Writing the API response failed: " + err.Error())
+	}
+}
+
+// writeError answers a request with an error message as JSON
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// queueJob queues a run for a request of the web UI
+func (d *daemon) queueJob(w http.ResponseWriter, opts scanOptions) {
+	if !d.request(opts) {
+		writeError(w, http.StatusConflict, "Another run is already waiting")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "queued"})
+}
+
+// apiHandler serves the JSON API the web UI is backed by:
+// GET /api/status returns the last scan results and the progress of the current run, POST /api/scan
+// starts a scan and POST /api/update with {"ips": [...]} updates the given devices. The REST API for
+// other automation is served as well.
+func apiHandler(d *daemon) *http.ServeMux {
+	api := http.NewServeMux()
+	api.HandleFunc("/api/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "Use GET")
+			return
+		}
+		writeJSON(w, http.StatusOK, d.status())
+	})
+	api.HandleFunc("/api/scan", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "Use POST")
+			return
+		}
+		d.queueJob(w, scanOptions{Update: r.URL.Query().Get("update") == "true"})
+	})
+	api.HandleFunc("/api/update", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "Use POST")
+			return
+		}
+		var body struct {
+			IPs []string `json:"ips"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.IPs) == 0 {
+			writeError(w, http.StatusBadRequest, "Expected a JSON object with the list of ips to update")
+			return
+		}
+		d.queueJob(w, scanOptions{Update: true, Only: body.IPs})
+	})
+	registerAPI(api, d)
+	return api
+}
+
+// webUIHandler serves the web UI and the API. All API requests need the token of TASMOGO_APITOKEN, if
+// it is set.
+func webUIHandler(d *daemon) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/api/", requireToken(apiHandler(d)))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := webUITemplate.Execute(w, nil); err != nil {
+			logWarn("Rendering the web UI failed: " + err.Error())
+		}
+	})
+	return mux
+}
+
+// serveWebUI serves the web UI and the REST API on the given address until tasmogo is stopped
+func serveWebUI(addr string, d *daemon) {
+	logInfo("Serving the web UI and API on " + addr)
+	if err := http.ListenAndServe(addr, webUIHandler(d)); err != nil {
+		logWarn("Serving the web UI failed: " + err.Error())
+	}
+}
+
+// webUITemplate is the single page of the web UI. It polls the status API and renders the devices.
+var webUITemplate = template.Must(template.New("webui").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>tasmogo</title>
+<style>
+body { font-family: sans-serif; font-size: 11pt; margin: 1.5em; }
+table { border-collapse: collapse; width: 100%; margin: 1em 0; }
+th, td { border: 1px solid #999; padding: 0.3em 0.5em; text-align: left; }
+th { background: #eee; }
+.outdated { color: #b00; }
+pre { background: #f4f4f4; padding: 0.5em; max-height: 20em; overflow: auto; }
+</style>
+</head>
+<body>
+<h1>tasmogo</h1>
+<p id="state">Loading…</p>
+<button id="scan">Rescan</button>
+<button id="update">Update selected</button>
+<table>
+<thead><tr><th><input type="checkbox" id="all"></th><th>IP</th><th>Name</th><th>Firmware</th><th>Variant</th><th>Status</th><th>Availability</th><th>Last seen</th></tr></thead>
+<tbody id="devices"></tbody>
+</table>
+<h2>Log</h2>
+<pre id="log"></pre>
+<script>
+const selected = new Set();
+// the API token can be given in the address, e.g. http://tasmogo:8080/#token=secret
+const token = new URLSearchParams(location.hash.slice(1)).get("token");
+const headers = token ? {"Authorization": "Bearer " + token} : {};
+
+function cell(row, text, cls) {
+  const td = row.insertCell();
+  td.textContent = text;
+  if (cls) td.className = cls;
+}
+
+function render(status) {
+  const busy = status.job !== "";
+  document.getElementById("state").textContent = busy
+    ? "Running " + status.job + "…"
+    : "Last scan " + new Date(status.lastScan).toLocaleString() + ", next scan " + new Date(status.nextScan).toLocaleString();
+  const body = document.getElementById("devices");
+  body.innerHTML = "";
+  for (const device of status.devices || []) {
+    const row = body.insertRow();
+    const box = document.createElement("input");
+    box.type = "checkbox";
+    box.disabled = !device.outdated;
+    box.checked = selected.has(device.ip);
+    box.onchange = () => box.checked ? selected.add(device.ip) : selected.delete(device.ip);
+    row.insertCell().appendChild(box);
+    cell(row, device.ip);
+    cell(row, device.name);
+    cell(row, device.version);
+    cell(row, device.variant);
+    cell(row, device.outdated ? "outdated" : (device.updateResult || "up to date"), device.outdated ? "outdated" : "");
+    cell(row, device.online === undefined ? "" : (device.online ? "online" : "offline"), device.online === false ? "outdated" : "");
+    cell(row, new Date(device.lastSeen).toLocaleString());
+  }
+  const log = document.getElementById("log");
+  log.textContent = (status.log || []).join("\n");
+  log.scrollTop = log.scrollHeight;
+}
+
+async function refresh() {
+  const res = await fetch("api/status", {headers: headers});
+  render(await res.json());
+}
+
+async function post(path, body) {
+  const res = await fetch(path, {method: "POST", headers: Object.assign({"Content-Type": "application/json"}, headers), body: JSON.stringify(body || {})});
+  if (!res.ok) alert((await res.json()).error);
+  refresh();
+}
+
+document.getElementById("scan").onclick = () => post("api/scan");
+document.getElementById("update").onclick = () => {
+  if (selected.size === 0) return alert("Select the devices to update first");
+  post("api/update", {ips: Array.from(selected)});
+  selected.clear();
+};
+document.getElementById("all").onchange = (e) => {
+  for (const box of document.querySelectorAll("#devices input")) {
+    if (box.disabled) continue;
+    box.checked = e.target.checked;
+    box.onchange();
+  }
+};
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_logTail(t *testing.T) {
+	assert := assert.New(t)
+	tail := &logTail{}
+	fmt.Fprint(tail, "first\nsecond\n")
+	assert.Equal([]string{"first", "second"}, tail.snapshot())
+	for i := 0; i < maxLogLines; i++ {
+		fmt.Fprintln(tail, i)
+	}
+	lines := tail.snapshot()
+	assert.Len(lines, maxLogLines)
+	assert.Equal("0", lines[0])
+}
+
+func Test_webUIHandler(t *testing.T) {
+	assert := assert.New(t)
+	d := newDaemon(func(context.Context, scanOptions) []tasmoDevice { return nil })
+	d.devices = []tasmoDevice{{Name: "plug", IP: net.IPv4(10, 0, 0, 1), Outdated: true}}
+	handler := webUIHandler(d)
+	request := func(method string, path string, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := request("GET", "/", "")
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Contains(rec.Body.String(), "Update selected")
+	assert.Equal(http.StatusNotFound, request("GET", "/missing", "").Code)
+
+	rec = request("GET", "/api/status", "")
+	var status daemonStatus
+	assert.Nil(json.Unmarshal(rec.Body.Bytes(), &status))
+	assert.Equal("10.0.0.1", status.Devices[0].IP)
+
+	assert.Equal(http.StatusMethodNotAllowed, request("GET", "/api/scan", "").Code)
+	assert.Equal(http.StatusBadRequest, request("POST", "/api/update", `{"ips": []}`).Code)
+	assert.Equal(http.StatusAccepted, request("POST", "/api/update", `{"ips": ["10.0.0.1"]}`).Code)
+	// only one run can wait
+	assert.Equal(http.StatusConflict, request("POST", "/api/scan", "").Code)
+	opts := <-d.jobs
+	assert.True(opts.Update)
+	assert.Equal([]string{"10.0.0.1"}, opts.Only)
+	assert.Equal(http.StatusAccepted, request("POST", "/api/scan", "").Code)
+}
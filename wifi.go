@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/spf13/viper"
+)
+
+// accessPointUsage is an access point and the devices connected to it
+type accessPointUsage struct {
+	SSID    string `json:"ssid"`
+	BSSID   string `json:"bssid"`
+	Channel int    `json:"channel"`
+	Devices int    `json:"devices"`
+	// AverageRSSI is the mean Wi-Fi quality of the devices in percent, Weakest the device with the lowest
+	AverageRSSI int    `json:"averageRssi"`
+	Weakest     string `json:"weakest"`
+	Saturated   bool   `json:"saturated"`
+}
+
+// channelUsage is a Wi-Fi channel and the access points and devices using it
+type channelUsage struct {
+	Channel      int  `json:"channel"`
+	AccessPoints int  `json:"accessPoints"`
+	Devices      int  `json:"devices"`
+	Saturated    bool `json:"saturated"`
+}
+
+// wifiAudit shows how the devices are distributed across the access points and channels. Unknown are
+// the devices that didn't report their access point, e.g. because they weren't asked in this run.
+type wifiAudit struct {
+	AccessPoints []accessPointUsage `json:"accessPoints"`
+	Channels     []channelUsage     `json:"channels"`
+	Unknown      int                `json:"unknown"`
+}
+
+// auditWifi groups the devices by access point and channel. An access point with more devices than
+// TASMOGO_WIFIMAXCLIENTS is saturated, a channel is saturated if all its access points together have
+// more or if several access points share it and get in each other's way.
+func auditWifi(devices []tasmoDevice) wifiAudit {
+	limit := viper.GetInt("wifimaxclients")
+	audit := wifiAudit{AccessPoints: make([]accessPointUsage, 0), Channels: make([]channelUsage, 0)}
+	aps := make(map[string]*accessPointUsage)
+	weakest := make(map[string]int)
+	for _, device := range devices {
+		if device.BSSID == "" || device.Cached {
+			audit.Unknown++
+			continue
+		}
+		ap, ok := aps[device.BSSID]
+		if !ok {
+			ap = &accessPointUsage{SSID: device.SSID, BSSID: device.BSSID, Channel: device.Channel}
+			aps[device.BSSID] = ap
+		}
+		ap.Devices++
+		ap.AverageRSSI += device.RSSI
+		if rssi, ok := weakest[device.BSSID]; !ok || device.RSSI < rssi {
+			weakest[device.BSSID] = device.RSSI
+			ap.Weakest = device.Name + " (" + strconv.Itoa(device.RSSI) + "%)"
+		}
+	}
+	channels := make(map[int]*channelUsage)
+	for _, ap := range aps {
+		ap.AverageRSSI /= ap.Devices
+		ap.Saturated = limit > 0 && ap.Devices > limit
+		audit.AccessPoints = append(audit.AccessPoints, *ap)
+		c, ok := channels[ap.Channel]
+		if !ok {
+			c = &channelUsage{Channel: ap.Channel}
+			channels[ap.Channel] = c
+		}
+		c.AccessPoints++
+		c.Devices += ap.Devices
+	}
+	for _, c := range channels {
+		c.Saturated = c.AccessPoints > 1 || (limit > 0 && c.Devices > limit)
+		audit.Channels = append(audit.Channels, *c)
+	}
+	// the busiest access points and channels first
+	sort.Slice(audit.AccessPoints, func(i, j int) bool {
+		a, b := audit.AccessPoints[i], audit.AccessPoints[j]
+		if a.Devices != b.Devices {
+			return a.Devices > b.Devices
+		}
+		return a.BSSID < b.BSSID
+	})
+	sort.Slice(audit.Channels, func(i, j int) bool {
+		return audit.Channels[i].Channel < audit.Channels[j].Channel
+	})
+	return audit
+}
+
+// renderWifiAudit generates the audit as JSON if TASMOGO_OUTPUT is "json", otherwise as tables of the
+// access points and the channels
+func renderWifiAudit(audit wifiAudit) (string, error) {
+	if viper.GetString("output") == "json" {
+		data, err := json.MarshalIndent(audit, "", "  ")
+		return string(data), err
+	}
+	flag := func(saturated bool) string {
+		if saturated {
+			return "saturated"
+		}
+		return ""
+	}
+	aps := table.NewWriter()
+	aps.SetTitle("Access points")
+	aps.AppendHeader(table.Row{"SSID", "BSSID", "Channel", "Devices", "Avg. RSSI", "Weakest", ""})
+	for _, ap := range audit.AccessPoints {
+		aps.AppendRow(table.Row{ap.SSID, ap.BSSID, ap.Channel, ap.Devices, strconv.Itoa(ap.AverageRSSI) + "%", ap.Weakest, flag(ap.Saturated)})
+	}
+	if audit.Unknown > 0 {
+		aps.AppendFooter(table.Row{"", "", "", "", "", "", strconv.Itoa(audit.Unknown) + " devices unknown"})
+	}
+	channels := table.NewWriter()
+	channels.SetTitle("Channels")
+	channels.AppendHeader(table.Row{"Channel", "Access points", "Devices", ""})
+	for _, c := range audit.Channels {
+		channels.AppendRow(table.Row{c.Channel, c.AccessPoints, c.Devices, flag(c.Saturated)})
+	}
+	return strings.Join([]string{aps.Render(), channels.Render()}, "\n"), nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_auditWifi(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	viper.Set("wifimaxclients", 2)
+	devices := []tasmoDevice{
+		{Name: "plug", SSID: "home", BSSID: "AP:01", Channel: 6, RSSI: 80},
+		{Name: "lamp", SSID: "home", BSSID: "AP:01", Channel: 6, RSSI: 40},
+		{Name: "heater", SSID: "home", BSSID: "AP:01", Channel: 6, RSSI: 60},
+		{Name: "garage", SSID: "home", BSSID: "AP:02", Channel: 1, RSSI: 30},
+		{Name: "shed", SSID: "home", BSSID: "AP:03", Channel: 1, RSSI: 50},
+		{Name: "cached", BSSID: "AP:01", Channel: 6, Cached: true},
+		{Name: "old"},
+	}
+	audit := auditWifi(devices)
+	assert.Equal(2, audit.Unknown)
+	assert.Len(audit.AccessPoints, 3)
+	assert.Equal(accessPointUsage{SSID: "home", BSSID: "AP:01", Channel: 6, Devices: 3, AverageRSSI: 60, Weakest: "lamp (40%)", Saturated: true}, audit.AccessPoints[0])
+	assert.False(audit.AccessPoints[1].Saturated)
+	// channel 1 is shared by two access points, channel 6 has too many devices
+	assert.Equal([]channelUsage{{Channel: 1, AccessPoints: 2, Devices: 2, Saturated: true}, {Channel: 6, AccessPoints: 1, Devices: 3, Saturated: true}}, audit.Channels)
+
+	viper.Set("wifimaxclients", 0)
+	audit = auditWifi(devices[:3])
+	assert.False(audit.AccessPoints[0].Saturated)
+	assert.False(audit.Channels[0].Saturated)
+}
+
+func Test_renderWifiAudit(t *testing.T) {
+	assert := assert.New(t)
+	defer viper.Reset()
+	viper.Set("wifimaxclients", 1)
+	audit := auditWifi([]tasmoDevice{
+		{Name: "plug", SSID: "home", BSSID: "AP:01", Channel: 6, RSSI: 80},
+		{Name: "lamp", SSID: "home", BSSID: "AP:01", Channel: 6, RSSI: 40},
+		{Name: "old"},
+	})
+	out, err := renderWifiAudit(audit)
+	assert.Nil(err)
+	assert.Contains(out, "| home | AP:01 |       6 |       2 | 60%       | lamp (40%) | saturated")
+	assert.Contains(out, "1 DEVICES UNKNOWN")
+
+	viper.Set("output", "json")
+	out, err = renderWifiAudit(audit)
+	assert.Nil(err)
+	var decoded wifiAudit
+	assert.Nil(json.Unmarshal([]byte(out), &decoded))
+	assert.Equal(audit, decoded)
+}